@@ -0,0 +1,170 @@
+package catena
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// An Aggregate is a function that reduces a set of values
+// to a single value.
+type Aggregate string
+
+// Supported aggregates.
+const (
+	AggregateSum   Aggregate = "sum"
+	AggregateMean  Aggregate = "mean"
+	AggregateMin   Aggregate = "min"
+	AggregateMax   Aggregate = "max"
+	AggregateCount Aggregate = "count"
+)
+
+// Valid returns an error if a is not a supported aggregate.
+func (a Aggregate) Valid() error {
+	switch a {
+	case AggregateSum, AggregateMean, AggregateMin, AggregateMax, AggregateCount:
+		return nil
+	}
+
+	return fmt.Errorf("catena: unknown aggregate %q", string(a))
+}
+
+// An aggregator accumulates values for an Aggregate.
+type aggregator struct {
+	sum   float64
+	min   float64
+	max   float64
+	count int64
+}
+
+// add adds value to the aggregator.
+func (agg *aggregator) add(value float64) {
+	if agg.count == 0 {
+		agg.min = value
+		agg.max = value
+	}
+
+	agg.sum += value
+	agg.min = math.Min(agg.min, value)
+	agg.max = math.Max(agg.max, value)
+	agg.count++
+}
+
+// merge adds the values added to other to the aggregator.
+func (agg *aggregator) merge(other aggregator) {
+	if other.count == 0 {
+		return
+	}
+
+	if agg.count == 0 {
+		*agg = other
+		return
+	}
+
+	agg.sum += other.sum
+	agg.min = math.Min(agg.min, other.min)
+	agg.max = math.Max(agg.max, other.max)
+	agg.count += other.count
+}
+
+// value returns the result of applying a to the values
+// added so far.
+func (agg *aggregator) value(a Aggregate) float64 {
+	switch a {
+	case AggregateSum:
+		return agg.sum
+	case AggregateMean:
+		if agg.count == 0 {
+			return math.NaN()
+		}
+
+		return agg.sum / float64(agg.count)
+	case AggregateMin:
+		if agg.count == 0 {
+			return math.NaN()
+		}
+
+		return agg.min
+	case AggregateMax:
+		if agg.count == 0 {
+			return math.NaN()
+		}
+
+		return agg.max
+	case AggregateCount:
+		return float64(agg.count)
+	}
+
+	return math.NaN()
+}
+
+// AggregateRange applies a to the points that Range would return for
+// source and metric in [start, end). Where Range would return the
+// means of rollup buckets, their stored min, max, sum and count are
+// combined instead, so a is applied to the raw values they summarize.
+// The mean, min and max of no points are NaN.
+func (db *DB) AggregateRange(source, metric string, start, end int64, a Aggregate) (float64, error) {
+	err := a.Valid()
+	if err != nil {
+		return 0, err
+	}
+
+	agg := aggregator{}
+	_, err = db.scanAggregators(source, metric, start, end, func(_ int64, summary aggregator) error {
+		agg.merge(summary)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return agg.value(a), nil
+}
+
+// DownsampleRange groups the points that Range would return for
+// source and metric in [start, end) into buckets of the given width,
+// and calls fn with the result of applying a to each bucket, in
+// timestamp order. Each point's timestamp is the start of its bucket.
+// Buckets without points are skipped. Rollup buckets are combined as
+// for AggregateRange, each into the bucket that holds its start, so
+// buckets narrower than the rollup resolution are only approximate.
+func (db *DB) DownsampleRange(source, metric string, start, end, width int64, a Aggregate,
+	fn func(Point) error) error {
+
+	err := a.Valid()
+	if err != nil {
+		return err
+	}
+
+	if width <= 0 {
+		return errors.New("catena: downsample width must be positive")
+	}
+
+	agg := aggregator{}
+	bucket := int64(0)
+
+	_, err = db.scanAggregators(source, metric, start, end, func(timestamp int64, summary aggregator) error {
+		ts := bucketStart(timestamp, width)
+		if agg.count > 0 && ts != bucket {
+			err := fn(Point{Timestamp: bucket, Value: agg.value(a)})
+			if err != nil {
+				return err
+			}
+
+			agg = aggregator{}
+		}
+
+		bucket = ts
+		agg.merge(summary)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if agg.count > 0 {
+		return fn(Point{Timestamp: bucket, Value: agg.value(a)})
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package catena
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/disk"
+	"github.com/Cistern/catena/vfs"
+	"github.com/Cistern/catena/wal"
+)
+
+// WithWALArchive makes the compactor keep a copy of the WAL of every
+// memory partition it compacts in dir, named after the partition like
+// "N.wal". Together with a Snapshot, the archived WALs let Restore
+// recover the DB as of a later point in time. The copy is a hard link
+// if dir is on the same file system as the DB. A partition whose WAL
+// can't be archived isn't compacted, and its compaction is reported
+// as failed and tried again later.
+//
+// The WALs of rows inserted into partitions after they were compacted
+// are not archived, so such rows are only restored if they are part
+// of the snapshot.
+func WithWALArchive(dir string) Option {
+	return func(db *DB) {
+		db.walArchiveDir = dir
+	}
+}
+
+// archiveWAL copies the WAL at filename to the WAL archive, if
+// there is one. The WAL must not be written to anymore.
+func (db *DB) archiveWAL(filename string) error {
+	if db.walArchiveDir == "" {
+		return nil
+	}
+
+	err := db.fs.MkdirAll(db.walArchiveDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(db.walArchiveDir, filepath.Base(filename))
+	tmpDest := dest + ".tmp"
+	db.fs.Remove(tmpDest)
+
+	if vfs.Link(db.fs, filename, tmpDest) != nil {
+		err = copyFilePrefix(db.fs, filename, tmpDest, fileSize(db.fs, filename))
+		if err != nil {
+			db.fs.Remove(tmpDest)
+			return err
+		}
+	}
+
+	err = db.fs.Rename(tmpDest, dest)
+	if err != nil {
+		db.fs.Remove(tmpDest)
+		return err
+	}
+
+	return db.fs.SyncDir(db.walArchiveDir)
+}
+
+// Restore restores the snapshot in snapshotDir to destDir, which is
+// created if it does not exist and must be empty otherwise, and then
+// replays the WALs in archiveDir that hold rows written after the
+// snapshot was taken. Only rows with timestamps before until are
+// restored, so the restored DB holds the rows up to until. Rows are
+// filtered as the WALs are replayed, and the snapshot's disk
+// partitions that hold rows at or after until are rewritten without
+// them. The restored DB is opened with OpenDB as usual.
+func Restore(snapshotDir, archiveDir, destDir string, until int64) error {
+	return RestoreFS(vfs.OS, snapshotDir, archiveDir, destDir, until)
+}
+
+// RestoreFS is like Restore for a snapshot, archive and
+// destination that are in fs.
+func RestoreFS(fs vfs.FS, snapshotDir, archiveDir, destDir string, until int64) error {
+	data, err := vfs.ReadFile(fs, filepath.Join(snapshotDir, snapshotManifestFilename))
+	if err != nil {
+		return err
+	}
+
+	manifest := snapshotManifest{}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return fmt.Errorf("catena: invalid snapshot manifest: %v", err)
+	}
+
+	err = fs.MkdirAll(destDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	names, err := readDirNames(fs, destDir)
+	if err != nil {
+		return err
+	}
+
+	if len(names) > 0 {
+		return errors.New("catena: Restore called with non-empty directory")
+	}
+
+	dirs := map[string]bool{destDir: true}
+	snapshotWALs := map[string]bool{}
+
+	for _, file := range manifest.Files {
+		src := filepath.Join(snapshotDir, file.Name)
+		dest := filepath.Join(destDir, file.Name)
+
+		err = fs.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+
+		dirs[filepath.Dir(dest)] = true
+
+		switch {
+		case strings.HasSuffix(file.Name, ".wal"):
+			snapshotWALs[file.Name] = true
+			err = replayWAL(fs, src, dest, until)
+		case strings.HasSuffix(file.Name, ".part"):
+			err = restorePartition(fs, src, dest, file.Size, until)
+		default:
+			if vfs.Link(fs, src, dest) != nil {
+				err = copyFilePrefix(fs, src, dest, file.Size)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	archived, err := readDirNames(fs, archiveDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, name := range archived {
+		if !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+
+		id, err := partitionID(name)
+		if err != nil {
+			return err
+		}
+
+		// Partitions that were compacted before the snapshot
+		// was taken are in the snapshot already.
+		if id <= manifest.LastPartitionID && !snapshotWALs[name] {
+			continue
+		}
+
+		// The archived WAL holds at least the rows of the
+		// snapshot's copy.
+		dest := filepath.Join(destDir, name)
+		fs.Remove(dest)
+
+		err = replayWAL(fs, filepath.Join(archiveDir, name), dest, until)
+		if err != nil {
+			return err
+		}
+	}
+
+	for dir := range dirs {
+		err = fs.SyncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restorePartition restores the disk partition at src, whose first
+// size bytes are part of the snapshot, to dest. It is linked or copied
+// if it only holds rows before until, and otherwise rewritten with just
+// those rows. Nothing is restored if it holds no such rows.
+func restorePartition(fs vfs.FS, src, dest string, size, until int64) error {
+	p, err := disk.OpenDiskPartitionFS(fs, src)
+	if err != nil {
+		return err
+	}
+
+	defer p.Close()
+
+	if p.MaxTimestamp() < until {
+		if vfs.Link(fs, src, dest) != nil {
+			return copyFilePrefix(fs, src, dest, size)
+		}
+
+		return nil
+	}
+
+	if p.MinTimestamp() >= until {
+		return nil
+	}
+
+	p.Hold()
+	rows, err := partitionRows([]partition.Partition{p})
+	p.Release()
+	if err != nil {
+		return err
+	}
+
+	kept := rows[:0]
+	for _, row := range rows {
+		if row.Timestamp < until {
+			kept = append(kept, row)
+		}
+	}
+
+	restored, err := writeDiskPartition(fs, dest, kept)
+	if err != nil {
+		return err
+	}
+
+	return restored.Close()
+}
+
+// replayWAL writes the rows of the WAL at src with timestamps before
+// until to a new WAL at dest. Replay stops at the first entry that
+// can't be read. No WAL is written if there are no such rows, since
+// an empty WAL would recover as an empty partition.
+func replayWAL(fs vfs.FS, src, dest string, until int64) error {
+	in, err := wal.OpenReadOnlyFileWALFS(fs, src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	var out *wal.FileWAL
+
+	for entry, err := in.ReadEntry(); err == nil; entry, err = in.ReadEntry() {
+		rows := []partition.Row{}
+		for _, row := range entry.Rows {
+			if row.Timestamp < until {
+				rows = append(rows, row)
+			}
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		if out == nil {
+			out, err = wal.NewFileWALFS(fs, dest)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = out.Append(wal.WALEntry{
+			Operation: entry.Operation,
+			Rows:      rows,
+		})
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	// Close syncs the file.
+	return out.Close()
+}
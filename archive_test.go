@@ -0,0 +1,266 @@
+package catena
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+func TestRestore(t *testing.T) {
+	for _, dir := range []string{"/tmp/catena_restore_test", "/tmp/catena_restore_test_archive",
+		"/tmp/catena_restore_test_snapshot", "/tmp/catena_restore_test_dest"} {
+		os.RemoveAll(dir)
+	}
+
+	db, err := NewDB("/tmp/catena_restore_test", 10, 0, WithWALArchive("/tmp/catena_restore_test_archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(start, end int64) {
+		rows := []Row{}
+		for ts := start; ts < end; ts++ {
+			rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+		}
+
+		err := db.InsertRows(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(0, 40)
+	db.compact()
+
+	for _, name := range []string{"1.wal", "2.wal"} {
+		if _, err := os.Stat(filepath.Join("/tmp/catena_restore_test_archive", name)); err != nil {
+			t.Errorf("expected %s to be archived: %v", name, err)
+		}
+	}
+
+	err = db.Snapshot("/tmp/catena_restore_test_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert(40, 80)
+	db.compact()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore("/tmp/catena_restore_test_snapshot", "/tmp/catena_restore_test_archive",
+		"/tmp/catena_restore_test_dest", 55)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Restore("/tmp/catena_restore_test_snapshot", "/tmp/catena_restore_test_archive",
+		"/tmp/catena_restore_test_dest", 55) == nil {
+		t.Error("expected an error for a non-empty directory")
+	}
+
+	restored, err := OpenDB("/tmp/catena_restore_test_dest", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partitions compacted before the snapshot aren't replayed
+	// again, and rows from 55 on are left out.
+	points, _, err := restored.Range("a", "b", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 55 {
+		t.Fatalf("expected %d points, got %d", 55, len(points))
+	}
+
+	for i, point := range points {
+		if point.Timestamp != int64(i) {
+			t.Fatalf("expected timestamp %d, got %d", i, point.Timestamp)
+		}
+	}
+
+	err = restored.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreFS(t *testing.T) {
+	fs := vfs.NewMemFS()
+
+	db, err := NewDB("/tmp/catena_restore_fs_test", 10, 0, WithFS(fs),
+		WithWALArchive("/tmp/catena_restore_fs_test_archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(start, end int64) {
+		rows := []Row{}
+		for ts := start; ts < end; ts++ {
+			rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+		}
+
+		err := db.InsertRows(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(0, 40)
+	db.compact()
+
+	err = db.Snapshot("/tmp/catena_restore_fs_test_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert(40, 80)
+	db.compact()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RestoreFS(fs, "/tmp/catena_restore_fs_test_snapshot", "/tmp/catena_restore_fs_test_archive",
+		"/tmp/catena_restore_fs_test_dest", 55)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written outside of fs.
+	for _, dir := range []string{"/tmp/catena_restore_fs_test", "/tmp/catena_restore_fs_test_archive",
+		"/tmp/catena_restore_fs_test_snapshot", "/tmp/catena_restore_fs_test_dest"} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist on disk, got %v", dir, err)
+		}
+	}
+
+	restored, err := OpenDB("/tmp/catena_restore_fs_test_dest", 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err := restored.Range("a", "b", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 55 {
+		t.Fatalf("expected %d points, got %d", 55, len(points))
+	}
+
+	err = restored.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2.part was compacted before the snapshot, and is
+	// rewritten without the rows at or after until.
+	err = RestoreFS(fs, "/tmp/catena_restore_fs_test_snapshot", "/tmp/catena_restore_fs_test_archive",
+		"/tmp/catena_restore_fs_test_early", 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err = OpenDB("/tmp/catena_restore_fs_test_early", 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err = restored.Range("a", "b", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 15 || points[14].Timestamp != 14 {
+		t.Fatalf("expected %d points up to %d, got %v", 15, 14, points)
+	}
+
+	err = restored.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveFailure(t *testing.T) {
+	dir := "/tmp/catena_archive_failure_test"
+	archiveDir := "/tmp/catena_archive_failure_test_archive"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	now := int64(0)
+	clock := func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	db, err := NewDB(dir, 10, 0, WithFS(fs), WithClock(clock), WithWALArchive(archiveDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 40; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles := func(dir string, expected []string) {
+		names, err := readDirNames(fs, dir)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+
+		files := []string{}
+		for _, name := range names {
+			if strings.HasSuffix(name, ".wal") || strings.HasSuffix(name, ".part") {
+				files = append(files, name)
+			}
+		}
+
+		if !reflect.DeepEqual(files, expected) {
+			t.Errorf("expected %v in %s, got %v", expected, dir, files)
+		}
+	}
+
+	fs.Inject(vfs.Fault{Op: vfs.OpRename, Pattern: "*.wal.tmp"})
+	db.compact()
+
+	// Nothing is compacted without its WAL archived.
+	if stats := db.CompactionStats(); stats.Failed[CompactionCompact] != 2 || stats.Backlog != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	checkFiles(dir, []string{"1.wal", "2.wal", "3.wal", "4.wal"})
+	checkFiles(archiveDir, []string{})
+
+	fs.Clear()
+	atomic.AddInt64(&now, 2)
+	db.compact()
+
+	if stats := db.CompactionStats(); stats.Succeeded[CompactionCompact] != 2 || stats.Backlog != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	checkFiles(dir, []string{"1.part", "2.part", "3.wal", "4.wal"})
+	checkFiles(archiveDir, []string{"1.wal", "2.wal"})
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,526 @@
+package catena
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/disk"
+	"github.com/Cistern/catena/vfs"
+)
+
+// backfillDirName is the directory within the DB directory
+// that backfills stage their rows in until they are committed.
+const backfillDirName = "backfill"
+
+// defaultBackfillFlushRows is the number of rows a backfill
+// buffers in memory before it stages them on disk.
+const defaultBackfillFlushRows = 1 << 20
+
+// A Backfill writes historical points for a time range directly into
+// new disk partitions, bypassing the WAL, memory partitions and the
+// compactor. It is meant for bulk imports of old data. Points are
+// buffered in memory and staged in disk partitions whenever the
+// buffer fills up, so a backfill of any size needs bounded memory.
+type Backfill struct {
+	db *DB
+
+	start int64
+	end   int64
+
+	// windows holds the rows that haven't been staged yet,
+	// keyed by the start of their partition-size window.
+	windows  map[int64][]partition.Row
+	buffered int
+
+	// flushRows is the number of buffered rows
+	// at which they are staged.
+	flushRows int
+
+	// staged lists the staged files of each window, oldest
+	// first. Their names start with stageID, which is unset
+	// until rows are first staged.
+	staged  map[int64][]string
+	stageID int64
+	stages  int
+
+	// lastTimestamps holds the last timestamp written for
+	// each series to make sure points arrive in order.
+	lastTimestamps map[seriesKey]int64
+
+	done bool
+}
+
+type seriesKey struct {
+	source string
+	metric string
+}
+
+// NewBackfill starts a backfill of the time range [start, end).
+// start and end must be multiples of the partition size. An error is
+// returned if the range overlaps any existing partition.
+func (db *DB) NewBackfill(start, end int64) (*Backfill, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	if start >= end || start%db.partitionSize != 0 || end%db.partitionSize != 0 {
+		return nil, fmt.Errorf("catena: invalid backfill range [%d, %d)", start, end)
+	}
+
+	if cutoff, ok := db.retentionCutoff(); ok && end <= cutoff {
+		return nil, &RetentionError{
+			Timestamp: start,
+			Cutoff:    cutoff,
+		}
+	}
+
+	err := db.checkBackfillOverlap(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backfill{
+		db:             db,
+		start:          start,
+		end:            end,
+		windows:        map[int64][]partition.Row{},
+		flushRows:      defaultBackfillFlushRows,
+		staged:         map[int64][]string{},
+		lastTimestamps: map[seriesKey]int64{},
+	}, nil
+}
+
+// WriteSeries adds points to the series for source and metric. points
+// must be sorted by timestamp, fall within the backfill's range, and
+// be newer than any points written to the same series before.
+func (b *Backfill) WriteSeries(source, metric string, points []Point) error {
+	if b.done {
+		return errors.New("catena: backfill is already done")
+	}
+
+	key := seriesKey{source, metric}
+	last, seen := b.lastTimestamps[key]
+
+	for _, point := range points {
+		if point.Timestamp < b.start || point.Timestamp >= b.end {
+			return fmt.Errorf("catena: backfill point with timestamp %d is outside of [%d, %d)",
+				point.Timestamp, b.start, b.end)
+		}
+
+		if seen && point.Timestamp <= last {
+			return fmt.Errorf("catena: backfill points for %s %s are not sorted", source, metric)
+		}
+
+		last = point.Timestamp
+		seen = true
+	}
+
+	for _, point := range points {
+		window := bucketStart(point.Timestamp, b.db.partitionSize)
+		b.windows[window] = append(b.windows[window], partition.Row{
+			Source: source,
+			Metric: metric,
+			Point:  partition.Point(point),
+		})
+	}
+
+	b.buffered += len(points)
+
+	if seen {
+		b.lastTimestamps[key] = last
+	}
+
+	if b.buffered >= b.flushRows {
+		return b.flush()
+	}
+
+	return nil
+}
+
+// flush stages the buffered rows in a disk partition per window.
+func (b *Backfill) flush() error {
+	if b.buffered == 0 {
+		return nil
+	}
+
+	db := b.db
+	dir := filepath.Join(db.baseDir, backfillDirName)
+
+	if b.stageID == 0 {
+		err := db.fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+
+		// Partition IDs are unique, so this keeps the
+		// files of concurrent backfills apart.
+		db.partitionCreateLock.Lock()
+		b.stageID = atomic.AddInt64(&db.lastPartitionID, 1)
+		db.partitionCreateLock.Unlock()
+	}
+
+	for window, rows := range b.windows {
+		filename := filepath.Join(dir, fmt.Sprintf("%d-%d.part", b.stageID, b.stages))
+		b.stages++
+
+		p, err := writeDiskPartition(db.fs, filename, rows)
+		if err != nil {
+			return err
+		}
+
+		p.Close()
+
+		b.staged[window] = append(b.staged[window], filename)
+		delete(b.windows, window)
+	}
+
+	b.buffered = 0
+	return nil
+}
+
+// Commit writes the backfilled points to a new disk partition per
+// partition-size window and adds them to the DB. The partitions only
+// become visible once all of their files are durable. The commit is
+// journaled in a backfillIntent, so if the DB stops during Commit,
+// either all of the partitions or none of them are there when it is
+// next opened. An error is returned if a partition overlapping the
+// backfill's range was created in the meantime.
+func (b *Backfill) Commit() error {
+	if b.done {
+		return errors.New("catena: backfill is already done")
+	}
+
+	b.done = true
+	defer b.removeStaged()
+
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+
+	if len(b.staged) == 0 {
+		return nil
+	}
+
+	db := b.db
+
+	windows := []int64{}
+	for window := range b.staged {
+		windows = append(windows, window)
+	}
+
+	sort.Sort(int64s(windows))
+
+	// Reserve a partition ID for each window.
+	db.partitionCreateLock.Lock()
+	err = db.checkBackfillOverlap(b.start, b.end)
+	if err != nil {
+		db.partitionCreateLock.Unlock()
+		return err
+	}
+
+	firstID := atomic.AddInt64(&db.lastPartitionID, int64(len(windows))) - int64(len(windows)) + 1
+	db.partitionCreateLock.Unlock()
+
+	intent := backfillIntent{
+		Outputs: []string{},
+	}
+
+	for i := range windows {
+		intent.Outputs = append(intent.Outputs, fmt.Sprintf("%d.part", firstID+int64(i)))
+	}
+
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+
+	intentFilename := filepath.Join(db.baseDir, backfillDirName, backfillIntentFilename(b.stageID))
+
+	err = writeFileFS(db.fs, intentFilename, data)
+	if err != nil {
+		return err
+	}
+
+	parts := []partition.Partition{}
+
+	// abort removes the partitions written so far. The intent is
+	// kept if any of them can't be removed, so that they are removed
+	// when the DB is next opened.
+	abort := func(err error) error {
+		for _, p := range parts {
+			p.ExclusiveHold()
+			destroyErr := p.Destroy()
+			p.ExclusiveRelease()
+			if destroyErr != nil {
+				return err
+			}
+		}
+
+		db.fs.Remove(intentFilename)
+		return err
+	}
+
+	for i, window := range windows {
+		filename := filepath.Join(db.baseDir, intent.Outputs[i])
+
+		p, err := b.commitWindow(filename, b.staged[window])
+		if err != nil {
+			return abort(err)
+		}
+
+		parts = append(parts, p)
+	}
+
+	db.partitionCreateLock.Lock()
+	defer db.partitionCreateLock.Unlock()
+
+	err = db.checkBackfillOverlap(b.start, b.end)
+	if err != nil {
+		return abort(err)
+	}
+
+	// Removing the intent commits the partitions.
+	err = db.fs.Remove(intentFilename)
+	if err == nil {
+		err = db.fs.SyncDir(filepath.Dir(intentFilename))
+	}
+
+	if err != nil {
+		return abort(err)
+	}
+
+	for i, p := range parts {
+		err = db.partitionList.Insert(p)
+		if err != nil {
+			for _, inserted := range parts[:i] {
+				db.partitionList.Remove(inserted)
+			}
+
+			return abort(err)
+		}
+
+		if db.partitionList.Size() == 1 {
+			atomic.StoreInt64(&db.minTimestamp, p.MinTimestamp())
+			atomic.StoreInt64(&db.maxTimestamp, p.MaxTimestamp())
+		}
+
+		for min := atomic.LoadInt64(&db.minTimestamp); min > p.MinTimestamp(); min = atomic.LoadInt64(&db.minTimestamp) {
+			if atomic.CompareAndSwapInt64(&db.minTimestamp, min, p.MinTimestamp()) {
+				break
+			}
+		}
+
+		for max := atomic.LoadInt64(&db.maxTimestamp); max < p.MaxTimestamp(); max = atomic.LoadInt64(&db.maxTimestamp) {
+			if atomic.CompareAndSwapInt64(&db.maxTimestamp, max, p.MaxTimestamp()) {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// commitWindow writes the partition at filename from the staged files
+// of a window. A single staged file is moved into place. Otherwise the
+// staged files are merged, which only holds the rows of the window in
+// memory.
+func (b *Backfill) commitWindow(filename string, staged []string) (partition.Partition, error) {
+	db := b.db
+
+	if len(staged) == 1 {
+		err := db.fs.Rename(staged[0], filename)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.fs.SyncDir(db.baseDir)
+		if err != nil {
+			db.fs.Remove(filename)
+			return nil, err
+		}
+
+		p, err := disk.OpenDiskPartitionFS(db.fs, filename)
+		if err != nil {
+			db.fs.Remove(filename)
+			return nil, err
+		}
+
+		return p, nil
+	}
+
+	inputs := []partition.Partition{}
+	for _, name := range staged {
+		p, err := disk.OpenDiskPartitionFS(db.fs, name)
+		if err != nil {
+			for _, input := range inputs {
+				input.Close()
+			}
+
+			return nil, err
+		}
+
+		inputs = append(inputs, p)
+	}
+
+	rows, err := partitionRows(inputs)
+
+	for _, input := range inputs {
+		input.Close()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return writeDiskPartition(db.fs, filename, rows)
+}
+
+// Abort discards the backfill.
+func (b *Backfill) Abort() {
+	b.done = true
+	b.removeStaged()
+}
+
+// removeStaged drops the buffered rows and removes the staged files.
+func (b *Backfill) removeStaged() {
+	for _, staged := range b.staged {
+		for _, filename := range staged {
+			b.db.fs.Remove(filename)
+		}
+	}
+
+	b.windows = map[int64][]partition.Row{}
+	b.buffered = 0
+	b.staged = map[int64][]string{}
+}
+
+// A backfillIntent records the partitions that a backfill commit
+// writes to the DB directory, in a file in the backfill directory
+// named "commit-<id>.json" after the backfill's stage ID. The intent
+// is removed once all of the partitions are durable, which commits
+// them. If the DB stops before then, the partitions are removed when
+// it is next opened.
+type backfillIntent struct {
+	Outputs []string `json:"outputs"`
+}
+
+// backfillIntentFilename returns the name of the intent
+// file of the backfill with stage ID id.
+func backfillIntentFilename(id int64) string {
+	return fmt.Sprintf("commit-%d.json", id)
+}
+
+// recoverBackfills rolls back the backfill commits that were
+// interrupted when the DB stopped, according to their intent files,
+// and removes the files staged by backfills that weren't committed.
+// It returns names, the contents of the DB directory, without the
+// partitions that were rolled back, or that a read only DB ignores.
+func (db *DB) recoverBackfills(names []string) ([]string, error) {
+	dir := filepath.Join(db.baseDir, backfillDirName)
+
+	staged, err := db.fs.ReadDirNames(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return names, nil
+		}
+
+		return nil, err
+	}
+
+	ignored := map[string]bool{}
+
+	for _, name := range staged {
+		if !strings.HasPrefix(name, "commit-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		data, err := vfs.ReadFile(db.fs, filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		intent := backfillIntent{}
+		err = json.Unmarshal(data, &intent)
+		if err != nil {
+			return nil, fmt.Errorf("catena: invalid backfill intent %s: %v", name, err)
+		}
+
+		for _, output := range intent.Outputs {
+			ignored[output] = true
+			if db.readOnly {
+				continue
+			}
+
+			err = db.fs.Remove(filepath.Join(db.baseDir, output))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	if db.readOnly {
+		return namesWithout(names, ignored), nil
+	}
+
+	if len(ignored) > 0 {
+		// The partitions are gone before their
+		// intents are removed.
+		err = db.fs.SyncDir(db.baseDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range staged {
+		err = db.fs.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return namesWithout(names, ignored), nil
+}
+
+// namesWithout returns the names that aren't in ignored.
+func namesWithout(names []string, ignored map[string]bool) []string {
+	if len(ignored) == 0 {
+		return names
+	}
+
+	remaining := []string{}
+	for _, name := range names {
+		if !ignored[name] {
+			remaining = append(remaining, name)
+		}
+	}
+
+	return remaining
+}
+
+// checkBackfillOverlap returns an error if any partition has points
+// within [start, end).
+func (db *DB) checkBackfillOverlap(start, end int64) error {
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+
+		p.Hold()
+		min, max := p.MinTimestamp(), p.MaxTimestamp()
+		p.Release()
+
+		if max >= start && min < end {
+			return fmt.Errorf("catena: backfill range [%d, %d) overlaps partition %s",
+				start, end, filepath.Base(p.Filename()))
+		}
+	}
+
+	return nil
+}
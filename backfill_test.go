@@ -0,0 +1,324 @@
+package catena
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+func TestBackfill(t *testing.T) {
+	os.RemoveAll("/tmp/catena_backfill_test")
+
+	db, err := NewDB("/tmp/catena_backfill_test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.InsertRows([]Row{
+		Row{
+			Source: "a",
+			Metric: "b",
+			Point: Point{
+				Timestamp: 105,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.NewBackfill(90, 110)
+	if err == nil {
+		t.Fatal("expected an error for a backfill overlapping a partition")
+	}
+
+	b, err := db.NewBackfill(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := []Point{}
+	for ts := int64(0); ts < 100; ts++ {
+		points = append(points, Point{
+			Timestamp: ts,
+			Value:     float64(ts),
+		})
+	}
+
+	err = b.WriteSeries("a", "b", points[50:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.WriteSeries("a", "b", points[:50])
+	if err == nil {
+		t.Fatal("expected an error for unsorted backfill points")
+	}
+
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, _, err := db.Range("a", "b", 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 51 {
+		t.Fatalf("expected %d points, got %d", 51, len(result))
+	}
+
+	if result[0].Timestamp != 50 || result[50].Timestamp != 105 {
+		t.Fatalf("unexpected points %v", result)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackfillStaging(t *testing.T) {
+	dir := "/tmp/catena_backfill_staging_test"
+	fs := vfs.NewMemFS()
+
+	db, err := NewDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := func() int {
+		names, err := fs.ReadDirNames(filepath.Join(dir, backfillDirName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(names)
+	}
+
+	b, err := db.NewBackfill(0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.flushRows = 10
+
+	for _, metric := range []string{"b", "c"} {
+		for start := int64(0); start < 30; start += 15 {
+			points := []Point{}
+			for ts := start; ts < start+15; ts++ {
+				points = append(points, Point{Timestamp: ts, Value: float64(ts)})
+			}
+
+			err = b.WriteSeries("a", metric, points)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Each flush stages a file per window.
+	if n := staged(); n != 8 {
+		t.Fatalf("expected %d staged files, got %d", 8, n)
+	}
+
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := staged(); n != 0 {
+		t.Errorf("expected the staged files to be removed, got %d", n)
+	}
+
+	// A partition is written per window.
+	if n := len(db.Partitions()); n != 3 {
+		t.Errorf("expected %d partitions, got %d", 3, n)
+	}
+
+	for _, metric := range []string{"b", "c"} {
+		points, _, err := db.Range("a", metric, 0, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != 30 {
+			t.Fatalf("expected %d points for %s, got %d", 30, metric, len(points))
+		}
+
+		for i, point := range points {
+			if point.Timestamp != int64(i) || point.Value != float64(i) {
+				t.Fatalf("unexpected point %v at index %d", point, i)
+			}
+		}
+	}
+
+	// Files staged by a backfill that wasn't committed
+	// are removed when the DB is opened.
+	b, err = db.NewBackfill(-20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.flushRows = 1
+
+	err = b.WriteSeries("a", "b", []Point{{Timestamp: -5, Value: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := staged(); n != 1 {
+		t.Fatalf("expected %d staged file, got %d", 1, n)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := staged(); n != 0 {
+		t.Errorf("expected the staged files to be removed, got %d", n)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackfillCommitRecovery(t *testing.T) {
+	dir := "/tmp/catena_backfill_recovery_test"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	db, err := NewDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.NewBackfill(0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := []Point{}
+	for ts := int64(0); ts < 30; ts++ {
+		points = append(points, Point{Timestamp: ts, Value: float64(ts)})
+	}
+
+	err = b.WriteSeries("a", "b", points)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The DB stops after the first window is moved into place,
+	// before the partition can be removed again.
+	fs.Inject(vfs.Fault{Op: vfs.OpRename, Pattern: "*-*.part", After: 1})
+	fs.Inject(vfs.Fault{Op: vfs.OpRemove, Pattern: "*.part"})
+
+	err = b.Commit()
+	if err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Clear()
+
+	parts := func() []string {
+		names, err := fs.ReadDirNames(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parts := []string{}
+		for _, name := range names {
+			if filepath.Ext(name) == ".part" {
+				parts = append(parts, name)
+			}
+		}
+
+		return parts
+	}
+
+	if n := len(parts()); n != 1 {
+		t.Fatalf("expected the first window's partition to be left behind, got %v", parts())
+	}
+
+	// A read only DB ignores the partition.
+	db, err = OpenDB(dir, 10, 0, WithFS(fs), WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(db.Partitions()); n != 0 {
+		t.Errorf("expected no partitions, got %d", n)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The interrupted commit is rolled back.
+	db, err = OpenDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(db.Partitions()); n != 0 {
+		t.Errorf("expected no partitions, got %d", n)
+	}
+
+	if left := parts(); len(left) != 0 {
+		t.Errorf("expected the partition to be removed, got %v", left)
+	}
+
+	names, err := fs.ReadDirNames(filepath.Join(dir, backfillDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 0 {
+		t.Errorf("expected the backfill directory to be empty, got %v", names)
+	}
+
+	// The range can be backfilled again.
+	b, err = db.NewBackfill(0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.WriteSeries("a", "b", points)
+	if err == nil {
+		err = b.Commit()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, _, err := db.Range("a", "b", 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 30 {
+		t.Errorf("expected %d points, got %d", 30, len(result))
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,652 @@
+// Command catena inspects and queries a catena database directory.
+//
+// Usage:
+//
+//	catena [-dir dir] [-partition-size n] [-unit unit] command [arguments]
+//
+// The commands are:
+//
+//	partitions   list partitions with their time ranges, sizes and series counts
+//	sources      list sources
+//	metrics      list the metrics of a source
+//	range        print the points of a series
+//	aggregate    aggregate the points of a series, optionally in buckets
+//	export       write series as CSV or newline-delimited JSON
+//	insert       insert rows read from standard input
+//	import       import CSV or newline-delimited JSON rows
+//	fsck         check the DB's files, and optionally repair them
+//
+// Every command but insert, import and fsck opens the DB read only, so
+// it is safe to run against a DB that is in use. insert, import and fsck
+// must not be run while another process has the DB open.
+//
+// The partition size isn't recorded in the DB, so insert and import
+// require -partition-size to be the size the DB was created with.
+// Rows would otherwise be cut into the wrong partition windows.
+//
+// The DB's rollup tiers are found from its rollup_N directories, so
+// reads past the raw partitions are answered from the tiers. Their
+// retention isn't recorded, so commands never drop rollup partitions.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// A command is a catena subcommand.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(env *env, args []string) error
+
+	// write is set if the command opens the DB for writing.
+	write bool
+
+	// offline is set if the command works on the DB's files
+	// instead of opening the DB.
+	offline bool
+}
+
+var commands = []*command{
+	{
+		name:    "partitions",
+		summary: "list partitions with their time ranges, sizes and series counts",
+		run:     runPartitions,
+	},
+	{
+		name:    "sources",
+		args:    "[-start ts] [-end ts]",
+		summary: "list sources",
+		run:     runSources,
+	},
+	{
+		name:    "metrics",
+		args:    "-source source [-start ts] [-end ts]",
+		summary: "list the metrics of a source",
+		run:     runMetrics,
+	},
+	{
+		name:    "range",
+		args:    "-source source -metric metric [-start ts] [-end ts]",
+		summary: "print the points of a series",
+		run:     runRange,
+	},
+	{
+		name:    "aggregate",
+		args:    "-source source -metric metric [-aggregate mean] [-interval n] [-start ts] [-end ts]",
+		summary: "aggregate the points of a series, optionally in buckets",
+		run:     runAggregate,
+	},
+	{
+		name:    "export",
+		args:    "[-format csv] [-source sources] [-metric metrics] [-start ts] [-end ts]",
+		summary: "write series as CSV or newline-delimited JSON",
+		run:     runExport,
+	},
+	{
+		name:    "insert",
+		summary: "insert rows of \"source metric timestamp value\" read from standard input",
+		run:     runInsert,
+		write:   true,
+	},
+	{
+		name:    "import",
+		args:    "[-format csv] [-columns timestamp,source,metric,value] [-timestamp-format format] [-batch-size n] [-backfill-size n] [-max-errors n] [-progress] [file]",
+		summary: "import CSV or newline-delimited JSON rows from a file or standard input",
+		run:     runImport,
+		write:   true,
+	},
+	{
+		name:    "fsck",
+		args:    "[-repair]",
+		summary: "check the DB's files, and optionally repair them",
+		run:     runFsck,
+		offline: true,
+	},
+}
+
+// An env is the environment of a command.
+type env struct {
+	cmd    *command
+	dir    string
+	db     *catena.DB
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line args and returns the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("catena", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	dir := flags.String("dir", ".", "database directory")
+	partitionSize := flags.Int("partition-size", 0, "partition size the DB was created with, required by insert and import")
+	unit := flags.Duration("unit", time.Second, "timestamp unit of the DB")
+
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: catena [flags] command [arguments]\n\nflags:")
+		flags.PrintDefaults()
+		fmt.Fprintln(stderr, "\ncommands:")
+		for _, cmd := range commands {
+			fmt.Fprintf(stderr, "  %-11s %s\n", cmd.name, cmd.summary)
+		}
+	}
+
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.name == flags.Arg(0) {
+			cmd = c
+		}
+	}
+
+	if cmd == nil {
+		fmt.Fprintf(stderr, "catena: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	if cmd.write && *partitionSize <= 0 {
+		fmt.Fprintf(stderr, "catena %s: -partition-size is required\n", cmd.name)
+		return 2
+	}
+
+	var db *catena.DB
+	if !cmd.offline {
+		opts := []catena.Option{catena.WithTimestampUnit(*unit)}
+		if !cmd.write {
+			opts = append(opts, catena.WithReadOnly())
+		}
+
+		rollups, err := rollupOptions(*dir, *unit)
+		if err == nil {
+			db, err = catena.OpenDB(*dir, *partitionSize, 0, append(opts, rollups...)...)
+		}
+
+		if err != nil {
+			fmt.Fprintf(stderr, "catena: %v\n", err)
+			return 1
+		}
+	}
+
+	out := bufio.NewWriter(stdout)
+
+	err := cmd.run(&env{cmd: cmd, dir: *dir, db: db, stdin: stdin, stdout: out, stderr: stderr}, flags.Args()[1:])
+	if flushErr := out.Flush(); err == nil {
+		err = flushErr
+	}
+
+	if db != nil {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err == flag.ErrHelp {
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "catena %s: %v\n", cmd.name, err)
+		return 1
+	}
+
+	return 0
+}
+
+// A seriesFlags holds the flags that select a series and time range.
+type seriesFlags struct {
+	*flag.FlagSet
+
+	source *string
+	metric *string
+	start  *int64
+	end    *int64
+}
+
+func newSeriesFlags(env *env) *seriesFlags {
+	flags := flag.NewFlagSet(env.cmd.name, flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: catena %s %s\n", env.cmd.name, env.cmd.args)
+		flags.PrintDefaults()
+	}
+
+	return &seriesFlags{
+		FlagSet: flags,
+		source:  flags.String("source", "", "source name"),
+		metric:  flags.String("metric", "", "metric name"),
+		start:   flags.Int64("start", math.MinInt64, "start timestamp, inclusive"),
+		end:     flags.Int64("end", math.MaxInt64, "end timestamp, exclusive"),
+	}
+}
+
+// parse parses args and checks that the source and, if
+// needMetric is set, the metric are given.
+func (f *seriesFlags) parse(args []string, needSource, needMetric bool) error {
+	err := f.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if f.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", f.Arg(0))
+	}
+
+	if needSource && *f.source == "" {
+		return errors.New("-source is required")
+	}
+
+	if needMetric && *f.metric == "" {
+		return errors.New("-metric is required")
+	}
+
+	return nil
+}
+
+func runPartitions(env *env, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected argument %q", args[0])
+	}
+
+	w := tabwriter.NewWriter(env.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tMIN\tMAX\tSIZE\tSERIES\tLATE\tRESOLUTION")
+
+	for _, p := range env.db.Partitions() {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", p.Filename, p.MinTimestamp, p.MaxTimestamp,
+			p.Size, p.Series, p.LateBuffers, p.Resolution)
+	}
+
+	return w.Flush()
+}
+
+func runSources(env *env, args []string) error {
+	flags := newSeriesFlags(env)
+	err := flags.parse(args, false, false)
+	if err != nil {
+		return err
+	}
+
+	return printSorted(env.stdout, env.db.Sources(*flags.start, *flags.end))
+}
+
+func runMetrics(env *env, args []string) error {
+	flags := newSeriesFlags(env)
+	err := flags.parse(args, true, false)
+	if err != nil {
+		return err
+	}
+
+	return printSorted(env.stdout, env.db.Metrics(*flags.source, *flags.start, *flags.end))
+}
+
+func runRange(env *env, args []string) error {
+	flags := newSeriesFlags(env)
+	err := flags.parse(args, true, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = env.db.Scan(*flags.source, *flags.metric, *flags.start, *flags.end, func(point catena.Point) error {
+		return printPoint(env.stdout, point)
+	})
+
+	return err
+}
+
+func runAggregate(env *env, args []string) error {
+	flags := newSeriesFlags(env)
+	aggregate := flags.String("aggregate", string(catena.AggregateMean), "sum, mean, min, max or count")
+	interval := flags.Int64("interval", 0, "bucket width in timestamp units, or 0 for a single value")
+
+	err := flags.parse(args, true, true)
+	if err != nil {
+		return err
+	}
+
+	a := catena.Aggregate(*aggregate)
+
+	if *interval > 0 {
+		return env.db.DownsampleRange(*flags.source, *flags.metric, *flags.start, *flags.end, *interval, a,
+			func(point catena.Point) error {
+				return printPoint(env.stdout, point)
+			})
+	}
+
+	value, err := env.db.AggregateRange(*flags.source, *flags.metric, *flags.start, *flags.end, a)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(env.stdout, formatValue(value))
+	return err
+}
+
+func runExport(env *env, args []string) error {
+	flags := newSeriesFlags(env)
+	format := flags.String("format", string(catena.ExportCSV), "csv or ndjson")
+	flags.Lookup("source").Usage = "comma-separated sources, or all sources if empty"
+	flags.Lookup("metric").Usage = "comma-separated metrics, or all metrics if empty"
+
+	err := flags.parse(args, false, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = env.db.Export(env.stdout, catena.ExportOptions{
+		Format:  catena.ExportFormat(*format),
+		Sources: splitList(*flags.source),
+		Metrics: splitList(*flags.metric),
+		Start:   *flags.start,
+		End:     *flags.end,
+	})
+
+	return err
+}
+
+// splitList splits a comma-separated list, returning
+// nil for an empty string.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// insertBatchSize is the number of rows inserted at a time.
+const insertBatchSize = 1000
+
+func runInsert(env *env, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected argument %q", args[0])
+	}
+
+	rows := []catena.Row{}
+	inserted := 0
+
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+
+		err := env.db.InsertRows(rows)
+		if err != nil {
+			return err
+		}
+
+		inserted += len(rows)
+		rows = rows[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(env.stdin)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		row, err := parseRow(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		rows = append(rows, row)
+		if len(rows) == insertBatchSize {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(env.stdout, "inserted %d rows\n", inserted)
+	return err
+}
+
+func runImport(env *env, args []string) error {
+	flags := flag.NewFlagSet(env.cmd.name, flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: catena %s %s\n", env.cmd.name, env.cmd.args)
+		flags.PrintDefaults()
+	}
+
+	format := flags.String("format", string(catena.ExportCSV), "csv or ndjson")
+	columns := flags.String("columns", "", "comma-separated names of the timestamp, source, metric and value columns or keys")
+	timestampFormat := flags.String("timestamp-format", "", "s, ms, ns or rfc3339, or empty for the DB's timestamp unit")
+	batchSize := flags.Int("batch-size", 1000, "rows inserted at a time")
+	backfillSize := flags.Int("backfill-size", 100000, "rows older than the DB backfilled at a time")
+	maxErrors := flags.Int("max-errors", 0, "stop after this many bad lines, or 0 for no limit")
+	progress := flags.Bool("progress", false, "report progress on standard error")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 1 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(1))
+	}
+
+	opts := catena.ImportOptions{
+		Format:          catena.ExportFormat(*format),
+		TimestampFormat: catena.TimestampFormat(*timestampFormat),
+		BatchSize:       *batchSize,
+		BackfillSize:    *backfillSize,
+		MaxErrors:       *maxErrors,
+	}
+
+	if *columns != "" {
+		names := splitList(*columns)
+		if len(names) != 4 {
+			return errors.New("-columns must name 4 columns")
+		}
+
+		opts.Columns = catena.ImportColumns{
+			Timestamp: names[0],
+			Source:    names[1],
+			Metric:    names[2],
+			Value:     names[3],
+		}
+	}
+
+	if *progress {
+		opts.Progress = func(stats catena.ImportStats) {
+			fmt.Fprintf(env.stderr, "%d lines, %d inserted, %d failed\n", stats.Lines, stats.Inserted, stats.Failed)
+		}
+	}
+
+	r := env.stdin
+	if flags.NArg() == 1 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		r = f
+	}
+
+	result, err := env.db.Import(r, opts)
+	if result != nil {
+		for _, importErr := range result.Errors {
+			fmt.Fprintf(env.stderr, "line %d: %v\n", importErr.Line, importErr.Err)
+		}
+
+		fmt.Fprintf(env.stdout, "inserted %d rows, backfilled %d rows\n", result.Inserted, result.Backfilled)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if result.Failed > 0 {
+		return fmt.Errorf("%d lines failed", result.Failed)
+	}
+
+	return nil
+}
+
+func runFsck(env *env, args []string) error {
+	flags := flag.NewFlagSet(env.cmd.name, flag.ContinueOnError)
+	flags.SetOutput(env.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(env.stderr, "usage: catena %s %s\n", env.cmd.name, env.cmd.args)
+		flags.PrintDefaults()
+	}
+
+	repair := flags.Bool("repair", false, "truncate torn WALs, rebuild .part files from WALs and quarantine unreadable files")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	fsck := catena.Check
+	if *repair {
+		fsck = catena.Repair
+	}
+
+	report, err := fsck(env.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Fprintln(env.stdout, problem)
+	}
+
+	_, err = fmt.Fprintf(env.stdout, "checked %d WALs with %d rows and %d .part files with %d points\n",
+		report.WALs, report.Rows, report.Parts, report.Points)
+	if err != nil {
+		return err
+	}
+
+	if len(report.Problems) > 0 && !*repair {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+
+	return nil
+}
+
+// parseRow parses a row of the form "source metric timestamp value".
+func parseRow(s string) (catena.Row, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 4 {
+		return catena.Row{}, errors.New("expected source, metric, timestamp and value")
+	}
+
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return catena.Row{}, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return catena.Row{}, fmt.Errorf("invalid value %q", fields[3])
+	}
+
+	return catena.Row{
+		Source: fields[0],
+		Metric: fields[1],
+		Point: catena.Point{
+			Timestamp: timestamp,
+			Value:     value,
+		},
+	}, nil
+}
+
+func printSorted(w io.Writer, names []string) error {
+	sort.Strings(names)
+	for _, name := range names {
+		_, err := fmt.Fprintln(w, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printPoint(w io.Writer, point catena.Point) error {
+	_, err := fmt.Fprintf(w, "%d %s\n", point.Timestamp, formatValue(point.Value))
+	return err
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// rollupOptions returns a WithRollup option for every rollup tier
+// directory in dir, which are named after their resolution in
+// timestamp units. The tiers are kept forever.
+func rollupOptions(dir string, unit time.Duration) ([]catena.Option, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []catena.Option{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "rollup_") {
+			continue
+		}
+
+		resolution, err := strconv.ParseInt(strings.TrimPrefix(name, "rollup_"), 10, 64)
+		if err != nil || resolution <= 0 {
+			continue
+		}
+
+		opts = append(opts, catena.WithRollup(time.Duration(resolution)*unit, 0))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+func TestCommands(t *testing.T) {
+	os.RemoveAll("/tmp/catena_cmd_test")
+
+	db, err := catena.NewDB("/tmp/catena_cmd_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runCmd := func(stdin string, args ...string) string {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+		status := run(append([]string{"-dir", "/tmp/catena_cmd_test", "-partition-size", "100"}, args...),
+			strings.NewReader(stdin), stdout, stderr)
+		if status != 0 {
+			t.Fatalf("%v: exit status %d: %s", args, status, stderr)
+		}
+
+		return stdout.String()
+	}
+
+	out := runCmd("# source metric timestamp value\nr1 if_in 10 1\nr1 if_in 20 2.5\n\nr2 if_out 30 -1\n", "insert")
+	if out != "inserted 3 rows\n" {
+		t.Errorf("unexpected insert output %q", out)
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"sources"}, "r1\nr2\n"},
+		{[]string{"metrics", "-source", "r1"}, "if_in\n"},
+		{[]string{"range", "-source", "r1", "-metric", "if_in", "-start", "15"}, "20 2.5\n"},
+		{[]string{"aggregate", "-source", "r1", "-metric", "if_in"}, "1.75\n"},
+		{[]string{"aggregate", "-source", "r1", "-metric", "if_in", "-aggregate", "count", "-interval", "10"}, "10 1\n20 1\n"},
+		{[]string{"export"}, "timestamp,source,metric,value\n10,r1,if_in,1\n20,r1,if_in,2.5\n30,r2,if_out,-1\n"},
+		{[]string{"export", "-format", "ndjson", "-source", "r2,r3", "-start", "30"},
+			`{"source":"r2","metric":"if_out","timestamp":30,"value":-1}` + "\n"},
+	}
+
+	for _, test := range tests {
+		if out = runCmd("", test.args...); out != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.args, test.expected, out)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(runCmd("", "partitions")), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "FILE") ||
+		!strings.HasPrefix(lines[1], "/tmp/catena_cmd_test/1.wal  10   30") || len(strings.Fields(lines[1])) != 7 {
+		t.Errorf("unexpected partitions output %q", lines)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"range", "-source", "r1"},
+		{"aggregate", "-source", "r1", "-metric", "if_in", "-aggregate", "median"},
+		{"export", "-format", "xml"},
+	} {
+		stderr := &bytes.Buffer{}
+		if run(append([]string{"-dir", "/tmp/catena_cmd_test"}, args...), nil, &bytes.Buffer{}, stderr) == 0 {
+			t.Errorf("%v: expected a failure", args)
+		}
+	}
+
+	stderr := &bytes.Buffer{}
+	if run([]string{"-dir", "/tmp/catena_cmd_test", "insert"}, strings.NewReader("r1 if_in 40 1\n"), &bytes.Buffer{}, stderr) != 2 ||
+		!strings.Contains(stderr.String(), "-partition-size is required") {
+		t.Errorf("expected a missing partition size, got %q", stderr)
+	}
+
+	stderr = &bytes.Buffer{}
+	if run([]string{"-dir", "/tmp/catena_cmd_test", "-partition-size", "100", "insert"}, strings.NewReader("r1 if_in x 1\n"), &bytes.Buffer{}, stderr) != 1 ||
+		!strings.Contains(stderr.String(), "line 1") {
+		t.Errorf("expected a line error, got %q", stderr)
+	}
+
+	if out = runCmd("", "fsck"); out != "checked 1 WALs with 3 rows and 0 .part files with 0 points\n" {
+		t.Errorf("unexpected fsck output %q", out)
+	}
+
+	f, err := os.OpenFile("/tmp/catena_cmd_test/1.wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.WriteString("torn")
+	f.Close()
+
+	stdout := &bytes.Buffer{}
+	if run([]string{"-dir", "/tmp/catena_cmd_test", "fsck"}, nil, stdout, &bytes.Buffer{}) != 1 ||
+		!strings.HasPrefix(stdout.String(), "/tmp/catena_cmd_test/1.wal: torn tail") {
+		t.Errorf("expected a torn tail, got %q", stdout)
+	}
+
+	if out = runCmd("", "fsck", "-repair"); !strings.HasSuffix(strings.SplitN(out, "\n", 2)[0], "truncated to 114 bytes") {
+		t.Errorf("unexpected repair output %q", out)
+	}
+
+	runCmd("", "fsck")
+
+	out = runCmd("host,name,time,value\nr3,if_in,1970-01-01T00:00:40Z,4\n", "import",
+		"-columns", "time,host,name,value", "-timestamp-format", "rfc3339")
+	if out != "inserted 1 rows, backfilled 0 rows\n" {
+		t.Errorf("unexpected import output %q", out)
+	}
+
+	if out = runCmd("", "range", "-source", "r3", "-metric", "if_in"); out != "40 4\n" {
+		t.Errorf("unexpected range output %q", out)
+	}
+
+	stderr = &bytes.Buffer{}
+	if run([]string{"-dir", "/tmp/catena_cmd_test", "-partition-size", "100", "import", "-format", "ndjson"}, strings.NewReader("{}\n"),
+		&bytes.Buffer{}, stderr) != 1 || !strings.HasPrefix(stderr.String(), "line 1: missing") {
+		t.Errorf("expected a line error, got %q", stderr)
+	}
+}
+
+func TestRollupTiers(t *testing.T) {
+	os.RemoveAll("/tmp/catena_cmd_rollup_test")
+
+	db, err := catena.NewDB("/tmp/catena_cmd_rollup_test", 10, 2, catena.WithRollup(10*time.Second, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []catena.Row{}
+	for ts := int64(0); ts < 40; ts++ {
+		rows = append(rows, catena.Row{Source: "a", Metric: "b", Point: catena.Point{Timestamp: ts, Value: float64(ts % 10)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the compactor to roll up and drop
+	// the partitions beyond the limit.
+	for deadline := time.Now().Add(10 * time.Second); db.CompactionStats().Succeeded[catena.CompactionDrop] < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for partitions to be dropped")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	status := run([]string{"-dir", "/tmp/catena_cmd_rollup_test", "-partition-size", "10",
+		"range", "-source", "a", "-metric", "b", "-end", "20"}, nil, stdout, stderr)
+	if status != 0 {
+		t.Fatalf("exit status %d: %s", status, stderr)
+	}
+
+	// The dropped partitions are read from the rollup tier.
+	if stdout.String() != "0 4.5\n10 4.5\n" {
+		t.Errorf("unexpected range output %q", stdout)
+	}
+}
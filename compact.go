@@ -1,22 +1,36 @@
 package catena
 
 import (
-	"os"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 
 	"github.com/Cistern/catena/partition"
 	"github.com/Cistern/catena/partition/disk"
 	"github.com/Cistern/catena/partition/memory"
+	"github.com/Cistern/catena/vfs"
 )
 
-// compact drops old partitions and compacts older memory to
-// read-only disk partitions.
+// compact runs continuous queries, drops old partitions, compacts
+// older memory to read-only disk partitions, folds late rows into
+// disk partitions and merges small disk partitions.
 func (db *DB) compact() {
+	// Merging in particular must not race with
+	// another compaction.
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+
+	db.runContinuousQueries()
+
+	// Look for partitions to drop. Partitions are dropped
+	// once there are more than maxPartitions of them or once
+	// they fall outside of the retention period.
+	cutoff, hasRetention := db.retentionCutoff()
 
-	// Look for partitions to drop
 	i := db.partitionList.NewIterator()
 	seen := 0
+	kept := false
 	lastMin := int64(0)
 	for i.Next() {
 		p, err := i.Value()
@@ -25,24 +39,50 @@ func (db *DB) compact() {
 		}
 
 		seen++
-		if seen <= db.maxPartitions {
+		tooMany := db.maxPartitions > 0 && seen > db.maxPartitions
+		expired := hasRetention && p.MaxTimestamp() < cutoff
+		if !tooMany && !expired {
+			kept = true
 			lastMin = p.MinTimestamp()
 			continue
 		}
 
-		atomic.SwapInt64(&db.minTimestamp, lastMin)
+		if !db.compactionDue(CompactionDrop, p.Filename()) {
+			continue
+		}
+
+		// Keep a summary of the partition around
+		// before it's gone.
+		start := db.clock()
+		p.Hold()
+		err = db.rollup(p)
+		p.Release()
+		if err != nil {
+			db.reportCompaction(CompactionDrop, p.Filename(), start, err)
+			continue
+		}
+
+		if kept {
+			atomic.SwapInt64(&db.minTimestamp, lastMin)
+		}
 
 		// Remove it from the list
 		db.partitionList.Remove(p)
 
 		// Make sure we're the only ones accessing the partition
 		p.ExclusiveHold()
-		p.Destroy()
+		err = p.Destroy()
 		p.ExclusiveRelease()
+
+		db.reportCompaction(CompactionDrop, p.Filename(), start, err)
+	}
+
+	for _, tier := range db.rollupTiers {
+		tier.dropExpired(db)
 	}
 
 	// Find partitions to compact
-	toCompact := []partition.Partition{}
+	toCompact := []*memory.MemoryPartition{}
 
 	seen = 0
 	i = db.partitionList.NewIterator()
@@ -55,53 +95,228 @@ func (db *DB) compact() {
 
 		p, _ := i.Value()
 
-		p.Hold()
-		if !p.ReadOnly() {
-			p.Release()
-			p.ExclusiveHold()
-			p.SetReadOnly()
-			p.ExclusiveRelease()
+		switch p := p.(type) {
+		case *memory.MemoryPartition:
+			p.Hold()
+			if !p.ReadOnly() {
+				p.Release()
+				p.ExclusiveHold()
+				p.SetReadOnly()
+				p.ExclusiveRelease()
+			} else {
+				p.Release()
+			}
 
 			toCompact = append(toCompact, p)
-		} else {
-			p.Release()
+
+		case *latePartition:
+			// Rows arrived after the memory partition
+			// was sealed.
+			if memPart, isMemory := p.base.(*memory.MemoryPartition); isMemory {
+				toCompact = append(toCompact, memPart)
+			}
 		}
 	}
 
-	for _, p := range toCompact {
-		// p is read-only, so no need to lock.
-		memPart := p.(*memory.MemoryPartition)
-
-		// Create the disk partition file
-		filename := strings.TrimSuffix(memPart.Filename(), ".wal") + ".part"
-		f, err := os.Create(filename)
-		if err != nil {
-			// ???
-			return
+	backlog := 0
+	for _, memPart := range toCompact {
+		if !db.compactionDue(CompactionCompact, memPart.Filename()) {
+			backlog++
+			continue
 		}
 
-		// Compact
-		err = memPart.Compact(f)
+		start := db.clock()
+		err := db.compactPartition(memPart)
+		db.reportCompaction(CompactionCompact, memPart.Filename(), start, err)
 		if err != nil {
-			// ???
-			return
+			backlog++
 		}
+	}
 
-		// Close and reopen.
-		f.Sync()
-		f.Close()
+	db.foldLatePartitions()
+	db.mergePartitions()
 
-		diskPart, err := disk.OpenDiskPartition(filename)
-		if err != nil {
-			// ???
+	db.setCompactionBacklog(backlog)
+}
+
+// A CompactionError describes a memory partition that could not be
+// compacted. The partition stays in memory, read only, and its
+// compaction is tried again later. See WithCompactionRetry.
+type CompactionError struct {
+	// Filename is the file name of the partition's WAL.
+	Filename string
+
+	Err error
+}
+
+func (e *CompactionError) Error() string {
+	return fmt.Sprintf("catena: compacting %s: %v", e.Filename, e.Err)
+}
+
+// WithCompactionErrorHandler sets a function that the compactor calls
+// whenever it fails to compact a memory partition. It is called from
+// the compactor's goroutine, which waits for it to return.
+func WithCompactionErrorHandler(handler func(*CompactionError)) Option {
+	return func(db *DB) {
+		db.compactionErrorHandler = handler
+	}
+}
+
+// compactPartition archives the WAL of the sealed memory partition
+// memPart, writes memPart to a disk partition and swaps it in. The
+// WAL is only destroyed once the disk partition has been synced and
+// renamed into place and the directory has been synced, so a crash at
+// any point leaves the WAL or a complete disk partition. If a disk
+// partition is found next to its WAL when the DB is opened, it is
+// removed and the WAL compacted again. On failure no disk partition
+// is left and memPart stays in the partition list.
+func (db *DB) compactPartition(memPart *memory.MemoryPartition) error {
+	// The WAL is archived before the disk partition is swapped in,
+	// since a WAL left next to the disk partition would replace it,
+	// and anything folded or merged into it, when the DB is opened.
+	err := db.archiveWAL(memPart.Filename())
+	if err != nil {
+		return err
+	}
+
+	// memPart is read-only, so no need to lock.
+	filename := strings.TrimSuffix(memPart.Filename(), ".wal") + ".part"
+
+	diskPart, err := writePartitionFile(db.fs, filename, memPart)
+	if err != nil {
+		// The file may have been renamed into place
+		// before the directory failed to sync.
+		db.fs.Remove(filename)
+		return err
+	}
+
+	// Swap the memory partition with the disk partition.
+	db.replaceBase(memPart, diskPart)
+
+	memPart.ExclusiveHold()
+	memPart.Destroy()
+	memPart.ExclusiveRelease()
+
+	return nil
+}
+
+// replaceBase replaces the sealed memory partition memPart with its
+// compacted disk partition, either in the partition list or, if rows
+// have arrived since it was sealed, underneath its late partition.
+func (db *DB) replaceBase(memPart *memory.MemoryPartition, diskPart *disk.DiskPartition) {
+	db.partitionCreateLock.Lock()
+	defer db.partitionCreateLock.Unlock()
+
+	err := db.partitionList.Replace([]partition.Partition{memPart}, diskPart)
+	if err == nil {
+		return
+	}
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		if lp, isLate := p.(*latePartition); isLate && lp.base == memPart {
+			lp.ExclusiveHold()
+			lp.base = diskPart
+			lp.ExclusiveRelease()
 			return
 		}
+	}
+}
+
+// writeDiskPartition encodes rows into a disk partition file at
+// filename in fs, using the same encoding as compaction, and opens
+// it. See writePartitionFile.
+func writeDiskPartition(fs vfs.FS, filename string, rows []partition.Row) (*disk.DiskPartition, error) {
+	builder := memory.NewMemoryPartition(nil)
+
+	err := builder.InsertRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	builder.SetReadOnly()
+
+	return writePartitionFile(fs, filename, builder)
+}
+
+// writePartitionFile compacts the read only memory partition p into
+// a disk partition file at filename in fs and opens it. The file is
+// written to filename plus ".tmp", synced, and renamed into place,
+// and then the directory is synced.
+func writePartitionFile(fs vfs.FS, filename string, p *memory.MemoryPartition) (*disk.DiskPartition, error) {
+	tmpFilename := filename + ".tmp"
+	f, err := vfs.Create(fs, tmpFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.Compact(f)
+	if err == nil {
+		err = f.Sync()
+	}
 
-		// Swap the memory partition with the disk partition.
-		db.partitionList.Swap(memPart, diskPart)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		fs.Remove(tmpFilename)
+		return nil, err
+	}
+
+	err = fs.Rename(tmpFilename, filename)
+	if err != nil {
+		fs.Remove(tmpFilename)
+		return nil, err
+	}
+
+	err = fs.SyncDir(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return disk.OpenDiskPartitionFS(fs, filename)
+}
+
+// writeFileFS writes data to filename in fs. The data is written to
+// filename plus ".tmp", synced, and renamed into place, and then the
+// directory is synced.
+func writeFileFS(fs vfs.FS, filename string, data []byte) error {
+	tmpFilename := filename + ".tmp"
+	f, err := vfs.Create(fs, tmpFilename)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
 
-		memPart.ExclusiveHold()
-		memPart.Destroy()
-		memPart.ExclusiveRelease()
+	if err == nil {
+		err = fs.Rename(tmpFilename, filename)
 	}
+
+	if err != nil {
+		fs.Remove(tmpFilename)
+		return err
+	}
+
+	return fs.SyncDir(filepath.Dir(filename))
+}
+
+// partitionID returns the numeric ID in the name of a
+// partition file, e.g. 3 for "/path/3.part".
+func partitionID(filename string) (int64, error) {
+	id := int64(0)
+	base := filepath.Base(filename)
+	_, err := fmt.Sscanf(base[:len(base)-len(filepath.Ext(base))], "%d", &id)
+	return id, err
 }
@@ -0,0 +1,627 @@
+package catena
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+func TestRetention(t *testing.T) {
+	os.RemoveAll("/tmp/catena_retention_test")
+
+	now := int64(1000)
+	clock := func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	db, err := NewDB("/tmp/catena_retention_test", 10, 0,
+		WithRetention(100*time.Second), WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ts := int64(900); ts < 1000; ts += 10 {
+		err = db.InsertRows([]Row{
+			Row{
+				Source: "a",
+				Metric: "b",
+				Point: Point{
+					Timestamp: ts,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.InsertRows([]Row{
+		Row{
+			Source: "a",
+			Metric: "b",
+			Point: Point{
+				Timestamp: 899,
+			},
+		},
+	})
+	if retentionErr, ok := err.(*RetentionError); !ok {
+		t.Fatalf("expected a *RetentionError, got %v", err)
+	} else if retentionErr.Cutoff != 900 {
+		t.Fatalf("expected cutoff %d, got %d", 900, retentionErr.Cutoff)
+	}
+
+	// Move forward in time so that half of the partitions expire.
+	atomic.StoreInt64(&now, 1050)
+	db.compact()
+
+	i, err := db.NewIterator("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.Point().Timestamp != 950 {
+		t.Fatalf("expected timestamp %d, got %d", 950, i.Point().Timestamp)
+	}
+
+	i.Close()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollup(t *testing.T) {
+	os.RemoveAll("/tmp/catena_rollup_test")
+
+	now := int64(1000)
+	clock := func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	db, err := NewDB("/tmp/catena_rollup_test", 10, 0,
+		WithRetention(100*time.Second), WithClock(clock),
+		WithRollup(time.Minute, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(900); ts < 1000; ts++ {
+		rows = append(rows, Row{
+			Source: "a",
+			Metric: "b",
+			Point: Point{
+				Timestamp: ts,
+				Value:     float64(ts),
+			},
+		})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, resolution, err := db.Range("a", "b", 900, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolution != 0 || len(points) != 100 {
+		t.Fatalf("expected 100 raw points, got %d at resolution %d", len(points), resolution)
+	}
+
+	// Expire all of the raw data.
+	atomic.StoreInt64(&now, 1200)
+	db.compact()
+
+	points, resolution, err = db.Range("a", "b", 900, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolution != 60 {
+		t.Fatalf("expected resolution %d, got %d", 60, resolution)
+	}
+
+	expected := []Point{
+		{Timestamp: 900, Value: 929.5},
+		{Timestamp: 960, Value: 979.5},
+	}
+
+	if len(points) != len(expected) {
+		t.Fatalf("expected %d points, got %d", len(expected), len(points))
+	}
+
+	for i := range expected {
+		if points[i] != expected[i] {
+			t.Fatalf("expected point %v, got %v", expected[i], points[i])
+		}
+	}
+
+	if metrics := db.Metrics("a", 900, 1000); len(metrics) != 1 || metrics[0] != "b" {
+		t.Fatalf("expected metrics [b], got %v", metrics)
+	}
+
+	// Aggregates combine the stored stats of the buckets
+	// instead of their means.
+	for a, expected := range map[Aggregate]float64{
+		AggregateCount: 100,
+		AggregateSum:   94950,
+		AggregateMin:   900,
+		AggregateMax:   999,
+		AggregateMean:  949.5,
+	} {
+		value, err := db.AggregateRange("a", "b", 900, 1000, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value != expected {
+			t.Errorf("expected %s %v, got %v", a, expected, value)
+		}
+	}
+
+	counts := []Point{}
+	err = db.DownsampleRange("a", "b", 900, 1000, 120, AggregateCount, func(point Point) error {
+		counts = append(counts, point)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(counts, []Point{{Timestamp: 840, Value: 60}, {Timestamp: 960, Value: 40}}) {
+		t.Errorf("unexpected downsampled counts %v", counts)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	os.RemoveAll("/tmp/catena_merge_test")
+
+	db, err := NewDB("/tmp/catena_merge_test", 10, 0, WithMergeSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 300; ts++ {
+		rows = append(rows, Row{
+			Source: "a",
+			Metric: "b",
+			Point: Point{
+				Timestamp: ts,
+				Value:     float64(ts),
+			},
+		})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.compact()
+
+	// Windows [0, 100) and [100, 200) are merged. The newest
+	// window isn't complete yet so it's left alone.
+	if size := db.partitionList.Size(); size != 12 {
+		t.Fatalf("expected %d partitions, got %d", 12, size)
+	}
+
+	checkPoints := func() {
+		points, _, err := db.Range("a", "b", 0, 300)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != 300 {
+			t.Fatalf("expected %d points, got %d", 300, len(points))
+		}
+
+		for i, point := range points {
+			if point.Timestamp != int64(i) {
+				t.Fatalf("expected timestamp %d, got %d", i, point.Timestamp)
+			}
+		}
+	}
+
+	checkPoints()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB("/tmp/catena_merge_test", 10, 0, WithMergeSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPoints()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactFaults(t *testing.T) {
+	dir := "/tmp/catena_compact_faults_test"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	errs := int32(0)
+	db, err := NewDB(dir, 10, 0, WithFS(fs), WithCompactionRetry(0, 0),
+		WithCompactionErrorHandler(func(err *CompactionError) {
+			atomic.AddInt32(&errs, 1)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 40; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(name string) bool {
+		_, err := fs.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	checkPoints := func() {
+		points, _, err := db.Range("a", "b", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != 40 {
+			t.Errorf("expected %d points, got %d", 40, len(points))
+		}
+	}
+
+	faults := []vfs.Fault{
+		{Op: vfs.OpWrite, Pattern: "*.part.tmp"},
+		{Op: vfs.OpSync, Pattern: "*.part.tmp"},
+		{Op: vfs.OpRename, Pattern: "*.part.tmp"},
+		{Op: vfs.OpSync, Pattern: filepath.Base(dir)},
+	}
+
+	for _, fault := range faults {
+		before := atomic.LoadInt32(&errs)
+
+		fs.Inject(fault)
+		db.compact()
+
+		// Both sealed partitions failed and were rolled back.
+		if failed := atomic.LoadInt32(&errs) - before; failed < 2 {
+			t.Errorf("%v fault: expected 2 errors, got %d", fault.Op, failed)
+		}
+
+		for _, name := range []string{"1.part", "1.part.tmp", "2.part", "2.part.tmp"} {
+			if exists(name) {
+				t.Errorf("%v fault: unexpected %s", fault.Op, name)
+			}
+		}
+
+		if !exists("1.wal") || !exists("2.wal") {
+			t.Errorf("%v fault: expected the WALs to be kept", fault.Op)
+		}
+
+		checkPoints()
+		fs.Clear()
+	}
+
+	// The partitions are compacted once the faults are gone.
+	db.compact()
+
+	for _, name := range []string{"1.part", "2.part"} {
+		if !exists(name) {
+			t.Errorf("expected %s", name)
+		}
+	}
+
+	if exists("1.wal") || exists("2.wal") {
+		t.Error("expected the compacted WALs to be destroyed")
+	}
+
+	checkPoints()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave files as a crash during compaction would.
+	for _, name := range []string{"3.part.tmp", "3.part"} {
+		f, err := vfs.Create(fs, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("partial"))
+		f.Close()
+	}
+
+	db, err = OpenDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if exists("3.part.tmp") || exists("3.part") {
+		t.Error("expected partial disk partitions to be removed")
+	}
+
+	checkPoints()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionHealth(t *testing.T) {
+	dir := "/tmp/catena_compaction_health_test"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	now := int64(0)
+	clock := func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&now))
+	}
+
+	advance := func(d time.Duration) {
+		atomic.AddInt64(&now, int64(d))
+	}
+
+	eventsLock := sync.Mutex{}
+	events := []CompactionEvent{}
+
+	db, err := NewDB(dir, 10, 0, WithFS(fs), WithClock(clock), WithCompactionBacklogLimit(1),
+		WithCompactionHook(func(event CompactionEvent) {
+			eventsLock.Lock()
+			events = append(events, event)
+			eventsLock.Unlock()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 40; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Inject(vfs.Fault{Op: vfs.OpWrite, Pattern: "*.part.tmp"})
+
+	check := func(failed int64, failures int, retryAt time.Duration) {
+		stats := db.CompactionStats()
+		if stats.Failed[CompactionCompact] != failed || stats.Backlog != 2 || len(stats.Failing) != 2 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+
+		for _, failure := range stats.Failing {
+			if failure.Failures != failures || failure.RetryAt != time.Unix(0, int64(retryAt)) {
+				t.Errorf("unexpected failure %+v", failure)
+			}
+		}
+
+		health := db.Health()
+		if health.Healthy || len(health.Problems) != 3 {
+			t.Errorf("unexpected health %+v", health)
+		}
+	}
+
+	db.compact()
+	check(2, 1, time.Second)
+
+	// The failed partitions wait to be retried.
+	advance(time.Second / 2)
+	db.compact()
+	check(2, 1, time.Second)
+
+	// The wait doubles.
+	advance(time.Second / 2)
+	db.compact()
+	check(4, 2, 3*time.Second)
+
+	eventsLock.Lock()
+	last := events[len(events)-1]
+	eventsLock.Unlock()
+
+	if last.Step != CompactionCompact || last.Failures != 2 || last.Err == nil {
+		t.Errorf("unexpected event %+v", last)
+	}
+
+	fs.Clear()
+	advance(2 * time.Second)
+	db.compact()
+
+	stats := db.CompactionStats()
+	if stats.Succeeded[CompactionCompact] != 2 || stats.Backlog != 0 || len(stats.Failing) != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if health := db.Health(); !health.Healthy || len(health.Problems) != 0 {
+		t.Errorf("unexpected health %+v", health)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollupPartialExpiry(t *testing.T) {
+	os.RemoveAll("/tmp/catena_rollup_partial_test")
+
+	now := int64(1000)
+	clock := func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	db, err := NewDB("/tmp/catena_rollup_partial_test", 10, 0,
+		WithRetention(100*time.Second), WithClock(clock),
+		WithRollup(time.Minute, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(900); ts < 1000; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire the raw data before 950.
+	atomic.StoreInt64(&now, 1050)
+	db.compact()
+
+	points, resolution, err := db.Range("a", "b", 900, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resolution != 60 {
+		t.Fatalf("expected resolution %d, got %d", 60, resolution)
+	}
+
+	// One bucket for the expired points, followed by the raw points.
+	if len(points) != 51 || points[0] != (Point{Timestamp: 900, Value: 924.5}) {
+		t.Fatalf("unexpected points %v", points)
+	}
+
+	for i, point := range points[1:] {
+		if point.Timestamp != int64(950+i) || point.Value != float64(950+i) {
+			t.Fatalf("expected raw point %d, got %v", 950+i, point)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeRecovery(t *testing.T) {
+	dir := "/tmp/catena_merge_recovery_test"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	db, err := NewDB(dir, 10, 0, WithFS(fs), WithMergeSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 300; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The merges stop after removing the first input.
+	fs.Inject(vfs.Fault{Op: vfs.OpRemove, Pattern: "*.part", After: 1})
+	db.compact()
+
+	lastPartitionID := atomic.LoadInt64(&db.lastPartitionID)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Clear()
+
+	intents, err := fs.ReadDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, name := range intents {
+		if strings.HasPrefix(name, "merge-") {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("expected a merge intent to be left")
+	}
+
+	// An intent whose output was never written
+	// leaves its inputs alone.
+	err = writeFileFS(fs, filepath.Join(dir, mergeIntentFilename(1000)),
+		[]byte(`{"output":"1000.part","inputs":["29.part","30.part"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(dir, 10, 0, WithFS(fs), WithMergeSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := atomic.LoadInt64(&db.lastPartitionID); id < lastPartitionID {
+		t.Errorf("expected partition IDs to keep increasing, got %d after %d", id, lastPartitionID)
+	}
+
+	names, err := fs.ReadDirNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "merge-") {
+			t.Errorf("unexpected %s", name)
+		}
+	}
+
+	points, _, err := db.Range("a", "b", 0, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 300 {
+		t.Fatalf("expected %d points, got %d", 300, len(points))
+	}
+
+	for i, point := range points {
+		if point.Timestamp != int64(i) {
+			t.Fatalf("expected timestamp %d, got %d", i, point.Timestamp)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,416 @@
+package catena
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+// continuousQueriesFilename is the name of the file in the DB
+// directory that stores continuous query definitions and their
+// progress.
+const continuousQueriesFilename = "continuous_queries.json"
+
+// A ContinuousQuery aggregates a set of series into fixed-width
+// buckets and writes the results into a new series. Continuous
+// queries are run by the compactor and only compute buckets that
+// are older than the newest point in the DB by at least Delay.
+type ContinuousQuery struct {
+	// Name identifies the query.
+	Name string `json:"name"`
+
+	// Select selects the input series.
+	Select Selector `json:"select"`
+
+	// DivideBy optionally selects a second set of series that is
+	// aggregated the same way. The result is then the ratio of
+	// the two aggregates, e.g. an error ratio.
+	DivideBy *Selector `json:"divide_by,omitempty"`
+
+	// Aggregate reduces all of the selected points within
+	// a bucket to a single value.
+	Aggregate Aggregate `json:"aggregate"`
+
+	// Interval is the bucket width in timestamp units.
+	Interval int64 `json:"interval"`
+
+	// Delay is how far behind the newest point a bucket has to
+	// end before it is computed. It allows late points to arrive.
+	// It defaults to Interval.
+	Delay int64 `json:"delay"`
+
+	// IntoSource and IntoMetric name the series that
+	// results are written to.
+	IntoSource string `json:"into_source"`
+	IntoMetric string `json:"into_metric"`
+}
+
+// A Selector selects series by source and metric. An empty
+// Source or Metric matches every source or metric.
+type Selector struct {
+	Source string `json:"source"`
+	Metric string `json:"metric"`
+}
+
+// continuousQueryState is a continuous query with its progress.
+// It is the unit persisted in continuousQueriesFilename.
+type continuousQueryState struct {
+	Query ContinuousQuery `json:"query"`
+
+	// Checkpoint is the start of the next bucket to compute.
+	// It is unset until the query has found data.
+	Checkpoint    int64 `json:"checkpoint"`
+	HasCheckpoint bool  `json:"has_checkpoint"`
+}
+
+// A ContinuousQueryError describes a failure to run a continuous
+// query. The query's buckets are computed again the next time the
+// compactor runs.
+type ContinuousQueryError struct {
+	// Query is the name of the query. It is empty if the
+	// progress of the queries could not be saved.
+	Query string
+
+	Err error
+}
+
+func (e *ContinuousQueryError) Error() string {
+	if e.Query == "" {
+		return fmt.Sprintf("catena: saving continuous queries: %v", e.Err)
+	}
+
+	return fmt.Sprintf("catena: continuous query %s: %v", e.Query, e.Err)
+}
+
+// WithContinuousQueryErrorHandler sets a function that the compactor
+// calls whenever a continuous query fails. It is called from the
+// compactor's goroutine, which waits for it to return.
+func WithContinuousQueryErrorHandler(handler func(*ContinuousQueryError)) Option {
+	return func(db *DB) {
+		db.continuousQueryErrorHandler = handler
+	}
+}
+
+// reportContinuousQueryError passes err for the
+// query name to the error handler, if there is one.
+func (db *DB) reportContinuousQueryError(name string, err error) {
+	if db.continuousQueryErrorHandler != nil {
+		db.continuousQueryErrorHandler(&ContinuousQueryError{
+			Query: name,
+			Err:   err,
+		})
+	}
+}
+
+// AddContinuousQuery registers q with the DB. The definition is
+// persisted in the DB directory and q starts running with the
+// next compaction.
+func (db *DB) AddContinuousQuery(q ContinuousQuery) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	if q.Name == "" {
+		return errors.New("catena: continuous query has no name")
+	}
+
+	if q.Interval <= 0 {
+		return errors.New("catena: continuous query interval must be positive")
+	}
+
+	if q.IntoSource == "" || q.IntoMetric == "" {
+		return errors.New("catena: continuous query has no output series")
+	}
+
+	err := q.Aggregate.Valid()
+	if err != nil {
+		return err
+	}
+
+	if q.Delay <= 0 {
+		q.Delay = q.Interval
+	}
+
+	db.continuousQueriesLock.Lock()
+	defer db.continuousQueriesLock.Unlock()
+
+	for _, state := range db.continuousQueries {
+		if state.Query.Name == q.Name {
+			return fmt.Errorf("catena: continuous query %s already exists", q.Name)
+		}
+	}
+
+	queries := append(db.continuousQueries, &continuousQueryState{Query: q})
+	err = db.saveContinuousQueries(queries)
+	if err != nil {
+		return err
+	}
+
+	db.continuousQueries = queries
+	return nil
+}
+
+// RemoveContinuousQuery stops and removes the continuous query
+// with the given name. Points it has already written are kept.
+func (db *DB) RemoveContinuousQuery(name string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.continuousQueriesLock.Lock()
+	defer db.continuousQueriesLock.Unlock()
+
+	queries := []*continuousQueryState{}
+	for _, state := range db.continuousQueries {
+		if state.Query.Name != name {
+			queries = append(queries, state)
+		}
+	}
+
+	if len(queries) == len(db.continuousQueries) {
+		return fmt.Errorf("catena: continuous query %s not found", name)
+	}
+
+	err := db.saveContinuousQueries(queries)
+	if err != nil {
+		return err
+	}
+
+	db.continuousQueries = queries
+	return nil
+}
+
+// ContinuousQueries returns the registered continuous queries.
+func (db *DB) ContinuousQueries() []ContinuousQuery {
+	db.continuousQueriesLock.Lock()
+	defer db.continuousQueriesLock.Unlock()
+
+	queries := []ContinuousQuery{}
+	for _, state := range db.continuousQueries {
+		queries = append(queries, state.Query)
+	}
+
+	return queries
+}
+
+// loadContinuousQueries reads persisted continuous queries
+// from the DB directory, if there are any.
+func (db *DB) loadContinuousQueries() error {
+	data, err := vfs.ReadFile(db.fs, filepath.Join(db.baseDir, continuousQueriesFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	queries := []*continuousQueryState{}
+	err = json.Unmarshal(data, &queries)
+	if err != nil {
+		return err
+	}
+
+	db.continuousQueries = queries
+	return nil
+}
+
+// saveContinuousQueries atomically replaces the persisted continuous
+// queries with queries. The caller must hold continuousQueriesLock.
+func (db *DB) saveContinuousQueries(queries []*continuousQueryState) error {
+	data, err := json.MarshalIndent(queries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileFS(db.fs, filepath.Join(db.baseDir, continuousQueriesFilename), data)
+}
+
+// runContinuousQueries computes every complete bucket of every
+// continuous query that hasn't been computed yet, and checkpoints
+// their progress.
+func (db *DB) runContinuousQueries() {
+	db.continuousQueriesLock.Lock()
+	defer db.continuousQueriesLock.Unlock()
+
+	if len(db.continuousQueries) == 0 || db.partitionList.Size() == 0 {
+		return
+	}
+
+	outputs := map[Selector]struct{}{}
+	for _, state := range db.continuousQueries {
+		outputs[Selector{state.Query.IntoSource, state.Query.IntoMetric}] = struct{}{}
+	}
+
+	progressed := false
+
+	for _, state := range db.continuousQueries {
+		q := state.Query
+
+		if !state.HasCheckpoint {
+			oldest, ok := db.oldestTimestamp()
+			if !ok {
+				continue
+			}
+
+			// Start at the first complete bucket. The bucket
+			// containing the oldest point may be missing data that
+			// has already been dropped.
+			state.Checkpoint = bucketStart(oldest, q.Interval)
+			if state.Checkpoint < oldest {
+				state.Checkpoint += q.Interval
+			}
+
+			state.HasCheckpoint = true
+			progressed = true
+		}
+
+		// Results for buckets older than the retention
+		// period would be rejected, so skip them.
+		if cutoff, ok := db.retentionCutoff(); ok && state.Checkpoint < cutoff {
+			first := bucketStart(cutoff, q.Interval)
+			if first < cutoff {
+				first += q.Interval
+			}
+
+			state.Checkpoint = first
+			progressed = true
+		}
+
+		end := bucketStart(atomic.LoadInt64(&db.maxTimestamp)-q.Delay, q.Interval)
+		if end <= state.Checkpoint {
+			continue
+		}
+
+		rows, err := db.evaluateContinuousQuery(q, state.Checkpoint, end, outputs)
+		if err != nil {
+			// Try again next time.
+			db.reportContinuousQueryError(q.Name, err)
+			continue
+		}
+
+		if len(rows) > 0 {
+			err = db.InsertRows(rows)
+			if err != nil {
+				db.reportContinuousQueryError(q.Name, err)
+				continue
+			}
+		}
+
+		state.Checkpoint = end
+		progressed = true
+	}
+
+	if progressed {
+		err := db.saveContinuousQueries(db.continuousQueries)
+		if err != nil {
+			db.reportContinuousQueryError("", err)
+		}
+	}
+}
+
+// evaluateContinuousQuery returns the result rows of q for the
+// buckets in [start, end). Series in exclude are never read so that
+// queries don't consume their own output.
+func (db *DB) evaluateContinuousQuery(q ContinuousQuery, start, end int64,
+	exclude map[Selector]struct{}) ([]Row, error) {
+
+	numerators, err := db.aggregateBuckets(q.Select, q.Interval, start, end, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var denominators map[int64]*aggregator
+	if q.DivideBy != nil {
+		denominators, err = db.aggregateBuckets(*q.DivideBy, q.Interval, start, end, exclude)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buckets := []int64{}
+	for ts := range numerators {
+		buckets = append(buckets, ts)
+	}
+
+	sort.Sort(int64s(buckets))
+
+	rows := []Row{}
+	for _, ts := range buckets {
+		value := numerators[ts].value(q.Aggregate)
+
+		if q.DivideBy != nil {
+			denominator, present := denominators[ts]
+			if !present || denominator.value(q.Aggregate) == 0 {
+				continue
+			}
+
+			value /= denominator.value(q.Aggregate)
+		}
+
+		rows = append(rows, Row{
+			Source: q.IntoSource,
+			Metric: q.IntoMetric,
+			Point: Point{
+				Timestamp: ts,
+				Value:     value,
+			},
+		})
+	}
+
+	return rows, nil
+}
+
+// aggregateBuckets aggregates the raw points of every series
+// matching sel in [start, end) into buckets of the given width.
+func (db *DB) aggregateBuckets(sel Selector, width, start, end int64,
+	exclude map[Selector]struct{}) (map[int64]*aggregator, error) {
+
+	buckets := map[int64]*aggregator{}
+
+	for _, source := range db.Sources(start, end) {
+		if sel.Source != "" && sel.Source != source {
+			continue
+		}
+
+		for _, metric := range db.Metrics(source, start, end) {
+			if sel.Metric != "" && sel.Metric != metric {
+				continue
+			}
+
+			if _, excluded := exclude[Selector{source, metric}]; excluded {
+				continue
+			}
+
+			points, err := db.rawRange(source, metric, start, end)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, point := range points {
+				ts := bucketStart(point.Timestamp, width)
+				agg, present := buckets[ts]
+				if !present {
+					agg = &aggregator{}
+					buckets[ts] = agg
+				}
+
+				agg.add(point.Value)
+			}
+		}
+	}
+
+	return buckets, nil
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,186 @@
+package catena
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+func TestContinuousQuery(t *testing.T) {
+	os.RemoveAll("/tmp/catena_continuous_test")
+
+	db, err := NewDB("/tmp/catena_continuous_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertRows := func(start, end int64) {
+		rows := []Row{}
+		for ts := start; ts < end; ts++ {
+			rows = append(rows, Row{
+				Source: "r1",
+				Metric: "m1",
+				Point: Point{
+					Timestamp: ts,
+					Value:     1,
+				},
+			}, Row{
+				Source: "r1",
+				Metric: "m2",
+				Point: Point{
+					Timestamp: ts,
+					Value:     2,
+				},
+			})
+		}
+
+		err := db.InsertRows(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkTotals := func(expected int) {
+		points, _, err := db.Range("r1", "total", 0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != expected {
+			t.Fatalf("expected %d points, got %d", expected, len(points))
+		}
+
+		for i, point := range points {
+			if point.Timestamp != int64(i*10) || point.Value != 30 {
+				t.Fatalf("unexpected point %v at index %d", point, i)
+			}
+		}
+	}
+
+	err = db.AddContinuousQuery(ContinuousQuery{
+		Name: "r1_total",
+		Select: Selector{
+			Source: "r1",
+		},
+		Aggregate:  AggregateSum,
+		Interval:   10,
+		IntoSource: "r1",
+		IntoMetric: "total",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertRows(0, 100)
+	db.runContinuousQueries()
+
+	// Buckets up to 80 are at least one interval
+	// older than the newest point.
+	checkTotals(8)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB("/tmp/catena_continuous_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queries := db.ContinuousQueries(); len(queries) != 1 || queries[0].Name != "r1_total" {
+		t.Fatalf("expected continuous query to be restored, got %v", queries)
+	}
+
+	// The query resumes from its checkpoint.
+	insertRows(100, 200)
+	db.runContinuousQueries()
+	checkTotals(18)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContinuousQueryRetention(t *testing.T) {
+	dir := "/tmp/catena_continuous_retention_test"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	now := int64(1000)
+	clock := func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	errsLock := sync.Mutex{}
+	errs := []*ContinuousQueryError{}
+
+	db, err := NewDB(dir, 100, 0, WithFS(fs), WithClock(clock),
+		WithRetention(100*time.Second),
+		WithContinuousQueryErrorHandler(func(err *ContinuousQueryError) {
+			errsLock.Lock()
+			errs = append(errs, err)
+			errsLock.Unlock()
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertRows := func(start, end int64) {
+		rows := []Row{}
+		for ts := start; ts < end; ts++ {
+			rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: 1}})
+		}
+
+		err := db.InsertRows(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insertRows(950, 1000)
+
+	err = db.AddContinuousQuery(ContinuousQuery{
+		Name:       "a_sum",
+		Select:     Selector{Source: "a", Metric: "b"},
+		Aggregate:  AggregateSum,
+		Interval:   10,
+		IntoSource: "a",
+		IntoMetric: "sum",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The query falls behind the retention period.
+	atomic.StoreInt64(&now, 1200)
+	insertRows(1100, 1200)
+
+	fs.Inject(vfs.Fault{Op: vfs.OpRename, Pattern: continuousQueriesFilename + ".tmp", Times: 1})
+	db.compact()
+
+	errsLock.Lock()
+	if len(errs) != 1 || errs[0].Query != "" {
+		t.Errorf("expected an error saving the queries, got %v", errs)
+	}
+	errsLock.Unlock()
+
+	points, _, err := db.Range("a", "sum", 0, 1200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Buckets before the cutoff at 1100 are skipped.
+	if len(points) != 8 || points[0].Timestamp != 1100 || points[0].Value != 10 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
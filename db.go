@@ -3,16 +3,17 @@ package catena
 import (
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Cistern/catena/partition"
 	"github.com/Cistern/catena/partition/disk"
 	"github.com/Cistern/catena/partition/memory"
+	"github.com/Cistern/catena/vfs"
 	"github.com/Cistern/catena/wal"
 )
 
@@ -29,26 +30,90 @@ type DB struct {
 	minTimestamp int64
 	maxTimestamp int64
 
+	retention     time.Duration
+	clock         func() time.Time
+	timestampUnit time.Duration
+
+	rollupTiers []*rollupTier
+	mergeSize   int64
+
+	fs            vfs.FS
+	walFactory    wal.Factory
+	walArchiveDir string
+
+	compactionHook         func(CompactionEvent)
+	compactionErrorHandler func(*CompactionError)
+	compactionRetryMin     time.Duration
+	compactionRetryMax     time.Duration
+	compactionBacklogLimit int
+
+	// compactionLock protects the compactor's counters.
+	compactionLock      sync.Mutex
+	compactionSucceeded map[CompactionStep]int64
+	compactionFailed    map[CompactionStep]int64
+	compactionFailures  map[compactionKey]*PartitionFailure
+	compactionBacklog   int
+
+	continuousQueries           []*continuousQueryState
+	continuousQueriesLock       sync.Mutex
+	continuousQueryErrorHandler func(*ContinuousQueryError)
+
 	partitionCreateLock sync.Mutex
+	compactLock         sync.Mutex
+
+	readOnly bool
+	closed   int32
+}
+
+// newDB returns a DB with opts applied. It does not touch baseDir.
+func newDB(baseDir string, partitionSize, maxPartitions int, opts []Option) *DB {
+	db := &DB{
+		baseDir:       baseDir,
+		partitionSize: int64(partitionSize),
+		maxPartitions: maxPartitions,
+		partitionList: newPartitionList(),
+		clock:         time.Now,
+		timestampUnit: time.Second,
+		fs:            vfs.OS,
+
+		compactionRetryMin:     defaultCompactionRetryMin,
+		compactionRetryMax:     defaultCompactionRetryMax,
+		compactionBacklogLimit: defaultCompactionBacklogLimit,
+
+		compactionSucceeded: map[CompactionStep]int64{},
+		compactionFailed:    map[CompactionStep]int64{},
+		compactionFailures:  map[compactionKey]*PartitionFailure{},
+	}
+
+	for _, opt := range opts {
+		opt(db)
+	}
+
+	if db.walFactory == nil {
+		db.walFactory = wal.FileFactory{FS: db.fs}
+	}
+
+	db.initRollupTiers()
+
+	return db
 }
 
 // NewDB creates a new DB located in baseDir. If baseDir
 // does not exist it will be created. An error is returned
-// if baseDir is not empty.
-func NewDB(baseDir string, partitionSize, maxPartitions int) (*DB, error) {
-	err := os.MkdirAll(baseDir, 0755)
-	if err != nil {
-		return nil, err
+// if baseDir is not empty. At most maxPartitions partitions
+// are kept, unless maxPartitions is zero.
+func NewDB(baseDir string, partitionSize, maxPartitions int, opts ...Option) (*DB, error) {
+	db := newDB(baseDir, partitionSize, maxPartitions, opts)
+	if db.readOnly {
+		return nil, errors.New("catena: NewDB called with a read only option")
 	}
 
-	dir, err := os.Open(baseDir)
+	err := db.fs.MkdirAll(baseDir, 0755)
 	if err != nil {
 		return nil, err
 	}
 
-	defer dir.Close()
-
-	names, err := dir.Readdirnames(-1)
+	names, err := db.fs.ReadDirNames(baseDir)
 	if err != nil {
 		return nil, err
 	}
@@ -57,16 +122,17 @@ func NewDB(baseDir string, partitionSize, maxPartitions int) (*DB, error) {
 		return nil, errors.New("catena: NewDB called with non-empty directory")
 	}
 
-	db := &DB{
-		baseDir:       baseDir,
-		partitionSize: int64(partitionSize),
-		maxPartitions: maxPartitions,
-		partitionList: newPartitionList(),
+	err = db.loadRollupTiers()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadLatePartitions()
+	if err != nil {
+		return nil, err
 	}
 
 	// Start up the compactor.
-	// TODO: use a semaphore to only have a single compactor
-	// at a time.
 	go func() {
 		for _ = range time.Tick(500 * time.Millisecond) {
 			db.compact()
@@ -76,32 +142,34 @@ func NewDB(baseDir string, partitionSize, maxPartitions int) (*DB, error) {
 	return db, nil
 }
 
-// OpenDB opens a DB located in baseDir.
-func OpenDB(baseDir string, partitionSize, maxPartitions int) (*DB, error) {
-	db := &DB{
-		baseDir:       baseDir,
-		partitionSize: int64(partitionSize),
-		maxPartitions: maxPartitions,
-		partitionList: newPartitionList(),
-	}
+// OpenDB opens a DB located in baseDir. The arguments have the
+// same meaning as for NewDB. See WithReadOnly for opening a DB
+// that is in use by another process.
+func OpenDB(baseDir string, partitionSize, maxPartitions int, opts ...Option) (*DB, error) {
+	db := newDB(baseDir, partitionSize, maxPartitions, opts)
 
-	dir, err := os.Open(baseDir)
+	dirInfo, err := db.fs.Stat(baseDir)
 	if err != nil {
 		return nil, err
 	}
 
-	defer dir.Close()
+	if !dirInfo.IsDir() {
+		return nil, errors.New("catena: baseDir is not a directory")
+	}
 
-	dirInfo, err := dir.Stat()
+	names, err := db.fs.ReadDirNames(baseDir)
 	if err != nil {
 		return nil, err
 	}
 
-	if !dirInfo.IsDir() {
-		return nil, errors.New("catena: baseDir is not a directory")
+	names = db.addListedWALs(baseDir, names)
+
+	names, err = db.recoverMerges(names)
+	if err != nil {
+		return nil, err
 	}
 
-	names, err := dir.Readdirnames(-1)
+	names, err = db.recoverBackfills(names)
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +179,25 @@ func OpenDB(baseDir string, partitionSize, maxPartitions int) (*DB, error) {
 		return nil, err
 	}
 
+	err = db.loadRollupTiers()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadLatePartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.loadContinuousQueries()
+	if err != nil {
+		return nil, err
+	}
+
+	if db.readOnly {
+		return db, nil
+	}
+
 	go func() {
 		for _ = range time.Tick(time.Millisecond * 50) {
 			db.compact()
@@ -121,8 +208,11 @@ func OpenDB(baseDir string, partitionSize, maxPartitions int) (*DB, error) {
 }
 
 // Close closes the DB and releases any internal state.
-// Close will block if there are active iterators.
+// Close will block if there are active iterators. InsertRows
+// returns ErrReadOnly once the DB has been closed.
 func (db *DB) Close() error {
+	atomic.StoreInt32(&db.closed, 1)
+
 	i := db.partitionList.NewIterator()
 	for i.Next() {
 		val, _ := i.Value()
@@ -140,6 +230,22 @@ func (db *DB) Close() error {
 		val.ExclusiveRelease()
 	}
 
+	for _, tier := range db.rollupTiers {
+		tier.lock.Lock()
+		for _, p := range tier.partitions {
+			p.ExclusiveHold()
+			err := p.Close()
+			p.ExclusiveRelease()
+			if err != nil {
+				tier.lock.Unlock()
+				return err
+			}
+		}
+
+		tier.partitions = nil
+		tier.lock.Unlock()
+	}
+
 	return nil
 }
 
@@ -154,7 +260,7 @@ func (db *DB) Sources(start, end int64) []string {
 
 		val.Hold()
 
-		if val.MaxTimestamp() > start && val.MinTimestamp() < end {
+		if val.MaxTimestamp() >= start && val.MinTimestamp() < end {
 			for _, source := range val.Sources() {
 				sourcesMap[source] = struct{}{}
 			}
@@ -163,6 +269,22 @@ func (db *DB) Sources(start, end int64) []string {
 		val.Release()
 	}
 
+	for _, tier := range db.rollupTiers {
+		tier.lock.RLock()
+		for _, p := range tier.partitions {
+			p.Hold()
+
+			if p.MaxTimestamp() >= start && p.MinTimestamp() < end {
+				for _, source := range p.Sources() {
+					sourcesMap[source] = struct{}{}
+				}
+			}
+
+			p.Release()
+		}
+		tier.lock.RUnlock()
+	}
+
 	sources := []string{}
 
 	for source := range sourcesMap {
@@ -183,7 +305,7 @@ func (db *DB) Metrics(source string, start, end int64) []string {
 
 		val.Hold()
 
-		if val.MaxTimestamp() > start && val.MinTimestamp() < end {
+		if val.MaxTimestamp() >= start && val.MinTimestamp() < end {
 
 			for _, metric := range val.Metrics(source) {
 				metricsMap[metric] = struct{}{}
@@ -193,6 +315,24 @@ func (db *DB) Metrics(source string, start, end int64) []string {
 		val.Release()
 	}
 
+	for _, tier := range db.rollupTiers {
+		tier.lock.RLock()
+		for _, p := range tier.partitions {
+			p.Hold()
+
+			if p.MaxTimestamp() >= start && p.MinTimestamp() < end {
+				for _, name := range p.Metrics(source) {
+					if metric, ok := rollupMetricName(name); ok {
+						metricsMap[metric] = struct{}{}
+					}
+				}
+			}
+
+			p.Release()
+		}
+		tier.lock.RUnlock()
+	}
+
 	metrics := []string{}
 
 	for metric := range metricsMap {
@@ -202,6 +342,72 @@ func (db *DB) Metrics(source string, start, end int64) []string {
 	return metrics
 }
 
+// MinTimestamp returns the oldest timestamp in the DB, including
+// those of points that are only kept in rollup tiers. It is 0 if
+// the DB is empty.
+func (db *DB) MinTimestamp() int64 {
+	min, ok := int64(0), false
+	if db.partitionList.Size() > 0 {
+		min, ok = atomic.LoadInt64(&db.minTimestamp), true
+	}
+
+	for _, tier := range db.rollupTiers {
+		tier.lock.RLock()
+		if len(tier.partitions) > 0 {
+			p := tier.partitions[0]
+			if !ok || p.MinTimestamp() < min {
+				min, ok = p.MinTimestamp(), true
+			}
+		}
+		tier.lock.RUnlock()
+	}
+
+	return min
+}
+
+// MaxTimestamp returns the newest timestamp in the DB. It is 0
+// if the DB is empty.
+func (db *DB) MaxTimestamp() int64 {
+	if db.partitionList.Size() > 0 {
+		return atomic.LoadInt64(&db.maxTimestamp)
+	}
+
+	max, ok := int64(0), false
+	for _, tier := range db.rollupTiers {
+		tier.lock.RLock()
+		for _, p := range tier.partitions {
+			if !ok || p.MaxTimestamp() > max {
+				max, ok = p.MaxTimestamp(), true
+			}
+		}
+		tier.lock.RUnlock()
+	}
+
+	return max
+}
+
+// TimestampUnit returns the unit of the DB's timestamps.
+func (db *DB) TimestampUnit() time.Duration {
+	return db.timestampUnit
+}
+
+// Now returns the current time, as a timestamp in the DB's unit.
+func (db *DB) Now() int64 {
+	return db.clock().UnixNano() / int64(db.timestampUnit)
+}
+
+// retentionCutoff returns the oldest timestamp that is still
+// within the retention period. ok is false if there is no
+// retention period.
+func (db *DB) retentionCutoff() (cutoff int64, ok bool) {
+	if db.retention <= 0 {
+		return 0, false
+	}
+
+	oldest := db.clock().Add(-db.retention)
+	return oldest.UnixNano() / int64(db.timestampUnit), true
+}
+
 // loadPartitions reads a slice of partition file names
 // and updates the internal partition state.
 func (db *DB) loadPartitions(names []string) error {
@@ -216,6 +422,25 @@ func (db *DB) loadPartitions(names []string) error {
 
 		wal := false
 
+		if strings.HasSuffix(name, ".part.tmp") {
+			// A disk partition was being written when the
+			// DB stopped. The rows are still in their old
+			// files.
+			if !db.readOnly {
+				err := db.fs.Remove(filepath.Join(db.baseDir, name))
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".wal") && !strings.HasSuffix(name, ".part") {
+			// Not a partition, e.g. a rollup tier directory.
+			continue
+		}
+
 		if strings.HasSuffix(name, ".wal") {
 			_, err := fmt.Sscanf(name, "%d.wal", &partitionNum)
 			if err != nil {
@@ -240,10 +465,13 @@ func (db *DB) loadPartitions(names []string) error {
 			if (seenWAL && !wal) || (!seenWAL && wal) {
 				// We have both a .wal and a .part, so
 				// we'll get rid of the .part and recompact.
+				// A read only DB just ignores the .part.
 				wal = true
-				err := os.Remove(filepath.Join(db.baseDir, fmt.Sprintf("%d.part", partitionNum)))
-				if err != nil {
-					return err
+				if !db.readOnly {
+					err := db.fs.Remove(filepath.Join(db.baseDir, fmt.Sprintf("%d.part", partitionNum)))
+					if err != nil {
+						return err
+					}
 				}
 			}
 		}
@@ -271,12 +499,7 @@ func (db *DB) loadPartitions(names []string) error {
 			filename = filepath.Join(db.baseDir,
 				fmt.Sprintf("%d.wal", part))
 
-			w, err := wal.OpenFileWAL(filename)
-			if err != nil {
-				return err
-			}
-
-			p, err = memory.RecoverMemoryPartition(w)
+			p, err = db.recoverWAL(filename)
 			if err != nil {
 				return err
 			}
@@ -285,7 +508,7 @@ func (db *DB) loadPartitions(names []string) error {
 			filename = filepath.Join(db.baseDir,
 				fmt.Sprintf("%d.part", part))
 
-			p, err = disk.OpenDiskPartition(filename)
+			p, err = disk.OpenDiskPartitionFS(db.fs, filename)
 			if err != nil {
 				return err
 			}
@@ -311,3 +534,45 @@ func (db *DB) loadPartitions(names []string) error {
 
 	return nil
 }
+
+// addListedWALs adds the names of the WALs in dir that the WAL
+// factory lists, if it is a wal.Lister, to names, the contents of dir.
+func (db *DB) addListedWALs(dir string, names []string) []string {
+	lister, ok := db.walFactory.(wal.Lister)
+	if !ok {
+		return names
+	}
+
+	present := map[string]bool{}
+	for _, name := range names {
+		present[name] = true
+	}
+
+	for _, filename := range lister.Filenames() {
+		name := filepath.Base(filename)
+		if filepath.Dir(filename) != filepath.Clean(dir) || present[name] {
+			continue
+		}
+
+		names = append(names, name)
+		present[name] = true
+	}
+
+	return names
+}
+
+// recoverWAL recovers the memory partition logged to filename.
+// A read only DB ignores entries that are only partially written
+// and leaves the file as it is.
+func (db *DB) recoverWAL(filename string) (*memory.MemoryPartition, error) {
+	w, err := db.walFactory.Open(filename, db.readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	if db.readOnly {
+		return memory.RecoverReadOnlyMemoryPartition(w), nil
+	}
+
+	return memory.RecoverMemoryPartition(w)
+}
@@ -1,17 +1,20 @@
 package catena
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"sync"
 	"testing"
+
+	"github.com/Cistern/catena/vfs"
+	"github.com/Cistern/catena/wal"
 )
 
 func TestDB(t *testing.T) {
-	os.RemoveAll("/tmp/catena")
-
-	db, err := NewDB("/tmp/catena", 500, 20)
+	db, err := NewDB("/tmp/catena", 500, 20, WithFS(vfs.NewMemFS()), WithWALFactory(wal.NewMemoryFactory()))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -66,3 +69,305 @@ func TestDB(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestReadOnly(t *testing.T) {
+	os.RemoveAll("/tmp/catena_read_only_test")
+
+	db, err := NewDB("/tmp/catena_read_only_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	rows := []Row{}
+	for ts := int64(0); ts < 50; ts++ {
+		rows = append(rows, Row{
+			Source: "src",
+			Metric: "met",
+			Point:  Point{Timestamp: ts, Value: float64(ts)},
+		})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an entry that is still being written.
+	walFiles, _ := filepath.Glob("/tmp/catena_read_only_test/*.wal")
+	if len(walFiles) != 1 {
+		t.Fatalf("expected a single WAL, got %v", walFiles)
+	}
+
+	f, err := os.OpenFile(walFiles[0], os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte{0x93, 0x19, 0x14, 0x11, 0, 1})
+	f.Close()
+
+	before, _ := os.Stat(walFiles[0])
+
+	readOnly, err := OpenDB("/tmp/catena_read_only_test", 100, 0, WithReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err := readOnly.Range("src", "met", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 50 {
+		t.Errorf("expected 50 points, got %d", len(points))
+	}
+
+	if err = readOnly.InsertRows(rows); err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	partitions := readOnly.Partitions()
+	if len(partitions) != 1 || partitions[0].Filename != walFiles[0] || partitions[0].MinTimestamp != 0 ||
+		partitions[0].MaxTimestamp != 49 || partitions[0].Series != 1 || partitions[0].Size != before.Size() {
+		t.Errorf("unexpected partitions %+v", partitions)
+	}
+
+	err = readOnly.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, _ := os.Stat(walFiles[0])
+	if after.Size() != before.Size() {
+		t.Errorf("WAL changed size from %d to %d", before.Size(), after.Size())
+	}
+}
+
+func TestWALFactory(t *testing.T) {
+	dir := "/tmp/catena_wal_factory_test"
+
+	rows := []Row{}
+	for ts := int64(0); ts < 40; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	tests := []struct {
+		factory wal.Factory
+
+		// recovered is the number of points left
+		// after the DB is opened again.
+		recovered int
+	}{
+		{wal.NewMemoryFactory(), 40},
+		{wal.NopFactory{}, 20},
+	}
+
+	for _, test := range tests {
+		fs := vfs.NewMemFS()
+
+		db, err := NewDB(dir, 10, 0, WithFS(fs), WithWALFactory(test.factory))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.InsertRows(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db.compact()
+
+		names, err := fs.ReadDirNames(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parts := []string{}
+		for _, name := range names {
+			if filepath.Ext(name) == ".wal" {
+				t.Errorf("unexpected WAL file %s", name)
+			}
+
+			if filepath.Ext(name) == ".part" {
+				parts = append(parts, name)
+			}
+		}
+
+		if len(parts) != 2 {
+			t.Errorf("expected 2 disk partitions, got %v", parts)
+		}
+
+		points, _, err := db.Range("a", "b", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != 40 {
+			t.Errorf("expected %d points, got %d", 40, len(points))
+		}
+
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = OpenDB(dir, 10, 0, WithFS(fs), WithWALFactory(test.factory))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points, _, err = db.Range("a", "b", 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != test.recovered {
+			t.Errorf("expected %d points after reopening, got %d", test.recovered, len(points))
+		}
+
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Compacted partitions' WALs are destroyed.
+	if filenames := tests[0].factory.(*wal.MemoryFactory).Filenames(); len(filenames) != 2 {
+		t.Errorf("expected 2 WALs, got %v", filenames)
+	}
+}
+
+// BenchmarkWAL compares the cost of inserting rows with file,
+// memory and no-op WALs. The DB's other files are kept in memory.
+func BenchmarkWAL(b *testing.B) {
+	dir, err := ioutil.TempDir("", "catena_wal_benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	rows := []Row{}
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, Row{
+			Source: "src",
+			Metric: "met_" + strconv.Itoa(i),
+			Point:  Point{Timestamp: 0, Value: float64(i)},
+		})
+	}
+
+	factories := []struct {
+		name    string
+		factory func() wal.Factory
+	}{
+		{"file", func() wal.Factory { return wal.FileFactory{} }},
+		{"memory", func() wal.Factory { return wal.NewMemoryFactory() }},
+		{"nop", func() wal.Factory { return wal.NopFactory{} }},
+	}
+
+	for _, f := range factories {
+		b.Run(f.name, func(b *testing.B) {
+			// The file WALs are written to dir on disk.
+			os.RemoveAll(filepath.Join(dir, "1.wal"))
+
+			db, err := NewDB(dir, 1<<40, 0, WithFS(vfs.NewMemFS()), WithWALFactory(f.factory()))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				for i := range rows {
+					rows[i].Timestamp = int64(n)
+				}
+
+				err = db.InsertRows(rows)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+
+			err = db.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFS(t *testing.T) {
+	os.RemoveAll("/tmp/catena_fs_test")
+
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	db, err := NewDB("/tmp/catena_fs_test", 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(start, end int64) error {
+		rows := []Row{}
+		for ts := start; ts < end; ts++ {
+			rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+		}
+
+		return db.InsertRows(rows)
+	}
+
+	err = insert(0, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.compact()
+
+	// A failed write leaves the WAL as it was.
+	fs.Inject(vfs.Fault{Op: vfs.OpWrite, Pattern: "*.wal", Times: 1})
+	if insert(40, 45) == nil {
+		t.Error("expected an injected fault")
+	}
+
+	err = insert(45, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("/tmp/catena_fs_test"); !os.IsNotExist(err) {
+		t.Errorf("expected no files on disk, got %v", err)
+	}
+
+	for _, name := range []string{"1.part", "2.part", "3.wal", "4.wal"} {
+		if _, err := fs.Stat(filepath.Join("/tmp/catena_fs_test", name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	db, err = OpenDB("/tmp/catena_fs_test", 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err := db.Range("a", "b", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 45 || points[39].Timestamp != 39 || points[40].Timestamp != 45 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
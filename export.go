@@ -0,0 +1,127 @@
+package catena
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// An ExportFormat is a format that Export writes rows in.
+type ExportFormat string
+
+const (
+	// ExportCSV writes a header line followed by a
+	// "timestamp,source,metric,value" line per row.
+	ExportCSV ExportFormat = "csv"
+
+	// ExportNDJSON writes a JSON encoded Row per line.
+	ExportNDJSON ExportFormat = "ndjson"
+)
+
+// ExportOptions selects the rows that Export writes.
+type ExportOptions struct {
+	Format ExportFormat
+
+	// Sources and Metrics restrict the export to the named
+	// sources and metrics. Every source or metric present in
+	// the time range is exported if they are empty.
+	Sources []string
+	Metrics []string
+
+	// Start is inclusive and End is exclusive.
+	Start int64
+	End   int64
+}
+
+// exportCSVHeader is the first record of a CSV export.
+var exportCSVHeader = []string{"timestamp", "source", "metric", "value"}
+
+// Export writes the points of the selected series to w, ordered by
+// source, metric and timestamp. Points are read one series at a time
+// as Scan reads them, so exports of any size use little memory, and
+// ranges that are only kept in a rollup tier are exported as the
+// tier's averages. It returns the number of rows written.
+func (db *DB) Export(w io.Writer, opts ExportOptions) (int, error) {
+	var write func(Row) error
+
+	buf := bufio.NewWriter(w)
+
+	switch opts.Format {
+	case ExportCSV:
+		csvWriter := csv.NewWriter(buf)
+		err := csvWriter.Write(exportCSVHeader)
+		if err != nil {
+			return 0, err
+		}
+
+		record := make([]string, len(exportCSVHeader))
+		write = func(row Row) error {
+			record[0] = strconv.FormatInt(row.Timestamp, 10)
+			record[1] = row.Source
+			record[2] = row.Metric
+			record[3] = strconv.FormatFloat(row.Value, 'g', -1, 64)
+
+			err := csvWriter.Write(record)
+			if err != nil {
+				return err
+			}
+
+			// Flush to buf, which does the buffering, so
+			// that write errors are noticed early.
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+
+	case ExportNDJSON:
+		encoder := json.NewEncoder(buf)
+		write = func(row Row) error {
+			return encoder.Encode(row)
+		}
+
+	default:
+		return 0, errors.New("catena: unknown export format " + strconv.Quote(string(opts.Format)))
+	}
+
+	sources := opts.Sources
+	if len(sources) == 0 {
+		sources = db.Sources(opts.Start, opts.End)
+		sort.Strings(sources)
+	}
+
+	written := 0
+
+	for _, source := range sources {
+		metrics := opts.Metrics
+		if len(metrics) == 0 {
+			metrics = db.Metrics(source, opts.Start, opts.End)
+			sort.Strings(metrics)
+		}
+
+		for _, metric := range metrics {
+			_, err := db.Scan(source, metric, opts.Start, opts.End, func(point Point) error {
+				err := write(Row{
+					Source: source,
+					Metric: metric,
+					Point:  point,
+				})
+				if err != nil {
+					return err
+				}
+
+				written++
+				return nil
+			})
+
+			if err != nil {
+				buf.Flush()
+				return written, err
+			}
+		}
+	}
+
+	return written, buf.Flush()
+}
@@ -0,0 +1,83 @@
+package catena
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	os.RemoveAll("/tmp/catena_export_test")
+
+	db, err := NewDB("/tmp/catena_export_test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 50; ts += 5 {
+		rows = append(rows,
+			Row{Source: "b", Metric: "m", Point: Point{Timestamp: ts, Value: float64(ts) / 2}},
+			Row{Source: "a", Metric: "m", Point: Point{Timestamp: ts, Value: float64(ts)}},
+			Row{Source: "a", Metric: "n,1", Point: Point{Timestamp: ts, Value: -1}},
+		)
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read across disk and memory partitions.
+	db.compact()
+
+	buf := &bytes.Buffer{}
+	n, err := db.Export(buf, ExportOptions{Format: ExportCSV, Start: 10, End: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `timestamp,source,metric,value
+10,a,m,10
+15,a,m,15
+20,a,m,20
+10,a,"n,1",-1
+15,a,"n,1",-1
+20,a,"n,1",-1
+10,b,m,5
+15,b,m,7.5
+20,b,m,10
+`
+	if n != 9 || buf.String() != expected {
+		t.Errorf("unexpected CSV export of %d rows:\n%s", n, buf)
+	}
+
+	buf.Reset()
+	n, err = db.Export(buf, ExportOptions{
+		Format:  ExportNDJSON,
+		Sources: []string{"b", "c"},
+		Metrics: []string{"m"},
+		Start:   40,
+		End:     100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `{"source":"b","metric":"m","timestamp":40,"value":20}
+{"source":"b","metric":"m","timestamp":45,"value":22.5}
+`
+	if n != 2 || buf.String() != expected {
+		t.Errorf("unexpected NDJSON export of %d rows:\n%s", n, buf)
+	}
+
+	_, err = db.Export(buf, ExportOptions{Format: "xml"})
+	if err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
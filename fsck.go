@@ -0,0 +1,456 @@
+package catena
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/disk"
+	"github.com/Cistern/catena/vfs"
+	"github.com/Cistern/catena/wal"
+)
+
+// quarantineDirName is the directory within the DB directory
+// that Repair moves files it can't repair to.
+const quarantineDirName = "quarantine"
+
+// A Problem is an inconsistency in a file of a DB.
+type Problem struct {
+	Filename string
+	Err      error
+
+	// Repair describes what Repair did about the problem.
+	// It is empty for problems found by Check.
+	Repair string
+}
+
+func (p Problem) String() string {
+	if p.Repair == "" {
+		return fmt.Sprintf("%s: %v", p.Filename, p.Err)
+	}
+
+	return fmt.Sprintf("%s: %v: %s", p.Filename, p.Err, p.Repair)
+}
+
+// A CheckReport is the result of checking the files of a DB.
+type CheckReport struct {
+	// WALs is the number of WAL files checked, and Entries and
+	// Rows are the number of entries and rows decoded from them.
+	WALs    int
+	Entries int
+	Rows    int
+
+	// Parts is the number of .part files checked, and Points is
+	// the number of points inflated from them.
+	Parts  int
+	Points int
+
+	Problems []Problem
+}
+
+// Check decodes every WAL and verifies every .part file of the DB in
+// baseDir, including those of rollup tiers and late rows, without
+// modifying anything. It reports WALs whose tail is torn, .part files
+// whose metadata can't be read or whose extents disagree with it,
+// .part files left next to the WAL they were compacted from and
+// leftover temporary files. The DB should not be open, since the tail
+// of a WAL that is being written looks torn.
+func Check(baseDir string) (*CheckReport, error) {
+	return CheckFS(vfs.OS, baseDir)
+}
+
+// CheckFS is like Check for a DB in fs.
+func CheckFS(fs vfs.FS, baseDir string) (*CheckReport, error) {
+	return fsck(fs, baseDir, false)
+}
+
+// Repair checks the DB in baseDir like Check and repairs the problems
+// it finds. Torn WALs are truncated to their last complete entry, a
+// .part file that is unreadable or has a WAL next to it is rebuilt from
+// the WAL, and temporary files are removed. Files that can't be repaired
+// are moved to the quarantine directory within baseDir. The DB must not
+// be open.
+func Repair(baseDir string) (*CheckReport, error) {
+	return RepairFS(vfs.OS, baseDir)
+}
+
+// RepairFS is like Repair for a DB in fs.
+func RepairFS(fs vfs.FS, baseDir string) (*CheckReport, error) {
+	return fsck(fs, baseDir, true)
+}
+
+// A checker walks the files of a DB.
+type checker struct {
+	fs      vfs.FS
+	baseDir string
+	repair  bool
+	report  *CheckReport
+}
+
+func fsck(fs vfs.FS, baseDir string, repair bool) (*CheckReport, error) {
+	c := &checker{
+		fs:      fs,
+		baseDir: baseDir,
+		repair:  repair,
+		report:  &CheckReport{},
+	}
+
+	names, err := readDirNames(fs, baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.checkDir(baseDir, names)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, "rollup_") {
+			continue
+		}
+
+		dir := filepath.Join(baseDir, name)
+		if fi, err := fs.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+
+		tierNames, err := readDirNames(fs, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.checkDir(dir, tierNames)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lateDir := filepath.Join(baseDir, lateDirName)
+	lateNames, err := readDirNames(fs, lateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, name := range lateNames {
+		if strings.HasSuffix(name, ".wal") {
+			_, _, err = c.checkWAL(filepath.Join(lateDir, name))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return c.report, nil
+}
+
+// checkDir checks the partitions and temporary files named by names
+// in dir, which is either the DB directory or a rollup tier directory.
+func (c *checker) checkDir(dir string, names []string) error {
+	hasWAL := map[int64]bool{}
+	hasPart := map[int64]bool{}
+	ids := []int64{}
+
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+
+		if strings.HasSuffix(name, ".tmp") {
+			err := c.fix(filename, errors.New("leftover temporary file"), func() (string, error) {
+				err := c.fs.Remove(filename)
+				if err != nil {
+					return "", err
+				}
+
+				return "removed", c.fs.SyncDir(dir)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".wal") && !strings.HasSuffix(name, ".part") {
+			continue
+		}
+
+		id, err := partitionID(name)
+		if err != nil {
+			return err
+		}
+
+		if !hasWAL[id] && !hasPart[id] {
+			ids = append(ids, id)
+		}
+
+		if strings.HasSuffix(name, ".wal") {
+			hasWAL[id] = true
+		} else {
+			hasPart[id] = true
+		}
+	}
+
+	sort.Sort(int64s(ids))
+
+	for _, id := range ids {
+		err := c.checkPartition(dir, id, hasWAL[id], hasPart[id])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPartition checks the WAL and .part files of partition id.
+func (c *checker) checkPartition(dir string, id int64, hasWAL, hasPart bool) error {
+	walFilename := filepath.Join(dir, fmt.Sprintf("%d.wal", id))
+	partFilename := filepath.Join(dir, fmt.Sprintf("%d.part", id))
+
+	rows := []partition.Row{}
+	if hasWAL {
+		var err error
+		rows, hasWAL, err = c.checkWAL(walFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !hasPart {
+		return nil
+	}
+
+	problem := c.checkPart(partFilename)
+	if problem == nil {
+		if !hasWAL {
+			return nil
+		}
+
+		// Compaction was interrupted before the WAL was removed,
+		// so the .part file may be incomplete.
+		problem = fmt.Errorf("orphaned by %s", filepath.Base(walFilename))
+	}
+
+	return c.fix(partFilename, problem, func() (string, error) {
+		if !hasWAL {
+			return c.quarantine(partFilename)
+		}
+
+		if len(rows) == 0 {
+			// There is nothing to rebuild from,
+			// so keep what the .part file has.
+			action, err := c.quarantine(walFilename)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("kept, %s %s", filepath.Base(walFilename), action), nil
+		}
+
+		p, err := writeDiskPartition(c.fs, partFilename, rows)
+		if err != nil {
+			return "", err
+		}
+
+		p.Close()
+
+		err = c.fs.Remove(walFilename)
+		if err == nil {
+			err = c.fs.SyncDir(dir)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("rebuilt from %d rows of %s", len(rows), filepath.Base(walFilename)), nil
+	})
+}
+
+// checkWAL decodes every entry of the WAL at filename and returns
+// its rows. ok is false if the WAL was moved to quarantine.
+func (c *checker) checkWAL(filename string) (rows []partition.Row, ok bool, err error) {
+	w, err := wal.OpenReadOnlyFileWALFS(c.fs, filename)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries := 0
+	var readErr error
+	for {
+		entry, err := w.ReadEntry()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+
+			break
+		}
+
+		entries++
+		rows = append(rows, entry.Rows...)
+	}
+
+	offset := w.ReadOffset()
+	w.Close()
+
+	c.report.WALs++
+	c.report.Entries += entries
+	c.report.Rows += len(rows)
+
+	size := fileSize(c.fs, filename)
+	if offset == size {
+		return rows, true, nil
+	}
+
+	if readErr == nil {
+		// The header of the last entry was written,
+		// but none of its data.
+		readErr = io.ErrUnexpectedEOF
+	}
+
+	problem := fmt.Errorf("torn tail at offset %d of %d: %v", offset, size, readErr)
+
+	if entries == 0 {
+		// Nothing can be recovered, and the file
+		// may not be a WAL at all.
+		return nil, !c.repair, c.fix(filename, problem, func() (string, error) {
+			return c.quarantine(filename)
+		})
+	}
+
+	return rows, true, c.fix(filename, problem, func() (string, error) {
+		err := truncateFile(c.fs, filename, offset)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("truncated to %d bytes", offset), nil
+	})
+}
+
+// checkPart verifies the .part file at filename and returns
+// its problem, if any.
+func (c *checker) checkPart(filename string) error {
+	c.report.Parts++
+
+	p, err := disk.OpenDiskPartitionFS(c.fs, filename)
+	if err != nil {
+		return fmt.Errorf("unreadable metadata: %v", err)
+	}
+
+	points, errs := p.Verify()
+	p.Close()
+
+	c.report.Points += points
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	return fmt.Errorf("%v, and %d more series", errs[0], len(errs)-1)
+}
+
+// fix records problem with filename. When repairing, it first calls
+// repair, which returns a description of what it did.
+func (c *checker) fix(filename string, problem error, repair func() (string, error)) error {
+	p := Problem{
+		Filename: filename,
+		Err:      problem,
+	}
+
+	if c.repair {
+		action, err := repair()
+		if err != nil {
+			return fmt.Errorf("catena: repairing %s: %v", filename, err)
+		}
+
+		p.Repair = action
+	}
+
+	c.report.Problems = append(c.report.Problems, p)
+	return nil
+}
+
+// quarantine moves filename to the quarantine directory, under
+// its path relative to the DB directory.
+func (c *checker) quarantine(filename string) (string, error) {
+	rel, err := filepath.Rel(c.baseDir, filename)
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(c.baseDir, quarantineDirName, rel)
+
+	err = c.fs.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// Don't replace a file quarantined earlier.
+	for i, base := 1, dest; ; i++ {
+		_, err = c.fs.Stat(dest)
+		if os.IsNotExist(err) {
+			break
+		}
+
+		dest = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	err = c.fs.Rename(filename, dest)
+	if err != nil {
+		return "", err
+	}
+
+	err = c.fs.SyncDir(filepath.Dir(filename))
+	if err == nil {
+		err = c.fs.SyncDir(filepath.Dir(dest))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return "moved to " + dest, nil
+}
+
+// truncateFile truncates filename in fs to size and syncs it.
+func truncateFile(fs vfs.FS, filename string, size int64) error {
+	f, err := fs.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// readDirNames returns the sorted names
+// of the entries of dir in fs.
+func readDirNames(fs vfs.FS, dir string) ([]string, error) {
+	names, err := fs.ReadDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
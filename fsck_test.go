@@ -0,0 +1,298 @@
+package catena
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/vfs"
+	"github.com/Cistern/catena/wal"
+)
+
+func TestFsck(t *testing.T) {
+	dir := "/tmp/catena_fsck_test"
+	os.RemoveAll(dir)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := func(start int64) []partition.Row {
+		rows := []partition.Row{}
+		for ts := start; ts < start+10; ts++ {
+			rows = append(rows, partition.Row{
+				Source: "a",
+				Metric: "b",
+				Point: partition.Point{
+					Timestamp: ts,
+					Value:     float64(ts),
+				},
+			})
+		}
+
+		return rows
+	}
+
+	writePart := func(name string, start int64) {
+		p, err := writeDiskPartition(vfs.OS, filepath.Join(dir, name), rows(start))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.Close()
+	}
+
+	writeWAL := func(name string, start int64, tail string) {
+		w, err := wal.NewFileWAL(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		all := rows(start)
+		for _, entry := range [][]partition.Row{all[:5], all[5:]} {
+			_, err = w.Append(wal.WALEntry{Operation: wal.OperationInsert, Rows: entry})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w.Close()
+
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.WriteString(tail)
+		f.Close()
+	}
+
+	// A good partition.
+	writePart("1.part", 10)
+
+	// Compaction was interrupted before 2.wal was removed.
+	writePart("2.part", 20)
+	writeWAL("2.wal", 20, "")
+
+	// A torn entry at the end of the newest partition.
+	writeWAL("3.wal", 30, "\x93\x19\x14\x11\x01\x05")
+
+	// Unreadable metadata.
+	err = ioutil.WriteFile(filepath.Join(dir, "4.part"), []byte("not a partition"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt extent.
+	writePart("6.part", 60)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "6.part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[20] ^= 0xff
+	err = ioutil.WriteFile(filepath.Join(dir, "6.part"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "7.part.tmp"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"7.part.tmp", "2.part", "3.wal", "4.part", "6.part"}
+
+	checkProblems := func(report *CheckReport, repaired bool) {
+		if len(report.Problems) != len(expected) {
+			t.Fatalf("expected %d problems, got %v", len(expected), report.Problems)
+		}
+
+		for i, problem := range report.Problems {
+			if filepath.Base(problem.Filename) != expected[i] {
+				t.Errorf("expected a problem with %s, got %v", expected[i], problem)
+			}
+
+			if (problem.Repair != "") != repaired {
+				t.Errorf("unexpected repair of %v", problem)
+			}
+		}
+	}
+
+	report, err := Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProblems(report, false)
+
+	if report.WALs != 2 || report.Entries != 4 || report.Rows != 20 || report.Parts != 4 || report.Points != 20 {
+		t.Errorf("unexpected counts %+v", report)
+	}
+
+	if !strings.Contains(report.Problems[2].Err.Error(), "torn tail at offset") {
+		t.Errorf("unexpected WAL problem %v", report.Problems[2])
+	}
+
+	// Check doesn't change anything.
+	report, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProblems(report, false)
+
+	report, err = Repair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProblems(report, true)
+
+	report, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 0 {
+		t.Fatalf("expected no problems after repair, got %v", report.Problems)
+	}
+
+	for _, name := range []string{"4.part", "6.part"} {
+		if _, err := os.Stat(filepath.Join(dir, quarantineDirName, name)); err != nil {
+			t.Errorf("expected %s to be quarantined: %v", name, err)
+		}
+	}
+
+	db, err := OpenDB(dir, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := db.AggregateRange("a", "b", 0, 100, AggregateCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 30 {
+		t.Errorf("expected 30 points, got %v", count)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairFS(t *testing.T) {
+	dir := "/tmp/catena_repair_fs_test"
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+
+	db, err := NewDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(start, end int64) error {
+		rows := []Row{}
+		for ts := start; ts < end; ts++ {
+			rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+		}
+
+		return db.InsertRows(rows)
+	}
+
+	err = insert(0, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The process crashes after compacting 1.wal but before
+	// removing it, halfway through writing an entry to 3.wal
+	// and after creating a temporary file.
+	fs.Inject(vfs.Fault{Op: vfs.OpRemove, Pattern: "1.wal", Times: 1})
+	db.compact()
+	fs.Clear()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile(filepath.Join(dir, "3.wal"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("\x93\x19\x14\x11\x01\x05"))
+	f.Close()
+
+	f, err = vfs.Create(fs, filepath.Join(dir, "3.part.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("partial"))
+	f.Close()
+
+	report, err := CheckFS(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"3.part.tmp", "1.part", "3.wal"}
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), report.Problems)
+	}
+
+	for i, problem := range report.Problems {
+		if filepath.Base(problem.Filename) != expected[i] {
+			t.Errorf("expected a problem with %s, got %v", expected[i], problem)
+		}
+	}
+
+	report, err = RepairFS(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != len(expected) {
+		t.Fatalf("expected %d repairs, got %v", len(expected), report.Problems)
+	}
+
+	report, err = CheckFS(fs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 0 {
+		t.Fatalf("expected no problems after repair, got %v", report.Problems)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to exist on disk, got %v", dir, err)
+	}
+
+	db, err = OpenDB(dir, 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err := db.Range("a", "b", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 25 {
+		t.Errorf("expected %d points, got %d", 25, len(points))
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,295 @@
+package catena
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	defaultCompactionRetryMin     = time.Second
+	defaultCompactionRetryMax     = 5 * time.Minute
+	defaultCompactionBacklogLimit = 10
+)
+
+// A CompactionStep is a step of the compactor that works on
+// a single partition, or on a group of partitions for merges.
+type CompactionStep string
+
+const (
+	// CompactionCompact writes a sealed memory
+	// partition to a disk partition.
+	CompactionCompact CompactionStep = "compact"
+
+	// CompactionDrop rolls up and removes a partition that fell
+	// outside of the retention period or the partition limit.
+	CompactionDrop CompactionStep = "drop"
+
+	// CompactionFold rewrites a disk partition with its late rows.
+	CompactionFold CompactionStep = "fold"
+
+	// CompactionMerge merges adjacent disk partitions. Merges are
+	// reported under the file name of the oldest partition.
+	CompactionMerge CompactionStep = "merge"
+)
+
+// A CompactionEvent is the outcome of a compaction step.
+type CompactionEvent struct {
+	Step     CompactionStep
+	Filename string
+	Duration time.Duration
+
+	// Err is nil if the step succeeded.
+	Err error
+
+	// Failures is the number of consecutive failures of the
+	// step for the partition, including this one. RetryAt is
+	// when the step is tried again. Both are only set if the
+	// step failed.
+	Failures int
+	RetryAt  time.Time
+}
+
+// A PartitionFailure describes a partition whose last
+// attempt at a compaction step failed.
+type PartitionFailure struct {
+	Step     CompactionStep
+	Filename string
+	Err      error
+
+	Failures    int
+	LastAttempt time.Time
+	RetryAt     time.Time
+}
+
+// CompactionStats counts the compactor's work since the DB was opened.
+type CompactionStats struct {
+	// Succeeded and Failed count the attempts of each step.
+	Succeeded map[CompactionStep]int64
+	Failed    map[CompactionStep]int64
+
+	// Backlog is the number of sealed memory partitions that
+	// were left in memory when the compactor last ran.
+	Backlog int
+
+	// Failing lists the partitions that are waiting to retry
+	// a step, ordered by file name.
+	Failing []PartitionFailure
+}
+
+// Health is a summary of the compactor's state to alert on.
+type Health struct {
+	// Healthy is false if the compaction backlog
+	// exceeds the limit.
+	Healthy      bool `json:"healthy"`
+	Backlog      int  `json:"backlog"`
+	BacklogLimit int  `json:"backlog_limit"`
+
+	// Problems describes the backlog, if it exceeds the
+	// limit, and every partition that is failing.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// compactionKey identifies a step for a partition.
+type compactionKey struct {
+	step     CompactionStep
+	filename string
+}
+
+// WithCompactionHook sets a function that the compactor calls with
+// the outcome of every step. It is called from the compactor's
+// goroutine, which waits for it to return.
+func WithCompactionHook(hook func(CompactionEvent)) Option {
+	return func(db *DB) {
+		db.compactionHook = hook
+	}
+}
+
+// WithCompactionRetry sets how long the compactor waits before it
+// tries a failed step for a partition again. The wait starts at min
+// and doubles with every consecutive failure, up to max. The defaults
+// are one second and five minutes. A min of zero retries every time
+// the compactor runs.
+func WithCompactionRetry(min, max time.Duration) Option {
+	return func(db *DB) {
+		db.compactionRetryMin = min
+		db.compactionRetryMax = max
+	}
+}
+
+// WithCompactionBacklogLimit sets the number of sealed memory
+// partitions that may wait for compaction before Health reports the
+// DB as unhealthy. The default is 10.
+func WithCompactionBacklogLimit(limit int) Option {
+	return func(db *DB) {
+		db.compactionBacklogLimit = limit
+	}
+}
+
+// compactionDue returns whether step should be tried for
+// the partition at filename, which isn't the case while
+// it waits to retry.
+func (db *DB) compactionDue(step CompactionStep, filename string) bool {
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+
+	failure, failing := db.compactionFailures[compactionKey{step, filename}]
+	return !failing || !db.clock().Before(failure.RetryAt)
+}
+
+// reportCompaction records the outcome of step for the partition at
+// filename, which was started at start, and passes it on to the hook.
+func (db *DB) reportCompaction(step CompactionStep, filename string, start time.Time, err error) {
+	now := db.clock()
+	event := CompactionEvent{
+		Step:     step,
+		Filename: filename,
+		Duration: now.Sub(start),
+		Err:      err,
+	}
+
+	key := compactionKey{step, filename}
+
+	db.compactionLock.Lock()
+	if err == nil {
+		db.compactionSucceeded[step]++
+		delete(db.compactionFailures, key)
+	} else {
+		db.compactionFailed[step]++
+
+		failure, failing := db.compactionFailures[key]
+		if !failing {
+			failure = &PartitionFailure{
+				Step:     step,
+				Filename: filename,
+			}
+			db.compactionFailures[key] = failure
+		}
+
+		failure.Err = err
+		failure.Failures++
+		failure.LastAttempt = now
+		failure.RetryAt = now.Add(db.compactionRetryDelay(failure.Failures))
+
+		event.Failures = failure.Failures
+		event.RetryAt = failure.RetryAt
+	}
+	db.compactionLock.Unlock()
+
+	if db.compactionHook != nil {
+		db.compactionHook(event)
+	}
+
+	if err != nil && step == CompactionCompact && db.compactionErrorHandler != nil {
+		db.compactionErrorHandler(&CompactionError{
+			Filename: filename,
+			Err:      err,
+		})
+	}
+}
+
+// compactionRetryDelay returns the wait after the given
+// number of consecutive failures.
+func (db *DB) compactionRetryDelay(failures int) time.Duration {
+	delay := db.compactionRetryMin
+	for i := 1; i < failures && delay < db.compactionRetryMax; i++ {
+		delay *= 2
+	}
+
+	if delay > db.compactionRetryMax {
+		delay = db.compactionRetryMax
+	}
+
+	return delay
+}
+
+// setCompactionBacklog records the backlog and forgets the failures
+// of partitions that are no longer in the DB, e.g. because they were
+// merged or dropped.
+func (db *DB) setCompactionBacklog(backlog int) {
+	filenames := map[string]bool{}
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		filenames[p.Filename()] = true
+	}
+
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+
+	db.compactionBacklog = backlog
+
+	for key := range db.compactionFailures {
+		if !filenames[key.filename] {
+			delete(db.compactionFailures, key)
+		}
+	}
+}
+
+// CompactionStats returns the compactor's counters and
+// the partitions that are failing.
+func (db *DB) CompactionStats() CompactionStats {
+	db.compactionLock.Lock()
+	defer db.compactionLock.Unlock()
+
+	stats := CompactionStats{
+		Succeeded: map[CompactionStep]int64{},
+		Failed:    map[CompactionStep]int64{},
+		Backlog:   db.compactionBacklog,
+		Failing:   []PartitionFailure{},
+	}
+
+	for step, n := range db.compactionSucceeded {
+		stats.Succeeded[step] = n
+	}
+
+	for step, n := range db.compactionFailed {
+		stats.Failed[step] = n
+	}
+
+	for _, failure := range db.compactionFailures {
+		stats.Failing = append(stats.Failing, *failure)
+	}
+
+	sort.Sort(partitionFailures(stats.Failing))
+
+	return stats
+}
+
+// Health reports whether the compactor keeps up.
+func (db *DB) Health() Health {
+	stats := db.CompactionStats()
+
+	health := Health{
+		Healthy:      stats.Backlog <= db.compactionBacklogLimit,
+		Backlog:      stats.Backlog,
+		BacklogLimit: db.compactionBacklogLimit,
+	}
+
+	if !health.Healthy {
+		health.Problems = append(health.Problems,
+			fmt.Sprintf("compaction backlog of %d partitions exceeds %d",
+				stats.Backlog, db.compactionBacklogLimit))
+	}
+
+	for _, failure := range stats.Failing {
+		health.Problems = append(health.Problems,
+			fmt.Sprintf("%s of %s failed %d times: %v",
+				failure.Step, failure.Filename, failure.Failures, failure.Err))
+	}
+
+	return health
+}
+
+type partitionFailures []PartitionFailure
+
+func (f partitionFailures) Len() int { return len(f) }
+func (f partitionFailures) Less(i, j int) bool {
+	if f[i].Filename != f[j].Filename {
+		return f[i].Filename < f[j].Filename
+	}
+
+	return f[i].Step < f[j].Step
+}
+func (f partitionFailures) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,560 @@
+package catena
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A TimestampFormat is the format of the timestamps read by Import.
+type TimestampFormat string
+
+const (
+	// TimestampNative timestamps are integers in the DB's
+	// timestamp unit, as written by Export.
+	TimestampNative TimestampFormat = ""
+
+	// TimestampSeconds, TimestampMilliseconds and
+	// TimestampNanoseconds timestamps are integers counting
+	// from the Unix epoch.
+	TimestampSeconds      TimestampFormat = "s"
+	TimestampMilliseconds TimestampFormat = "ms"
+	TimestampNanoseconds  TimestampFormat = "ns"
+
+	// TimestampRFC3339 timestamps are strings such as
+	// "2006-01-02T15:04:05Z07:00".
+	TimestampRFC3339 TimestampFormat = "rfc3339"
+)
+
+// defaultImportBatchSize is the number of rows Import inserts at a
+// time unless ImportOptions.BatchSize is set.
+const defaultImportBatchSize = 1000
+
+// defaultImportBackfillSize is the number of held back rows Import
+// backfills at a time unless ImportOptions.BackfillSize is set.
+const defaultImportBackfillSize = 100000
+
+// ImportColumns names the CSV columns or NDJSON keys that hold each
+// field of a row. Empty names default to those Export writes.
+type ImportColumns struct {
+	Timestamp string
+	Source    string
+	Metric    string
+	Value     string
+}
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// Format is ExportCSV or ExportNDJSON. CSV input must
+	// start with a header naming the columns.
+	Format ExportFormat
+
+	Columns         ImportColumns
+	TimestampFormat TimestampFormat
+
+	// BatchSize is the number of rows passed to each InsertRows
+	// call. It defaults to 1000.
+	BatchSize int
+
+	// BackfillSize is the number of held back rows that are
+	// written with each backfill. It defaults to 100000.
+	BackfillSize int
+
+	// MaxErrors stops the import once more than MaxErrors lines
+	// have failed. Zero means there is no limit.
+	MaxErrors int
+
+	// Progress, if set, is called after each batch.
+	Progress func(ImportStats)
+}
+
+// ImportStats counts the lines handled by Import.
+type ImportStats struct {
+	// Lines is the number of lines read, not counting CSV
+	// headers and empty NDJSON lines.
+	Lines int
+
+	// Inserted is the number of rows inserted with InsertRows
+	// and Backfilled the number written by a backfill.
+	Inserted   int
+	Backfilled int
+
+	// Failed is the number of lines that couldn't be imported.
+	Failed int
+}
+
+// An ImportError describes a line that Import couldn't import.
+type ImportError struct {
+	Line int
+	Err  error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("catena: line %d: %v", e.Line, e.Err)
+}
+
+// An ImportResult is the outcome of an Import.
+type ImportResult struct {
+	ImportStats
+	Errors []*ImportError
+}
+
+// errTooManyImportErrors is returned by Import when more than
+// ImportOptions.MaxErrors lines failed.
+var errTooManyImportErrors = errors.New("catena: too many import errors")
+
+// Import reads rows in the given format from r and inserts them in
+// batches. Lines that can't be parsed, or whose rows are older than
+// the retention period, are collected in the result instead of
+// failing the import. Rows older than every partition of the DB are
+// held back and written with a Backfill once BackfillSize of them are
+// held back or r is exhausted, so that loading history doesn't create
+// a partition per batch.
+// An error is returned if reading r or inserting rows fails, in
+// which case the result counts what was imported until then.
+func (db *DB) Import(r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	im := &importer{
+		db:           db,
+		opts:         opts,
+		result:       &ImportResult{},
+		batchSize:    opts.BatchSize,
+		backfillSize: opts.BackfillSize,
+		columns:      opts.Columns,
+	}
+
+	if im.batchSize <= 0 {
+		im.batchSize = defaultImportBatchSize
+	}
+
+	if im.backfillSize <= 0 {
+		im.backfillSize = defaultImportBackfillSize
+	}
+
+	for _, c := range []struct {
+		name *string
+		def  string
+	}{
+		{&im.columns.Timestamp, "timestamp"},
+		{&im.columns.Source, "source"},
+		{&im.columns.Metric, "metric"},
+		{&im.columns.Value, "value"},
+	} {
+		if *c.name == "" {
+			*c.name = c.def
+		}
+	}
+
+	var err error
+
+	switch opts.Format {
+	case ExportCSV:
+		err = im.readCSV(r)
+	case ExportNDJSON:
+		err = im.readNDJSON(r)
+	default:
+		return nil, errors.New("catena: unknown import format " + strconv.Quote(string(opts.Format)))
+	}
+
+	if err == nil {
+		err = im.flush()
+	}
+
+	if err == nil {
+		err = im.backfill()
+	}
+
+	if opts.Progress != nil {
+		opts.Progress(im.result.ImportStats)
+	}
+
+	return im.result, err
+}
+
+// An importer holds the state of an Import.
+type importer struct {
+	db           *DB
+	opts         ImportOptions
+	result       *ImportResult
+	batchSize    int
+	backfillSize int
+	columns      ImportColumns
+
+	rows []Row
+
+	// old holds the rows to backfill.
+	old []Row
+}
+
+// readCSV reads CSV records from r.
+func (im *importer) readCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+
+	columns := []int{}
+	for _, name := range []string{im.columns.Timestamp, im.columns.Source, im.columns.Metric, im.columns.Value} {
+		i, ok := index[name]
+		if !ok {
+			return fmt.Errorf("catena: CSV header has no %q column", name)
+		}
+
+		columns = append(columns, i)
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			err = im.add(parseErr.StartLine, Row{}, parseErr.Err)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		field := func(i int) (string, error) {
+			if columns[i] >= len(record) {
+				return "", fmt.Errorf("missing %q column", header[columns[i]])
+			}
+
+			return record[columns[i]], nil
+		}
+
+		row, err := im.parseRow(field)
+		err = im.add(line, row, err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readNDJSON reads a JSON object per line from r.
+func (im *importer) readNDJSON(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	keys := []string{im.columns.Timestamp, im.columns.Source, im.columns.Metric, im.columns.Value}
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		object := map[string]interface{}{}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		err := decoder.Decode(&object)
+		if err != nil {
+			err = im.add(line, Row{}, err)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		field := func(i int) (string, error) {
+			switch v := object[keys[i]].(type) {
+			case string:
+				return v, nil
+			case json.Number:
+				return v.String(), nil
+			case nil:
+				return "", fmt.Errorf("missing %q key", keys[i])
+			}
+
+			return "", fmt.Errorf("%q is not a string or number", keys[i])
+		}
+
+		row, err := im.parseRow(field)
+		err = im.add(line, row, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseRow parses a row from the timestamp, source, metric and
+// value fields returned by field.
+func (im *importer) parseRow(field func(int) (string, error)) (Row, error) {
+	fields := [4]string{}
+	for i := range fields {
+		s, err := field(i)
+		if err != nil {
+			return Row{}, err
+		}
+
+		fields[i] = strings.TrimSpace(s)
+	}
+
+	timestamp, err := im.parseTimestamp(fields[0])
+	if err != nil {
+		return Row{}, err
+	}
+
+	if fields[1] == "" || fields[2] == "" {
+		return Row{}, errors.New("empty source or metric")
+	}
+
+	if len(fields[1]) > 255 || len(fields[2]) > 255 {
+		return Row{}, errors.New("source or metric longer than 255 bytes")
+	}
+
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return Row{}, fmt.Errorf("invalid value %q", fields[3])
+	}
+
+	return Row{
+		Source: fields[1],
+		Metric: fields[2],
+		Point: Point{
+			Timestamp: timestamp,
+			Value:     value,
+		},
+	}, nil
+}
+
+// parseTimestamp parses s according to the import's timestamp
+// format and returns it in the DB's timestamp unit.
+func (im *importer) parseTimestamp(s string) (int64, error) {
+	unit := im.db.timestampUnit
+
+	switch im.opts.TimestampFormat {
+	case TimestampNative:
+	case TimestampSeconds:
+		unit = time.Second
+	case TimestampMilliseconds:
+		unit = time.Millisecond
+	case TimestampNanoseconds:
+		unit = time.Nanosecond
+	case TimestampRFC3339:
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+
+		return t.UnixNano() / int64(im.db.timestampUnit), nil
+	default:
+		return 0, fmt.Errorf("unknown timestamp format %q", im.opts.TimestampFormat)
+	}
+
+	timestamp, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+
+	if unit >= im.db.timestampUnit {
+		return timestamp * int64(unit/im.db.timestampUnit), nil
+	}
+
+	return timestamp / int64(im.db.timestampUnit/unit), nil
+}
+
+// add adds the row parsed from line, or records parseErr, and
+// inserts the batch once it is full.
+func (im *importer) add(line int, row Row, parseErr error) error {
+	im.result.Lines++
+
+	if parseErr != nil {
+		return im.fail(line, parseErr)
+	}
+
+	if cutoff, ok := im.db.retentionCutoff(); ok && row.Timestamp < cutoff {
+		return im.fail(line, &RetentionError{
+			Timestamp: row.Timestamp,
+			Cutoff:    cutoff,
+		})
+	}
+
+	im.rows = append(im.rows, row)
+	if len(im.rows) < im.batchSize {
+		return nil
+	}
+
+	err := im.flush()
+	if err == nil && im.opts.Progress != nil {
+		im.opts.Progress(im.result.ImportStats)
+	}
+
+	return err
+}
+
+// fail records that line couldn't be imported.
+func (im *importer) fail(line int, err error) error {
+	im.result.Failed++
+	im.result.Errors = append(im.result.Errors, &ImportError{
+		Line: line,
+		Err:  err,
+	})
+
+	if im.opts.MaxErrors > 0 && im.result.Failed > im.opts.MaxErrors {
+		return errTooManyImportErrors
+	}
+
+	return nil
+}
+
+// flush inserts the current batch, holding back the rows that
+// are older than every partition, and backfills the held back
+// rows once there are enough of them.
+func (im *importer) flush() error {
+	if len(im.rows) == 0 {
+		return nil
+	}
+
+	rows := im.rows
+	if cutoff, ok := im.db.oldestPartitionStart(); ok {
+		rows = []Row{}
+		for _, row := range im.rows {
+			if row.Timestamp < cutoff {
+				im.old = append(im.old, row)
+			} else {
+				rows = append(rows, row)
+			}
+		}
+	}
+
+	err := im.db.InsertRows(rows)
+	if err != nil {
+		return err
+	}
+
+	im.result.Inserted += len(rows)
+	im.rows = im.rows[:0]
+
+	if len(im.old) >= im.backfillSize {
+		// Later rows that are older than the backfilled
+		// partitions are held back for the next backfill.
+		return im.backfill()
+	}
+
+	return nil
+}
+
+// backfill writes the rows that were held back.
+func (im *importer) backfill() error {
+	if len(im.old) == 0 {
+		return nil
+	}
+
+	// The last row for a timestamp wins, as it
+	// does for InsertRows.
+	sort.Stable(rowsBySeries(im.old))
+
+	size := im.db.partitionSize
+	start := bucketStart(im.old[0].Timestamp, size)
+	end := start
+
+	for _, row := range im.old {
+		if e := bucketStart(row.Timestamp, size) + size; e > end {
+			end = e
+		}
+
+		if s := bucketStart(row.Timestamp, size); s < start {
+			start = s
+		}
+	}
+
+	b, err := im.db.NewBackfill(start, end)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(im.old); {
+		j := i
+		points := []Point{}
+		for ; j < len(im.old) && im.old[j].Source == im.old[i].Source && im.old[j].Metric == im.old[i].Metric; j++ {
+			if len(points) > 0 && points[len(points)-1].Timestamp == im.old[j].Timestamp {
+				points[len(points)-1] = im.old[j].Point
+				continue
+			}
+
+			points = append(points, im.old[j].Point)
+		}
+
+		err = b.WriteSeries(im.old[i].Source, im.old[i].Metric, points)
+		if err != nil {
+			b.Abort()
+			return err
+		}
+
+		i = j
+	}
+
+	err = b.Commit()
+	if err != nil {
+		return err
+	}
+
+	im.result.Backfilled += len(im.old)
+	im.old = nil
+	return nil
+}
+
+// oldestPartitionStart returns the start of the partition key range
+// of the oldest raw partition. ok is false if there are no partitions.
+func (db *DB) oldestPartitionStart() (start int64, ok bool) {
+	if db.partitionList.Size() == 0 {
+		return 0, false
+	}
+
+	return bucketStart(atomic.LoadInt64(&db.minTimestamp), db.partitionSize), true
+}
+
+// rowsBySeries sorts rows by source, metric and timestamp.
+type rowsBySeries []Row
+
+func (r rowsBySeries) Len() int      { return len(r) }
+func (r rowsBySeries) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r rowsBySeries) Less(i, j int) bool {
+	if r[i].Source != r[j].Source {
+		return r[i].Source < r[j].Source
+	}
+
+	if r[i].Metric != r[j].Metric {
+		return r[i].Metric < r[j].Metric
+	}
+
+	return r[i].Timestamp < r[j].Timestamp
+}
@@ -0,0 +1,185 @@
+package catena
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+func TestImport(t *testing.T) {
+	os.RemoveAll("/tmp/catena_import_test")
+
+	db, err := NewDB("/tmp/catena_import_test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.InsertRows([]Row{{Source: "a", Metric: "m", Point: Point{Timestamp: 100, Value: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csvInput := `val,time,host,name
+2,105000,a,m
+x,106000,a,m
+3,20000,a,m
+4,21"000,a,m
+5,35000,b,m
+6,20000,a,m
+7,110000
+8,111000,b,m
+`
+
+	progress := []ImportStats{}
+	result, err := db.Import(strings.NewReader(csvInput), ImportOptions{
+		Format:          ExportCSV,
+		Columns:         ImportColumns{Timestamp: "time", Source: "host", Metric: "name", Value: "val"},
+		TimestampFormat: TimestampMilliseconds,
+		BatchSize:       2,
+		Progress: func(stats ImportStats) {
+			progress = append(progress, stats)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ImportStats{Lines: 8, Inserted: 2, Backfilled: 3, Failed: 3}
+	if result.ImportStats != expected {
+		t.Errorf("expected %+v, got %+v", expected, result.ImportStats)
+	}
+
+	lines := []int{}
+	for _, importErr := range result.Errors {
+		lines = append(lines, importErr.Line)
+	}
+
+	if !reflect.DeepEqual(lines, []int{3, 5, 8}) {
+		t.Errorf("unexpected errors %v", result.Errors)
+	}
+
+	if len(progress) != 3 || progress[len(progress)-1] != expected {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	points, _, err := db.Range("a", "m", 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last row for timestamp 20 wins.
+	expectedPoints := []Point{{20, 6}, {100, 1}, {105, 2}}
+	if !reflect.DeepEqual(points, expectedPoints) {
+		t.Errorf("expected points %v, got %v", expectedPoints, points)
+	}
+
+	ndjsonInput := `{"source":"c","metric":"m","timestamp":"1970-01-01T00:02:00Z","value":1.5}
+
+{"source":"c","metric":"m","timestamp":"yesterday","value":1}
+{"source":"c","metric":"m",
+{"source":"c","metric":"m","timestamp":"1970-01-01T00:02:01.5Z","value":"2"}
+`
+
+	result, err = db.Import(strings.NewReader(ndjsonInput), ImportOptions{
+		Format:          ExportNDJSON,
+		TimestampFormat: TimestampRFC3339,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = ImportStats{Lines: 4, Inserted: 2, Failed: 2}
+	if result.ImportStats != expected || result.Errors[0].Line != 3 || result.Errors[1].Line != 4 {
+		t.Errorf("unexpected result %+v %v", result.ImportStats, result.Errors)
+	}
+
+	points, _, err = db.Range("c", "m", 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPoints = []Point{{120, 1.5}, {121, 2}}
+	if !reflect.DeepEqual(points, expectedPoints) {
+		t.Errorf("expected points %v, got %v", expectedPoints, points)
+	}
+
+	result, err = db.Import(strings.NewReader(ndjsonInput), ImportOptions{
+		Format:    ExportNDJSON,
+		MaxErrors: 1,
+	})
+	if err != errTooManyImportErrors || result.Failed != 2 {
+		t.Errorf("expected too many errors, got %v with %+v", err, result)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportBackfillSize(t *testing.T) {
+	db, err := NewDB("/tmp/catena_import_backfill_test", 10, 0, WithFS(vfs.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.InsertRows([]Row{{Source: "a", Metric: "m", Point: Point{Timestamp: 100, Value: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// History arrives newest first.
+	input := "timestamp,source,metric,value\n"
+	for ts := 49; ts >= 0; ts-- {
+		input += fmt.Sprintf("%d,a,m,%d\n", ts, ts)
+	}
+
+	progress := []ImportStats{}
+	result, err := db.Import(strings.NewReader(input), ImportOptions{
+		Format:       ExportCSV,
+		BatchSize:    5,
+		BackfillSize: 10,
+		Progress: func(stats ImportStats) {
+			progress = append(progress, stats)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ImportStats{Lines: 50, Backfilled: 50}
+	if result.ImportStats != expected {
+		t.Errorf("expected %+v, got %+v", expected, result.ImportStats)
+	}
+
+	// The held back rows are backfilled every other batch.
+	for i, stats := range progress[:10] {
+		if backfilled := (i + 1) / 2 * 10; stats.Backfilled != backfilled {
+			t.Errorf("expected %d rows backfilled after batch %d, got %d", backfilled, i+1, stats.Backfilled)
+		}
+	}
+
+	points, _, err := db.Range("a", "m", 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 51 {
+		t.Fatalf("expected %d points, got %d", 51, len(points))
+	}
+
+	for i, point := range points[:50] {
+		if point.Timestamp != int64(i) || point.Value != float64(i) {
+			t.Fatalf("unexpected point %v at index %d", point, i)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,11 +10,52 @@ import (
 
 	"github.com/Cistern/catena/partition"
 	"github.com/Cistern/catena/partition/memory"
-	"github.com/Cistern/catena/wal"
 )
 
+// ErrReadOnly is returned by InsertRows when the DB doesn't
+// accept writes, because it has been closed or was opened
+// with WithReadOnly.
+var ErrReadOnly = errors.New("catena: database is read only")
+
+// A RetentionError is returned by InsertRows when a row is
+// older than the retention period allows.
+type RetentionError struct {
+	// Timestamp is the timestamp of the rejected row.
+	Timestamp int64
+
+	// Cutoff is the oldest timestamp that would have been accepted.
+	Cutoff int64
+}
+
+func (e *RetentionError) Error() string {
+	return fmt.Sprintf("catena: row with timestamp %d is older than retention cutoff %d",
+		e.Timestamp, e.Cutoff)
+}
+
 // InsertRows inserts the given rows into the database.
+// A *RetentionError is returned, and no rows are inserted,
+// if any row is older than the retention period. Rows for
+// partitions that have already been compacted are buffered
+// and merged into those partitions later. Rows that fall in a
+// partition window no partition covers yet, whether between
+// existing partitions or before the oldest one, get a new
+// partition for that window.
 func (db *DB) InsertRows(rows []Row) error {
+	if db.readOnly || atomic.LoadInt32(&db.closed) != 0 {
+		return ErrReadOnly
+	}
+
+	if cutoff, ok := db.retentionCutoff(); ok {
+		for _, row := range rows {
+			if row.Timestamp < cutoff {
+				return &RetentionError{
+					Timestamp: row.Timestamp,
+					Cutoff:    cutoff,
+				}
+			}
+		}
+	}
+
 	keyToRows := map[int][]Row{}
 
 	for _, row := range rows {
@@ -35,7 +76,7 @@ func (db *DB) InsertRows(rows []Row) error {
 		maxTimestampInRows := int64(0)
 
 		for i, row := range rowsForKey {
-			if i == 1 {
+			if i == 0 {
 				minTimestampInRows = row.Timestamp
 				maxTimestampInRows = row.Timestamp
 			}
@@ -49,101 +90,134 @@ func (db *DB) InsertRows(rows []Row) error {
 			}
 		}
 
-		var p partition.Partition
-
-	FIND_PARTITION:
+		partitionRows := *(*[]partition.Row)(unsafe.Pointer(&rowsForKey))
 
-		i := db.partitionList.NewIterator()
-		for i.Next() {
-			val, _ := i.Value()
-			val.Hold()
+		err := db.insertKey(int64(key), partitionRows, minTimestampInRows, maxTimestampInRows)
+		if err != nil {
+			return err
+		}
 
-			if val.MinTimestamp()/db.partitionSize == int64(key) {
-				p = val
-				goto VALID_PARTITION
+		for min := atomic.LoadInt64(&db.minTimestamp); min > minTimestampInRows; min = atomic.LoadInt64(&db.minTimestamp) {
+			if atomic.CompareAndSwapInt64(&db.minTimestamp, min, minTimestampInRows) {
+				break
 			}
+		}
 
-			if val.MinTimestamp()/db.partitionSize < int64(key) && val.MaxTimestamp()/db.partitionSize >= int64(key) {
-				p = val
-				goto VALID_PARTITION
+		for max := atomic.LoadInt64(&db.maxTimestamp); max < maxTimestampInRows; max = atomic.LoadInt64(&db.maxTimestamp) {
+			if atomic.CompareAndSwapInt64(&db.maxTimestamp, max, maxTimestampInRows) {
+				break
 			}
-
-			val.Release()
 		}
+	}
 
-		db.partitionCreateLock.Lock()
-		if p == nil {
-			if int64(key) < atomic.LoadInt64(&db.minTimestamp)/db.partitionSize {
-				db.partitionCreateLock.Unlock()
-				return errors.New("catena: row(s) being inserted are too old")
-			}
+	return nil
+}
 
-			if db.partitionList.Size() == 0 ||
-				int64(key) > atomic.LoadInt64(&db.maxTimestamp)/db.partitionSize {
-
-				// Need to make a new partition
-				newPartitionID := atomic.LoadInt64(&db.lastPartitionID) + 1
-				w, err := wal.NewFileWAL(filepath.Join(db.baseDir,
-					fmt.Sprintf("%d.wal", newPartitionID)))
-				if err != nil {
-					// Couldn't create the WAL. Maybe another writer has created
-					// the WAL file. Retry.
-					db.partitionCreateLock.Unlock()
-					goto FIND_PARTITION
+// insertKey inserts rows, which all have the given partition key,
+// into their partition. A partition is created if there isn't one yet,
+// wherever the key falls relative to the existing partitions.
+// If the partition has already been sealed the rows are buffered in
+// a late partition instead.
+func (db *DB) insertKey(key int64, rows []partition.Row, minTimestamp, maxTimestamp int64) error {
+	for {
+		p := db.findPartition(key)
+		if p != nil {
+			if !p.ReadOnly() {
+				err := p.InsertRows(rows)
+				p.Release()
+				if err == errLatePartitionRetired {
+					continue
 				}
 
-				p = memory.NewMemoryPartition(w)
-				db.partitionList.Insert(p)
-				p.Hold()
+				return err
+			}
 
-				if db.partitionList.Size() == 1 {
-					atomic.SwapInt64(&db.minTimestamp, minTimestampInRows)
-					atomic.SwapInt64(&db.maxTimestamp, maxTimestampInRows)
-				}
+			p.Release()
+		}
 
-				if !atomic.CompareAndSwapInt64(&db.lastPartitionID, newPartitionID-1, newPartitionID) {
-					p.Release()
-					p.Destroy()
-					db.partitionCreateLock.Unlock()
-					goto FIND_PARTITION
-				}
-			}
+		db.partitionCreateLock.Lock()
 
-			if p == nil {
-				db.partitionCreateLock.Unlock()
-				goto FIND_PARTITION
+		// Another writer may have created the partition, or the
+		// compactor may have replaced it, while we were waiting
+		// for the lock.
+		p = db.findPartition(key)
+		if p == nil {
+			err := db.createPartition(rows)
+			if err == nil && db.partitionList.Size() == 1 {
+				atomic.SwapInt64(&db.minTimestamp, minTimestamp)
+				atomic.SwapInt64(&db.maxTimestamp, maxTimestamp)
 			}
-		}
 
-		db.partitionCreateLock.Unlock()
+			db.partitionCreateLock.Unlock()
+			return err
+		}
 
-	VALID_PARTITION:
+		readOnly := p.ReadOnly()
+		p.Release()
 
-		if p.ReadOnly() {
-			p.Release()
-			return errors.New("catena: insert into read-only partition")
+		var err error
+		if readOnly {
+			err = db.wrapLatePartition(p)
 		}
 
-		err := p.InsertRows(*(*[]partition.Row)(unsafe.Pointer(&rows)))
+		db.partitionCreateLock.Unlock()
+
 		if err != nil {
-			p.Release()
 			return err
 		}
+	}
+}
 
-		p.Release()
-
-		for min := atomic.LoadInt64(&db.minTimestamp); min > minTimestampInRows; min = atomic.LoadInt64(&db.minTimestamp) {
-			if atomic.CompareAndSwapInt64(&db.minTimestamp, min, minTimestampInRows) {
-				break
-			}
+// findPartition returns the partition that holds rows for the
+// given partition key, or nil if there isn't one. The returned
+// partition is held and must be released.
+func (db *DB) findPartition(key int64) partition.Partition {
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		val, _ := i.Value()
+		val.Hold()
+
+		if val.MinTimestamp()/db.partitionSize == key {
+			return val
 		}
 
-		for max := atomic.LoadInt64(&db.maxTimestamp); max < maxTimestampInRows; max = atomic.LoadInt64(&db.maxTimestamp) {
-			if atomic.CompareAndSwapInt64(&db.maxTimestamp, max, maxTimestampInRows) {
-				break
-			}
+		if val.MinTimestamp()/db.partitionSize < key && val.MaxTimestamp()/db.partitionSize >= key {
+			return val
 		}
+
+		val.Release()
+	}
+
+	return nil
+}
+
+// createPartition creates a new memory partition containing rows
+// and adds it to the partition list. The rows are inserted before
+// the partition is added so that it is placed correctly in the list.
+// The caller must hold partitionCreateLock.
+func (db *DB) createPartition(rows []partition.Row) error {
+	newPartitionID := atomic.LoadInt64(&db.lastPartitionID) + 1
+	w, err := db.walFactory.Create(filepath.Join(db.baseDir,
+		fmt.Sprintf("%d.wal", newPartitionID)))
+	if err != nil {
+		return err
 	}
 
+	p := memory.NewMemoryPartition(w)
+
+	err = p.InsertRows(rows)
+	if err != nil {
+		p.Destroy()
+		return err
+	}
+
+	err = db.partitionList.Insert(p)
+	if err != nil {
+		p.Destroy()
+		return err
+	}
+
+	atomic.StoreInt64(&db.lastPartitionID, newPartitionID)
+
 	return nil
 }
@@ -0,0 +1,115 @@
+package catena
+
+import (
+	"testing"
+
+	"github.com/Cistern/catena/vfs"
+)
+
+func TestInsertRowsPartitionKeys(t *testing.T) {
+	db, err := NewDB("/tmp/catena_insert_keys_test", 10, 0, WithFS(vfs.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rows span two partition keys, and the first row
+	// holds neither the oldest nor the newest timestamp.
+	rows := []Row{}
+	for _, ts := range []int64{15, 12, 25, 18} {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if min, max := db.MinTimestamp(), db.MaxTimestamp(); min != 12 || max != 25 {
+		t.Errorf("expected timestamps [%d, %d], got [%d, %d]", 12, 25, min, max)
+	}
+
+	// Each partition only gets the rows for its own key.
+	expected := [][2]int64{{25, 25}, {12, 18}}
+
+	infos := db.Partitions()
+	if len(infos) != len(expected) {
+		t.Fatalf("expected %d partitions, got %d", len(expected), len(infos))
+	}
+
+	for i, info := range infos {
+		if info.MinTimestamp != expected[i][0] || info.MaxTimestamp != expected[i][1] {
+			t.Errorf("expected partition %d to cover [%d, %d], got [%d, %d]",
+				i, expected[i][0], expected[i][1], info.MinTimestamp, info.MaxTimestamp)
+		}
+	}
+
+	points, _, err := db.Range("a", "b", 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 4 {
+		t.Errorf("expected %d points, got %v", 4, points)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertRowsGap(t *testing.T) {
+	db, err := NewDB("/tmp/catena_insert_gap_test", 10, 0, WithFS(vfs.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(ts int64) {
+		err := db.InsertRows([]Row{
+			Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(15)
+	insert(35)
+
+	// The rows fall between the two partitions, and
+	// before the oldest one.
+	insert(25)
+	insert(5)
+
+	expected := []int64{35, 25, 15, 5}
+
+	infos := db.Partitions()
+	if len(infos) != len(expected) {
+		t.Fatalf("expected %d partitions, got %d", len(expected), len(infos))
+	}
+
+	for i, info := range infos {
+		if info.MinTimestamp != expected[i] || info.MaxTimestamp != expected[i] {
+			t.Errorf("expected partition %d to hold %d, got [%d, %d]",
+				i, expected[i], info.MinTimestamp, info.MaxTimestamp)
+		}
+	}
+
+	if min := db.MinTimestamp(); min != 5 {
+		t.Errorf("expected min timestamp %d, got %d", 5, min)
+	}
+
+	points, _, err := db.Range("a", "b", 0, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 4 || points[0].Timestamp != 5 || points[3].Timestamp != 35 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
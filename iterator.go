@@ -6,6 +6,15 @@ import (
 	"github.com/Cistern/catena/partition"
 )
 
+// ErrSeriesNotFound is returned by NewIterator and Iterator.Reset
+// if no partition holds the source and metric.
+var ErrSeriesNotFound = errors.New("catena: couldn't find metric for iterator")
+
+// ErrNoMorePoints is returned by an Iterator's Next and Seek methods
+// once there are no more points. Any other error means the points
+// couldn't be read.
+var ErrNoMorePoints = partition.ErrNoMorePoints
+
 // An Iterator is a cursor over an array of points
 // for a source and metric.
 type Iterator struct {
@@ -38,7 +47,7 @@ func (db *DB) NewIterator(source, metric string) (*Iterator, error) {
 	}
 
 	if p == nil {
-		return nil, errors.New("catena: couldn't find metric for iterator")
+		return nil, ErrSeriesNotFound
 	}
 
 	partitionIter, err := p.NewIterator(source, metric)
@@ -61,16 +70,17 @@ func (db *DB) NewIterator(source, metric string) (*Iterator, error) {
 func (i *Iterator) Next() error {
 	currentPoint := i.Point()
 	err := i.Iterator.Next()
-	if err == nil {
-		return nil
+	if err != ErrNoMorePoints {
+		return err
 	}
 
-	err = i.Seek(currentPoint.Timestamp + 1)
-	return err
+	// Newer partitions may hold later points.
+	return i.Seek(currentPoint.Timestamp + 1)
 }
 
 // Seek moves the iterator to the first timestamp greater than
-// or equal to timestamp.
+// or equal to timestamp. ErrNoMorePoints is returned if there
+// is no such point.
 func (i *Iterator) Seek(timestamp int64) error {
 	if i.Iterator != nil {
 		i.Iterator.Close()
@@ -96,12 +106,16 @@ func (i *Iterator) Seek(timestamp int64) error {
 			val.Release()
 
 			if err != nil {
-				continue
+				return err
 			}
 
 			err = partitionIter.Seek(timestamp)
 			if err != nil {
 				partitionIter.Close()
+				if err != ErrNoMorePoints {
+					return err
+				}
+
 				continue
 			}
 
@@ -117,7 +131,7 @@ func (i *Iterator) Seek(timestamp int64) error {
 	}
 
 	if i.Iterator == nil {
-		return errors.New("catena: couldn't find metric for iterator")
+		return ErrNoMorePoints
 	}
 
 	return nil
@@ -125,7 +139,10 @@ func (i *Iterator) Seek(timestamp int64) error {
 
 // Reset moves i to the first available timestamp.
 func (i *Iterator) Reset() error {
-	i.Iterator.Close()
+	if i.Iterator != nil {
+		i.Iterator.Close()
+		i.Iterator = nil
+	}
 
 	var p partition.Partition
 
@@ -146,7 +163,7 @@ func (i *Iterator) Reset() error {
 	}
 
 	if p == nil {
-		return errors.New("catena: couldn't find metric for iterator")
+		return ErrSeriesNotFound
 	}
 
 	defer p.Release()
@@ -1,9 +1,13 @@
 package catena
 
 import (
+	"bytes"
 	"os"
 	"testing"
 	"time"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/vfs"
 )
 
 func TestIterator(t *testing.T) {
@@ -269,3 +273,89 @@ func TestIterator(t *testing.T) {
 
 	db.Close()
 }
+
+func TestIteratorErrors(t *testing.T) {
+	fs := vfs.NewMemFS()
+
+	err := fs.MkdirAll("/tmp/catena_iterator_errors_test", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []partition.Row{}
+	for ts := int64(10); ts < 20; ts++ {
+		rows = append(rows, partition.Row{Source: "a", Metric: "b", Point: partition.Point{Timestamp: ts}})
+	}
+
+	filename := "/tmp/catena_iterator_errors_test/1.part"
+	p, err := writeDiskPartition(fs, filename, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Close()
+
+	db, err := OpenDB("/tmp/catena_iterator_errors_test", 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := db.NewIterator("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = i.Seek(20)
+	if err != ErrNoMorePoints {
+		t.Errorf("expected ErrNoMorePoints seeking past the last point, got %v", err)
+	}
+
+	i.Close()
+
+	_, err = db.NewIterator("a", "c")
+	if err != ErrSeriesNotFound {
+		t.Errorf("expected ErrSeriesNotFound, got %v", err)
+	}
+
+	points, _, err := db.Range("a", "c", 0, 100)
+	if err != nil || len(points) != 0 {
+		t.Errorf("expected no points for a missing series, got %v (%v)", points, err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the gzip header of the extent.
+	data, err := vfs.ReadFile(fs, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extent := bytes.LastIndex(data, []byte{0x1f, 0x8b})
+	if extent < 0 {
+		t.Fatal("extent not found")
+	}
+
+	data[extent] ^= 0xff
+	err = writeFileFS(fs, filename, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB("/tmp/catena_iterator_errors_test", 10, 0, WithFS(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = db.Range("a", "b", 0, 100)
+	if err == nil {
+		t.Error("expected an error reading a corrupt extent")
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,111 @@
+package catena
+
+import (
+	"errors"
+	"sort"
+)
+
+// A Label is a name and value pair. Protocols with tagged series
+// encode their tags as labels in a row's source.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// FormatLabels encodes labels as a source string. Labels are sorted
+// by name and written as name=value pairs separated by commas, with
+// commas, equals signs and backslashes escaped by a backslash, so
+// that the same set of labels always yields the same source.
+func FormatLabels(labels []Label) string {
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.Stable(labelsByName(sorted))
+
+	buf := []byte{}
+	for i, label := range sorted {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		buf = appendEscaped(buf, label.Name)
+		buf = append(buf, '=')
+		buf = appendEscaped(buf, label.Value)
+	}
+
+	return string(buf)
+}
+
+// ParseLabels decodes a source string written by FormatLabels.
+func ParseLabels(source string) ([]Label, error) {
+	labels := []Label{}
+	if source == "" {
+		return labels, nil
+	}
+
+	label := Label{}
+	current := []byte{}
+	inValue := false
+
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+
+		switch c {
+		case '\\':
+			i++
+			if i == len(source) {
+				return nil, errors.New("catena: labels end with an escape character")
+			}
+
+			current = append(current, source[i])
+		case '=':
+			if inValue {
+				return nil, errors.New("catena: unescaped '=' in label value")
+			}
+
+			label.Name = string(current)
+			current = current[:0]
+			inValue = true
+		case ',':
+			if !inValue {
+				return nil, errors.New("catena: label has no value")
+			}
+
+			label.Value = string(current)
+			labels = append(labels, label)
+
+			label = Label{}
+			current = current[:0]
+			inValue = false
+		default:
+			current = append(current, c)
+		}
+	}
+
+	if !inValue {
+		return nil, errors.New("catena: label has no value")
+	}
+
+	label.Value = string(current)
+	labels = append(labels, label)
+
+	return labels, nil
+}
+
+func appendEscaped(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\', ',', '=':
+			buf = append(buf, '\\')
+		}
+
+		buf = append(buf, s[i])
+	}
+
+	return buf
+}
+
+type labelsByName []Label
+
+func (l labelsByName) Len() int           { return len(l) }
+func (l labelsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l labelsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
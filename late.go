@@ -0,0 +1,640 @@
+package catena
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/disk"
+	"github.com/Cistern/catena/partition/memory"
+)
+
+// lateDirName is the directory within the DB directory that holds
+// the WALs of rows inserted into sealed partitions.
+const lateDirName = "late"
+
+var errLatePartitionRetired = errors.New("catena: late partition retired")
+
+// A latePartition overlays a sealed partition with buffers of rows
+// that arrived after the partition was sealed. Reads merge the
+// buffers with the sealed partition, and the compactor folds the
+// buffers into the sealed partition's file.
+//
+// Buffered rows are logged to WALs named "late/<id>-<generation>.wal"
+// where id is the ID of the sealed partition.
+type latePartition struct {
+	db   *DB
+	id   int64
+	base partition.Partition
+
+	// active receives new rows. It is created on demand.
+	active     *memory.MemoryPartition
+	activeLock sync.Mutex
+
+	// sealed buffers are waiting to be folded into base.
+	sealed []*memory.MemoryPartition
+
+	nextGeneration int
+
+	// retired is set once the partition has been replaced in the
+	// partition list. Inserts into a retired partition are retried.
+	retired bool
+
+	lock sync.RWMutex
+}
+
+// newLatePartition returns a latePartition overlaying base.
+func (db *DB) newLatePartition(base partition.Partition) (*latePartition, error) {
+	id, err := partitionID(base.Filename())
+	if err != nil {
+		return nil, err
+	}
+
+	return &latePartition{
+		db:   db,
+		id:   id,
+		base: base,
+	}, nil
+}
+
+// wrapLatePartition replaces the sealed partition p in the partition
+// list with a latePartition overlaying it. The caller must hold
+// partitionCreateLock.
+func (db *DB) wrapLatePartition(p partition.Partition) error {
+	lp, err := db.newLatePartition(p)
+	if err != nil {
+		return err
+	}
+
+	return db.partitionList.Replace([]partition.Partition{p}, lp)
+}
+
+// buffers returns all of the buffers of p, oldest first.
+func (p *latePartition) buffers() []*memory.MemoryPartition {
+	buffers := append([]*memory.MemoryPartition(nil), p.sealed...)
+
+	p.activeLock.Lock()
+	if p.active != nil {
+		buffers = append(buffers, p.active)
+	}
+	p.activeLock.Unlock()
+
+	return buffers
+}
+
+func (p *latePartition) InsertRows(rows []partition.Row) error {
+	if p.retired {
+		return errLatePartitionRetired
+	}
+
+	p.activeLock.Lock()
+	if p.active == nil {
+		w, err := p.db.walFactory.Create(filepath.Join(p.db.baseDir, lateDirName,
+			fmt.Sprintf("%d-%d.wal", p.id, p.nextGeneration)))
+		if err != nil {
+			p.activeLock.Unlock()
+			return err
+		}
+
+		p.nextGeneration++
+		p.active = memory.NewMemoryPartition(w)
+	}
+	active := p.active
+	p.activeLock.Unlock()
+
+	return active.InsertRows(rows)
+}
+
+func (p *latePartition) ReadOnly() bool {
+	return p.retired
+}
+
+func (p *latePartition) Filename() string {
+	return p.base.Filename()
+}
+
+func (p *latePartition) MinTimestamp() int64 {
+	min := p.base.MinTimestamp()
+	for _, buffer := range p.buffers() {
+		if buffer.MinTimestamp() < min {
+			min = buffer.MinTimestamp()
+		}
+	}
+
+	return min
+}
+
+func (p *latePartition) MaxTimestamp() int64 {
+	max := p.base.MaxTimestamp()
+	for _, buffer := range p.buffers() {
+		if buffer.MaxTimestamp() > max {
+			max = buffer.MaxTimestamp()
+		}
+	}
+
+	return max
+}
+
+func (p *latePartition) Sources() []string {
+	sourcesMap := map[string]struct{}{}
+	for _, source := range p.base.Sources() {
+		sourcesMap[source] = struct{}{}
+	}
+
+	for _, buffer := range p.buffers() {
+		for _, source := range buffer.Sources() {
+			sourcesMap[source] = struct{}{}
+		}
+	}
+
+	sources := []string{}
+	for source := range sourcesMap {
+		sources = append(sources, source)
+	}
+
+	return sources
+}
+
+func (p *latePartition) Metrics(source string) []string {
+	metricsMap := map[string]struct{}{}
+	for _, metric := range p.base.Metrics(source) {
+		metricsMap[metric] = struct{}{}
+	}
+
+	for _, buffer := range p.buffers() {
+		for _, metric := range buffer.Metrics(source) {
+			metricsMap[metric] = struct{}{}
+		}
+	}
+
+	metrics := []string{}
+	for metric := range metricsMap {
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+func (p *latePartition) HasSource(source string) bool {
+	if p.base.HasSource(source) {
+		return true
+	}
+
+	for _, buffer := range p.buffers() {
+		if buffer.HasSource(source) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *latePartition) HasMetric(source, metric string) bool {
+	if p.base.HasMetric(source, metric) {
+		return true
+	}
+
+	for _, buffer := range p.buffers() {
+		if buffer.HasMetric(source, metric) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetReadOnly does nothing. The base partition is already read-only
+// and late partitions always accept rows until they are retired.
+func (p *latePartition) SetReadOnly() {
+}
+
+func (p *latePartition) Close() error {
+	for _, buffer := range p.buffers() {
+		err := buffer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.base.Close()
+}
+
+func (p *latePartition) Destroy() error {
+	for _, buffer := range p.buffers() {
+		err := buffer.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.base.Destroy()
+}
+
+func (p *latePartition) Hold() {
+	p.lock.RLock()
+}
+
+func (p *latePartition) Release() {
+	p.lock.RUnlock()
+}
+
+func (p *latePartition) ExclusiveHold() {
+	p.lock.Lock()
+}
+
+func (p *latePartition) ExclusiveRelease() {
+	p.lock.Unlock()
+}
+
+// NewIterator returns an Iterator over the merged points of the base
+// partition and the buffers. Where several points share a timestamp,
+// the most recently inserted one wins. The points are merged as the
+// iterator advances.
+func (p *latePartition) NewIterator(source string, metric string) (partition.Iterator, error) {
+	p.Hold()
+
+	i := &mergeIterator{
+		release: p.Release,
+	}
+
+	for _, part := range append([]partition.Partition{p.base}, memoryPartitions(p.buffers())...) {
+		if !part.HasMetric(source, metric) {
+			continue
+		}
+
+		partIter, err := part.NewIterator(source, metric)
+		if err != nil {
+			i.Close()
+			return nil, err
+		}
+
+		i.iters = append(i.iters, partIter)
+		i.ok = append(i.ok, false)
+	}
+
+	if len(i.iters) == 0 {
+		i.Close()
+		return nil, errors.New("catena: metric not found")
+	}
+
+	return i, nil
+}
+
+// fold rewrites the base partition's file to include the sealed
+// buffers of p, sealing the active buffer first. Once the new file
+// is in place the folded buffers are destroyed, and if no rows
+// arrived in the meantime p is replaced by a plain disk partition.
+func (db *DB) fold(p *latePartition) error {
+	if _, isDisk := p.base.(*disk.DiskPartition); !isDisk {
+		// Wait for the base partition to be compacted.
+		return nil
+	}
+
+	// Seal the active buffer. Inserters hold p, so once we have
+	// it exclusively nobody is writing to the buffer.
+	p.ExclusiveHold()
+	p.activeLock.Lock()
+	if p.active != nil {
+		p.active.SetReadOnly()
+		p.sealed = append(p.sealed, p.active)
+		p.active = nil
+	}
+	p.activeLock.Unlock()
+	folded := append([]*memory.MemoryPartition(nil), p.sealed...)
+	base := p.base
+	p.ExclusiveRelease()
+
+	if len(folded) == 0 {
+		return nil
+	}
+
+	p.Hold()
+	rows, err := partitionRows(append([]partition.Partition{base}, memoryPartitions(folded)...))
+	p.Release()
+	if err != nil {
+		return err
+	}
+
+	rewritten, err := writeDiskPartition(db.fs, base.Filename(), rows)
+	if err != nil {
+		return err
+	}
+
+	db.partitionCreateLock.Lock()
+	p.ExclusiveHold()
+
+	p.base = rewritten
+	p.sealed = p.sealed[len(folded):]
+
+	p.activeLock.Lock()
+	empty := p.active == nil && len(p.sealed) == 0
+	p.activeLock.Unlock()
+
+	if empty {
+		err = db.partitionList.Replace([]partition.Partition{p}, rewritten)
+		if err == nil {
+			p.retired = true
+		}
+	}
+
+	p.ExclusiveRelease()
+	db.partitionCreateLock.Unlock()
+
+	// The old file has been replaced, so only
+	// close the old mapping.
+	base.ExclusiveHold()
+	base.Close()
+	base.ExclusiveRelease()
+
+	for _, buffer := range folded {
+		buffer.Destroy()
+	}
+
+	return nil
+}
+
+// foldLatePartitions folds the buffers of every late partition
+// into its base partition.
+func (db *DB) foldLatePartitions() {
+	latePartitions := []*latePartition{}
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		if lp, isLate := p.(*latePartition); isLate {
+			latePartitions = append(latePartitions, lp)
+		}
+	}
+
+	for _, lp := range latePartitions {
+		lp.Hold()
+		_, isDisk := lp.base.(*disk.DiskPartition)
+		lp.Release()
+
+		// Folding waits for the base partition
+		// to be compacted.
+		if !isDisk || !db.compactionDue(CompactionFold, lp.Filename()) {
+			continue
+		}
+
+		start := db.clock()
+		err := db.fold(lp)
+		db.reportCompaction(CompactionFold, lp.Filename(), start, err)
+	}
+}
+
+// loadLatePartitions recovers the late buffers in the late directory
+// and overlays them on their sealed partitions. Buffers whose sealed
+// partition no longer exists are inserted as regular rows, unless the
+// DB is read only.
+func (db *DB) loadLatePartitions() error {
+	lateDir := filepath.Join(db.baseDir, lateDirName)
+
+	if !db.readOnly {
+		err := db.fs.MkdirAll(lateDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	names, err := db.fs.ReadDirNames(lateDir)
+	if err != nil && !(db.readOnly && os.IsNotExist(err)) {
+		return err
+	}
+
+	names = db.addListedWALs(lateDir, names)
+	sort.Strings(names)
+
+	latePartitions := map[int64]*latePartition{}
+	orphans := []*memory.MemoryPartition{}
+
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+
+		id, generation := int64(0), 0
+		_, err := fmt.Sscanf(name, "%d-%d.wal", &id, &generation)
+		if err != nil {
+			return err
+		}
+
+		buffer, err := db.recoverWAL(filepath.Join(lateDir, name))
+		if err != nil {
+			return err
+		}
+
+		buffer.SetReadOnly()
+
+		lp, present := latePartitions[id]
+		if !present {
+			base := db.partitionByID(id)
+			if base == nil {
+				orphans = append(orphans, buffer)
+				continue
+			}
+
+			lp, err = db.newLatePartition(base)
+			if err != nil {
+				return err
+			}
+
+			err = db.partitionList.Replace([]partition.Partition{base}, lp)
+			if err != nil {
+				return err
+			}
+
+			latePartitions[id] = lp
+		}
+
+		lp.sealed = append(lp.sealed, buffer)
+		if generation >= lp.nextGeneration {
+			lp.nextGeneration = generation + 1
+		}
+	}
+
+	if db.readOnly {
+		// Orphans can't be inserted, so they are read
+		// as partitions of their own.
+		for _, buffer := range orphans {
+			db.partitionList.Insert(buffer)
+		}
+
+		return nil
+	}
+
+	cutoff, hasRetention := db.retentionCutoff()
+
+	for _, buffer := range orphans {
+		bufferRows, err := partitionRows([]partition.Partition{buffer})
+		if err != nil {
+			return err
+		}
+
+		rows := []Row{}
+		for _, row := range bufferRows {
+			if hasRetention && row.Timestamp < cutoff {
+				continue
+			}
+
+			rows = append(rows, Row{
+				Source: row.Source,
+				Metric: row.Metric,
+				Point:  Point(row.Point),
+			})
+		}
+
+		err = db.InsertRows(rows)
+		if err != nil {
+			return err
+		}
+
+		err = buffer.Destroy()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// partitionByID returns the partition in the partition list with
+// the given ID, or nil if there isn't one.
+func (db *DB) partitionByID(id int64) partition.Partition {
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		if pID, err := partitionID(p.Filename()); err == nil && pID == id {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func memoryPartitions(buffers []*memory.MemoryPartition) []partition.Partition {
+	parts := []partition.Partition{}
+	for _, buffer := range buffers {
+		parts = append(parts, buffer)
+	}
+
+	return parts
+}
+
+// A mergeIterator merges the iterators of a late partition's base
+// and buffers. iters is ordered from the oldest to the most recently
+// inserted points, so where several iterators are positioned at the
+// same timestamp the last one's point is current.
+type mergeIterator struct {
+	iters []partition.Iterator
+
+	// ok[n] is set while iters[n] is positioned at a point
+	// that is current or hasn't been reached yet.
+	ok []bool
+
+	current partition.Point
+	started bool
+	release func()
+}
+
+func (i *mergeIterator) Point() partition.Point {
+	return i.current
+}
+
+func (i *mergeIterator) Reset() error {
+	for n, partIter := range i.iters {
+		err := i.moved(n, partIter.Reset())
+		if err != nil {
+			return err
+		}
+	}
+
+	return i.pick()
+}
+
+func (i *mergeIterator) Seek(timestamp int64) error {
+	for n, partIter := range i.iters {
+		err := i.moved(n, partIter.Seek(timestamp))
+		if err != nil {
+			return err
+		}
+	}
+
+	return i.pick()
+}
+
+func (i *mergeIterator) Next() error {
+	if !i.started {
+		return i.Reset()
+	}
+
+	// Move every iterator at the current
+	// timestamp past it.
+	for n, partIter := range i.iters {
+		if i.ok[n] && partIter.Point().Timestamp == i.current.Timestamp {
+			err := i.moved(n, partIter.Next())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return i.pick()
+}
+
+// moved records whether iters[n] is positioned at a point after
+// being moved with the error err. The end of its points isn't an
+// error for the mergeIterator, so it returns nil for that.
+func (i *mergeIterator) moved(n int, err error) error {
+	i.ok[n] = err == nil
+	if err == partition.ErrNoMorePoints {
+		return nil
+	}
+
+	return err
+}
+
+// pick makes the earliest point of the positioned iterators current.
+func (i *mergeIterator) pick() error {
+	found := false
+	for n, partIter := range i.iters {
+		if !i.ok[n] {
+			continue
+		}
+
+		point := partIter.Point()
+		if !found || point.Timestamp <= i.current.Timestamp {
+			i.current = point
+			found = true
+		}
+	}
+
+	if !found {
+		return partition.ErrNoMorePoints
+	}
+
+	i.started = true
+	return nil
+}
+
+func (i *mergeIterator) Close() {
+	for _, partIter := range i.iters {
+		partIter.Close()
+	}
+
+	i.iters = nil
+
+	if i.release != nil {
+		i.release()
+		i.release = nil
+	}
+}
+
+// latePartition is a Partition and mergeIterator is an Iterator.
+var _ partition.Partition = &latePartition{}
+var _ partition.Iterator = &mergeIterator{}
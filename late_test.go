@@ -0,0 +1,183 @@
+package catena
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/memory"
+)
+
+func TestLateRows(t *testing.T) {
+	os.RemoveAll("/tmp/catena_late_test")
+
+	db, err := NewDB("/tmp/catena_late_test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertRow := func(ts int64, value float64) {
+		err := db.InsertRows([]Row{
+			Row{
+				Source: "a",
+				Metric: "b",
+				Point: Point{
+					Timestamp: ts,
+					Value:     value,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkPoints := func(expected map[int64]float64) {
+		points, _, err := db.Range("a", "b", 0, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != len(expected) {
+			t.Fatalf("expected %d points, got %d", len(expected), len(points))
+		}
+
+		for i, point := range points {
+			if i > 0 && points[i-1].Timestamp >= point.Timestamp {
+				t.Fatalf("points out of order at index %d", i)
+			}
+
+			if value, present := expected[point.Timestamp]; !present || value != point.Value {
+				t.Fatalf("unexpected point %v", point)
+			}
+		}
+	}
+
+	expected := map[int64]float64{}
+	for ts := int64(100); ts < 150; ts++ {
+		insertRow(ts, 1)
+		expected[ts] = 1
+	}
+
+	// Compact everything except for the two newest partitions.
+	db.compact()
+
+	// Overwrite a point in a compacted partition, and
+	// add one that is older than everything else.
+	insertRow(105, 2)
+	expected[105] = 2
+	insertRow(50, 1)
+	expected[50] = 1
+
+	checkPoints(expected)
+
+	// Fold the late rows into the compacted partition.
+	db.compact()
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		if _, isLate := p.(*latePartition); isLate {
+			t.Fatal("expected late rows to be folded")
+		}
+	}
+
+	checkPoints(expected)
+
+	// Late rows are recovered from their WAL.
+	insertRow(115, 3)
+	expected[115] = 3
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB("/tmp/catena_late_test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkPoints(expected)
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLateIterator(t *testing.T) {
+	newBuffer := func(timestamps []int64, value float64) *memory.MemoryPartition {
+		p := memory.NewMemoryPartition(nil)
+		for _, ts := range timestamps {
+			err := p.InsertRows([]partition.Row{{
+				Source: "a",
+				Metric: "b",
+				Point:  partition.Point{Timestamp: ts, Value: value},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return p
+	}
+
+	p := &latePartition{
+		base:   newBuffer([]int64{10, 20, 30, 40}, 1),
+		sealed: []*memory.MemoryPartition{newBuffer([]int64{5, 20, 35}, 2)},
+		active: newBuffer([]int64{20, 45}, 3),
+	}
+
+	i, err := p.NewIterator("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	// Where timestamps collide, the newest buffer wins.
+	expected := []partition.Point{
+		{Timestamp: 5, Value: 2},
+		{Timestamp: 10, Value: 1},
+		{Timestamp: 20, Value: 3},
+		{Timestamp: 30, Value: 1},
+		{Timestamp: 35, Value: 2},
+		{Timestamp: 40, Value: 1},
+		{Timestamp: 45, Value: 3},
+	}
+
+	points := []partition.Point{}
+	for i.Next() == nil {
+		points = append(points, i.Point())
+	}
+
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+
+	err = i.Seek(21)
+	if err != nil || i.Point() != expected[3] {
+		t.Errorf("expected %v after seeking, got %v (%v)", expected[3], i.Point(), err)
+	}
+
+	err = i.Next()
+	if err != nil || i.Point() != expected[4] {
+		t.Errorf("expected %v, got %v (%v)", expected[4], i.Point(), err)
+	}
+
+	err = i.Seek(46)
+	if err == nil {
+		t.Errorf("expected an error seeking past the last point, got %v", i.Point())
+	}
+
+	err = i.Reset()
+	if err != nil || i.Point() != expected[0] {
+		t.Errorf("expected %v after resetting, got %v (%v)", expected[0], i.Point(), err)
+	}
+
+	_, err = p.NewIterator("a", "c")
+	if err == nil {
+		t.Error("expected an error for a missing metric")
+	}
+}
@@ -0,0 +1,261 @@
+package catena
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/disk"
+	"github.com/Cistern/catena/vfs"
+)
+
+// WithMergeSize makes the compactor merge adjacent disk partitions
+// into larger partitions that each cover a window of size timestamp
+// units. Merging keeps the number of files, and the number of
+// partitions an Iterator has to walk, low when partitionSize is small.
+// size should be a multiple of partitionSize.
+func WithMergeSize(size int) Option {
+	return func(db *DB) {
+		db.mergeSize = int64(size)
+	}
+}
+
+// mergePartitions merges runs of disk partitions that belong to the
+// same merge window. Only windows that are followed by newer data are
+// merged, so each window is usually rewritten once.
+func (db *DB) mergePartitions() {
+	if db.mergeSize <= 0 {
+		return
+	}
+
+	groups := [][]partition.Partition{}
+	group := []partition.Partition{}
+	groupKey := int64(0)
+	groupMergeable := true
+
+	closeGroup := func() {
+		if len(group) > 1 && groupMergeable {
+			groups = append(groups, group)
+		}
+	}
+
+	i := db.partitionList.NewIterator()
+	first := true
+	for i.Next() {
+		p, _ := i.Value()
+		key := p.MinTimestamp() / db.mergeSize
+
+		if first || key != groupKey {
+			// The newest window is still being filled.
+			if !first {
+				closeGroup()
+			}
+
+			group = []partition.Partition{}
+			groupKey = key
+			groupMergeable = !first
+			first = false
+		}
+
+		if _, isDisk := p.(*disk.DiskPartition); !isDisk {
+			groupMergeable = false
+		}
+
+		group = append(group, p)
+	}
+
+	closeGroup()
+
+	for _, group := range groups {
+		filename := group[len(group)-1].Filename()
+		if !db.compactionDue(CompactionMerge, filename) {
+			continue
+		}
+
+		start := db.clock()
+		err := db.merge(group)
+		db.reportCompaction(CompactionMerge, filename, start, err)
+	}
+}
+
+// A mergeIntent records a merge before its output is written, in a
+// file named "merge-<id>.json" after the output's partition ID. If
+// the DB stops before the merge is finished, the intent tells which
+// files to remove when it is next opened: the inputs if the output
+// was renamed into place, and nothing otherwise.
+type mergeIntent struct {
+	Output string   `json:"output"`
+	Inputs []string `json:"inputs"`
+}
+
+// mergeIntentFilename returns the name of the intent
+// file of the merge whose output has partition ID id.
+func mergeIntentFilename(id int64) string {
+	return fmt.Sprintf("merge-%d.json", id)
+}
+
+// merge merges group, a run of consecutive disk partitions ordered
+// newest first, into a single disk partition with a new partition ID.
+// The inputs are only removed once the merged file is durable.
+func (db *DB) merge(group []partition.Partition) error {
+	for _, p := range group {
+		p.Hold()
+	}
+
+	rows, err := partitionRows(group)
+
+	for _, p := range group {
+		p.Release()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Reserve a partition ID.
+	db.partitionCreateLock.Lock()
+	id := atomic.AddInt64(&db.lastPartitionID, 1)
+	db.partitionCreateLock.Unlock()
+
+	filename := filepath.Join(db.baseDir, fmt.Sprintf("%d.part", id))
+
+	intent := mergeIntent{
+		Output: filepath.Base(filename),
+		Inputs: []string{},
+	}
+
+	for _, p := range group {
+		intent.Inputs = append(intent.Inputs, filepath.Base(p.Filename()))
+	}
+
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+
+	intentFilename := filepath.Join(db.baseDir, mergeIntentFilename(id))
+
+	err = writeFileFS(db.fs, intentFilename, data)
+	if err != nil {
+		return err
+	}
+
+	merged, err := writeDiskPartition(db.fs, filename, rows)
+	if err != nil {
+		db.fs.Remove(intentFilename)
+		return err
+	}
+
+	db.partitionCreateLock.Lock()
+	err = db.partitionList.Replace(group, merged)
+	db.partitionCreateLock.Unlock()
+	if err != nil {
+		// Nothing refers to the merged partition yet.
+		merged.Destroy()
+		db.fs.Remove(intentFilename)
+		return err
+	}
+
+	for _, p := range group {
+		p.ExclusiveHold()
+		err = p.Destroy()
+		p.ExclusiveRelease()
+		if err != nil {
+			// The intent is kept, so the remaining inputs
+			// are removed when the DB is next opened.
+			return err
+		}
+	}
+
+	return db.fs.Remove(intentFilename)
+}
+
+// recoverMerges finishes or abandons the merges that were interrupted
+// when the DB stopped, according to their intent files among names,
+// the contents of the DB directory. It returns names without the files
+// that were removed, or that a read only DB ignores.
+func (db *DB) recoverMerges(names []string) ([]string, error) {
+	ignored := map[string]bool{}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, "merge-") {
+			continue
+		}
+
+		if strings.HasSuffix(name, ".json.tmp") {
+			// The merge hadn't started.
+			ignored[name] = true
+			if !db.readOnly {
+				err := db.fs.Remove(filepath.Join(db.baseDir, name))
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		intentFilename := filepath.Join(db.baseDir, name)
+		ignored[name] = true
+
+		data, err := vfs.ReadFile(db.fs, intentFilename)
+		if err != nil {
+			return nil, err
+		}
+
+		intent := mergeIntent{}
+		err = json.Unmarshal(data, &intent)
+		if err != nil {
+			return nil, fmt.Errorf("catena: invalid merge intent %s: %v", name, err)
+		}
+
+		// The output is only renamed into place once it is
+		// complete, so the inputs are only needed without it.
+		_, err = db.fs.Stat(filepath.Join(db.baseDir, intent.Output))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			for _, input := range intent.Inputs {
+				ignored[input] = true
+				if db.readOnly {
+					continue
+				}
+
+				err = db.fs.Remove(filepath.Join(db.baseDir, input))
+				if err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+		}
+
+		if !db.readOnly {
+			err = db.fs.Remove(intentFilename)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(ignored) == 0 {
+		return names, nil
+	}
+
+	if !db.readOnly {
+		err := db.fs.SyncDir(db.baseDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return namesWithout(names, ignored), nil
+}
@@ -0,0 +1,80 @@
+package catena
+
+import (
+	"time"
+
+	"github.com/Cistern/catena/vfs"
+	"github.com/Cistern/catena/wal"
+)
+
+// An Option configures a DB. Options are passed to NewDB and OpenDB.
+type Option func(*DB)
+
+// WithRetention sets the duration for which points are kept.
+// Partitions whose newest point is older than the retention
+// period are dropped by the compactor, and rows older than the
+// retention period are rejected by InsertRows. A retention of
+// zero keeps everything, subject to the partition limit.
+func WithRetention(retention time.Duration) Option {
+	return func(db *DB) {
+		db.retention = retention
+	}
+}
+
+// WithClock sets the function used to read the current time.
+// It defaults to time.Now and is mostly useful for tests.
+func WithClock(clock func() time.Time) Option {
+	return func(db *DB) {
+		db.clock = clock
+	}
+}
+
+// WithTimestampUnit sets the unit of the timestamps stored in
+// the DB. It is used to convert wall-clock time and durations
+// to timestamps. The default is time.Second.
+func WithTimestampUnit(unit time.Duration) Option {
+	return func(db *DB) {
+		db.timestampUnit = unit
+	}
+}
+
+// WithReadOnly opens a DB for reading only, so that it is safe to
+// open a directory that another process is writing to. No compactor
+// runs, no files are created, removed or truncated, WAL entries that
+// are only partially written are ignored, and InsertRows returns
+// ErrReadOnly. NewDB can't create a read only DB.
+func WithReadOnly() Option {
+	return func(db *DB) {
+		db.readOnly = true
+	}
+}
+
+// WithFS sets the file system that the DB stores its files in. The
+// default is vfs.OS. Unless a WAL factory is set with WithWALFactory,
+// the WALs are files of fs as well, and so are snapshots and the
+// WAL archive. Use RestoreFS, CheckFS and RepairFS for a DB in fs.
+func WithFS(fs vfs.FS) Option {
+	return func(db *DB) {
+		db.fs = fs
+	}
+}
+
+// WithWALFactory sets the factory that creates and opens the WALs of
+// the DB's memory partitions. The default is a wal.FileFactory, which
+// logs to files in the DB directory. Disk partitions are written to
+// the DB directory regardless. WALs are found by listing the DB
+// directory when it is opened, so OpenDB only recovers WALs that are
+// stored there, or that factory lists if it is a wal.Lister.
+// WithWALArchive and Snapshot need file WALs.
+func WithWALFactory(factory wal.Factory) Option {
+	return func(db *DB) {
+		db.walFactory = factory
+	}
+}
+
+// WithoutWAL makes the DB discard its WAL entries, for ephemeral
+// caches and benchmarks. Rows that haven't been compacted to disk
+// partitions are lost when the DB is closed.
+func WithoutWAL() Option {
+	return WithWALFactory(wal.NopFactory{})
+}
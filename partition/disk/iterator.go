@@ -75,7 +75,10 @@ func (i *diskIterator) Reset() error {
 // Seek moves the iterator to the first timestamp greater
 // than or equal to the given timestamp.
 func (i *diskIterator) Seek(timestamp int64) error {
-	i.Reset()
+	err := i.Reset()
+	if err != nil {
+		return err
+	}
 
 	for {
 		firstTSInExtent := i.currentExtent.startTS
@@ -104,8 +107,6 @@ func (i *diskIterator) Seek(timestamp int64) error {
 			}
 		}
 	}
-
-	return errors.New("partition/disk: could not seek to requested timestamp")
 }
 
 // Next moves the iterator to the next point.
@@ -130,7 +131,7 @@ func (i *diskIterator) nextExtent() error {
 	var err error
 
 	if i.currentExtentIndex == len(i.metric.extents)-1 {
-		return errors.New("partition/disk: no more extents")
+		return partition.ErrNoMorePoints
 	}
 
 	i.currentExtentIndex++
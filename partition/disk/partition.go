@@ -4,11 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"os"
 	"sync"
-	"syscall"
 
 	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/vfs"
 )
 
 const Magic = uint32(0xcafec0de)
@@ -21,7 +20,8 @@ type DiskPartition struct {
 	maxTS int64
 
 	// File on disk
-	f        *os.File
+	fs       vfs.FS
+	f        vfs.File
 	filename string
 
 	// Memory mapped backed by f
@@ -47,28 +47,27 @@ type diskMetric struct {
 	extents []diskExtent
 }
 
+// OpenDiskPartition opens the disk partition stored at filename.
 func OpenDiskPartition(filename string) (*DiskPartition, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
+	return OpenDiskPartitionFS(vfs.OS, filename)
+}
 
-	// Run Stat to get the file size.
-	fInfo, err := f.Stat()
+// OpenDiskPartitionFS is like OpenDiskPartition,
+// but opens the file in fs.
+func OpenDiskPartitionFS(fs vfs.FS, filename string) (*DiskPartition, error) {
+	f, err := vfs.Open(fs, filename)
 	if err != nil {
-		f.Close()
 		return nil, err
 	}
 
-	mapped, err := syscall.Mmap(int(f.Fd()), 0, int(fInfo.Size()),
-		// Set read only protection and shared mapping flag.
-		syscall.PROT_READ, syscall.MAP_SHARED)
+	mapped, err := vfs.Map(f)
 	if err != nil {
 		f.Close()
 		return nil, err
 	}
 
 	p := &DiskPartition{
+		fs:       fs,
 		f:        f,
 		filename: filename,
 		mapped:   mapped,
@@ -81,7 +80,7 @@ func OpenDiskPartition(filename string) (*DiskPartition, error) {
 		// Failed to read partition metadata, so
 		// we need to clean up. There's nothing
 		// else we can do.
-		munmapErr := syscall.Munmap(mapped)
+		munmapErr := vfs.Unmap(f, mapped)
 		if munmapErr != nil {
 			// What do we do?
 		} else {
@@ -335,7 +334,7 @@ func (p *DiskPartition) ExclusiveRelease() {
 }
 
 func (p *DiskPartition) Close() error {
-	err := syscall.Munmap(p.mapped)
+	err := vfs.Unmap(p.f, p.mapped)
 	if err != nil {
 		return err
 	}
@@ -350,5 +349,5 @@ func (p *DiskPartition) Destroy() error {
 		return err
 	}
 
-	return os.Remove(p.filename)
+	return p.fs.Remove(p.filename)
 }
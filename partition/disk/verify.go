@@ -0,0 +1,146 @@
+package disk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/Cistern/catena/partition"
+)
+
+// Verify inflates every extent of the partition and checks it
+// against the metadata: each extent must hold exactly its number
+// of points, start at its start timestamp, and every series must be
+// in strictly increasing timestamp order within the partition's
+// minimum and maximum timestamps. It returns the number of points
+// read and an error for each series that is inconsistent.
+func (p *DiskPartition) Verify() (int, []error) {
+	points := 0
+	errs := []error{}
+
+	sources := []string{}
+	for name := range p.sources {
+		sources = append(sources, name)
+	}
+
+	sort.Strings(sources)
+
+	for _, sourceName := range sources {
+		source := p.sources[sourceName]
+
+		metrics := []string{}
+		for name := range source.metrics {
+			metrics = append(metrics, name)
+		}
+
+		sort.Strings(metrics)
+
+		for _, metricName := range metrics {
+			n, err := p.verifyMetric(source.metrics[metricName])
+			points += n
+			if err != nil {
+				errs = append(errs, fmt.Errorf("partition/disk: %s/%s: %v", sourceName, metricName, err))
+			}
+		}
+	}
+
+	return points, errs
+}
+
+// verifyMetric checks the extents of m and returns the number of
+// points read before the first inconsistency.
+func (p *DiskPartition) verifyMetric(m diskMetric) (int, error) {
+	if len(m.extents) == 0 {
+		return 0, errors.New("no extents")
+	}
+
+	total := uint32(0)
+	for _, e := range m.extents {
+		total += e.numPoints
+	}
+
+	if total != m.numPoints {
+		return 0, fmt.Errorf("extents hold %d points, expected %d", total, m.numPoints)
+	}
+
+	read := 0
+	prev := partition.Point{}
+
+	for i, e := range m.extents {
+		points, err := p.verifyExtent(e)
+		if err != nil {
+			return read, fmt.Errorf("extent %d: %v", i, err)
+		}
+
+		if points[0].Timestamp != e.startTS {
+			return read, fmt.Errorf("extent %d: starts at %d, expected %d", i, points[0].Timestamp, e.startTS)
+		}
+
+		for _, point := range points {
+			if read > 0 && point.Timestamp <= prev.Timestamp {
+				return read, fmt.Errorf("extent %d: timestamp %d follows %d", i, point.Timestamp, prev.Timestamp)
+			}
+
+			if point.Timestamp < p.minTS || point.Timestamp > p.maxTS {
+				return read, fmt.Errorf("extent %d: timestamp %d outside of partition range [%d, %d]",
+					i, point.Timestamp, p.minTS, p.maxTS)
+			}
+
+			prev = point
+			read++
+		}
+	}
+
+	return read, nil
+}
+
+// verifyExtent inflates e and checks that it holds exactly
+// e.numPoints points.
+func (p *DiskPartition) verifyExtent(e diskExtent) ([]partition.Point, error) {
+	if e.numPoints == 0 {
+		return nil, errors.New("no points")
+	}
+
+	if e.offset < 0 || e.offset >= int64(len(p.mapped)) {
+		return nil, fmt.Errorf("offset %d outside of file", e.offset)
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(p.mapped[e.offset:]))
+	if err != nil {
+		return nil, err
+	}
+
+	defer gzipReader.Close()
+
+	// Each extent is a gzip stream of its own.
+	gzipReader.Multistream(false)
+
+	points := []partition.Point{}
+	for i := uint32(0); i < e.numPoints; i++ {
+		point := partition.Point{}
+
+		err = binary.Read(gzipReader, binary.LittleEndian, &point)
+		if err != nil {
+			return nil, fmt.Errorf("read %d of %d points: %v", i, e.numPoints, err)
+		}
+
+		points = append(points, point)
+	}
+
+	// Reaching the end of the stream also checks its checksum.
+	n, err := io.Copy(ioutil.Discard, gzipReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 0 {
+		return nil, fmt.Errorf("%d bytes after %d points", n, e.numPoints)
+	}
+
+	return points, nil
+}
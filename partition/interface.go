@@ -1,5 +1,12 @@
 package partition
 
+import "errors"
+
+// ErrNoMorePoints is returned by an Iterator's Next and Seek
+// methods once there are no more points. Any other error
+// means the points couldn't be read.
+var ErrNoMorePoints = errors.New("partition: no more points")
+
 type Partition interface {
 	// Insertion
 	InsertRows([]Row) error
@@ -93,6 +93,12 @@ func (m *memoryMetric) insertAfter(point partition.Point, after int) int {
 	for i = after; i < lenPoints && m.points[i].Timestamp < point.Timestamp; i++ {
 	}
 
+	if i < lenPoints && m.points[i].Timestamp == point.Timestamp {
+		// The last point written for a timestamp wins.
+		m.points[i] = point
+		return i
+	}
+
 	// Resize
 	m.points = append(m.points, point)
 
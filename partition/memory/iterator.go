@@ -72,7 +72,7 @@ func (i *memoryIterator) Seek(timestamp int64) error {
 
 	i.currentPoint = i.metric.points[i.currentIndex]
 	if i.currentPoint.Timestamp < timestamp {
-		return errors.New("partition/memory: could not seek to requested timestamp")
+		return partition.ErrNoMorePoints
 	}
 
 	return nil
@@ -97,7 +97,7 @@ func (i *memoryIterator) Next() error {
 	}
 
 	if i.currentIndex == len(i.metric.points)-1 {
-		return errors.New("partition/memory: iterator index out of bounds")
+		return partition.ErrNoMorePoints
 	}
 
 	i.currentIndex++
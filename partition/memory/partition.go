@@ -42,6 +42,7 @@ type memoryMetric struct {
 }
 
 // NewMemoryPartition creates a new MemoryPartition backed by WAL.
+// WAL may be nil, in which case inserts are not logged.
 func NewMemoryPartition(WAL wal.WAL) *MemoryPartition {
 	p := MemoryPartition{
 		readOnly: false,
@@ -83,6 +84,23 @@ func RecoverMemoryPartition(WAL wal.WAL) (*MemoryPartition, error) {
 	return p, err
 }
 
+// RecoverReadOnlyMemoryPartition recovers a read-only MemoryPartition
+// from WAL without modifying it. Recovery stops at the first entry
+// that can't be read, such as one that is still being written at the
+// end of a live WAL.
+func RecoverReadOnlyMemoryPartition(WAL wal.WAL) *MemoryPartition {
+	p := NewMemoryPartition(nil)
+
+	for entry, err := WAL.ReadEntry(); err == nil; entry, err = WAL.ReadEntry() {
+		p.InsertRows(entry.Rows)
+	}
+
+	p.wal = WAL
+	p.readOnly = true
+
+	return p
+}
+
 // InsertRows inserts rows into the partition.
 func (p *MemoryPartition) InsertRows(rows []partition.Row) error {
 	if p.readOnly {
@@ -148,9 +166,11 @@ func (m *MemoryPartition) SetReadOnly() {
 // and closes its WAL.
 func (m *MemoryPartition) Close() error {
 	// Close WAL
-	err := m.wal.Close()
-	if err != nil {
-		return err
+	if m.wal != nil {
+		err := m.wal.Close()
+		if err != nil {
+			return err
+		}
 	}
 
 	m.readOnly = true
@@ -173,6 +193,10 @@ func (p *MemoryPartition) ReadOnly() bool {
 }
 
 func (p *MemoryPartition) Filename() string {
+	if p.wal == nil {
+		return ""
+	}
+
 	return p.wal.Filename()
 }
 
@@ -233,10 +257,12 @@ func (p *MemoryPartition) ExclusiveRelease() {
 
 // Destroy destroys the memory partition as well as its WAL.
 func (m *MemoryPartition) Destroy() error {
-	// Destroy WAL
-	err := m.wal.Destroy()
-
 	m.readOnly = true
 
-	return err
+	// Destroy WAL
+	if m.wal == nil {
+		return nil
+	}
+
+	return m.wal.Destroy()
 }
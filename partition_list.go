@@ -143,6 +143,53 @@ NEXT:
 	goto NEXT
 }
 
+// Replace atomically replaces old, which must be a run of consecutive
+// partitions in the list, with new. Iterators either see all of old
+// or new, never a mix.
+func (l *partitionList) Replace(old []partition.Partition, new partition.Partition) error {
+	if len(old) == 0 {
+		return errors.New("catena/partition_list: nothing to replace")
+	}
+
+	n := &partitionListNode{
+		val:  new,
+		next: nil,
+	}
+
+RETRY:
+	prevPtr := &l.head
+	currentPtr := atomic.LoadPointer(prevPtr)
+
+	for currentPtr != nil && (*partitionListNode)(currentPtr).val != old[0] {
+		prevPtr = &(*partitionListNode)(currentPtr).next
+		currentPtr = atomic.LoadPointer(prevPtr)
+	}
+
+	if currentPtr == nil {
+		return errors.New("catena/partition_list: partition not found")
+	}
+
+	// Make sure the rest of old follows.
+	lastNode := (*partitionListNode)(currentPtr)
+	for _, v := range old[1:] {
+		nextPtr := atomic.LoadPointer(&lastNode.next)
+		if nextPtr == nil || (*partitionListNode)(nextPtr).val != v {
+			return errors.New("catena/partition_list: partitions are not consecutive")
+		}
+
+		lastNode = (*partitionListNode)(nextPtr)
+	}
+
+	n.next = atomic.LoadPointer(&lastNode.next)
+
+	if !atomic.CompareAndSwapPointer(prevPtr, currentPtr, unsafe.Pointer(n)) {
+		goto RETRY
+	}
+
+	atomic.AddInt32(&l.size, int32(1-len(old)))
+	return nil
+}
+
 // Remove removes v from the list. An error is returned if v is not present.
 func (l *partitionList) Remove(v partition.Partition) error {
 HEAD:
@@ -0,0 +1,110 @@
+package catena
+
+import (
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/vfs"
+)
+
+// PartitionInfo describes a partition of a DB.
+type PartitionInfo struct {
+	// Filename is the partition's file: a .wal file for partitions
+	// that are still in memory and a .part file for compacted ones.
+	Filename string
+
+	MinTimestamp int64
+	MaxTimestamp int64
+
+	// Size is the size of the partition's files in bytes,
+	// including the WALs of its late rows.
+	Size int64
+
+	// Series is the number of source and metric pairs.
+	Series int
+
+	// LateBuffers is the number of WALs of rows that arrived
+	// after the partition was compacted.
+	LateBuffers int
+
+	// Resolution is the resolution of a rollup partition,
+	// or 0 for a partition of raw points.
+	Resolution int64
+}
+
+// Partitions describes the DB's partitions: raw partitions from
+// newest to oldest, followed by the partitions of each rollup tier
+// from finest to coarsest.
+func (db *DB) Partitions() []PartitionInfo {
+	infos := []PartitionInfo{}
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+
+		p.Hold()
+		info := db.partitionInfo(p)
+
+		if lp, ok := p.(*latePartition); ok {
+			for _, buffer := range lp.buffers() {
+				info.Size += fileSize(db.fs, buffer.Filename())
+				info.LateBuffers++
+			}
+		}
+
+		p.Release()
+
+		infos = append(infos, info)
+	}
+
+	for _, tier := range db.rollupTiers {
+		tier.lock.RLock()
+		for _, p := range tier.partitions {
+			p.Hold()
+			info := db.partitionInfo(p)
+
+			// Every raw series is stored as several rollup series.
+			info.Series = 0
+			for _, source := range p.Sources() {
+				for _, name := range p.Metrics(source) {
+					if _, ok := rollupMetricName(name); ok {
+						info.Series++
+					}
+				}
+			}
+
+			p.Release()
+
+			info.Resolution = tier.resolution
+			infos = append(infos, info)
+		}
+		tier.lock.RUnlock()
+	}
+
+	return infos
+}
+
+// partitionInfo describes p, which must be held.
+func (db *DB) partitionInfo(p partition.Partition) PartitionInfo {
+	info := PartitionInfo{
+		Filename:     p.Filename(),
+		MinTimestamp: p.MinTimestamp(),
+		MaxTimestamp: p.MaxTimestamp(),
+		Size:         fileSize(db.fs, p.Filename()),
+	}
+
+	for _, source := range p.Sources() {
+		info.Series += len(p.Metrics(source))
+	}
+
+	return info
+}
+
+// fileSize returns the size of the named file of fs,
+// or 0 if it can't be read.
+func fileSize(fs vfs.FS, filename string) int64 {
+	fi, err := fs.Stat(filename)
+	if err != nil {
+		return 0
+	}
+
+	return fi.Size()
+}
@@ -0,0 +1,145 @@
+// Package graphite implements ingestion of the Graphite plaintext
+// protocol, where each line is "path value timestamp" with the
+// timestamp in seconds.
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// A Splitter maps a dotted Graphite path to a source and metric.
+type Splitter func(path string) (source, metric string, err error)
+
+// SplitAt returns a Splitter that uses the first n components of a
+// path as the source and the rest as the metric, so that SplitAt(2)
+// maps servers.web01.cpu.idle to source servers.web01 and metric
+// cpu.idle. If n is negative, the last -n components are the metric
+// and the rest are the source. Paths with too few components are
+// rejected.
+func SplitAt(n int) Splitter {
+	return func(path string) (string, string, error) {
+		components := strings.Split(path, ".")
+		for _, component := range components {
+			if component == "" {
+				return "", "", fmt.Errorf("graphite: empty component in path %q", path)
+			}
+		}
+
+		i := n
+		if n < 0 {
+			i = len(components) + n
+		}
+
+		if i <= 0 || i >= len(components) {
+			return "", "", fmt.Errorf("graphite: can't split path %q at %d", path, n)
+		}
+
+		return strings.Join(components[:i], "."), strings.Join(components[i:], "."), nil
+	}
+}
+
+// A Parser converts Graphite lines to rows.
+type Parser struct {
+	// Split maps paths to sources and metrics.
+	Split Splitter
+
+	// Unit is the unit of the rows' timestamps, which should
+	// be the DB's timestamp unit. It defaults to time.Second.
+	Unit time.Duration
+
+	// Now returns the timestamp, in Unit, used for lines with a
+	// timestamp of -1. It defaults to the current time.
+	Now func() int64
+}
+
+// ParseLine parses a single line. Empty lines yield no rows.
+func (p *Parser) ParseLine(line string) ([]catena.Row, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	if len(fields) != 3 {
+		return nil, errors.New("graphite: expected path, value and timestamp")
+	}
+
+	source, metric, err := p.Split(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("graphite: invalid value %q", fields[1])
+	}
+
+	timestamp, err := p.timestamp(fields[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return []catena.Row{
+		catena.Row{
+			Source: source,
+			Metric: metric,
+			Point: catena.Point{
+				Timestamp: timestamp,
+				Value:     value,
+			},
+		},
+	}, nil
+}
+
+// timestamp converts a timestamp in seconds, which may
+// have a fractional part, to p.Unit.
+func (p *Parser) timestamp(s string) (int64, error) {
+	unit := p.Unit
+	if unit == 0 {
+		unit = time.Second
+	}
+
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("graphite: invalid timestamp %q", s)
+	}
+
+	if seconds == -1 {
+		if p.Now != nil {
+			return p.Now(), nil
+		}
+
+		return time.Now().UnixNano() / int64(unit), nil
+	}
+
+	whole := math.Floor(seconds)
+	timestamp := protocol.ConvertTimestamp(int64(whole), time.Second, unit)
+
+	if unit < time.Second {
+		timestamp += int64((seconds - whole) * float64(time.Second/unit))
+	}
+
+	return timestamp, nil
+}
+
+// NewServer returns a LineServer that reads the plaintext protocol
+// over TCP, maps paths with split and writes rows to w.
+func NewServer(db *catena.DB, w *protocol.Writer, split Splitter) *protocol.LineServer {
+	p := &Parser{
+		Split: split,
+		Unit:  db.TimestampUnit(),
+		Now:   db.Now,
+	}
+
+	return &protocol.LineServer{
+		ParseLine: p.ParseLine,
+		Writer:    w,
+	}
+}
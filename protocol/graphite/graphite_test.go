@@ -0,0 +1,114 @@
+package graphite
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+func TestSplitAt(t *testing.T) {
+	source, metric, err := SplitAt(2)("servers.web01.cpu.idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source != "servers.web01" || metric != "cpu.idle" {
+		t.Errorf("unexpected source %q and metric %q", source, metric)
+	}
+
+	source, metric, err = SplitAt(-1)("servers.web01.cpu.idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source != "servers.web01.cpu" || metric != "idle" {
+		t.Errorf("unexpected source %q and metric %q", source, metric)
+	}
+
+	for _, path := range []string{"servers.web01", "servers..cpu"} {
+		_, _, err = SplitAt(2)(path)
+		if err == nil {
+			t.Errorf("expected an error for %q", path)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	os.RemoveAll("/tmp/catena_graphite_test")
+
+	clock := func() time.Time {
+		return time.Unix(1000, 0)
+	}
+
+	db, err := catena.NewDB("/tmp/catena_graphite_test", 100, 0,
+		catena.WithRetention(500*time.Second), catena.WithClock(clock),
+		catena.WithTimestampUnit(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(db, protocol.NewWriter(db, 1000, time.Hour), SplitAt(1))
+
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write([]byte(
+		"web01.load 1.5 600.25\r\n" +
+			"web01.load 2 -1\n" +
+			"web01.load 3\n" +
+			"web01 4 700\n" +
+			"web01.load 5 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the lines to be read, and close the
+	// server while the connection is still open.
+	for s.Stats().Lines < 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.Stats()
+	if stats.ParseErrors != 2 || stats.Written != 2 || stats.Rejected != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	points, _, err := db.Range("web01", "load", 0, 2000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 || points[0].Timestamp != 600250 || points[1].Timestamp != 1000000 {
+		t.Errorf("unexpected points %v", points)
+	}
+}
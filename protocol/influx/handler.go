@@ -0,0 +1,137 @@
+package influx
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// A Handler implements the InfluxDB write endpoint. It accepts line
+// protocol in POST request bodies, optionally gzipped, with the
+// timestamp precision in the precision parameter.
+//
+// Rows from well-formed lines are inserted even if other lines are
+// malformed, in which case the response is 400 Bad Request and lists
+// the malformed lines. Rows older than the retention period are
+// dropped, and the response is 422 Unprocessable Entity.
+type Handler struct {
+	db *catena.DB
+}
+
+// NewHandler returns a Handler that inserts into db.
+func NewHandler(db *catena.DB) *Handler {
+	return &Handler{db: db}
+}
+
+type writeResponse struct {
+	Error string `json:"error"`
+
+	// Lines lists the malformed lines.
+	Lines []lineError `json:"lines,omitempty"`
+
+	// Dropped is the number of rows dropped for being
+	// older than the retention period.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+type lineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		protocol.WriteJSON(w, http.StatusMethodNotAllowed, writeResponse{
+			Error: fmt.Sprintf("influx: method %s not allowed", r.Method),
+		})
+		return
+	}
+
+	precision, err := ParsePrecision(r.FormValue("precision"))
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, writeResponse{Error: err.Error()})
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			protocol.WriteJSON(w, http.StatusBadRequest, writeResponse{Error: err.Error()})
+			return
+		}
+
+		defer gz.Close()
+		body = gz
+	}
+
+	p := &Parser{
+		Precision: precision,
+		Unit:      h.db.TimestampUnit(),
+		Now:       h.db.Now,
+	}
+
+	rows, lineErrs, err := p.Parse(body)
+	if err != nil {
+		protocol.WriteJSON(w, http.StatusBadRequest, writeResponse{Error: err.Error()})
+		return
+	}
+
+	dropped, err := protocol.Insert(h.db, rows)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == catena.ErrReadOnly {
+			status = http.StatusConflict
+		}
+
+		protocol.WriteJSON(w, status, writeResponse{Error: err.Error()})
+		return
+	}
+
+	if len(lineErrs) > 0 {
+		resp := writeResponse{
+			Error:   fmt.Sprintf("partial write: %d malformed lines", len(lineErrs)),
+			Dropped: dropped,
+		}
+
+		for _, lineErr := range lineErrs {
+			resp.Lines = append(resp.Lines, lineError{
+				Line:  lineErr.Line,
+				Error: lineErr.Err.Error(),
+			})
+		}
+
+		protocol.WriteJSON(w, http.StatusBadRequest, resp)
+		return
+	}
+
+	if dropped > 0 {
+		protocol.WriteJSON(w, http.StatusUnprocessableEntity, writeResponse{
+			Error:   fmt.Sprintf("partial write: %d points older than the retention period dropped", dropped),
+			Dropped: dropped,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NewServer returns a LineServer that reads line protocol with
+// nanosecond timestamps over TCP and writes it to w.
+func NewServer(db *catena.DB, w *protocol.Writer) *protocol.LineServer {
+	p := &Parser{
+		Unit: db.TimestampUnit(),
+		Now:  db.Now,
+	}
+
+	return &protocol.LineServer{
+		ParseLine: p.ParseLine,
+		Writer:    w,
+	}
+}
@@ -0,0 +1,194 @@
+package influx
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+func TestParseLine(t *testing.T) {
+	p := &Parser{
+		Precision: time.Millisecond,
+		Unit:      time.Second,
+		Now: func() int64 {
+			return 42
+		},
+	}
+
+	rows, err := p.ParseLine(`cpu\ load,host=a\,b,region=us\ west idle=1.5,user=2i,busy=t,name="x y=z" 1500000`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+
+	if rows[0].Metric != "cpu load_idle" || rows[0].Value != 1.5 || rows[0].Timestamp != 1500 {
+		t.Errorf("unexpected row %+v", rows[0])
+	}
+
+	if rows[1].Metric != "cpu load_user" || rows[1].Value != 2 {
+		t.Errorf("unexpected row %+v", rows[1])
+	}
+
+	labels, err := catena.ParseLabels(rows[0].Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(labels) != 2 || labels[0] != (catena.Label{Name: "host", Value: "a,b"}) ||
+		labels[1] != (catena.Label{Name: "region", Value: "us west"}) {
+		t.Errorf("unexpected labels %v", labels)
+	}
+
+	rows, err = p.ParseLine("mem free=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || rows[0].Source != "" || rows[0].Timestamp != 42 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+
+	for _, line := range []string{
+		"mem",
+		"mem free",
+		"mem free=abc",
+		"mem free=1 abc",
+		`mem name="abc`,
+		",host=a free=1",
+	} {
+		_, err = p.ParseLine(line)
+		if err == nil {
+			t.Errorf("expected an error for %q", line)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	os.RemoveAll("/tmp/catena_influx_test")
+
+	clock := func() time.Time {
+		return time.Unix(1000, 0)
+	}
+
+	db, err := catena.NewDB("/tmp/catena_influx_test", 100, 0,
+		catena.WithRetention(500*time.Second), catena.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s := httptest.NewServer(NewHandler(db))
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/write?precision=s", "text/plain", strings.NewReader(
+		"cpu,host=a idle=1 600\n"+
+			"cpu,host=a idle=\n"+
+			"cpu,host=a idle=2 610\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp, err = http.Post(s.URL+"/write?precision=s", "text/plain", strings.NewReader(
+		"cpu,host=a idle=3 400\n"+
+			"cpu,host=a idle=4 620\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+
+	points, _, err := db.Range("host=a", "cpu_idle", 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 3 || points[0].Value != 1 || points[1].Value != 2 || points[2].Value != 4 {
+		t.Errorf("unexpected points %v", points)
+	}
+}
+
+func TestServer(t *testing.T) {
+	os.RemoveAll("/tmp/catena_influx_server_test")
+
+	db, err := catena.NewDB("/tmp/catena_influx_server_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(db, protocol.NewWriter(db, 1000, 0))
+
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write([]byte(
+		"disk used=1 1000000000000\n" +
+			"disk used 1000000000000\n" +
+			"disk used=2 1001000000000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	// Wait for the lines to be read before closing.
+	for s.Stats().Lines < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.Stats()
+	if stats.ParseErrors != 1 || stats.Written != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	points, _, err := db.Range("", "disk_used", 0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 || points[0].Timestamp != 1000 || points[1].Timestamp != 1001 {
+		t.Errorf("unexpected points %v", points)
+	}
+}
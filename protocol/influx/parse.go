@@ -0,0 +1,312 @@
+// Package influx implements ingestion of the InfluxDB line protocol.
+//
+// Each numeric field of a line becomes a row. The row's metric is the
+// measurement and the field key joined by an underscore, e.g.
+// cpu_usage_idle, and its source is the line's tag set encoded with
+// catena.FormatLabels. String and boolean fields are ignored.
+package influx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// A Parser converts line protocol to rows. The zero value reads
+// nanosecond timestamps and writes timestamps in seconds.
+type Parser struct {
+	// Precision is the unit of the timestamps in the input.
+	// It defaults to time.Nanosecond.
+	Precision time.Duration
+
+	// Unit is the unit of the rows' timestamps, which should
+	// be the DB's timestamp unit. It defaults to time.Second.
+	Unit time.Duration
+
+	// Now returns the timestamp, in Unit, used for lines without
+	// a timestamp. It defaults to the current time.
+	Now func() int64
+}
+
+// ParsePrecision parses a precision as used by the InfluxDB write
+// API, such as "ns", "ms" or "s". The empty string is nanoseconds.
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+
+	return 0, fmt.Errorf("influx: unknown precision %q", s)
+}
+
+// Parse reads line protocol from r. It returns the rows of every
+// well-formed line, and a *protocol.LineError for each malformed
+// line. err is only set if reading from r fails.
+func (p *Parser) Parse(r io.Reader) (rows []catena.Row, lineErrs []*protocol.LineError, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), protocol.MaxLineLength)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		lineRows, err := p.ParseLine(strings.TrimSuffix(scanner.Text(), "\r"))
+		if err != nil {
+			lineErrs = append(lineErrs, &protocol.LineError{Line: lineNumber, Err: err})
+			continue
+		}
+
+		rows = append(rows, lineRows...)
+	}
+
+	return rows, lineErrs, scanner.Err()
+}
+
+// ParseLine parses a single line. Empty lines and
+// comments yield no rows.
+func (p *Parser) ParseLine(line string) ([]catena.Row, error) {
+	line = strings.TrimLeft(line, " \t")
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+
+	sections, err := splitSections(line)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sections) < 2 {
+		return nil, errors.New("influx: missing fields")
+	}
+
+	if len(sections) > 3 {
+		return nil, errors.New("influx: unexpected text after timestamp")
+	}
+
+	key := split(sections[0], ',', false)
+	measurement := unescape(key[0])
+	if measurement == "" {
+		return nil, errors.New("influx: missing measurement")
+	}
+
+	labels := []catena.Label{}
+	for _, tag := range key[1:] {
+		name, value, err := splitPair(tag)
+		if err != nil {
+			return nil, fmt.Errorf("influx: invalid tag %q: %v", tag, err)
+		}
+
+		labels = append(labels, catena.Label{Name: name, Value: value})
+	}
+
+	source := catena.FormatLabels(labels)
+
+	timestamp, err := p.timestamp(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []catena.Row{}
+	for _, field := range split(sections[1], ',', true) {
+		name, value, err := splitPair(field)
+		if err != nil {
+			return nil, fmt.Errorf("influx: invalid field %q: %v", field, err)
+		}
+
+		v, numeric, err := parseFieldValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("influx: invalid value for field %s: %v", name, err)
+		}
+
+		if !numeric {
+			continue
+		}
+
+		rows = append(rows, catena.Row{
+			Source: source,
+			Metric: measurement + "_" + name,
+			Point: catena.Point{
+				Timestamp: timestamp,
+				Value:     v,
+			},
+		})
+	}
+
+	return rows, nil
+}
+
+// timestamp returns the line's timestamp converted to p.Unit.
+func (p *Parser) timestamp(sections []string) (int64, error) {
+	unit := p.Unit
+	if unit == 0 {
+		unit = time.Second
+	}
+
+	if len(sections) < 3 {
+		if p.Now != nil {
+			return p.Now(), nil
+		}
+
+		return time.Now().UnixNano() / int64(unit), nil
+	}
+
+	ts, err := strconv.ParseInt(sections[2], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("influx: invalid timestamp %q", sections[2])
+	}
+
+	precision := p.Precision
+	if precision == 0 {
+		precision = time.Nanosecond
+	}
+
+	return protocol.ConvertTimestamp(ts, precision, unit), nil
+}
+
+// parseFieldValue parses a field value. numeric is false for
+// strings and booleans.
+func parseFieldValue(s string) (v float64, numeric bool, err error) {
+	if s == "" {
+		return 0, false, errors.New("empty value")
+	}
+
+	switch s {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return 0, false, nil
+	}
+
+	if s[0] == '"' {
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return 0, false, errors.New("unterminated string")
+		}
+
+		return 0, false, nil
+	}
+
+	switch s[len(s)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(n), true, err
+	case 'u':
+		n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(n), true, err
+	}
+
+	v, err = strconv.ParseFloat(s, 64)
+	return v, true, err
+}
+
+// splitSections splits a line into its key, fields and timestamp
+// at unescaped spaces outside of quoted strings.
+func splitSections(line string) ([]string, error) {
+	sections := []string{}
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case line[i] == '"' && len(sections) == 1:
+			quoted = !quoted
+		case line[i] == ' ' && !quoted:
+			if i > start {
+				sections = append(sections, line[start:i])
+			}
+
+			start = i + 1
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("influx: unterminated string")
+	}
+
+	if start < len(line) {
+		sections = append(sections, line[start:])
+	}
+
+	return sections, nil
+}
+
+// split splits s at unescaped occurrences of sep. If quotes is true,
+// separators in quoted strings are ignored.
+func split(s string, sep byte, quotes bool) []string {
+	parts := []string{}
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// splitPair splits a key=value pair and unescapes the key. The
+// value is only unescaped if it isn't a quoted string.
+func splitPair(s string) (key, value string, err error) {
+	parts := split(s, '=', true)
+	if len(parts) != 2 {
+		return "", "", errors.New("expected key=value")
+	}
+
+	key = unescape(parts[0])
+	if key == "" {
+		return "", "", errors.New("empty key")
+	}
+
+	value = parts[1]
+	if !strings.HasPrefix(value, `"`) {
+		value = unescape(value)
+	}
+
+	return key, value, nil
+}
+
+// unescape removes the backslashes that escape
+// commas, equals signs and spaces.
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', '=', ' ', '\\':
+				i++
+			}
+		}
+
+		buf = append(buf, s[i])
+	}
+
+	return string(buf)
+}
@@ -0,0 +1,159 @@
+package opentsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// A dataPoint is a data point as sent to /api/put. Value
+// is either a number or a string holding a number.
+type dataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// A Handler implements the OpenTSDB /api/put endpoint. It accepts
+// a single data point or an array of data points. Valid data points
+// are inserted even if others are invalid, in which case the response
+// is 400 Bad Request and lists the invalid data points, as OpenTSDB
+// does with the details parameter. Data points older than the
+// retention period are dropped, and the response is 422
+// Unprocessable Entity.
+type Handler struct {
+	db     *catena.DB
+	parser *Parser
+}
+
+// NewHandler returns a Handler that inserts into db.
+func NewHandler(db *catena.DB) *Handler {
+	return &Handler{
+		db: db,
+		parser: &Parser{
+			Unit: db.TimestampUnit(),
+		},
+	}
+}
+
+type putResponse struct {
+	Success int        `json:"success"`
+	Failed  int        `json:"failed"`
+	Errors  []putError `json:"errors"`
+}
+
+type putError struct {
+	DataPoint *dataPoint `json:"datapoint,omitempty"`
+	Error     string     `json:"error"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("opentsdb: method %s not allowed", r.Method))
+		return
+	}
+
+	body := json.RawMessage{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	dataPoints := []dataPoint{}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		err = json.Unmarshal(body, &dataPoints)
+	} else {
+		single := dataPoint{}
+		err = json.Unmarshal(body, &single)
+		dataPoints = append(dataPoints, single)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	resp := putResponse{Errors: []putError{}}
+	rows := []catena.Row{}
+
+	for i := range dataPoints {
+		row, err := h.parser.dataPointRow(dataPoints[i])
+		if err != nil {
+			resp.Failed++
+			resp.Errors = append(resp.Errors, putError{
+				DataPoint: &dataPoints[i],
+				Error:     err.Error(),
+			})
+			continue
+		}
+
+		rows = append(rows, row)
+	}
+
+	dropped, err := protocol.Insert(h.db, rows)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == catena.ErrReadOnly {
+			status = http.StatusConflict
+		}
+
+		writeError(w, status, err)
+		return
+	}
+
+	resp.Success = len(rows) - dropped
+	resp.Failed += dropped
+
+	switch {
+	case len(resp.Errors) > 0:
+		protocol.WriteJSON(w, http.StatusBadRequest, resp)
+	case dropped > 0:
+		resp.Errors = append(resp.Errors, putError{
+			Error: fmt.Sprintf("%d data points older than the retention period dropped", dropped),
+		})
+		protocol.WriteJSON(w, http.StatusUnprocessableEntity, resp)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// dataPointRow returns the row for a data point sent to /api/put.
+func (p *Parser) dataPointRow(dp dataPoint) (catena.Row, error) {
+	var value float64
+	switch v := dp.Value.(type) {
+	case float64:
+		value = v
+	case string:
+		var err error
+		value, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return catena.Row{}, fmt.Errorf("opentsdb: invalid value %q", v)
+		}
+	default:
+		return catena.Row{}, fmt.Errorf("opentsdb: invalid value %v", dp.Value)
+	}
+
+	labels := []catena.Label{}
+	for name, value := range dp.Tags {
+		labels = append(labels, catena.Label{Name: name, Value: value})
+	}
+
+	return p.row(dp.Metric, dp.Timestamp, value, labels)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	protocol.WriteJSON(w, status, putResponse{
+		Errors: []putError{
+			putError{Error: err.Error()},
+		},
+	})
+}
@@ -0,0 +1,132 @@
+// Package opentsdb implements OpenTSDB compatible ingestion, through
+// the telnet style put command and the HTTP /api/put endpoint.
+//
+// A data point's metric becomes the row's metric, and its tags are
+// encoded as the row's source with catena.FormatLabels. Timestamps
+// are seconds, or milliseconds if they have more than 10 digits,
+// as in OpenTSDB.
+package opentsdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// maxSeconds is the largest timestamp that is
+// interpreted as seconds rather than milliseconds.
+const maxSeconds = 9999999999
+
+// A Parser converts OpenTSDB data points to rows.
+type Parser struct {
+	// Unit is the unit of the rows' timestamps, which should
+	// be the DB's timestamp unit. It defaults to time.Second.
+	Unit time.Duration
+}
+
+// ParseLine parses a telnet style command. Only put commands yield
+// rows. version commands, which some agents send as keepalives,
+// and empty lines are ignored.
+func (p *Parser) ParseLine(line string) ([]catena.Row, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	switch fields[0] {
+	case "put":
+	case "version":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("opentsdb: unknown command %q", fields[0])
+	}
+
+	if len(fields) < 4 {
+		return nil, errors.New("opentsdb: expected put <metric> <timestamp> <value> [<tagk=tagv> ...]")
+	}
+
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("opentsdb: invalid timestamp %q", fields[2])
+	}
+
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return nil, fmt.Errorf("opentsdb: invalid value %q", fields[3])
+	}
+
+	labels := []catena.Label{}
+	for _, tag := range fields[4:] {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 || i == len(tag)-1 {
+			return nil, fmt.Errorf("opentsdb: invalid tag %q", tag)
+		}
+
+		labels = append(labels, catena.Label{Name: tag[:i], Value: tag[i+1:]})
+	}
+
+	row, err := p.row(fields[1], timestamp, value, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return []catena.Row{row}, nil
+}
+
+// row returns the row for a data point.
+func (p *Parser) row(metric string, timestamp int64, value float64, labels []catena.Label) (catena.Row, error) {
+	if metric == "" {
+		return catena.Row{}, errors.New("opentsdb: missing metric")
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return catena.Row{}, fmt.Errorf("opentsdb: invalid value %v", value)
+	}
+
+	if timestamp < 0 {
+		return catena.Row{}, fmt.Errorf("opentsdb: invalid timestamp %d", timestamp)
+	}
+
+	return catena.Row{
+		Source: catena.FormatLabels(labels),
+		Metric: metric,
+		Point: catena.Point{
+			Timestamp: p.timestamp(timestamp),
+			Value:     value,
+		},
+	}, nil
+}
+
+// timestamp converts an OpenTSDB timestamp to p.Unit.
+func (p *Parser) timestamp(ts int64) int64 {
+	unit := p.Unit
+	if unit == 0 {
+		unit = time.Second
+	}
+
+	precision := time.Second
+	if ts > maxSeconds {
+		precision = time.Millisecond
+	}
+
+	return protocol.ConvertTimestamp(ts, precision, unit)
+}
+
+// NewServer returns a LineServer that reads telnet
+// style put commands and writes rows to w.
+func NewServer(db *catena.DB, w *protocol.Writer) *protocol.LineServer {
+	p := &Parser{
+		Unit: db.TimestampUnit(),
+	}
+
+	return &protocol.LineServer{
+		ParseLine: p.ParseLine,
+		Writer:    w,
+	}
+}
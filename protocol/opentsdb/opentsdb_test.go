@@ -0,0 +1,110 @@
+package opentsdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+func TestParseLine(t *testing.T) {
+	p := &Parser{
+		Unit: time.Millisecond,
+	}
+
+	rows, err := p.ParseLine("put sys.cpu.user 1356998400 42.5 host=web01 cpu=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || rows[0].Source != "cpu=0,host=web01" || rows[0].Metric != "sys.cpu.user" ||
+		rows[0].Timestamp != 1356998400000 || rows[0].Value != 42.5 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+
+	rows, err = p.ParseLine("put sys.cpu.user 1356998400500 1 host=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || rows[0].Timestamp != 1356998400500 {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+
+	rows, err = p.ParseLine("version")
+	if err != nil || len(rows) != 0 {
+		t.Errorf("expected version to be ignored, got %v, %v", rows, err)
+	}
+
+	for _, line := range []string{
+		"get sys.cpu.user",
+		"put sys.cpu.user 1356998400",
+		"put sys.cpu.user abc 1",
+		"put sys.cpu.user 1356998400 abc",
+		"put sys.cpu.user 1356998400 1 host",
+	} {
+		_, err = p.ParseLine(line)
+		if err == nil {
+			t.Errorf("expected an error for %q", line)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	os.RemoveAll("/tmp/catena_opentsdb_test")
+
+	db, err := catena.NewDB("/tmp/catena_opentsdb_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	s := httptest.NewServer(NewHandler(db))
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/api/put", "application/json", strings.NewReader(
+		`{"metric": "sys.cpu.user", "timestamp": 1000, "value": 1, "tags": {"host": "web01"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	resp, err = http.Post(s.URL+"/api/put", "application/json", strings.NewReader(`[
+		{"metric": "sys.cpu.user", "timestamp": 1001, "value": "2", "tags": {"host": "web01"}},
+		{"metric": "sys.cpu.user", "timestamp": 1002, "value": "x", "tags": {"host": "web01"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := putResponse{}
+	json.NewDecoder(resp.Body).Decode(&put)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	if put.Success != 1 || put.Failed != 1 || len(put.Errors) != 1 {
+		t.Errorf("unexpected response %+v", put)
+	}
+
+	points, _, err := db.Range("host=web01", "sys.cpu.user", 0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 || points[0].Value != 1 || points[1].Timestamp != 1001 || points[1].Value != 2 {
+		t.Errorf("unexpected points %v", points)
+	}
+}
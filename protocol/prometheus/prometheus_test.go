@@ -0,0 +1,250 @@
+package prometheus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/vfs"
+)
+
+// writeRequest is a snappy compressed WriteRequest with samples at
+// 1000000ms and 1015000ms, and a stale marker at 1030000ms, for
+//
+//	http_requests_total{job="api",instance="web01:9090"}
+//	up{job="api",instance="web01:9090"}
+const writeRequest = "cc01f0550a720a1f0a085f5f6e616d655f5f1213687474705f72657175657374735f746f74616c" +
+	"0a0a0a036a6f6212036170690a160a08696e7374616e6365120a77656230313a39303930120d" +
+	"09000000000000244010c0843d150f24344010d8f93d120d0902051f24f07f10f0ee3e0a520a" +
+	"0e1d7408027570b2630008f03f102e630024f03f10d8f93d1a020801"
+
+// framedWriteRequest is the same WriteRequest in the snappy framing format.
+const framedWriteRequest = "ff060000734e6150705900930000080b5780" + writeRequest
+
+func TestWriteHandler(t *testing.T) {
+	os.RemoveAll("/tmp/catena_prometheus_write_test")
+
+	db, err := catena.NewDB("/tmp/catena_prometheus_write_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	h := NewWriteHandler(db)
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	// Post every payload twice, as Prometheus does when it retries.
+	for _, payload := range []string{writeRequest, writeRequest, framedWriteRequest, framedWriteRequest} {
+		body, _ := hex.DecodeString(payload)
+
+		resp, err := http.Post(s.URL, "application/x-protobuf", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+	}
+
+	points, _, err := db.Range("instance=web01:9090,job=api", "http_requests_total", 0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 || points[0].Timestamp != 1000 || points[0].Value != 10 ||
+		points[1].Timestamp != 1015 || points[1].Value != 20 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	points, _, err = db.Range("instance=web01:9090,job=api", "up", 0, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	resp, err := http.Post(s.URL, "application/x-protobuf", bytes.NewReader([]byte("not snappy")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	if stats := h.Stats(); stats.Written != 16 || stats.ParseErrors != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestReadHandler(t *testing.T) {
+	os.RemoveAll("/tmp/catena_prometheus_read_test")
+
+	db, err := catena.NewDB("/tmp/catena_prometheus_read_test", 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	body, _ := hex.DecodeString(writeRequest)
+	w := httptest.NewRecorder()
+	NewWriteHandler(db).ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+
+	s := httptest.NewServer(NewReadHandler(db))
+	defer s.Close()
+
+	// Select http_requests_total{job=~"a.*"} from 1000s to 1010s.
+	matcher := func(matchType int, name, value string) []byte {
+		m := &protoWriter{}
+		m.varintField(1, uint64(matchType))
+		m.stringField(2, name)
+		m.stringField(3, value)
+		return m.buf
+	}
+
+	q := &protoWriter{}
+	q.varintField(1, 1000000)
+	q.varintField(2, 1010000)
+	q.bytesField(3, matcher(matchEqual, "__name__", "http_requests_total"))
+	q.bytesField(3, matcher(matchRegexp, "job", "a.*"))
+
+	req := &protoWriter{}
+	req.bytesField(1, q.buf)
+
+	resp, err := http.Post(s.URL, "application/x-protobuf", bytes.NewReader(encodeSnappy(req.buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	buf, err := decodeSnappy(respBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A ReadResponse has the same layout as a WriteRequest,
+	// with another level of nesting for the query results.
+	r := &protoReader{buf: buf}
+	r.next()
+	results, err := decodeWriteRequest(r.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || len(results[0].samples) != 1 || len(results[0].labels) != 3 ||
+		results[0].samples[0] != (sample{value: 10, timestamp: 1000000}) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	// Ask for streamed chunks, which are preferred.
+	req.varintField(2, responseTypeStreamedXORChunks)
+	req.varintField(2, responseTypeSamples)
+
+	resp, err = http.Post(s.URL, "application/x-protobuf", bytes.NewReader(encodeSnappy(req.buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respBody, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	length, n := binary.Uvarint(respBody)
+	if n <= 0 || uint64(len(respBody)) != uint64(n)+4+length {
+		t.Fatalf("expected a single frame, got %x", respBody)
+	}
+
+	msg := respBody[n+4:]
+	if binary.BigEndian.Uint32(respBody[n:]) != crc32.Checksum(msg, crc32c) {
+		t.Fatal("frame checksum mismatch")
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	cases := []struct {
+		unit       time.Duration
+		start, end int64
+
+		expectedStart, expectedEnd int64
+	}{
+		{time.Millisecond, 1000, 2000, 1000, 2001},
+		{time.Millisecond, math.MinInt64, math.MaxInt64, math.MinInt64, math.MaxInt64},
+		{time.Second, 1500, 2500, 1, 3},
+		{time.Second, -1500, math.MaxInt64, -2, math.MaxInt64/1000 + 1},
+		{time.Microsecond, 1, 2, 1000, 3000},
+		{time.Microsecond, math.MinInt64, math.MaxInt64, math.MinInt64, math.MaxInt64},
+	}
+
+	for _, c := range cases {
+		db, err := catena.NewDB("/tmp/catena_prometheus_time_range_test", 100, 0,
+			catena.WithFS(vfs.NewMemFS()), catena.WithTimestampUnit(c.unit))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start, end := NewReadHandler(db).timeRange(query{start: c.start, end: c.end})
+		if start != c.expectedStart || end != c.expectedEnd {
+			t.Errorf("%v [%d, %d]: expected [%d, %d), got [%d, %d)",
+				c.unit, c.start, c.end, c.expectedStart, c.expectedEnd, start, end)
+		}
+
+		db.Close()
+	}
+}
+
+func TestXORChunk(t *testing.T) {
+	c := newXORChunk()
+
+	timestamps := []int64{1000000, 1015000, 1030000, 1045500, 1060000, 1200000, 5000000, 5000001}
+	values := []float64{10, 20, 20, 35.5, -1, 1e10, 0.1, 0.1}
+	for i := range timestamps {
+		c.append(timestamps[i], values[i])
+	}
+
+	// Encoded by Prometheus' chunkenc package.
+	expected := "000880897a40240000000000009875d60c81f4d24f5ef063025ff63f0f51e608ff7ca817cf8000" +
+		"0000001bec7061fbedd9ce35ccccccdfffffffffffc6044100"
+
+	if hex.EncodeToString(c.bytes()) != expected {
+		t.Errorf("expected chunk %s, got %x", expected, c.bytes())
+	}
+}
+
+func TestSnappy(t *testing.T) {
+	src := bytes.Repeat([]byte("catena remote read "), 10000)
+
+	decoded, err := decodeSnappy(encodeSnappy(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decoded, src) {
+		t.Error("snappy round trip mismatch")
+	}
+}
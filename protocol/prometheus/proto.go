@@ -0,0 +1,149 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoCorrupt = errors.New("prometheus: corrupt protobuf message")
+
+// A protoReader reads the fields of a protocol buffer message.
+type protoReader struct {
+	buf []byte
+	err error
+}
+
+// next reads the next field's key. It returns false at the
+// end of the message or if the message is corrupt.
+func (r *protoReader) next() (field int, wireType int, ok bool) {
+	if r.err != nil || len(r.buf) == 0 {
+		return 0, 0, false
+	}
+
+	key := r.varint()
+	if r.err != nil {
+		return 0, 0, false
+	}
+
+	return int(key >> 3), int(key & 0x07), true
+}
+
+func (r *protoReader) varint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errProtoCorrupt
+		return 0
+	}
+
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *protoReader) fixed64() uint64 {
+	if len(r.buf) < 8 {
+		r.err = errProtoCorrupt
+		return 0
+	}
+
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return v
+}
+
+func (r *protoReader) bytes() []byte {
+	length := r.varint()
+	if r.err != nil {
+		return nil
+	}
+
+	if length > uint64(len(r.buf)) {
+		r.err = errProtoCorrupt
+		return nil
+	}
+
+	v := r.buf[:length]
+	r.buf = r.buf[length:]
+	return v
+}
+
+func (r *protoReader) double() float64 {
+	return math.Float64frombits(r.fixed64())
+}
+
+// skip skips a field of the given wire type.
+func (r *protoReader) skip(wireType int) {
+	switch wireType {
+	case wireVarint:
+		r.varint()
+	case wireFixed64:
+		r.fixed64()
+	case wireBytes:
+		r.bytes()
+	case wireFixed32:
+		if len(r.buf) < 4 {
+			r.err = errProtoCorrupt
+			return
+		}
+
+		r.buf = r.buf[4:]
+	default:
+		r.err = errProtoCorrupt
+	}
+}
+
+// expect sets an error unless wireType is expected.
+func (r *protoReader) expect(wireType, expected int) bool {
+	if wireType != expected {
+		r.err = errProtoCorrupt
+		return false
+	}
+
+	return true
+}
+
+// A protoWriter encodes a protocol buffer message.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) key(field, wireType int) {
+	w.varint(uint64(field<<3 | wireType))
+}
+
+func (w *protoWriter) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *protoWriter) varintField(field int, v uint64) {
+	w.key(field, wireVarint)
+	w.varint(v)
+}
+
+func (w *protoWriter) doubleField(field int, v float64) {
+	w.key(field, wireFixed64)
+
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	w.buf = append(w.buf, tmp[:]...)
+}
+
+func (w *protoWriter) bytesField(field int, v []byte) {
+	w.key(field, wireBytes)
+	w.varint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *protoWriter) stringField(field int, v string) {
+	w.bytesField(field, []byte(v))
+}
@@ -0,0 +1,535 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// Response types a ReadRequest can accept.
+const (
+	responseTypeSamples           = 0
+	responseTypeStreamedXORChunks = 1
+)
+
+// Label matcher types.
+const (
+	matchEqual     = 0
+	matchNotEqual  = 1
+	matchRegexp    = 2
+	matchNotRegexp = 3
+)
+
+// chunkEncodingXOR is the Chunk encoding of XOR chunks.
+const chunkEncodingXOR = 1
+
+type query struct {
+	// start and end are milliseconds, both inclusive.
+	start    int64
+	end      int64
+	matchers []*matcher
+}
+
+type matcher struct {
+	matchType int
+	name      string
+	value     string
+	re        *regexp.Regexp
+}
+
+// matches returns whether a label value matches. Missing
+// labels have the empty string as their value.
+func (m *matcher) matches(value string) bool {
+	switch m.matchType {
+	case matchEqual:
+		return value == m.value
+	case matchNotEqual:
+		return value != m.value
+	case matchRegexp:
+		return m.re.MatchString(value)
+	case matchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+// A readSeries is a catena series selected by a query.
+type readSeries struct {
+	source string
+	metric string
+
+	// labels include the metric name and are sorted.
+	labels []catena.Label
+}
+
+// A ReadHandler implements the remote_read endpoint. It accepts
+// snappy compressed ReadRequest messages and answers each query with
+// the raw points of the matching series, read with catena Iterators.
+//
+// If the request accepts streamed XOR chunks before samples, series
+// are streamed one at a time as ChunkedReadResponse frames. Otherwise
+// the whole ReadResponse is built in memory and snappy compressed.
+type ReadHandler struct {
+	db *catena.DB
+}
+
+// NewReadHandler returns a ReadHandler that reads from db.
+func NewReadHandler(db *catena.DB) *ReadHandler {
+	return &ReadHandler{db: db}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *ReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("prometheus: method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	queries, responseTypes, err := readReadRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Use the first supported response type the client accepts.
+	// Clients that don't say only accept samples.
+	responseType := -1
+	if len(responseTypes) == 0 {
+		responseType = responseTypeSamples
+	}
+
+	for _, t := range responseTypes {
+		if t == responseTypeSamples || t == responseTypeStreamedXORChunks {
+			responseType = t
+			break
+		}
+	}
+
+	if responseType < 0 {
+		http.Error(w, "prometheus: no supported response type accepted", http.StatusBadRequest)
+		return
+	}
+
+	if responseType == responseTypeStreamedXORChunks {
+		h.streamChunks(w, queries)
+		return
+	}
+
+	h.writeSamples(w, queries)
+}
+
+// writeSamples writes a snappy compressed ReadResponse.
+func (h *ReadHandler) writeSamples(w http.ResponseWriter, queries []query) {
+	resp := &protoWriter{}
+
+	for _, q := range queries {
+		result := &protoWriter{}
+
+		for _, s := range h.selectSeries(q) {
+			ts := &protoWriter{}
+			writeLabels(ts, s.labels)
+
+			err := h.scan(s, q, func(t int64, v float64) error {
+				sample := &protoWriter{}
+				sample.doubleField(1, v)
+				sample.varintField(2, uint64(t))
+
+				ts.bytesField(2, sample.buf)
+				return nil
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			result.bytesField(1, ts.buf)
+		}
+
+		resp.bytesField(1, result.buf)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(encodeSnappy(resp.buf))
+}
+
+// streamChunks writes a ChunkedReadResponse frame for every series
+// as soon as it has been read. Each frame is the uvarint length of the
+// message, its big endian CRC-32C checksum and the message itself.
+// Errors after the first frame can only be reported by cutting the
+// stream short.
+func (h *ReadHandler) streamChunks(w http.ResponseWriter, queries []query) {
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+
+	flusher, _ := w.(http.Flusher)
+
+	for i, q := range queries {
+		for _, s := range h.selectSeries(q) {
+			series := &protoWriter{}
+			writeLabels(series, s.labels)
+
+			chunk := newXORChunk()
+			writeChunk := func() {
+				c := &protoWriter{}
+				c.varintField(1, uint64(chunk.minTime))
+				c.varintField(2, uint64(chunk.maxTime))
+				c.varintField(3, chunkEncodingXOR)
+				c.bytesField(4, chunk.bytes())
+
+				series.bytesField(2, c.buf)
+				chunk = newXORChunk()
+			}
+
+			err := h.scan(s, q, func(t int64, v float64) error {
+				chunk.append(t, v)
+				if chunk.samples == maxChunkSamples {
+					writeChunk()
+				}
+
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			if chunk.samples > 0 {
+				writeChunk()
+			}
+
+			msg := &protoWriter{}
+			msg.bytesField(1, series.buf)
+			msg.varintField(2, uint64(i))
+
+			var frame [binary.MaxVarintLen64 + 4]byte
+			n := binary.PutUvarint(frame[:], uint64(len(msg.buf)))
+			binary.BigEndian.PutUint32(frame[n:], crc32.Checksum(msg.buf, crc32c))
+
+			_, err = w.Write(append(frame[:n+4], msg.buf...))
+			if err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// selectSeries returns the series with points in q's time
+// range whose labels match all of q's matchers.
+func (h *ReadHandler) selectSeries(q query) []readSeries {
+	start, end := h.timeRange(q)
+	selected := []readSeries{}
+
+	for _, source := range h.db.Sources(start, end) {
+		labels, err := catena.ParseLabels(source)
+		if err != nil {
+			// Not written by a tagged protocol.
+			continue
+		}
+
+		for _, metric := range h.db.Metrics(source, start, end) {
+			seriesLabels := append([]catena.Label{{Name: metricNameLabel, Value: metric}}, labels...)
+			sort.Sort(labelsByName(seriesLabels))
+
+			if matchesAll(q.matchers, seriesLabels) {
+				selected = append(selected, readSeries{
+					source: source,
+					metric: metric,
+					labels: seriesLabels,
+				})
+			}
+		}
+	}
+
+	sort.Sort(readSeriesByLabels(selected))
+	return selected
+}
+
+// scan calls fn with the timestamp in milliseconds and the value of
+// every point of s in q's time range, read with a catena.Iterator.
+func (h *ReadHandler) scan(s readSeries, q query, fn func(t int64, v float64) error) error {
+	i, err := h.db.NewIterator(s.source, s.metric)
+	if err == catena.ErrSeriesNotFound {
+		// The series has been dropped since it was selected.
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer i.Close()
+
+	start, _ := h.timeRange(q)
+	for err = i.Seek(start); err == nil; err = i.Next() {
+		point := i.Point()
+
+		t := h.toMillis(point.Timestamp)
+		if t > q.end {
+			return nil
+		}
+
+		if t < q.start {
+			continue
+		}
+
+		err = fn(t, point.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err != catena.ErrNoMorePoints {
+		return err
+	}
+
+	return nil
+}
+
+// timeRange returns q's time range in the DB's unit,
+// as a half-open range.
+func (h *ReadHandler) timeRange(q query) (start, end int64) {
+	unit := h.db.TimestampUnit()
+	if unit >= time.Millisecond {
+		perUnit := int64(unit / time.Millisecond)
+
+		start, end = floorDiv(q.start, perUnit), floorDiv(q.end, perUnit)
+		if end < math.MaxInt64 {
+			end++
+		}
+
+		return start, end
+	}
+
+	perMilli := int64(time.Millisecond / unit)
+
+	start, end = math.MinInt64, math.MaxInt64
+	if q.start > math.MinInt64/perMilli {
+		start = q.start * perMilli
+	}
+
+	if q.end < math.MaxInt64/perMilli-1 {
+		end = (q.end + 1) * perMilli
+	}
+
+	return start, end
+}
+
+func (h *ReadHandler) toMillis(ts int64) int64 {
+	unit := h.db.TimestampUnit()
+	if unit >= time.Millisecond {
+		return ts * int64(unit/time.Millisecond)
+	}
+
+	return floorDiv(ts, int64(time.Millisecond/unit))
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+
+	return q
+}
+
+func matchesAll(matchers []*matcher, labels []catena.Label) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, label := range labels {
+			if label.Name == m.name {
+				value = label.Value
+				break
+			}
+		}
+
+		if !m.matches(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeLabels(w *protoWriter, labels []catena.Label) {
+	for _, label := range labels {
+		l := &protoWriter{}
+		l.stringField(1, label.Name)
+		l.stringField(2, label.Value)
+
+		w.bytesField(1, l.buf)
+	}
+}
+
+// readReadRequest reads and decodes a compressed ReadRequest.
+func readReadRequest(r *http.Request) ([]query, []int, error) {
+	buf, err := readBody(r.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return decodeReadRequest(buf)
+}
+
+// decodeReadRequest decodes a ReadRequest message into its
+// queries and accepted response types.
+func decodeReadRequest(buf []byte) ([]query, []int, error) {
+	queries := []query{}
+	responseTypes := []int{}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		switch field {
+		case 1:
+			if !r.expect(wireType, wireBytes) {
+				break
+			}
+
+			q, err := decodeQuery(r.bytes())
+			if err != nil {
+				return nil, nil, err
+			}
+
+			queries = append(queries, q)
+		case 2:
+			switch wireType {
+			case wireVarint:
+				responseTypes = append(responseTypes, int(r.varint()))
+			case wireBytes:
+				// A packed repeated field.
+				packed := &protoReader{buf: r.bytes()}
+				for len(packed.buf) > 0 && packed.err == nil {
+					responseTypes = append(responseTypes, int(packed.varint()))
+				}
+
+				if packed.err != nil {
+					return nil, nil, packed.err
+				}
+			default:
+				r.err = errProtoCorrupt
+			}
+		default:
+			r.skip(wireType)
+		}
+	}
+
+	return queries, responseTypes, r.err
+}
+
+func decodeQuery(buf []byte) (query, error) {
+	q := query{
+		start: math.MinInt64,
+		end:   math.MaxInt64,
+	}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		switch field {
+		case 1:
+			if r.expect(wireType, wireVarint) {
+				q.start = int64(r.varint())
+			}
+		case 2:
+			if r.expect(wireType, wireVarint) {
+				q.end = int64(r.varint())
+			}
+		case 3:
+			if !r.expect(wireType, wireBytes) {
+				break
+			}
+
+			m, err := decodeMatcher(r.bytes())
+			if err != nil {
+				return q, err
+			}
+
+			q.matchers = append(q.matchers, m)
+		default:
+			// Read hints are only an optimization.
+			r.skip(wireType)
+		}
+	}
+
+	return q, r.err
+}
+
+func decodeMatcher(buf []byte) (*matcher, error) {
+	m := &matcher{}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		switch field {
+		case 1:
+			if r.expect(wireType, wireVarint) {
+				m.matchType = int(r.varint())
+			}
+		case 2:
+			if r.expect(wireType, wireBytes) {
+				m.name = string(r.bytes())
+			}
+		case 3:
+			if r.expect(wireType, wireBytes) {
+				m.value = string(r.bytes())
+			}
+		default:
+			r.skip(wireType)
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	switch m.matchType {
+	case matchEqual, matchNotEqual:
+	case matchRegexp, matchNotRegexp:
+		// Prometheus regular expressions are fully anchored.
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return nil, err
+		}
+
+		m.re = re
+	default:
+		return nil, errors.New("prometheus: unknown matcher type")
+	}
+
+	return m, nil
+}
+
+type labelsByName []catena.Label
+
+func (l labelsByName) Len() int           { return len(l) }
+func (l labelsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l labelsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type readSeriesByLabels []readSeries
+
+func (s readSeriesByLabels) Len() int { return len(s) }
+func (s readSeriesByLabels) Less(i, j int) bool {
+	a, b := s[i].labels, s[j].labels
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			if a[k].Name != b[k].Name {
+				return a[k].Name < b[k].Name
+			}
+
+			return a[k].Value < b[k].Value
+		}
+	}
+
+	return len(a) < len(b)
+}
+func (s readSeriesByLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,311 @@
+package prometheus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// maxDecodedLength bounds the size of a decompressed message.
+const maxDecodedLength = 64 << 20
+
+var (
+	errSnappyCorrupt  = errors.New("prometheus: corrupt snappy input")
+	errSnappyTooLarge = errors.New("prometheus: snappy input decodes to too much data")
+)
+
+// snappyStreamIdentifier starts every stream in the snappy framing
+// format. remote_write uses the block format, but framed bodies
+// are accepted as well.
+var snappyStreamIdentifier = []byte("\xff\x06\x00\x00sNaPpY")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// decodeSnappy decompresses src, which is in either the snappy
+// block format or the snappy framing format.
+func decodeSnappy(src []byte) ([]byte, error) {
+	if bytes.HasPrefix(src, snappyStreamIdentifier) {
+		return decodeSnappyFramed(src)
+	}
+
+	return decodeSnappyBlock(src)
+}
+
+// decodeSnappyBlock decompresses a snappy block: the varint encoded
+// decompressed length followed by literals and back references.
+func decodeSnappyBlock(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errSnappyCorrupt
+	}
+
+	if length > maxDecodedLength {
+		return nil, errSnappyTooLarge
+	}
+
+	src = src[n:]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+
+		switch tag & 0x03 {
+		case 0x00:
+			// A literal. Short lengths are stored in the
+			// tag, longer ones in the following 1-4 bytes.
+			litLen := int(tag >> 2)
+			src = src[1:]
+
+			if litLen >= 60 {
+				extra := litLen - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+
+				litLen = 0
+				for i := extra - 1; i >= 0; i-- {
+					litLen = litLen<<8 | int(src[i])
+				}
+
+				src = src[extra:]
+			}
+
+			litLen++
+			if litLen <= 0 || litLen > len(src) || len(dst)+litLen > int(length) {
+				return nil, errSnappyCorrupt
+			}
+
+			dst = append(dst, src[:litLen]...)
+			src = src[litLen:]
+			continue
+
+		case 0x01:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+
+			copyLen := 4 + int(tag>>2)&0x07
+			offset := int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+
+			if !appendCopy(&dst, offset, copyLen, int(length)) {
+				return nil, errSnappyCorrupt
+			}
+
+		case 0x02:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+
+			copyLen := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+
+			if !appendCopy(&dst, offset, copyLen, int(length)) {
+				return nil, errSnappyCorrupt
+			}
+
+		case 0x03:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+
+			copyLen := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+
+			if !appendCopy(&dst, offset, copyLen, int(length)) {
+				return nil, errSnappyCorrupt
+			}
+		}
+	}
+
+	if len(dst) != int(length) {
+		return nil, errSnappyCorrupt
+	}
+
+	return dst, nil
+}
+
+// appendCopy appends copyLen bytes starting offset bytes back from
+// the end of dst. The ranges may overlap, which repeats the data.
+func appendCopy(dst *[]byte, offset, copyLen, maxLen int) bool {
+	d := *dst
+	if offset <= 0 || offset > len(d) || len(d)+copyLen > maxLen {
+		return false
+	}
+
+	start := len(d) - offset
+	for i := 0; i < copyLen; i++ {
+		d = append(d, d[start+i])
+	}
+
+	*dst = d
+	return true
+}
+
+// decodeSnappyFramed decompresses a stream in the snappy framing
+// format, which is a sequence of checksummed chunks.
+func decodeSnappyFramed(src []byte) ([]byte, error) {
+	dst := []byte{}
+
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, errSnappyCorrupt
+		}
+
+		chunkType := src[0]
+		chunkLen := int(src[1]) | int(src[2])<<8 | int(src[3])<<16
+		src = src[4:]
+
+		if chunkLen > len(src) {
+			return nil, errSnappyCorrupt
+		}
+
+		chunk := src[:chunkLen]
+		src = src[chunkLen:]
+
+		switch {
+		case chunkType == 0xff:
+			// The stream identifier, which may be repeated.
+			if !bytes.Equal(chunk, snappyStreamIdentifier[4:]) {
+				return nil, errSnappyCorrupt
+			}
+
+		case chunkType == 0x00 || chunkType == 0x01:
+			if len(chunk) < 4 {
+				return nil, errSnappyCorrupt
+			}
+
+			checksum := binary.LittleEndian.Uint32(chunk[:4])
+			data := chunk[4:]
+
+			if chunkType == 0x00 {
+				var err error
+				data, err = decodeSnappyBlock(data)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if maskedCRC(data) != checksum {
+				return nil, errors.New("prometheus: snappy checksum mismatch")
+			}
+
+			if len(dst)+len(data) > maxDecodedLength {
+				return nil, errSnappyTooLarge
+			}
+
+			dst = append(dst, data...)
+
+		case chunkType >= 0x80:
+			// Padding and other skippable chunks.
+
+		default:
+			return nil, errSnappyCorrupt
+		}
+	}
+
+	return dst, nil
+}
+
+// maskedCRC returns the CRC-32C checksum of data,
+// masked as the snappy framing format requires.
+func maskedCRC(data []byte) uint32 {
+	c := crc32.Checksum(data, crc32c)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+// encodeSnappy compresses src in the snappy block format. Input is
+// compressed in independent 64KB blocks, so that every back reference
+// fits in a two byte offset.
+func encodeSnappy(src []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(src)))
+
+	dst := append([]byte{}, tmp[:n]...)
+	for len(src) > 0 {
+		block := src
+		if len(block) > 1<<16 {
+			block = block[:1<<16]
+		}
+
+		dst = encodeSnappyBlock(dst, block)
+		src = src[len(block):]
+	}
+
+	return dst
+}
+
+// encodeSnappyBlock appends the literals and back references for
+// src to dst. Matches are found with a hash table of the positions
+// of four byte sequences.
+func encodeSnappyBlock(dst, src []byte) []byte {
+	// table holds positions plus one, so that zero is empty.
+	var table [1 << 14]int32
+
+	literalStart := 0
+	for i := 0; i+4 <= len(src); {
+		current := binary.LittleEndian.Uint32(src[i:])
+		h := (current * 0x1e35a7bd) >> 18
+
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != current {
+			i++
+			continue
+		}
+
+		dst = appendLiteral(dst, src[literalStart:i])
+
+		matchLen := 4
+		for i+matchLen < len(src) && src[candidate+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+
+		dst = appendCopies(dst, i-candidate, matchLen)
+
+		i += matchLen
+		literalStart = i
+	}
+
+	return appendLiteral(dst, src[literalStart:])
+}
+
+func appendLiteral(dst, literal []byte) []byte {
+	if len(literal) == 0 {
+		return dst
+	}
+
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	default:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	}
+
+	return append(dst, literal...)
+}
+
+// appendCopies appends back references with two byte offsets,
+// which are at most 64 bytes long each.
+func appendCopies(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+
+		dst = append(dst, byte(n-1)<<2|0x02, byte(offset), byte(offset>>8))
+		length -= n
+	}
+
+	return dst
+}
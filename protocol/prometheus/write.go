@@ -0,0 +1,287 @@
+// Package prometheus implements the Prometheus remote_write and
+// remote_read protocols for catena.
+//
+// A Prometheus series maps to a catena series by using its __name__
+// label as the metric and encoding the remaining labels as the source
+// with catena.FormatLabels. Prometheus timestamps are milliseconds and
+// are converted to the DB's timestamp unit.
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// maxRequestSize bounds the size of a compressed request body.
+const maxRequestSize = 32 << 20
+
+// metricNameLabel is the label that holds a series' metric name.
+const metricNameLabel = "__name__"
+
+// staleNaN is the value Prometheus uses to mark a series as stale.
+// It isn't a sample, so it is never stored.
+const staleNaN = 0x7ff0000000000002
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type timeSeries struct {
+	labels  []catena.Label
+	samples []sample
+}
+
+// A WriteHandler implements the remote_write endpoint. It accepts
+// snappy compressed WriteRequest messages and inserts their samples.
+//
+// Prometheus resends samples after restarts and when retrying, and
+// samples of a series may arrive out of order across shards. Resent
+// samples overwrite the stored ones, out of order samples are merged
+// into their partitions like any late rows, and samples older than the
+// retention period are dropped. Requests are only rejected if they
+// can't be decoded, so Prometheus doesn't retry them forever.
+type WriteHandler struct {
+	db *catena.DB
+
+	badRequests int64
+	written     int64
+	rejected    int64
+	failed      int64
+}
+
+// NewWriteHandler returns a WriteHandler that inserts into db.
+func NewWriteHandler(db *catena.DB) *WriteHandler {
+	return &WriteHandler{db: db}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *WriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("prometheus: method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	series, err := readWriteRequest(r.Body)
+	if err != nil {
+		atomic.AddInt64(&h.badRequests, 1)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows := []catena.Row{}
+	for _, ts := range series {
+		source, metric, err := seriesName(ts.labels)
+		if err != nil {
+			atomic.AddInt64(&h.badRequests, 1)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, s := range ts.samples {
+			if math.Float64bits(s.value) == staleNaN {
+				continue
+			}
+
+			rows = append(rows, catena.Row{
+				Source: source,
+				Metric: metric,
+				Point: catena.Point{
+					Timestamp: protocol.ConvertTimestamp(s.timestamp, time.Millisecond, h.db.TimestampUnit()),
+					Value:     s.value,
+				},
+			})
+		}
+	}
+
+	rejected, err := protocol.Insert(h.db, rows)
+	atomic.AddInt64(&h.rejected, int64(rejected))
+
+	if err != nil {
+		atomic.AddInt64(&h.failed, int64(len(rows)-rejected))
+
+		// Prometheus retries on 5xx responses.
+		status := http.StatusInternalServerError
+		if err == catena.ErrReadOnly {
+			status = http.StatusServiceUnavailable
+		}
+
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	atomic.AddInt64(&h.written, int64(len(rows)-rejected))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stats returns the handler's counters. ParseErrors counts
+// requests that couldn't be decoded.
+func (h *WriteHandler) Stats() protocol.Stats {
+	return protocol.Stats{
+		ParseErrors: atomic.LoadInt64(&h.badRequests),
+		Written:     atomic.LoadInt64(&h.written),
+		Rejected:    atomic.LoadInt64(&h.rejected),
+		Failed:      atomic.LoadInt64(&h.failed),
+	}
+}
+
+// seriesName returns the catena source and metric for labels.
+func seriesName(labels []catena.Label) (source, metric string, err error) {
+	rest := make([]catena.Label, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == metricNameLabel {
+			metric = label.Value
+			continue
+		}
+
+		rest = append(rest, label)
+	}
+
+	if metric == "" {
+		return "", "", errors.New("prometheus: series has no metric name")
+	}
+
+	return catena.FormatLabels(rest), metric, nil
+}
+
+// readWriteRequest reads and decodes a compressed WriteRequest.
+func readWriteRequest(body io.Reader) ([]timeSeries, error) {
+	buf, err := readBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeWriteRequest(buf)
+}
+
+// readBody reads and decompresses a request body.
+func readBody(body io.Reader) ([]byte, error) {
+	compressed, err := ioutil.ReadAll(io.LimitReader(body, maxRequestSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(compressed) > maxRequestSize {
+		return nil, errors.New("prometheus: request too large")
+	}
+
+	return decodeSnappy(compressed)
+}
+
+// decodeWriteRequest decodes a WriteRequest message. Only its
+// time series are read, and only their labels and samples.
+func decodeWriteRequest(buf []byte) ([]timeSeries, error) {
+	series := []timeSeries{}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		if field != 1 {
+			r.skip(wireType)
+			continue
+		}
+
+		if !r.expect(wireType, wireBytes) {
+			break
+		}
+
+		ts, err := decodeTimeSeries(r.bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		series = append(series, ts)
+	}
+
+	return series, r.err
+}
+
+func decodeTimeSeries(buf []byte) (timeSeries, error) {
+	ts := timeSeries{}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		switch field {
+		case 1:
+			if !r.expect(wireType, wireBytes) {
+				break
+			}
+
+			label, err := decodeLabel(r.bytes())
+			if err != nil {
+				return ts, err
+			}
+
+			ts.labels = append(ts.labels, label)
+		case 2:
+			if !r.expect(wireType, wireBytes) {
+				break
+			}
+
+			s, err := decodeSample(r.bytes())
+			if err != nil {
+				return ts, err
+			}
+
+			ts.samples = append(ts.samples, s)
+		default:
+			// Exemplars and native histograms aren't supported.
+			r.skip(wireType)
+		}
+	}
+
+	return ts, r.err
+}
+
+func decodeLabel(buf []byte) (catena.Label, error) {
+	label := catena.Label{}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		switch field {
+		case 1:
+			if r.expect(wireType, wireBytes) {
+				label.Name = string(r.bytes())
+			}
+		case 2:
+			if r.expect(wireType, wireBytes) {
+				label.Value = string(r.bytes())
+			}
+		default:
+			r.skip(wireType)
+		}
+	}
+
+	return label, r.err
+}
+
+func decodeSample(buf []byte) (sample, error) {
+	s := sample{}
+
+	r := &protoReader{buf: buf}
+	for field, wireType, ok := r.next(); ok; field, wireType, ok = r.next() {
+		switch field {
+		case 1:
+			if r.expect(wireType, wireFixed64) {
+				s.value = r.double()
+			}
+		case 2:
+			if r.expect(wireType, wireVarint) {
+				s.timestamp = int64(r.varint())
+			}
+		default:
+			r.skip(wireType)
+		}
+	}
+
+	return s, r.err
+}
@@ -0,0 +1,168 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// maxChunkSamples is the number of samples Prometheus puts in a chunk.
+const maxChunkSamples = 120
+
+// A bitWriter appends bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	buf []byte
+
+	// free is the number of unused bits in the last byte.
+	free uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << (w.free - 1)
+	}
+
+	w.free--
+}
+
+// writeBits writes the n least significant bits of v.
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v>>uint(i)&1 == 1)
+	}
+}
+
+func (w *bitWriter) writeByte(b byte) {
+	w.writeBits(uint64(b), 8)
+}
+
+// An xorChunk encodes samples in the Gorilla style XOR chunk
+// encoding used by Prometheus: timestamps as delta of deltas and
+// values XORed with the previous value.
+type xorChunk struct {
+	w bitWriter
+
+	samples int
+	minTime int64
+	maxTime int64
+
+	t      int64
+	tDelta uint64
+	v      float64
+
+	leading  uint8
+	trailing uint8
+}
+
+func newXORChunk() *xorChunk {
+	return &xorChunk{
+		// The chunk starts with the big endian number of samples.
+		w:       bitWriter{buf: make([]byte, 2, 128)},
+		leading: 0xff,
+	}
+}
+
+// append adds a sample. Timestamps must be increasing.
+func (c *xorChunk) append(t int64, v float64) {
+	var tDelta uint64
+	var tmp [binary.MaxVarintLen64]byte
+
+	switch c.samples {
+	case 0:
+		for _, b := range tmp[:binary.PutVarint(tmp[:], t)] {
+			c.w.writeByte(b)
+		}
+
+		c.w.writeBits(math.Float64bits(v), 64)
+		c.minTime = t
+	case 1:
+		tDelta = uint64(t - c.t)
+		for _, b := range tmp[:binary.PutUvarint(tmp[:], tDelta)] {
+			c.w.writeByte(b)
+		}
+
+		c.writeValue(v)
+	default:
+		tDelta = uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+
+		switch {
+		case dod == 0:
+			c.w.writeBit(false)
+		case bitRange(dod, 14):
+			c.w.writeBits(0x02, 2)
+			c.w.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.w.writeBits(0x06, 3)
+			c.w.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.w.writeBits(0x0e, 4)
+			c.w.writeBits(uint64(dod), 20)
+		default:
+			c.w.writeBits(0x0f, 4)
+			c.w.writeBits(uint64(dod), 64)
+		}
+
+		c.writeValue(v)
+	}
+
+	c.t = t
+	c.tDelta = tDelta
+	c.v = v
+	c.maxTime = t
+	c.samples++
+
+	binary.BigEndian.PutUint16(c.w.buf, uint16(c.samples))
+}
+
+// writeValue writes v XORed with the previous value. Only the
+// meaningful bits are written, reusing the previous window of
+// leading and trailing zeros if the XOR fits in it.
+func (c *xorChunk) writeValue(v float64) {
+	delta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if delta == 0 {
+		c.w.writeBit(false)
+		return
+	}
+
+	c.w.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(delta))
+	trailing := uint8(bits.TrailingZeros64(delta))
+
+	// The number of leading zeros is written with 5 bits.
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		c.w.writeBit(false)
+		c.w.writeBits(delta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+
+	c.leading, c.trailing = leading, trailing
+
+	// 64 significant bits are written as 0.
+	significant := 64 - int(leading) - int(trailing)
+
+	c.w.writeBit(true)
+	c.w.writeBits(uint64(leading), 5)
+	c.w.writeBits(uint64(significant), 6)
+	c.w.writeBits(delta>>trailing, significant)
+}
+
+func (c *xorChunk) bytes() []byte {
+	return c.w.buf
+}
+
+// bitRange returns whether x fits in a signed nbits
+// wide field as Prometheus encodes it.
+func bitRange(x int64, nbits uint) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
@@ -0,0 +1,196 @@
+package protocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// MaxLineLength is the longest line a LineServer accepts.
+const MaxLineLength = 1 << 20
+
+// A LineError is an error for a single malformed line of input.
+type LineError struct {
+	// Line is the line number, starting at 1.
+	Line int
+
+	Err error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// A LineServer accepts TCP connections for a line-based protocol.
+// Every line is converted to rows by ParseLine and written to Writer.
+type LineServer struct {
+	// ParseLine converts a line without its line terminator to rows.
+	ParseLine func(line string) ([]catena.Row, error)
+
+	// Writer receives the parsed rows.
+	Writer *Writer
+
+	// ErrorLog, if set, is called with a *LineError for every
+	// malformed line, and with errors returned by Writer.
+	ErrorLog func(err error)
+
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	lock     sync.Mutex
+	wg       sync.WaitGroup
+
+	lines       int64
+	parseErrors int64
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (s *LineServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, and
+// then returns nil. Each connection is read in its own goroutine.
+func (s *LineServer) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return errors.New("protocol: server is closed")
+	}
+
+	s.listener = l
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.lock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and stops reading from open
+// connections. It waits for the lines that have already been read
+// to be written, and flushes Writer.
+func (s *LineServer) Close() error {
+	s.lock.Lock()
+	s.closed = true
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+
+	for conn := range s.conns {
+		// Unblock readers without dropping what
+		// they have already read.
+		conn.SetReadDeadline(time.Now())
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+
+	flushErr := s.Writer.Flush()
+	if err == nil {
+		err = flushErr
+	}
+
+	return err
+}
+
+// Stats returns the server's counters, including those of its Writer.
+func (s *LineServer) Stats() Stats {
+	stats := s.Writer.Stats()
+	stats.Lines = atomic.LoadInt64(&s.lines)
+	stats.ParseErrors = atomic.LoadInt64(&s.parseErrors)
+
+	return stats
+}
+
+func (s *LineServer) serveConn(conn net.Conn) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MaxLineLength)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		atomic.AddInt64(&s.lines, 1)
+
+		line := scanner.Text()
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+
+		rows, err := s.ParseLine(line)
+		if err != nil {
+			atomic.AddInt64(&s.parseErrors, 1)
+			s.logError(&LineError{Line: lineNumber, Err: err})
+			continue
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		err = s.Writer.Write(rows)
+		if err != nil {
+			s.logError(err)
+		}
+	}
+}
+
+func (s *LineServer) logError(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+}
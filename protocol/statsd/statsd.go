@@ -0,0 +1,391 @@
+// Package statsd implements a StatsD server that aggregates metrics
+// over a flush interval and inserts the results into a DB.
+//
+// Each flush writes the following series for a metric called name,
+// all under the server's source:
+//
+//	counters  counters.name.count, counters.name.rate
+//	timers    timers.name.count, timers.name.rate, timers.name.mean,
+//	          timers.name.p90, timers.name.upper
+//	gauges    gauges.name
+//	sets      sets.name.count
+//
+// so metrics of different types with the same name don't collide.
+// Rates are per second over the time since the previous flush. Gauges
+// keep their value and are written on every flush once they have been
+// set. The other types are reset after each flush and are only
+// written if they received samples.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// DefaultAddr is the address StatsD clients send to by default,
+// restricted to localhost.
+const DefaultAddr = "127.0.0.1:8125"
+
+// maxPacketSize is the largest UDP payload.
+const maxPacketSize = 65535
+
+// A Server receives StatsD packets over UDP.
+type Server struct {
+	// Source is the source of every row the server writes.
+	Source string
+
+	// FlushInterval is the aggregation interval.
+	FlushInterval time.Duration
+
+	// ErrorLog, if set, is called with every malformed
+	// line's error and with insert errors.
+	ErrorLog func(err error)
+
+	db *catena.DB
+
+	counters map[string]float64
+	timers   map[string]*timer
+	gauges   map[string]float64
+	sets     map[string]map[string]struct{}
+	lock     sync.Mutex
+
+	// intervalStart is when the current interval started. It is
+	// zero until Serve is called.
+	intervalStart time.Time
+	clock         func() time.Time
+
+	conn   net.PacketConn
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	lines       int64
+	parseErrors int64
+	written     int64
+	rejected    int64
+	failed      int64
+}
+
+type timer struct {
+	values []float64
+
+	// count is the number of samples the values represent,
+	// taking sample rates into account.
+	count float64
+}
+
+// NewServer returns a Server that writes to db with source "statsd"
+// and a flush interval of 10 seconds.
+func NewServer(db *catena.DB) *Server {
+	return &Server{
+		Source:        "statsd",
+		FlushInterval: 10 * time.Second,
+		db:            db,
+		counters:      map[string]float64{},
+		timers:        map[string]*timer{},
+		gauges:        map[string]float64{},
+		sets:          map[string]map[string]struct{}{},
+		clock:         time.Now,
+		done:          make(chan struct{}),
+	}
+}
+
+// ListenAndServe listens on the UDP address addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(conn)
+}
+
+// Serve reads packets from conn and flushes every FlushInterval
+// until Close is called, and then returns nil.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return errors.New("statsd: server is closed")
+	}
+
+	s.conn = conn
+	s.intervalStart = s.clock()
+	s.lock.Unlock()
+
+	s.wg.Add(1)
+	go s.flushPeriodically()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			return err
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			atomic.AddInt64(&s.lines, 1)
+
+			err = s.handleLine(line)
+			if err != nil {
+				atomic.AddInt64(&s.parseErrors, 1)
+				s.logError(err)
+			}
+		}
+	}
+}
+
+// Close stops reading packets and flushes
+// what has been aggregated so far.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+
+	flushErr := s.Flush()
+	if err == nil {
+		err = flushErr
+	}
+
+	return err
+}
+
+// Stats returns the server's counters. Lines counts metrics
+// received rather than network lines.
+func (s *Server) Stats() protocol.Stats {
+	return protocol.Stats{
+		Lines:       atomic.LoadInt64(&s.lines),
+		ParseErrors: atomic.LoadInt64(&s.parseErrors),
+		Written:     atomic.LoadInt64(&s.written),
+		Rejected:    atomic.LoadInt64(&s.rejected),
+		Failed:      atomic.LoadInt64(&s.failed),
+	}
+}
+
+// handleLine parses a line of the form name:value|type[|@rate]
+// and adds it to the current interval.
+func (s *Server) handleLine(line string) error {
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return fmt.Errorf("statsd: invalid line %q", line)
+	}
+
+	name := line[:colon]
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("statsd: invalid line %q", line)
+	}
+
+	valueString, kind := fields[0], fields[1]
+
+	rate := 1.0
+	for _, field := range fields[2:] {
+		if strings.HasPrefix(field, "@") {
+			var err error
+			rate, err = strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return fmt.Errorf("statsd: invalid sample rate %q", field)
+			}
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if kind == "s" {
+		set := s.sets[name]
+		if set == nil {
+			set = map[string]struct{}{}
+			s.sets[name] = set
+		}
+
+		set[valueString] = struct{}{}
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(valueString, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("statsd: invalid value %q", valueString)
+	}
+
+	switch kind {
+	case "c":
+		s.counters[name] += value / rate
+	case "ms", "h":
+		t := s.timers[name]
+		if t == nil {
+			t = &timer{}
+			s.timers[name] = t
+		}
+
+		t.values = append(t.values, value)
+		t.count += 1 / rate
+	case "g":
+		if valueString[0] == '+' || valueString[0] == '-' {
+			s.gauges[name] += value
+		} else {
+			s.gauges[name] = value
+		}
+	default:
+		return fmt.Errorf("statsd: unknown metric type %q", kind)
+	}
+
+	return nil
+}
+
+// Flush writes the aggregates of the current interval and
+// starts a new one.
+func (s *Server) Flush() error {
+	ts := s.db.Now()
+
+	s.lock.Lock()
+
+	// Intervals are cut short by Close and may run long
+	// if inserts are slow, so rates use the actual length.
+	now := s.clock()
+	seconds := s.FlushInterval.Seconds()
+	if !s.intervalStart.IsZero() && now.After(s.intervalStart) {
+		seconds = now.Sub(s.intervalStart).Seconds()
+	}
+
+	s.intervalStart = now
+
+	rows := []catena.Row{}
+	add := func(metric string, value float64) {
+		rows = append(rows, catena.Row{
+			Source: s.Source,
+			Metric: metric,
+			Point: catena.Point{
+				Timestamp: ts,
+				Value:     value,
+			},
+		})
+	}
+
+	for name, count := range s.counters {
+		add("counters."+name+".count", count)
+		add("counters."+name+".rate", count/seconds)
+	}
+
+	for name, t := range s.timers {
+		sort.Float64s(t.values)
+
+		sum := 0.0
+		for _, v := range t.values {
+			sum += v
+		}
+
+		add("timers."+name+".count", t.count)
+		add("timers."+name+".rate", t.count/seconds)
+		add("timers."+name+".mean", sum/float64(len(t.values)))
+		add("timers."+name+".p90", percentile(t.values, 90))
+		add("timers."+name+".upper", t.values[len(t.values)-1])
+	}
+
+	for name, value := range s.gauges {
+		add("gauges."+name, value)
+	}
+
+	for name, set := range s.sets {
+		add("sets."+name+".count", float64(len(set)))
+	}
+
+	s.counters = map[string]float64{}
+	s.timers = map[string]*timer{}
+	s.sets = map[string]map[string]struct{}{}
+
+	s.lock.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	rejected, err := protocol.Insert(s.db, rows)
+	atomic.AddInt64(&s.rejected, int64(rejected))
+
+	if err != nil {
+		atomic.AddInt64(&s.failed, int64(len(rows)-rejected))
+		return err
+	}
+
+	atomic.AddInt64(&s.written, int64(len(rows)-rejected))
+	return nil
+}
+
+// percentile returns the largest value within the lowest pct percent
+// of sorted, which must not be empty, the way StatsD computes it.
+func percentile(sorted []float64, pct float64) float64 {
+	n := int(math.Floor(pct/100*float64(len(sorted)) + 0.5))
+	if n < 1 {
+		n = 1
+	}
+
+	return sorted[n-1]
+}
+
+func (s *Server) flushPeriodically() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.Flush()
+			if err != nil {
+				s.logError(err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) logError(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+}
@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+func TestServer(t *testing.T) {
+	os.RemoveAll("/tmp/catena_statsd_test")
+
+	clock := func() time.Time {
+		return time.Unix(1000, 0)
+	}
+
+	db, err := catena.NewDB("/tmp/catena_statsd_test", 100, 0, catena.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := int64(0)
+
+	s := NewServer(db)
+	s.FlushInterval = time.Hour
+	s.clock = func() time.Time {
+		return time.Unix(atomic.LoadInt64(&now), 0)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(conn)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	packets := []string{
+		"requests:1|c\nrequests:2|c|@0.5\nrequests:7|ms",
+		"temperature:20|g\ntemperature:-5|g",
+		"users:a|s\nusers:b|s\nusers:a|s",
+		"latency:1|ms:x",
+	}
+
+	latency := ""
+	for i := 1; i <= 10; i++ {
+		if latency != "" {
+			latency += "\n"
+		}
+
+		latency += "latency:" + string('0'+byte(i%10)) + "|ms"
+	}
+	packets = append(packets, latency)
+
+	for _, packet := range packets {
+		_, err = client.Write([]byte(packet))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for s.Stats().Lines < 19 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close flushes half way through the interval.
+	atomic.StoreInt64(&now, 1800)
+
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := s.Stats(); stats.ParseErrors != 1 {
+		t.Errorf("expected 1 parse error, got %d", stats.ParseErrors)
+	}
+
+	expected := map[string]float64{
+		"counters.requests.count": 5,
+		"counters.requests.rate":  5.0 / 1800,
+		"timers.requests.count":   1,
+		"gauges.temperature":      15,
+		"sets.users.count":        2,
+		"timers.latency.count":    10,
+		"timers.latency.mean":     4.5,
+		"timers.latency.p90":      8,
+		"timers.latency.upper":    9,
+	}
+
+	for metric, value := range expected {
+		points, _, err := db.Range("statsd", metric, 0, 2000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != 1 || points[0].Timestamp != 1000 || points[0].Value != value {
+			t.Errorf("%s: expected %v at 1000, got %v", metric, value, points)
+		}
+	}
+}
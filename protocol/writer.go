@@ -0,0 +1,175 @@
+// Package protocol contains the plumbing shared by catena's
+// ingestion protocols: inserting and batching rows, serving
+// line-based protocols over TCP and writing JSON responses.
+package protocol
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// Insert inserts rows into db. InsertRows rejects a whole batch if
+// any row is older than the retention period, so those rows are
+// dropped and the rest are inserted. The number of dropped rows
+// is returned.
+func Insert(db *catena.DB, rows []catena.Row) (rejected int, err error) {
+	for len(rows) > 0 {
+		err = db.InsertRows(rows)
+
+		retentionErr, ok := err.(*catena.RetentionError)
+		if !ok {
+			return rejected, err
+		}
+
+		kept := make([]catena.Row, 0, len(rows))
+		for _, row := range rows {
+			if row.Timestamp >= retentionErr.Cutoff {
+				kept = append(kept, row)
+			}
+		}
+
+		rejected += len(rows) - len(kept)
+		rows = kept
+	}
+
+	return rejected, nil
+}
+
+// ConvertTimestamp converts a timestamp in the unit from to the unit
+// to. Units that aren't multiples of each other lose precision.
+func ConvertTimestamp(ts int64, from, to time.Duration) int64 {
+	if from >= to {
+		return ts * int64(from/to)
+	}
+
+	return ts / int64(to/from)
+}
+
+// Stats are counters kept by a Writer and a LineServer.
+type Stats struct {
+	// Lines is the number of lines read.
+	Lines int64
+
+	// ParseErrors is the number of malformed lines.
+	ParseErrors int64
+
+	// Written is the number of rows inserted.
+	Written int64
+
+	// Rejected is the number of rows dropped for being
+	// older than the retention period.
+	Rejected int64
+
+	// Failed is the number of rows lost to other insert errors.
+	Failed int64
+}
+
+// A Writer batches rows and inserts them into a DB once a batch
+// is full or the flush interval has passed.
+type Writer struct {
+	db        *catena.DB
+	batchSize int
+
+	rows []catena.Row
+	lock sync.Mutex
+
+	written  int64
+	rejected int64
+	failed   int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWriter returns a Writer that inserts rows into db in batches
+// of batchSize rows. If flushInterval is positive, partial batches
+// are also inserted every flushInterval.
+func NewWriter(db *catena.DB, batchSize int, flushInterval time.Duration) *Writer {
+	w := &Writer{
+		db:        db,
+		batchSize: batchSize,
+		done:      make(chan struct{}),
+	}
+
+	if flushInterval > 0 {
+		w.wg.Add(1)
+		go w.flushPeriodically(flushInterval)
+	}
+
+	return w
+}
+
+// Write adds rows to the current batch, and inserts the
+// batch if it is full.
+func (w *Writer) Write(rows []catena.Row) error {
+	w.lock.Lock()
+	w.rows = append(w.rows, rows...)
+	full := len(w.rows) >= w.batchSize
+	w.lock.Unlock()
+
+	if full {
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// Flush inserts the current batch.
+func (w *Writer) Flush() error {
+	w.lock.Lock()
+	rows := w.rows
+	w.rows = nil
+	w.lock.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	rejected, err := Insert(w.db, rows)
+	atomic.AddInt64(&w.rejected, int64(rejected))
+
+	if err != nil {
+		atomic.AddInt64(&w.failed, int64(len(rows)-rejected))
+		return err
+	}
+
+	atomic.AddInt64(&w.written, int64(len(rows)-rejected))
+	return nil
+}
+
+// Close stops periodic flushing and inserts the current batch.
+func (w *Writer) Close() error {
+	close(w.done)
+	w.wg.Wait()
+
+	return w.Flush()
+}
+
+// Stats returns the Writer's counters.
+func (w *Writer) Stats() Stats {
+	return Stats{
+		Written:  atomic.LoadInt64(&w.written),
+		Rejected: atomic.LoadInt64(&w.rejected),
+		Failed:   atomic.LoadInt64(&w.failed),
+	}
+}
+
+func (w *Writer) flushPeriodically(interval time.Duration) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Errors are counted in the stats.
+			w.Flush()
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package catena
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Cistern/catena/partition"
+)
+
+// Range returns the points for source and metric with timestamps
+// in [start, end). Raw points are returned if the raw partitions
+// still cover start. Otherwise the points older than the oldest raw
+// partition are read from the finest rollup tier that covers start,
+// with each point holding the mean of its bucket, and are followed
+// by the raw points. The resolution of the rollup points is also
+// returned, which is 0 if all of the points are raw.
+func (db *DB) Range(source, metric string, start, end int64) ([]Point, int64, error) {
+	points := []Point{}
+	resolution, err := db.Scan(source, metric, start, end, func(point Point) error {
+		points = append(points, point)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return points, resolution, nil
+}
+
+// Scan calls fn with each point that Range would return, in
+// timestamp order, without keeping raw points in memory. Scanning
+// stops at the first error returned by fn, which is then returned.
+// The resolution of the points is returned as for Range.
+func (db *DB) Scan(source, metric string, start, end int64, fn func(Point) error) (int64, error) {
+	return db.scanAggregators(source, metric, start, end, func(timestamp int64, agg aggregator) error {
+		return fn(Point{
+			Timestamp: timestamp,
+			Value:     agg.value(AggregateMean),
+		})
+	})
+}
+
+// scanAggregators is like Scan, but calls fn with an aggregator of
+// each rollup bucket's stored min, max, sum and count instead of its
+// mean, and with an aggregator of the single value of each raw point.
+func (db *DB) scanAggregators(source, metric string, start, end int64,
+	fn func(int64, aggregator) error) (int64, error) {
+
+	rawFn := func(point Point) error {
+		agg := aggregator{}
+		agg.add(point.Value)
+		return fn(point.Timestamp, agg)
+	}
+
+	tier := db.rangeTier(start)
+	if tier == nil {
+		return 0, db.rawScan(source, metric, start, end, rawFn)
+	}
+
+	// The tier is only read up to the oldest raw
+	// point. The raw partitions cover the rest.
+	rawStart := end
+	if oldest, ok := db.oldestTimestamp(); ok && oldest < end {
+		rawStart = oldest
+	}
+
+	buckets, err := tier.buckets(source, metric, start, rawStart)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, b := range buckets {
+		err = fn(b.timestamp, aggregator{
+			sum:   b.sum,
+			min:   b.min,
+			max:   b.max,
+			count: int64(b.count),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if rawStart < end {
+		err = db.rawScan(source, metric, rawStart, end, rawFn)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return tier.resolution, nil
+}
+
+// rangeTier returns the finest rollup tier that should be used
+// to read points starting at start, or nil if raw points
+// should be used.
+func (db *DB) rangeTier(start int64) *rollupTier {
+	if len(db.rollupTiers) == 0 {
+		return nil
+	}
+
+	var oldestTier *rollupTier
+	oldest, rawOK := db.oldestTimestamp()
+	if rawOK && oldest <= start {
+		return nil
+	}
+
+	for _, tier := range db.rollupTiers {
+		tierOldest, ok := tier.oldestTimestamp()
+		if !ok {
+			continue
+		}
+
+		if tierOldest <= start {
+			return tier
+		}
+
+		if !rawOK || tierOldest < oldest {
+			oldest = tierOldest
+			oldestTier = tier
+			rawOK = true
+		}
+	}
+
+	// Nothing covers start, so use whatever
+	// reaches back the furthest.
+	return oldestTier
+}
+
+// oldestTimestamp returns the oldest timestamp in the raw
+// partitions. ok is false if there are no partitions.
+func (db *DB) oldestTimestamp() (oldest int64, ok bool) {
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		val, _ := i.Value()
+		if !ok || val.MinTimestamp() < oldest {
+			oldest = val.MinTimestamp()
+			ok = true
+		}
+	}
+
+	return oldest, ok
+}
+
+// rawRange returns the raw points for source and metric with
+// timestamps in [start, end).
+func (db *DB) rawRange(source, metric string, start, end int64) ([]Point, error) {
+	points := []Point{}
+	err := db.rawScan(source, metric, start, end, func(point Point) error {
+		points = append(points, point)
+		return nil
+	})
+
+	return points, err
+}
+
+// rawScan calls fn with each raw point for source and metric
+// with a timestamp in [start, end). Partitions that don't overlap
+// [start, end) are skipped without being opened.
+func (db *DB) rawScan(source, metric string, start, end int64, fn func(Point) error) error {
+	parts := db.rangePartitions(start, end)
+
+	// The partitions are scanned oldest first, and each is only
+	// held until it has been scanned.
+	for n := len(parts) - 1; n >= 0; n-- {
+		p := parts[n]
+
+		var err error
+		if p.HasMetric(source, metric) {
+			start, err = scanPartition(p, source, metric, start, end, fn)
+		}
+
+		p.Release()
+
+		if err != nil {
+			for _, p := range parts[:n] {
+				p.Release()
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rangePartitions returns the partitions that may hold points with
+// timestamps in [start, end), newest first. They are held.
+func (db *DB) rangePartitions(start, end int64) []partition.Partition {
+	parts := []partition.Partition{}
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		if p.MinTimestamp() >= end || p.MaxTimestamp() < start {
+			continue
+		}
+
+		p.Hold()
+		parts = append(parts, p)
+	}
+
+	return parts
+}
+
+// scanPartition calls fn with each point for source and metric in p
+// with a timestamp in [start, end). It returns the timestamp after
+// the last point, or start if there were none, so that the next
+// partition can be scanned from there. p must be held.
+func scanPartition(p partition.Partition, source, metric string, start, end int64,
+	fn func(Point) error) (int64, error) {
+
+	i, err := p.NewIterator(source, metric)
+	if err != nil {
+		return start, err
+	}
+
+	defer i.Close()
+
+	for err = i.Seek(start); err == nil; err = i.Next() {
+		point := i.Point()
+		if point.Timestamp >= end {
+			return start, nil
+		}
+
+		err = fn(Point(point))
+		if err != nil {
+			return start, err
+		}
+
+		start = point.Timestamp + 1
+	}
+
+	if err != partition.ErrNoMorePoints {
+		return start, err
+	}
+
+	return start, nil
+}
+
+// partitionPoints returns the points for source and metric in p
+// with timestamps in [start, end). p must be held.
+func partitionPoints(p partition.Partition, source, metric string, start, end int64) ([]partition.Point, error) {
+	points := []partition.Point{}
+
+	if !p.HasMetric(source, metric) {
+		return points, nil
+	}
+
+	i, err := p.NewIterator(source, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	defer i.Close()
+
+	for err = i.Next(); err == nil; err = i.Next() {
+		point := i.Point()
+		if point.Timestamp >= end {
+			return points, nil
+		}
+
+		if point.Timestamp >= start {
+			points = append(points, point)
+		}
+	}
+
+	if err != partition.ErrNoMorePoints {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// mergedPoints returns the points for source and metric across parts,
+// sorted by timestamp. Where several points share a timestamp, the
+// point from the last of parts wins. parts must be held.
+func mergedPoints(parts []partition.Partition, source, metric string) ([]partition.Point, error) {
+	points := []partition.Point{}
+	for _, p := range parts {
+		partPoints, err := partitionPoints(p, source, metric, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+
+		points = append(points, partPoints...)
+	}
+
+	return dedupPoints(points), nil
+}
+
+// partitionRows returns the rows of every series in parts, merged
+// as by mergedPoints. parts must be held.
+func partitionRows(parts []partition.Partition) ([]partition.Row, error) {
+	series := map[string]map[string]struct{}{}
+	for _, p := range parts {
+		for _, source := range p.Sources() {
+			if series[source] == nil {
+				series[source] = map[string]struct{}{}
+			}
+
+			for _, metric := range p.Metrics(source) {
+				series[source][metric] = struct{}{}
+			}
+		}
+	}
+
+	rows := []partition.Row{}
+	for source, metrics := range series {
+		for metric := range metrics {
+			points, err := mergedPoints(parts, source, metric)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, point := range points {
+				rows = append(rows, partition.Row{
+					Source: source,
+					Metric: metric,
+					Point:  point,
+				})
+			}
+		}
+	}
+
+	return rows, nil
+}
+
+// dedupPoints sorts points by timestamp and keeps only the last
+// of any points that share a timestamp.
+func dedupPoints(points []partition.Point) []partition.Point {
+	sort.Stable(pointsByTimestamp(points))
+
+	deduped := points[:0]
+	for _, point := range points {
+		if len(deduped) > 0 && deduped[len(deduped)-1].Timestamp == point.Timestamp {
+			deduped[len(deduped)-1] = point
+			continue
+		}
+
+		deduped = append(deduped, point)
+	}
+
+	return deduped
+}
+
+type pointsByTimestamp []partition.Point
+
+func (p pointsByTimestamp) Len() int           { return len(p) }
+func (p pointsByTimestamp) Less(i, j int) bool { return p[i].Timestamp < p[j].Timestamp }
+func (p pointsByTimestamp) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// bucketStart returns the start of the bucket of the given width
+// that contains timestamp.
+func bucketStart(timestamp, width int64) int64 {
+	start := timestamp - timestamp%width
+	if timestamp < 0 && timestamp%width != 0 {
+		start -= width
+	}
+
+	return start
+}
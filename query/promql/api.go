@@ -0,0 +1,261 @@
+package promql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// A Handler serves the query endpoints of the Prometheus HTTP API,
+// so that dashboards that speak it can query a DB directly:
+//
+//	GET|POST /api/v1/query         query, optional time
+//	GET|POST /api/v1/query_range   query, start, end, step
+//
+// Times are Unix timestamps in seconds or RFC 3339 dates, and step
+// is a duration or a number of seconds.
+type Handler struct {
+	engine *Engine
+	mux    *http.ServeMux
+}
+
+// NewHandler returns a Handler that evaluates queries with engine.
+func NewHandler(engine *Engine) *Handler {
+	h := &Handler{
+		engine: engine,
+		mux:    http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/api/v1/query", h.handleQuery)
+	h.mux.HandleFunc("/api/v1/query_range", h.handleQueryRange)
+
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType ValueType   `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type apiSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  apiPoint          `json:"value"`
+}
+
+type apiSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []apiPoint        `json:"values"`
+}
+
+// An apiPoint is encoded as a pair of the timestamp
+// in seconds and the value as a string.
+type apiPoint [2]interface{}
+
+func (h *Handler) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "bad_data",
+			fmt.Errorf("promql: method %s not allowed", r.Method))
+		return
+	}
+
+	ts := h.engine.db.Now()
+	if s := r.FormValue("time"); s != "" {
+		var err error
+		ts, err = h.parseTime(s)
+		if err != nil {
+			h.writeError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+	}
+
+	v, err := h.engine.Instant(r.FormValue("query"), ts)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: v.Type(),
+			Result:     h.result(v),
+		},
+	})
+}
+
+func (h *Handler) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		h.writeError(w, http.StatusMethodNotAllowed, "bad_data",
+			fmt.Errorf("promql: method %s not allowed", r.Method))
+		return
+	}
+
+	start, err := h.parseTime(r.FormValue("start"))
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	end, err := h.parseTime(r.FormValue("end"))
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	step, err := h.parseStep(r.FormValue("step"))
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	m, err := h.engine.Range(r.FormValue("query"), start, end, step)
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, apiResponse{
+		Status: "success",
+		Data: queryData{
+			ResultType: ValueTypeMatrix,
+			Result:     h.result(m),
+		},
+	})
+}
+
+func (h *Handler) result(v Value) interface{} {
+	switch v := v.(type) {
+	case Scalar:
+		return h.point(catena.Point(v))
+	case Vector:
+		samples := make([]apiSample, len(v))
+		for i, sample := range v {
+			samples[i] = apiSample{
+				Metric: labelsMap(sample.Labels),
+				Value:  h.point(sample.Point),
+			}
+		}
+
+		return samples
+	case Matrix:
+		series := make([]apiSeries, len(v))
+		for i, s := range v {
+			points := make([]apiPoint, len(s.Points))
+			for j, point := range s.Points {
+				points[j] = h.point(point)
+			}
+
+			series[i] = apiSeries{
+				Metric: labelsMap(s.Labels),
+				Values: points,
+			}
+		}
+
+		return series
+	}
+
+	return nil
+}
+
+func (h *Handler) point(point catena.Point) apiPoint {
+	seconds := float64(point.Timestamp) * h.engine.db.TimestampUnit().Seconds()
+
+	value := strconv.FormatFloat(point.Value, 'f', -1, 64)
+	switch {
+	case math.IsInf(point.Value, 1):
+		value = "+Inf"
+	case math.IsInf(point.Value, -1):
+		value = "-Inf"
+	case math.IsNaN(point.Value):
+		value = "NaN"
+	}
+
+	return apiPoint{json.Number(strconv.FormatFloat(seconds, 'f', -1, 64)), value}
+}
+
+// parseTime parses a Unix timestamp in seconds or an RFC 3339
+// date into a timestamp in the DB's unit.
+func (h *Handler) parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("promql: missing time")
+	}
+
+	unit := float64(h.engine.db.TimestampUnit())
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Floor(f * float64(time.Second) / unit)), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("promql: invalid time %q", s)
+	}
+
+	return t.UnixNano() / int64(h.engine.db.TimestampUnit()), nil
+}
+
+// parseStep parses a duration or a number of seconds into
+// a number of units of the DB.
+func (h *Handler) parseStep(s string) (int64, error) {
+	if s == "" {
+		return 0, errors.New("promql: missing step")
+	}
+
+	d, err := parseDuration(s)
+	if err != nil {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f <= 0 {
+			return 0, fmt.Errorf("promql: invalid step %q", s)
+		}
+
+		d = time.Duration(f * float64(time.Second))
+	}
+
+	step := int64(d / h.engine.db.TimestampUnit())
+	if step <= 0 {
+		return 0, fmt.Errorf("promql: step %q is shorter than the DB's timestamp unit", s)
+	}
+
+	return step, nil
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, status int, errorType string, err error) {
+	h.writeJSON(w, status, apiResponse{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     err.Error(),
+	})
+}
+
+func labelsMap(labels []catena.Label) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, label := range labels {
+		m[label.Name] = label.Value
+	}
+
+	return m
+}
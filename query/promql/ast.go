@@ -0,0 +1,258 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Expr is a parsed PromQL expression.
+type Expr interface {
+	// Type returns the type of value the expression evaluates to.
+	Type() ValueType
+
+	String() string
+}
+
+// A MatchType is the type of a label matcher.
+type MatchType int
+
+// Label matcher types.
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+
+	return "?"
+}
+
+// A Matcher matches the value of a label. Series without
+// the label match as if its value were the empty string.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher returns a Matcher. Regular expressions are anchored
+// at both ends.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("promql: invalid regular expression %q: %v", value, err)
+		}
+
+		m.re = re
+	}
+
+	return m, nil
+}
+
+// Matches returns whether value matches.
+func (m *Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+func (m *Matcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// A NumberLiteral is a constant scalar.
+type NumberLiteral struct {
+	Value float64
+}
+
+// A VectorSelector selects the latest point of every matching
+// series. The metric name in a selector is a matcher on __name__.
+type VectorSelector struct {
+	Matchers []*Matcher
+}
+
+// A MatrixSelector selects the points of every matching series
+// within Range of the evaluation time.
+type MatrixSelector struct {
+	*VectorSelector
+	Range time.Duration
+}
+
+// A Call is a function call.
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+// An AggregateExpr aggregates the samples of a vector, grouped by
+// the labels in Grouping, or by all the other labels if Without
+// is set. Param is the k of topk and bottomk.
+type AggregateExpr struct {
+	Op       string
+	Param    Expr
+	Expr     Expr
+	Grouping []string
+	Without  bool
+}
+
+// A BinaryExpr is an arithmetic operation. Between two vectors, it
+// is applied to samples with the same labels, ignoring metric names.
+type BinaryExpr struct {
+	Op  string
+	LHS Expr
+	RHS Expr
+}
+
+// A ParenExpr is a parenthesized expression.
+type ParenExpr struct {
+	Expr Expr
+}
+
+// Type implements Expr.
+func (e *NumberLiteral) Type() ValueType { return ValueTypeScalar }
+
+// Type implements Expr.
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+
+// Type implements Expr.
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+
+// Type implements Expr.
+func (e *Call) Type() ValueType { return functions[e.Func].returnType }
+
+// Type implements Expr.
+func (e *AggregateExpr) Type() ValueType { return ValueTypeVector }
+
+// Type implements Expr.
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+
+	return ValueTypeVector
+}
+
+// Type implements Expr.
+func (e *ParenExpr) Type() ValueType { return e.Expr.Type() }
+
+func (e *NumberLiteral) String() string {
+	return strconv.FormatFloat(e.Value, 'g', -1, 64)
+}
+
+func (e *VectorSelector) String() string {
+	name := ""
+	matchers := []string{}
+
+	for _, m := range e.Matchers {
+		if m.Name == metricNameLabel && m.Type == MatchEqual && name == "" {
+			name = m.Value
+			continue
+		}
+
+		matchers = append(matchers, m.String())
+	}
+
+	if len(matchers) == 0 && name != "" {
+		return name
+	}
+
+	return name + "{" + strings.Join(matchers, ",") + "}"
+}
+
+func (e *MatrixSelector) String() string {
+	return e.VectorSelector.String() + "[" + formatDuration(e.Range) + "]"
+}
+
+func (e *Call) String() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.String()
+	}
+
+	return e.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (e *AggregateExpr) String() string {
+	s := e.Op
+	if len(e.Grouping) > 0 || e.Without {
+		keyword := "by"
+		if e.Without {
+			keyword = "without"
+		}
+
+		s += " " + keyword + " (" + strings.Join(e.Grouping, ", ") + ")"
+	}
+
+	if e.Param != nil {
+		return s + " (" + e.Param.String() + ", " + e.Expr.String() + ")"
+	}
+
+	return s + " (" + e.Expr.String() + ")"
+}
+
+func (e *BinaryExpr) String() string {
+	return e.LHS.String() + " " + e.Op + " " + e.RHS.String()
+}
+
+func (e *ParenExpr) String() string {
+	return "(" + e.Expr.String() + ")"
+}
+
+// formatDuration formats d with the largest units that fit.
+func formatDuration(d time.Duration) string {
+	units := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	}
+
+	if d == 0 {
+		return "0s"
+	}
+
+	s := ""
+	for _, unit := range units {
+		if d >= unit.d {
+			s += strconv.FormatInt(int64(d/unit.d), 10) + unit.name
+			d %= unit.d
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,632 @@
+// Package promql evaluates a subset of PromQL against a catena DB.
+//
+// A catena series maps to a PromQL series the same way as in the
+// Prometheus remote_write protocol: the metric is the __name__ label
+// and the source holds the other labels, encoded with
+// catena.FormatLabels. Sources that aren't encoded labels, such as
+// those written by the Graphite protocol, have a single source label
+// with the whole source as its value.
+//
+// Timestamps are in the DB's unit, and durations in queries are
+// converted to it.
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// DefaultLookbackDelta is how far back an instant vector
+// selector looks for the latest point of a series.
+const DefaultLookbackDelta = 5 * time.Minute
+
+// maxSteps bounds the number of steps of a range query.
+const maxSteps = 11000
+
+// An Engine evaluates queries against a DB.
+type Engine struct {
+	db *catena.DB
+
+	// LookbackDelta is how far back an instant vector selector
+	// looks for the latest point of a series.
+	LookbackDelta time.Duration
+}
+
+// NewEngine returns an Engine for db.
+func NewEngine(db *catena.DB) *Engine {
+	return &Engine{
+		db:            db,
+		LookbackDelta: DefaultLookbackDelta,
+	}
+}
+
+// Instant evaluates query at ts. The result is a Scalar, a Vector,
+// or a Matrix if the query is a range vector selector.
+func (e *Engine) Instant(query string, ts int64) (Value, error) {
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := e.newEvaluator(ts, ts)
+	return ev.eval(expr, ts)
+}
+
+// Range evaluates query at every step from start to end, both
+// inclusive, and returns the series of the results. Scalar
+// results are a series without labels.
+func (e *Engine) Range(query string, start, end, step int64) (Matrix, error) {
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := expr.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+		return nil, fmt.Errorf("promql: range query must return a scalar or an instant vector, got %s", t)
+	}
+
+	if step <= 0 {
+		return nil, errors.New("promql: step must be positive")
+	}
+
+	if end < start {
+		return nil, errors.New("promql: end is before start")
+	}
+
+	if (end-start)/step >= maxSteps {
+		return nil, fmt.Errorf("promql: range query exceeds the maximum of %d steps", maxSteps)
+	}
+
+	ev := e.newEvaluator(start, end)
+
+	seriesByLabels := map[string]*Series{}
+	for t := start; t <= end; t += step {
+		v, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+
+		var samples Vector
+		switch v := v.(type) {
+		case Scalar:
+			samples = Vector{{Labels: []catena.Label{}, Point: catena.Point(v)}}
+		case Vector:
+			samples = v
+		}
+
+		for _, sample := range samples {
+			key := catena.FormatLabels(sample.Labels)
+
+			s := seriesByLabels[key]
+			if s == nil {
+				s = &Series{Labels: sample.Labels}
+				seriesByLabels[key] = s
+			}
+
+			s.Points = append(s.Points, sample.Point)
+		}
+	}
+
+	m := Matrix{}
+	for _, s := range seriesByLabels {
+		m = append(m, *s)
+	}
+
+	sort.Sort(matrixByLabels(m))
+	return m, nil
+}
+
+// A selectedSeries is a series selected by a vector selector,
+// with its points in the time range of the query.
+type selectedSeries struct {
+	labels []catena.Label
+	points []catena.Point
+}
+
+// An evaluator evaluates expressions at timestamps from start to end.
+// Selected series are read once for the whole time range.
+type evaluator struct {
+	db             *catena.DB
+	start          int64
+	end            int64
+	lookback       int64
+	secondsPerUnit float64
+
+	selected map[*VectorSelector][]selectedSeries
+}
+
+func (e *Engine) newEvaluator(start, end int64) *evaluator {
+	ev := &evaluator{
+		db:             e.db,
+		start:          start,
+		end:            end,
+		secondsPerUnit: e.db.TimestampUnit().Seconds(),
+		selected:       map[*VectorSelector][]selectedSeries{},
+	}
+
+	ev.lookback = ev.units(e.LookbackDelta)
+	return ev
+}
+
+// units converts d to the DB's unit. It is at least one unit.
+func (ev *evaluator) units(d time.Duration) int64 {
+	n := int64(d / ev.db.TimestampUnit())
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+func (ev *evaluator) eval(expr Expr, t int64) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{Timestamp: t, Value: e.Value}, nil
+
+	case *ParenExpr:
+		return ev.eval(e.Expr, t)
+
+	case *VectorSelector:
+		return ev.evalVectorSelector(e, t)
+
+	case *MatrixSelector:
+		return ev.evalMatrixSelector(e, t)
+
+	case *Call:
+		return ev.evalCall(e, t)
+
+	case *AggregateExpr:
+		return ev.evalAggregate(e, t)
+
+	case *BinaryExpr:
+		return ev.evalBinary(e, t)
+	}
+
+	return nil, fmt.Errorf("promql: unsupported expression %s", expr)
+}
+
+func (ev *evaluator) evalVectorSelector(sel *VectorSelector, t int64) (Vector, error) {
+	series, err := ev.selectSeries(sel, ev.lookback)
+	if err != nil {
+		return nil, err
+	}
+
+	v := Vector{}
+	for _, s := range series {
+		points := pointsInRange(s.points, t-ev.lookback, t)
+		if len(points) == 0 {
+			continue
+		}
+
+		v = append(v, Sample{
+			Labels: s.labels,
+			Point: catena.Point{
+				Timestamp: t,
+				Value:     points[len(points)-1].Value,
+			},
+		})
+	}
+
+	return v, nil
+}
+
+func (ev *evaluator) evalMatrixSelector(sel *MatrixSelector, t int64) (Matrix, error) {
+	window := ev.units(sel.Range)
+
+	series, err := ev.selectSeries(sel.VectorSelector, window)
+	if err != nil {
+		return nil, err
+	}
+
+	m := Matrix{}
+	for _, s := range series {
+		points := pointsInRange(s.points, t-window, t)
+		if len(points) == 0 {
+			continue
+		}
+
+		m = append(m, Series{Labels: s.labels, Points: points})
+	}
+
+	return m, nil
+}
+
+func (ev *evaluator) evalCall(call *Call, t int64) (Vector, error) {
+	f := functions[call.Func]
+
+	sel := unwrapParens(call.Args[0]).(*MatrixSelector)
+	window := ev.units(sel.Range)
+
+	m, err := ev.evalMatrixSelector(sel, t)
+	if err != nil {
+		return nil, err
+	}
+
+	v := Vector{}
+	seen := map[string]bool{}
+
+	for _, s := range m {
+		value, ok := f.call(s.Points, t-window, t, ev.secondsPerUnit)
+		if !ok {
+			continue
+		}
+
+		labels := dropMetricName(s.Labels)
+
+		key := catena.FormatLabels(labels)
+		if seen[key] {
+			return nil, fmt.Errorf("promql: %s returned more than one series with the labels {%s}", call.Func, key)
+		}
+
+		seen[key] = true
+
+		v = append(v, Sample{
+			Labels: labels,
+			Point:  catena.Point{Timestamp: t, Value: value},
+		})
+	}
+
+	return v, nil
+}
+
+func (ev *evaluator) evalAggregate(agg *AggregateExpr, t int64) (Vector, error) {
+	val, err := ev.eval(agg.Expr, t)
+	if err != nil {
+		return nil, err
+	}
+
+	v := val.(Vector)
+
+	k := 0
+	if agg.Param != nil {
+		param, err := ev.eval(agg.Param, t)
+		if err != nil {
+			return nil, err
+		}
+
+		f := param.(Scalar).Value
+		if math.IsNaN(f) {
+			return nil, fmt.Errorf("promql: %s parameter is not a number", agg.Op)
+		}
+
+		if f >= 1 {
+			k = int(math.Min(f, math.MaxInt32))
+		}
+	}
+
+	type group struct {
+		labels  []catena.Label
+		samples Vector
+	}
+
+	groups := map[string]*group{}
+	keys := []string{}
+
+	for _, sample := range v {
+		labels := groupLabels(sample.Labels, agg.Grouping, agg.Without)
+		key := catena.FormatLabels(labels)
+
+		g := groups[key]
+		if g == nil {
+			g = &group{labels: labels}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+
+		g.samples = append(g.samples, sample)
+	}
+
+	sort.Strings(keys)
+
+	result := Vector{}
+	for _, key := range keys {
+		g := groups[key]
+
+		switch agg.Op {
+		case "topk", "bottomk":
+			samples := make(Vector, len(g.samples))
+			copy(samples, g.samples)
+
+			if agg.Op == "topk" {
+				sort.Stable(sort.Reverse(vectorByValue(samples)))
+			} else {
+				sort.Stable(vectorByValue(samples))
+			}
+
+			if len(samples) > k {
+				samples = samples[:k]
+			}
+
+			result = append(result, samples...)
+			continue
+		}
+
+		result = append(result, Sample{
+			Labels: g.labels,
+			Point: catena.Point{
+				Timestamp: t,
+				Value:     aggregate(agg.Op, g.samples),
+			},
+		})
+	}
+
+	return result, nil
+}
+
+// aggregate applies an aggregation operator to samples.
+func aggregate(op string, samples Vector) float64 {
+	value := samples[0].Value
+
+	for _, sample := range samples[1:] {
+		switch op {
+		case "sum", "avg":
+			value += sample.Value
+		case "min":
+			if sample.Value < value || math.IsNaN(value) {
+				value = sample.Value
+			}
+		case "max":
+			if sample.Value > value || math.IsNaN(value) {
+				value = sample.Value
+			}
+		}
+	}
+
+	switch op {
+	case "avg":
+		value /= float64(len(samples))
+	case "count":
+		value = float64(len(samples))
+	}
+
+	return value
+}
+
+func (ev *evaluator) evalBinary(e *BinaryExpr, t int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, t)
+	if err != nil {
+		return nil, err
+	}
+
+	rhs, err := ev.eval(e.RHS, t)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			return Scalar{Timestamp: t, Value: applyOp(e.Op, l.Value, r.Value)}, nil
+		case Vector:
+			v := make(Vector, len(r))
+			for i, sample := range r {
+				v[i] = Sample{
+					Labels: dropMetricName(sample.Labels),
+					Point:  catena.Point{Timestamp: t, Value: applyOp(e.Op, l.Value, sample.Value)},
+				}
+			}
+
+			return v, nil
+		}
+
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			v := make(Vector, len(l))
+			for i, sample := range l {
+				v[i] = Sample{
+					Labels: dropMetricName(sample.Labels),
+					Point:  catena.Point{Timestamp: t, Value: applyOp(e.Op, sample.Value, r.Value)},
+				}
+			}
+
+			return v, nil
+		case Vector:
+			return vectorBinary(e.Op, l, r, t)
+		}
+	}
+
+	return nil, fmt.Errorf("promql: unsupported operands for %s", e.Op)
+}
+
+// vectorBinary applies op to the samples of lhs and rhs that have
+// the same labels, ignoring metric names.
+func vectorBinary(op string, lhs, rhs Vector, t int64) (Vector, error) {
+	rhsByLabels := map[string]Sample{}
+	for _, sample := range rhs {
+		key := catena.FormatLabels(dropMetricName(sample.Labels))
+		if _, ok := rhsByLabels[key]; ok {
+			return nil, fmt.Errorf("promql: many-to-many matching not allowed: "+
+				"found duplicate series {%s} on the right hand side", key)
+		}
+
+		rhsByLabels[key] = sample
+	}
+
+	v := Vector{}
+	seen := map[string]bool{}
+
+	for _, sample := range lhs {
+		labels := dropMetricName(sample.Labels)
+		key := catena.FormatLabels(labels)
+
+		if seen[key] {
+			return nil, fmt.Errorf("promql: many-to-many matching not allowed: "+
+				"found duplicate series {%s} on the left hand side", key)
+		}
+
+		seen[key] = true
+
+		match, ok := rhsByLabels[key]
+		if !ok {
+			continue
+		}
+
+		v = append(v, Sample{
+			Labels: labels,
+			Point:  catena.Point{Timestamp: t, Value: applyOp(op, sample.Value, match.Value)},
+		})
+	}
+
+	return v, nil
+}
+
+func applyOp(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		return a / b
+	}
+
+	return math.NaN()
+}
+
+// selectSeries returns the series that match sel, with their points
+// from window before the start of the query to its end.
+func (ev *evaluator) selectSeries(sel *VectorSelector, window int64) ([]selectedSeries, error) {
+	if series, ok := ev.selected[sel]; ok {
+		return series, nil
+	}
+
+	// Points are selected in (t-window, t].
+	start, end := ev.start-window+1, ev.end+1
+	series := []selectedSeries{}
+
+	for _, source := range ev.db.Sources(start, end) {
+		labels, err := catena.ParseLabels(source)
+		if err != nil {
+			labels = []catena.Label{{Name: "source", Value: source}}
+		}
+
+		for _, metric := range ev.db.Metrics(source, start, end) {
+			seriesLabels := append([]catena.Label{{Name: metricNameLabel, Value: metric}}, labels...)
+			sort.Sort(labelsByName(seriesLabels))
+
+			if !matchesAll(sel.Matchers, seriesLabels) {
+				continue
+			}
+
+			points, _, err := ev.db.Range(source, metric, start, end)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(points) == 0 {
+				continue
+			}
+
+			series = append(series, selectedSeries{
+				labels: seriesLabels,
+				points: points,
+			})
+		}
+	}
+
+	sort.Sort(selectedSeriesByLabels(series))
+
+	ev.selected[sel] = series
+	return series, nil
+}
+
+// pointsInRange returns the points with timestamps in (start, end].
+// points must be sorted by timestamp.
+func pointsInRange(points []catena.Point, start, end int64) []catena.Point {
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Timestamp > start
+	})
+
+	j := sort.Search(len(points), func(j int) bool {
+		return points[j].Timestamp > end
+	})
+
+	return points[i:j]
+}
+
+func matchesAll(matchers []*Matcher, labels []catena.Label) bool {
+	for _, m := range matchers {
+		if !m.Matches(labelValue(labels, m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func labelValue(labels []catena.Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+
+	return ""
+}
+
+func dropMetricName(labels []catena.Label) []catena.Label {
+	dropped := make([]catena.Label, 0, len(labels))
+	for _, label := range labels {
+		if label.Name != metricNameLabel {
+			dropped = append(dropped, label)
+		}
+	}
+
+	return dropped
+}
+
+// groupLabels returns the labels of the group a sample with labels
+// belongs to.
+func groupLabels(labels []catena.Label, grouping []string, without bool) []catena.Label {
+	group := []catena.Label{}
+
+	for _, label := range labels {
+		listed := false
+		for _, name := range grouping {
+			if label.Name == name {
+				listed = true
+				break
+			}
+		}
+
+		if without && !listed && label.Name != metricNameLabel {
+			group = append(group, label)
+		} else if !without && listed {
+			group = append(group, label)
+		}
+	}
+
+	return group
+}
+
+type labelsByName []catena.Label
+
+func (l labelsByName) Len() int           { return len(l) }
+func (l labelsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l labelsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+type selectedSeriesByLabels []selectedSeries
+
+func (s selectedSeriesByLabels) Len() int { return len(s) }
+func (s selectedSeriesByLabels) Less(i, j int) bool {
+	return catena.FormatLabels(s[i].labels) < catena.FormatLabels(s[j].labels)
+}
+func (s selectedSeriesByLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+type vectorByValue Vector
+
+func (v vectorByValue) Len() int { return len(v) }
+func (v vectorByValue) Less(i, j int) bool {
+	// NaNs sort first, so they are dropped by topk.
+	return v[i].Value < v[j].Value || (math.IsNaN(v[i].Value) && !math.IsNaN(v[j].Value))
+}
+func (v vectorByValue) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
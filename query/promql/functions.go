@@ -0,0 +1,204 @@
+package promql
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Cistern/catena"
+)
+
+// A function computes a value from the points of a series within a
+// range vector. start and end are the bounds of the range and
+// secondsPerUnit converts timestamps to seconds. If ok is false,
+// the series has no value.
+type function struct {
+	argTypes   []ValueType
+	returnType ValueType
+
+	call func(points []catena.Point, start, end int64, secondsPerUnit float64) (value float64, ok bool)
+}
+
+// functions are the supported functions, by name.
+var functions = map[string]*function{
+	"rate":            rangeFunction(rate),
+	"irate":           rangeFunction(irate),
+	"increase":        rangeFunction(increase),
+	"avg_over_time":   rangeFunction(avgOverTime),
+	"sum_over_time":   rangeFunction(sumOverTime),
+	"min_over_time":   rangeFunction(minOverTime),
+	"max_over_time":   rangeFunction(maxOverTime),
+	"count_over_time": rangeFunction(countOverTime),
+}
+
+// Functions returns the names of the supported functions. Every
+// function takes a range vector and returns an instant vector
+// without metric names.
+func Functions() []string {
+	names := []string{}
+	for name := range functions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func rangeFunction(call func([]catena.Point, int64, int64, float64) (float64, bool)) *function {
+	return &function{
+		argTypes:   []ValueType{ValueTypeMatrix},
+		returnType: ValueTypeVector,
+		call:       call,
+	}
+}
+
+// rate returns the per-second rate of increase of a counter.
+func rate(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	increase, ok := extrapolatedIncrease(points, start, end, secondsPerUnit)
+	if !ok {
+		return 0, false
+	}
+
+	return increase / (float64(end-start) * secondsPerUnit), true
+}
+
+// increase returns the increase of a counter over the range.
+func increase(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	return extrapolatedIncrease(points, start, end, secondsPerUnit)
+}
+
+// extrapolatedIncrease returns the increase of a counter between its
+// first and last points, accounting for counter resets, extrapolated
+// towards the bounds of the range the way Prometheus does: up to the
+// bounds if the points get within 110% of the average interval
+// between points, or by half an interval otherwise, and never below
+// a counter value of zero.
+func extrapolatedIncrease(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	first, last := points[0], points[len(points)-1]
+
+	result := last.Value - first.Value
+	prev := first.Value
+	for _, point := range points[1:] {
+		if point.Value < prev {
+			// A counter reset.
+			result += prev
+		}
+
+		prev = point.Value
+	}
+
+	durationToStart := float64(first.Timestamp-start) * secondsPerUnit
+	durationToEnd := float64(end-last.Timestamp) * secondsPerUnit
+	sampledInterval := float64(last.Timestamp-first.Timestamp) * secondsPerUnit
+	averageInterval := sampledInterval / float64(len(points)-1)
+
+	if result > 0 && first.Value >= 0 {
+		durationToZero := sampledInterval * (first.Value / result)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	threshold := averageInterval * 1.1
+	interval := sampledInterval
+
+	if durationToStart < threshold {
+		interval += durationToStart
+	} else {
+		interval += averageInterval / 2
+	}
+
+	if durationToEnd < threshold {
+		interval += durationToEnd
+	} else {
+		interval += averageInterval / 2
+	}
+
+	return result * (interval / sampledInterval), true
+}
+
+// irate returns the per-second rate of increase of a counter
+// between its last two points.
+func irate(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) < 2 {
+		return 0, false
+	}
+
+	prev, last := points[len(points)-2], points[len(points)-1]
+
+	delta := last.Value - prev.Value
+	if delta < 0 {
+		// A counter reset.
+		delta = last.Value
+	}
+
+	interval := float64(last.Timestamp-prev.Timestamp) * secondsPerUnit
+	if interval == 0 {
+		return 0, false
+	}
+
+	return delta / interval, true
+}
+
+func avgOverTime(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	sum, _ := sumOverTime(points, start, end, secondsPerUnit)
+	return sum / float64(len(points)), true
+}
+
+func sumOverTime(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	sum := 0.0
+	for _, point := range points {
+		sum += point.Value
+	}
+
+	return sum, true
+}
+
+func minOverTime(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	min := points[0].Value
+	for _, point := range points[1:] {
+		if point.Value < min || math.IsNaN(min) {
+			min = point.Value
+		}
+	}
+
+	return min, true
+}
+
+func maxOverTime(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	max := points[0].Value
+	for _, point := range points[1:] {
+		if point.Value > max || math.IsNaN(max) {
+			max = point.Value
+		}
+	}
+
+	return max, true
+}
+
+func countOverTime(points []catena.Point, start, end int64, secondsPerUnit float64) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	return float64(len(points)), true
+}
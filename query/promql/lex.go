@@ -0,0 +1,268 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBrace
+	tokenRightBrace
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+	tokenEqual
+	tokenNotEqual
+	tokenRegexpMatch
+	tokenNotRegexpMatch
+	tokenAdd
+	tokenSub
+	tokenMul
+	tokenDiv
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokenEOF {
+		return "end of input"
+	}
+
+	return strconv.Quote(t.val)
+}
+
+// lex splits a query into tokens.
+func lex(input string) ([]token, error) {
+	tokens := []token{}
+
+	for pos := 0; pos < len(input); {
+		c := input[pos]
+		start := pos
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+
+		case isIdentifierStart(c):
+			for pos < len(input) && isIdentifierChar(input[pos]) {
+				pos++
+			}
+
+			tokens = append(tokens, token{tokenIdentifier, input[start:pos], start})
+			continue
+
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			for pos < len(input) && (isDigit(input[pos]) || input[pos] == '.') {
+				pos++
+			}
+
+			// A number followed by a unit is a duration.
+			if pos < len(input) && isDurationUnit(input[pos]) {
+				for pos < len(input) && (isDigit(input[pos]) || isDurationUnit(input[pos])) {
+					pos++
+				}
+
+				tokens = append(tokens, token{tokenDuration, input[start:pos], start})
+				continue
+			}
+
+			// Exponents.
+			if pos < len(input) && (input[pos] == 'e' || input[pos] == 'E') {
+				pos++
+				if pos < len(input) && (input[pos] == '+' || input[pos] == '-') {
+					pos++
+				}
+
+				for pos < len(input) && isDigit(input[pos]) {
+					pos++
+				}
+			}
+
+			tokens = append(tokens, token{tokenNumber, input[start:pos], start})
+			continue
+
+		case c == '"' || c == '\'' || c == '`':
+			s, n, err := lexString(input[pos:])
+			if err != nil {
+				return nil, fmt.Errorf("promql: %v at position %d", err, pos)
+			}
+
+			pos += n
+			tokens = append(tokens, token{tokenString, s, start})
+			continue
+		}
+
+		typ := tokenEOF
+		length := 1
+
+		switch c {
+		case '(':
+			typ = tokenLeftParen
+		case ')':
+			typ = tokenRightParen
+		case '{':
+			typ = tokenLeftBrace
+		case '}':
+			typ = tokenRightBrace
+		case '[':
+			typ = tokenLeftBracket
+		case ']':
+			typ = tokenRightBracket
+		case ',':
+			typ = tokenComma
+		case '+':
+			typ = tokenAdd
+		case '-':
+			typ = tokenSub
+		case '*':
+			typ = tokenMul
+		case '/':
+			typ = tokenDiv
+		case '=':
+			typ = tokenEqual
+			if strings.HasPrefix(input[pos:], "=~") {
+				typ = tokenRegexpMatch
+				length = 2
+			}
+		case '!':
+			if strings.HasPrefix(input[pos:], "!=") {
+				typ = tokenNotEqual
+				length = 2
+			} else if strings.HasPrefix(input[pos:], "!~") {
+				typ = tokenNotRegexpMatch
+				length = 2
+			}
+		}
+
+		if typ == tokenEOF {
+			r, _ := utf8.DecodeRuneInString(input[pos:])
+			return nil, fmt.Errorf("promql: unexpected character %q at position %d", r, pos)
+		}
+
+		pos += length
+		tokens = append(tokens, token{typ, input[start:pos], start})
+	}
+
+	return append(tokens, token{tokenEOF, "", len(input)}), nil
+}
+
+// lexString reads a quoted string at the start of s. It returns
+// the unquoted string and the length of the quoted string.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			quoted := s[:i+1]
+			if quote == '\'' {
+				// Turn it into a double quoted string.
+				quoted = `"` + strings.Replace(strings.Replace(quoted[1:i], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+			}
+
+			unquoted, err := strconv.Unquote(quoted)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid string %s", s[:i+1])
+			}
+
+			return unquoted, i + 1, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// parseDuration parses a duration such as 5m or 1h30m. In addition
+// to the units time.ParseDuration knows, d, w and y are days, weeks
+// and 365 day years.
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+
+	for rest := s; rest != ""; {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+
+		j := i
+		for j < len(rest) && isDurationUnit(rest[j]) {
+			j++
+		}
+
+		if i == 0 || j == i {
+			return 0, fmt.Errorf("promql: invalid duration %q", s)
+		}
+
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("promql: invalid duration %q", s)
+		}
+
+		var unit time.Duration
+		switch rest[i:j] {
+		case "ms":
+			unit = time.Millisecond
+		case "s":
+			unit = time.Second
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		case "d":
+			unit = 24 * time.Hour
+		case "w":
+			unit = 7 * 24 * time.Hour
+		case "y":
+			unit = 365 * 24 * time.Hour
+		default:
+			return 0, fmt.Errorf("promql: invalid duration unit in %q", s)
+		}
+
+		d += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+
+	return d, nil
+}
+
+func isIdentifierStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isDurationUnit(c byte) bool {
+	switch c {
+	case 's', 'm', 'h', 'd', 'w', 'y':
+		return true
+	}
+
+	return false
+}
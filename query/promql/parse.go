@@ -0,0 +1,461 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// aggregateOps are the supported aggregation operators. Those that
+// take a parameter before the vector are true.
+var aggregateOps = map[string]bool{
+	"sum":     false,
+	"avg":     false,
+	"min":     false,
+	"max":     false,
+	"count":   false,
+	"topk":    true,
+	"bottomk": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a PromQL expression.
+//
+// Supported are vector and range vector selectors with label
+// matchers, the functions in Functions, the sum, avg, min, max,
+// count, topk and bottomk aggregations with by and without clauses,
+// and arithmetic between scalars and vectors. Vectors are matched by
+// their labels, ignoring the metric name, so every sample of either
+// side must have at most one match on the other.
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.unexpected(t, "")
+	}
+
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.unexpected(t, context)
+	}
+
+	return t, nil
+}
+
+func (p *parser) unexpected(t token, context string) error {
+	if context != "" {
+		context = " in " + context
+	}
+
+	return fmt.Errorf("promql: unexpected %s%s at position %d", t, context, t.pos)
+}
+
+// precedence returns the precedence of a binary operator,
+// or 0 if t isn't one.
+func precedence(t token) int {
+	switch t.typ {
+	case tokenAdd, tokenSub:
+		return 1
+	case tokenMul, tokenDiv:
+		return 2
+	}
+
+	return 0
+}
+
+// parseExpr parses binary expressions with operators of at least
+// minPrecedence. Operators are left associative.
+func (p *parser) parseExpr(minPrecedence int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		prec := precedence(op)
+		if prec == 0 || prec < minPrecedence {
+			return lhs, nil
+		}
+
+		p.next()
+
+		rhs, err := p.parseExpr(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, operand := range []Expr{lhs, rhs} {
+			if t := operand.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+				return nil, fmt.Errorf("promql: binary expression must contain only scalar and instant vector types, got %s", t)
+			}
+		}
+
+		lhs = &BinaryExpr{Op: op.val, LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	t := p.peek()
+	if t.typ != tokenAdd && t.typ != tokenSub {
+		return p.parsePostfix()
+	}
+
+	p.next()
+
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if expr.Type() != ValueTypeScalar && expr.Type() != ValueTypeVector {
+		return nil, fmt.Errorf("promql: unary expression only allowed on scalars and instant vectors")
+	}
+
+	if t.typ == tokenAdd {
+		return expr, nil
+	}
+
+	if n, ok := expr.(*NumberLiteral); ok {
+		n.Value = -n.Value
+		return n, nil
+	}
+
+	return &BinaryExpr{Op: "*", LHS: &NumberLiteral{Value: -1}, RHS: expr}, nil
+}
+
+// parsePostfix parses a primary expression and an optional range.
+func (p *parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().typ != tokenLeftBracket {
+		return expr, nil
+	}
+
+	t := p.next()
+
+	sel, ok := expr.(*VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("promql: ranges only allowed for vector selectors at position %d", t.pos)
+	}
+
+	t, err = p.expect(tokenDuration, "range")
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := parseDuration(t.val)
+	if err != nil {
+		return nil, err
+	}
+
+	if d <= 0 {
+		return nil, fmt.Errorf("promql: range must be positive at position %d", t.pos)
+	}
+
+	if _, err = p.expect(tokenRightBracket, "range"); err != nil {
+		return nil, err
+	}
+
+	return &MatrixSelector{VectorSelector: sel, Range: d}, nil
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.peek()
+
+	switch t.typ {
+	case tokenNumber:
+		p.next()
+
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("promql: invalid number %q at position %d", t.val, t.pos)
+		}
+
+		return &NumberLiteral{Value: f}, nil
+
+	case tokenLeftParen:
+		p.next()
+
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = p.expect(tokenRightParen, "parenthesized expression"); err != nil {
+			return nil, err
+		}
+
+		return &ParenExpr{Expr: expr}, nil
+
+	case tokenLeftBrace:
+		return p.parseSelector("")
+
+	case tokenIdentifier:
+		p.next()
+
+		switch strings.ToLower(t.val) {
+		case "inf":
+			return &NumberLiteral{Value: math.Inf(1)}, nil
+		case "nan":
+			return &NumberLiteral{Value: math.NaN()}, nil
+		}
+
+		if _, ok := aggregateOps[t.val]; ok {
+			return p.parseAggregate(t.val)
+		}
+
+		if p.peek().typ == tokenLeftParen {
+			return p.parseCall(t)
+		}
+
+		return p.parseSelector(t.val)
+	}
+
+	return nil, p.unexpected(t, "expression")
+}
+
+// parseSelector parses the label matchers of a selector for metric,
+// which may be empty.
+func (p *parser) parseSelector(metric string) (Expr, error) {
+	sel := &VectorSelector{}
+
+	if metric != "" {
+		m, _ := NewMatcher(MatchEqual, metricNameLabel, metric)
+		sel.Matchers = append(sel.Matchers, m)
+	}
+
+	if p.peek().typ == tokenLeftBrace {
+		p.next()
+
+		for p.peek().typ != tokenRightBrace {
+			name, err := p.expect(tokenIdentifier, "label matching")
+			if err != nil {
+				return nil, err
+			}
+
+			var matchType MatchType
+
+			op := p.next()
+			switch op.typ {
+			case tokenEqual:
+				matchType = MatchEqual
+			case tokenNotEqual:
+				matchType = MatchNotEqual
+			case tokenRegexpMatch:
+				matchType = MatchRegexp
+			case tokenNotRegexpMatch:
+				matchType = MatchNotRegexp
+			default:
+				return nil, p.unexpected(op, "label matching")
+			}
+
+			value, err := p.expect(tokenString, "label matching")
+			if err != nil {
+				return nil, err
+			}
+
+			m, err := NewMatcher(matchType, name.val, value.val)
+			if err != nil {
+				return nil, err
+			}
+
+			sel.Matchers = append(sel.Matchers, m)
+
+			if p.peek().typ != tokenComma {
+				break
+			}
+
+			p.next()
+		}
+
+		if _, err := p.expect(tokenRightBrace, "label matching"); err != nil {
+			return nil, err
+		}
+	}
+
+	// A selector has to narrow down the series somehow.
+	for _, m := range sel.Matchers {
+		if !m.Matches("") {
+			return sel, nil
+		}
+	}
+
+	return nil, fmt.Errorf("promql: vector selector must contain at least one non-empty matcher")
+}
+
+func (p *parser) parseCall(name token) (Expr, error) {
+	f, ok := functions[name.val]
+	if !ok {
+		return nil, fmt.Errorf("promql: unknown function %q at position %d", name.val, name.pos)
+	}
+
+	p.next()
+
+	call := &Call{Func: name.val}
+	for p.peek().typ != tokenRightParen {
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+
+		call.Args = append(call.Args, arg)
+
+		if p.peek().typ != tokenComma {
+			break
+		}
+
+		p.next()
+	}
+
+	if _, err := p.expect(tokenRightParen, "function call"); err != nil {
+		return nil, err
+	}
+
+	if len(call.Args) != len(f.argTypes) {
+		return nil, fmt.Errorf("promql: function %q expects %d arguments, got %d",
+			name.val, len(f.argTypes), len(call.Args))
+	}
+
+	for i, arg := range call.Args {
+		if t := unwrapParens(arg).Type(); t != f.argTypes[i] {
+			return nil, fmt.Errorf("promql: function %q expects argument %d of type %s, got %s",
+				name.val, i+1, f.argTypes[i], t)
+		}
+	}
+
+	return call, nil
+}
+
+// parseAggregate parses an aggregation. The grouping clause
+// may come before or after the arguments.
+func (p *parser) parseAggregate(op string) (Expr, error) {
+	agg := &AggregateExpr{Op: op}
+
+	grouped, err := p.parseGrouping(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = p.expect(tokenLeftParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	if aggregateOps[op] {
+		agg.Param, err = p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+
+		if agg.Param.Type() != ValueTypeScalar {
+			return nil, fmt.Errorf("promql: %s expects a scalar parameter", op)
+		}
+
+		if _, err = p.expect(tokenComma, "aggregation"); err != nil {
+			return nil, err
+		}
+	}
+
+	agg.Expr, err = p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if agg.Expr.Type() != ValueTypeVector {
+		return nil, fmt.Errorf("promql: %s expects an instant vector, got %s", op, agg.Expr.Type())
+	}
+
+	if _, err = p.expect(tokenRightParen, "aggregation"); err != nil {
+		return nil, err
+	}
+
+	if !grouped {
+		if _, err = p.parseGrouping(agg); err != nil {
+			return nil, err
+		}
+	}
+
+	return agg, nil
+}
+
+// parseGrouping parses an optional by or without clause into agg.
+func (p *parser) parseGrouping(agg *AggregateExpr) (bool, error) {
+	t := p.peek()
+	if t.typ != tokenIdentifier || (t.val != "by" && t.val != "without") {
+		return false, nil
+	}
+
+	p.next()
+	agg.Without = t.val == "without"
+
+	if _, err := p.expect(tokenLeftParen, "grouping"); err != nil {
+		return false, err
+	}
+
+	for p.peek().typ != tokenRightParen {
+		label, err := p.expect(tokenIdentifier, "grouping")
+		if err != nil {
+			return false, err
+		}
+
+		agg.Grouping = append(agg.Grouping, label.val)
+
+		if p.peek().typ != tokenComma {
+			break
+		}
+
+		p.next()
+	}
+
+	if _, err := p.expect(tokenRightParen, "grouping"); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func unwrapParens(expr Expr) Expr {
+	for {
+		paren, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+
+		expr = paren.Expr
+	}
+}
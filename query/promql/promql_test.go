@@ -0,0 +1,282 @@
+package promql
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Cistern/catena"
+)
+
+func newTestDB(t *testing.T, dir string) *catena.DB {
+	os.RemoveAll(dir)
+
+	db, err := catena.NewDB(dir, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counters for two instances, b growing twice as fast as a,
+	// and gauges with a source that isn't encoded labels.
+	rows := []catena.Row{}
+	for ts := int64(0); ts <= 300; ts += 15 {
+		for i, instance := range []string{"a", "b"} {
+			rows = append(rows, catena.Row{
+				Source: catena.FormatLabels([]catena.Label{
+					{Name: "instance", Value: instance},
+					{Name: "job", Value: "api"},
+				}),
+				Metric: "http_requests_total",
+				Point: catena.Point{
+					Timestamp: ts,
+					Value:     float64(ts/15*10) * float64(i+1),
+				},
+			})
+		}
+
+		rows = append(rows, catena.Row{
+			Source: "servers.web01",
+			Metric: "load",
+			Point:  catena.Point{Timestamp: ts, Value: float64(ts % 60)},
+		})
+
+		rows = append(rows, catena.Row{
+			Source: "servers.web01",
+			Metric: "uptime",
+			Point:  catena.Point{Timestamp: ts, Value: float64(ts)},
+		})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestParse(t *testing.T) {
+	valid := map[string]string{
+		`up`: `up`,
+		`http_requests_total{job="api", instance!~'b.*'}`: `http_requests_total{job="api",instance!~"b.*"}`,
+		`{__name__=~"http_.*"}[1h30m]`:                    `{__name__=~"http_.*"}[1h30m]`,
+		`sum by (job) (rate(http_requests_total[5m]))`:    `sum by (job) (rate(http_requests_total[5m]))`,
+		`sum(rate(http_requests_total[5m])) without (a)`:  `sum without (a) (rate(http_requests_total[5m]))`,
+		`topk(3, avg_over_time(load[10m]))`:               `topk (3, avg_over_time(load[10m]))`,
+		`a + b * 2 - -1`:                                  `a + b * 2 - -1`,
+		`(a + b) / 2e3`:                                   `(a + b) / 2000`,
+		`-a`:                                              `-1 * a`,
+	}
+
+	for query, expected := range valid {
+		expr, err := Parse(query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+
+		if expr.String() != expected {
+			t.Errorf("%s: expected %s, got %s", query, expected, expr)
+		}
+	}
+
+	invalid := []string{
+		``,
+		`{job=~".*"}`,
+		`up{job="api"`,
+		`rate(up)`,
+		`rate(up[5m], 1)`,
+		`unknown(up[5m])`,
+		`up[5m] + 1`,
+		`(up)[5m]`,
+		`sum(up[5m])`,
+		`topk(up, up)`,
+		`up{job=~"("}`,
+		`up[5x]`,
+		`up "string"`,
+	}
+
+	for _, query := range invalid {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestInstant(t *testing.T) {
+	db := newTestDB(t, "/tmp/catena_promql_instant_test")
+	defer db.Close()
+
+	e := NewEngine(db)
+
+	tests := []struct {
+		query  string
+		labels []string
+		values []float64
+	}{
+		{
+			query:  `http_requests_total{job="api"}`,
+			labels: []string{"__name__=http_requests_total,instance=a,job=api", "__name__=http_requests_total,instance=b,job=api"},
+			values: []float64{200, 400},
+		},
+		{
+			query:  `rate(http_requests_total{instance="a"}[1m])`,
+			labels: []string{"instance=a,job=api"},
+			values: []float64{10.0 / 15},
+		},
+		{
+			query:  `sum by (job) (rate(http_requests_total[1m]))`,
+			labels: []string{"job=api"},
+			values: []float64{30.0 / 15},
+		},
+		{
+			query:  `topk(1, http_requests_total)`,
+			labels: []string{"__name__=http_requests_total,instance=b,job=api"},
+			values: []float64{400},
+		},
+		{
+			query:  `http_requests_total / missing_metric`,
+			labels: []string{},
+			values: []float64{},
+		},
+		{
+			query:  `increase(http_requests_total[2m]) / rate(http_requests_total[2m])`,
+			labels: []string{"instance=a,job=api", "instance=b,job=api"},
+			values: []float64{120, 120},
+		},
+		{
+			query:  `avg_over_time(load{source="servers.web01"}[1m]) * 2`,
+			labels: []string{"source=servers.web01"},
+			values: []float64{45},
+		},
+		{
+			query:  `count(http_requests_total) + max(load)`,
+			labels: []string{""},
+			values: []float64{2},
+		},
+	}
+
+	for _, test := range tests {
+		v, err := e.Instant(test.query, 300)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+
+		vector, ok := v.(Vector)
+		if !ok || len(vector) != len(test.values) {
+			t.Errorf("%s: unexpected result %v", test.query, v)
+			continue
+		}
+
+		for i, sample := range vector {
+			if catena.FormatLabels(sample.Labels) != test.labels[i] ||
+				math.Abs(sample.Value-test.values[i]) > 1e-9 || sample.Timestamp != 300 {
+				t.Errorf("%s: expected {%s} %v, got %v", test.query, test.labels[i], test.values[i], sample)
+			}
+		}
+	}
+
+	v, err := e.Instant(`2 * (3 + 4)`, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ok := v.(Scalar); !ok || s.Value != 14 {
+		t.Errorf("unexpected result %v", v)
+	}
+
+	// Points older than the lookback delta aren't selected.
+	v, err = e.Instant(`http_requests_total`, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v.(Vector)) != 0 {
+		t.Errorf("expected no samples, got %v", v)
+	}
+
+	_, err = e.Instant(`load + {source="servers.web01"}`, 300)
+	if err == nil {
+		t.Error("expected a many-to-many matching error")
+	}
+}
+
+func TestRange(t *testing.T) {
+	db := newTestDB(t, "/tmp/catena_promql_range_test")
+	defer db.Close()
+
+	e := NewEngine(db)
+
+	m, err := e.Range(`sum(http_requests_total)`, 60, 300, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m) != 1 || len(m[0].Labels) != 0 || len(m[0].Points) != 5 {
+		t.Fatalf("unexpected result %v", m)
+	}
+
+	for i, point := range m[0].Points {
+		ts := int64(60 + 60*i)
+		if point.Timestamp != ts || point.Value != float64(ts/15*30) {
+			t.Errorf("unexpected point %v", point)
+		}
+	}
+
+	m, err = e.Range(`max_over_time(load[1m])`, 0, 300, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m) != 1 || len(m[0].Points) != 21 || m[0].Points[20].Value != 45 {
+		t.Fatalf("unexpected result %v", m)
+	}
+
+	if _, err = e.Range(`load[1m]`, 0, 300, 15); err == nil {
+		t.Error("expected an error for a range vector")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	db := newTestDB(t, "/tmp/catena_promql_handler_test")
+	defer db.Close()
+
+	h := NewHandler(NewEngine(db))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", `/api/v1/query?query=topk(1,http_requests_total)&time=300`, nil))
+
+	expected := `{"status":"success","data":{"resultType":"vector","result":[` +
+		`{"metric":{"__name__":"http_requests_total","instance":"b","job":"api"},"value":[300,"400"]}]}}` + "\n"
+	if w.Code != 200 || w.Body.String() != expected {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", `/api/v1/query_range?query=load&start=1970-01-01T00:04:00Z&end=300&step=30s`, nil))
+
+	resp := struct {
+		Data struct {
+			Result []apiSeries
+		}
+	}{}
+
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != 200 || len(resp.Data.Result) != 1 || len(resp.Data.Result[0].Values) != 3 {
+		t.Errorf("unexpected response %d %+v", w.Code, resp)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", `/api/v1/query?query=rate(load)`, nil))
+
+	if w.Code != 400 {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,73 @@
+package promql
+
+import (
+	"github.com/Cistern/catena"
+)
+
+// metricNameLabel is the label that holds a series' metric name.
+const metricNameLabel = "__name__"
+
+// A ValueType is the type of a Value.
+type ValueType string
+
+// Value types.
+const (
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+)
+
+// A Value is the result of evaluating an expression:
+// a Scalar, a Vector or a Matrix.
+type Value interface {
+	Type() ValueType
+}
+
+// A Scalar is a single value at a timestamp.
+type Scalar catena.Point
+
+// A Sample is a point of a series.
+type Sample struct {
+	// Labels are sorted by name.
+	Labels []catena.Label
+	catena.Point
+}
+
+// A Vector is a set of samples with the same timestamp,
+// one for each series.
+type Vector []Sample
+
+// A Series is a series' points in timestamp order.
+type Series struct {
+	// Labels are sorted by name.
+	Labels []catena.Label
+	Points []catena.Point
+}
+
+// A Matrix is a set of series.
+type Matrix []Series
+
+// Type implements Value.
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+
+// Type implements Value.
+func (Vector) Type() ValueType { return ValueTypeVector }
+
+// Type implements Value.
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+
+type matrixByLabels Matrix
+
+func (m matrixByLabels) Len() int { return len(m) }
+func (m matrixByLabels) Less(i, j int) bool {
+	return catena.FormatLabels(m[i].Labels) < catena.FormatLabels(m[j].Labels)
+}
+func (m matrixByLabels) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+
+type vectorByLabels Vector
+
+func (v vectorByLabels) Len() int { return len(v) }
+func (v vectorByLabels) Less(i, j int) bool {
+	return catena.FormatLabels(v[i].Labels) < catena.FormatLabels(v[j].Labels)
+}
+func (v vectorByLabels) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
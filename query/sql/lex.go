@@ -0,0 +1,198 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+	tokenSemicolon
+	tokenStar
+	tokenAdd
+	tokenSub
+	tokenEqual
+	tokenLess
+	tokenLessEqual
+	tokenGreater
+	tokenGreaterEqual
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	if t.typ == tokenEOF {
+		return "end of query"
+	}
+
+	return strconv.Quote(t.val)
+}
+
+// is returns whether t is the keyword k, ignoring case.
+func (t token) is(k string) bool {
+	return t.typ == tokenIdentifier && strings.EqualFold(t.val, k)
+}
+
+// lex splits a query into tokens.
+func lex(input string) ([]token, error) {
+	tokens := []token{}
+
+	for pos := 0; pos < len(input); {
+		c := input[pos]
+		start := pos
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+
+		case isLetter(c) || c == '_':
+			for pos < len(input) && (isLetter(input[pos]) || isDigit(input[pos]) || input[pos] == '_') {
+				pos++
+			}
+
+			tokens = append(tokens, token{tokenIdentifier, input[start:pos], start})
+			continue
+
+		case isDigit(c):
+			for pos < len(input) && isDigit(input[pos]) {
+				pos++
+			}
+
+			// A number followed by a unit is a duration.
+			if pos < len(input) && isLetter(input[pos]) {
+				for pos < len(input) && isLetter(input[pos]) {
+					pos++
+				}
+
+				tokens = append(tokens, token{tokenDuration, input[start:pos], start})
+				continue
+			}
+
+			tokens = append(tokens, token{tokenNumber, input[start:pos], start})
+			continue
+
+		case c == '\'':
+			// Quotes are escaped by doubling them.
+			s := []byte{}
+			for pos++; ; pos++ {
+				if pos == len(input) {
+					return nil, fmt.Errorf("sql: unterminated string at position %d", start)
+				}
+
+				if input[pos] == '\'' {
+					if pos+1 < len(input) && input[pos+1] == '\'' {
+						pos++
+					} else {
+						break
+					}
+				}
+
+				s = append(s, input[pos])
+			}
+
+			pos++
+			tokens = append(tokens, token{tokenString, string(s), start})
+			continue
+		}
+
+		typ := tokenEOF
+		length := 1
+
+		switch c {
+		case '(':
+			typ = tokenLeftParen
+		case ')':
+			typ = tokenRightParen
+		case ',':
+			typ = tokenComma
+		case ';':
+			typ = tokenSemicolon
+		case '*':
+			typ = tokenStar
+		case '+':
+			typ = tokenAdd
+		case '-':
+			typ = tokenSub
+		case '=':
+			typ = tokenEqual
+		case '<':
+			typ = tokenLess
+			if strings.HasPrefix(input[pos:], "<=") {
+				typ = tokenLessEqual
+				length = 2
+			}
+		case '>':
+			typ = tokenGreater
+			if strings.HasPrefix(input[pos:], ">=") {
+				typ = tokenGreaterEqual
+				length = 2
+			}
+		}
+
+		if typ == tokenEOF {
+			return nil, fmt.Errorf("sql: unexpected character %q at position %d", c, pos)
+		}
+
+		pos += length
+		tokens = append(tokens, token{typ, input[start:pos], start})
+	}
+
+	return append(tokens, token{tokenEOF, "", len(input)}), nil
+}
+
+// durationUnits are the units of duration literals.
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"u":  time.Microsecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseDuration parses a duration literal such as 10s or 1h.
+func parseDuration(s string) (time.Duration, error) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("sql: invalid duration %q", s)
+	}
+
+	unit, ok := durationUnits[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("sql: invalid duration unit in %q", s)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
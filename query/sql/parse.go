@@ -0,0 +1,444 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+// A Statement is a parsed SELECT statement.
+type Statement struct {
+	// Aggregate is empty if the statement selects raw values.
+	Aggregate catena.Aggregate
+
+	Source string
+	Metric string
+
+	// Conditions restrict the time range. They are combined with AND.
+	Conditions []TimeCondition
+
+	// GroupBy is the width of the time buckets, or 0.
+	GroupBy time.Duration
+
+	// Limit is the maximum number of points returned, or 0.
+	Limit int
+}
+
+// A TimeCondition compares the time of points to Value.
+// Op is one of =, <, <=, > and >=.
+type TimeCondition struct {
+	Op    string
+	Value TimeExpr
+}
+
+// A TimeExpr is a point in time: now(), a timestamp in the DB's unit,
+// or an RFC 3339 date, plus an offset.
+type TimeExpr struct {
+	Now       bool
+	Timestamp int64
+	Date      time.Time
+	Offset    time.Duration
+}
+
+// resolve returns e as a timestamp in the DB's unit.
+func (e TimeExpr) resolve(db *catena.DB) int64 {
+	unit := db.TimestampUnit()
+
+	ts := e.Timestamp
+	switch {
+	case e.Now:
+		ts = db.Now()
+	case !e.Date.IsZero():
+		ts = e.Date.UnixNano() / int64(unit)
+	}
+
+	return ts + int64(e.Offset/unit)
+}
+
+func (e TimeExpr) String() string {
+	s := strconv.FormatInt(e.Timestamp, 10)
+	switch {
+	case e.Now:
+		s = "now()"
+	case !e.Date.IsZero():
+		s = "'" + e.Date.Format(time.RFC3339Nano) + "'"
+	}
+
+	switch {
+	case e.Offset > 0:
+		s += "+" + formatDuration(e.Offset)
+	case e.Offset < 0:
+		s += "-" + formatDuration(-e.Offset)
+	}
+
+	return s
+}
+
+func (s *Statement) String() string {
+	field := "value"
+	if s.Aggregate != "" {
+		field = string(s.Aggregate) + "(value)"
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM source=%s AND metric=%s", field, quote(s.Source), quote(s.Metric))
+
+	for i, c := range s.Conditions {
+		keyword := " AND"
+		if i == 0 {
+			keyword = " WHERE"
+		}
+
+		q += keyword + " time " + c.Op + " " + c.Value.String()
+	}
+
+	if s.GroupBy > 0 {
+		q += " GROUP BY time(" + formatDuration(s.GroupBy) + ")"
+	}
+
+	if s.Limit > 0 {
+		q += " LIMIT " + strconv.Itoa(s.Limit)
+	}
+
+	return q
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a statement of the form
+//
+//	SELECT value | aggregate(value)
+//	FROM source='...' AND metric='...'
+//	[WHERE time <op> <time> [AND ...]]
+//	[GROUP BY time(<duration>)]
+//	[LIMIT <n>]
+//
+// Keywords are case insensitive. The aggregates are those of
+// catena.Aggregate, and GROUP BY requires one. Conditions on source,
+// metric and time may be given in FROM and WHERE alike. Times are
+// now(), integer timestamps in the DB's unit or RFC 3339 dates in
+// quotes, optionally plus or minus durations such as 1h or 30s.
+func Parse(query string) (*Statement, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	s := &Statement{}
+
+	err = p.expectKeyword("SELECT")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.parseField(s)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.expectKeyword("FROM")
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.parseConditions(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().is("WHERE") {
+		p.next()
+
+		err = p.parseConditions(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Source == "" || s.Metric == "" {
+		return nil, fmt.Errorf("sql: statement must select a source and a metric")
+	}
+
+	if p.peek().is("GROUP") {
+		err = p.parseGroupBy(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek().is("LIMIT") {
+		p.next()
+
+		t, err := p.expect(tokenNumber, "LIMIT")
+		if err != nil {
+			return nil, err
+		}
+
+		s.Limit, err = strconv.Atoi(t.val)
+		if err != nil || s.Limit <= 0 {
+			return nil, fmt.Errorf("sql: invalid limit %s", t.val)
+		}
+	}
+
+	if p.peek().typ == tokenSemicolon {
+		p.next()
+	}
+
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.unexpected(t, "")
+	}
+
+	return s, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) expect(typ tokenType, context string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.unexpected(t, context)
+	}
+
+	return t, nil
+}
+
+func (p *parser) expectKeyword(k string) error {
+	t := p.next()
+	if !t.is(k) {
+		return fmt.Errorf("sql: expected %s, got %s at position %d", k, t, t.pos)
+	}
+
+	return nil
+}
+
+func (p *parser) unexpected(t token, context string) error {
+	if context != "" {
+		context = " in " + context
+	}
+
+	return fmt.Errorf("sql: unexpected %s%s at position %d", t, context, t.pos)
+}
+
+// parseField parses value, * or aggregate(value).
+func (p *parser) parseField(s *Statement) error {
+	t := p.next()
+	switch {
+	case t.typ == tokenStar || t.is("value"):
+		return nil
+	case t.typ != tokenIdentifier:
+		return p.unexpected(t, "SELECT")
+	}
+
+	a := catena.Aggregate(strings.ToLower(t.val))
+	if err := a.Valid(); err != nil {
+		return fmt.Errorf("sql: unknown aggregate %q at position %d", t.val, t.pos)
+	}
+
+	s.Aggregate = a
+
+	if _, err := p.expect(tokenLeftParen, "SELECT"); err != nil {
+		return err
+	}
+
+	if t = p.next(); !t.is("value") {
+		return p.unexpected(t, "SELECT")
+	}
+
+	_, err := p.expect(tokenRightParen, "SELECT")
+	return err
+}
+
+// parseConditions parses conditions separated by AND.
+func (p *parser) parseConditions(s *Statement) error {
+	for {
+		err := p.parseCondition(s)
+		if err != nil {
+			return err
+		}
+
+		if !p.peek().is("AND") {
+			return nil
+		}
+
+		p.next()
+	}
+}
+
+func (p *parser) parseCondition(s *Statement) error {
+	t := p.next()
+
+	switch {
+	case t.is("source"), t.is("metric"):
+		if _, err := p.expect(tokenEqual, "condition"); err != nil {
+			return err
+		}
+
+		value, err := p.expect(tokenString, "condition")
+		if err != nil {
+			return err
+		}
+
+		field := &s.Source
+		if t.is("metric") {
+			field = &s.Metric
+		}
+
+		if *field != "" {
+			return fmt.Errorf("sql: %s is selected more than once", strings.ToLower(t.val))
+		}
+
+		if value.val == "" {
+			return fmt.Errorf("sql: empty %s at position %d", strings.ToLower(t.val), value.pos)
+		}
+
+		*field = value.val
+		return nil
+
+	case t.is("time"):
+		op := p.next()
+		switch op.typ {
+		case tokenEqual, tokenLess, tokenLessEqual, tokenGreater, tokenGreaterEqual:
+		default:
+			return p.unexpected(op, "time condition")
+		}
+
+		value, err := p.parseTimeExpr()
+		if err != nil {
+			return err
+		}
+
+		s.Conditions = append(s.Conditions, TimeCondition{Op: op.val, Value: value})
+		return nil
+	}
+
+	return p.unexpected(t, "condition")
+}
+
+func (p *parser) parseTimeExpr() (TimeExpr, error) {
+	e := TimeExpr{}
+
+	t := p.next()
+	switch {
+	case t.is("now"):
+		if _, err := p.expect(tokenLeftParen, "now()"); err != nil {
+			return e, err
+		}
+
+		if _, err := p.expect(tokenRightParen, "now()"); err != nil {
+			return e, err
+		}
+
+		e.Now = true
+
+	case t.typ == tokenNumber:
+		ts, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("sql: invalid timestamp %s at position %d", t.val, t.pos)
+		}
+
+		e.Timestamp = ts
+
+	case t.typ == tokenString:
+		date, err := time.Parse(time.RFC3339Nano, t.val)
+		if err != nil {
+			return e, fmt.Errorf("sql: invalid date %q at position %d", t.val, t.pos)
+		}
+
+		e.Date = date
+
+	default:
+		return e, p.unexpected(t, "time")
+	}
+
+	for p.peek().typ == tokenAdd || p.peek().typ == tokenSub {
+		sign := p.next()
+
+		t, err := p.expect(tokenDuration, "time")
+		if err != nil {
+			return e, err
+		}
+
+		d, err := parseDuration(t.val)
+		if err != nil {
+			return e, err
+		}
+
+		if sign.typ == tokenSub {
+			d = -d
+		}
+
+		e.Offset += d
+	}
+
+	return e, nil
+}
+
+// parseGroupBy parses GROUP BY time(<duration>).
+func (p *parser) parseGroupBy(s *Statement) error {
+	p.next()
+
+	if err := p.expectKeyword("BY"); err != nil {
+		return err
+	}
+
+	if err := p.expectKeyword("time"); err != nil {
+		return err
+	}
+
+	if _, err := p.expect(tokenLeftParen, "GROUP BY"); err != nil {
+		return err
+	}
+
+	t, err := p.expect(tokenDuration, "GROUP BY")
+	if err != nil {
+		return err
+	}
+
+	s.GroupBy, err = parseDuration(t.val)
+	if err != nil {
+		return err
+	}
+
+	if s.GroupBy <= 0 {
+		return fmt.Errorf("sql: GROUP BY interval must be positive")
+	}
+
+	if s.Aggregate == "" {
+		return fmt.Errorf("sql: GROUP BY requires an aggregate")
+	}
+
+	_, err = p.expect(tokenRightParen, "GROUP BY")
+	return err
+}
+
+// formatDuration formats d with the largest unit that divides it.
+func formatDuration(d time.Duration) string {
+	for _, unit := range []string{"w", "d", "h", "m", "s", "ms", "us", "ns"} {
+		if d%durationUnits[unit] == 0 {
+			return strconv.FormatInt(int64(d/durationUnits[unit]), 10) + unit
+		}
+	}
+
+	return d.String()
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,239 @@
+// Package sql implements a small SQL-like query language for ad-hoc
+// analysis of a catena DB, such as
+//
+//	SELECT mean(value) FROM source='r1' AND metric='if_in'
+//	WHERE time > now()-1h GROUP BY time(1m)
+//
+// Statements are compiled into a Plan that runs a single DB.Range,
+// DB.AggregateRange or DB.DownsampleRange call.
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Cistern/catena"
+)
+
+// An Operation is the DB operation a Plan runs.
+type Operation string
+
+// Operations.
+const (
+	OperationRange      Operation = "range"
+	OperationAggregate  Operation = "aggregate"
+	OperationDownsample Operation = "downsample"
+)
+
+// A Plan is a compiled statement.
+type Plan struct {
+	Operation Operation
+	Source    string
+	Metric    string
+
+	// Start and End bound the time range as [Start, End). They are
+	// narrowed to the time range of the DB's partitions.
+	Start int64
+	End   int64
+
+	Aggregate catena.Aggregate
+
+	// Width is the bucket width of a downsample, in the DB's unit.
+	Width int64
+
+	Limit int
+
+	// Empty is set if no partition overlaps the time range,
+	// in which case the DB isn't read at all.
+	Empty bool
+}
+
+// A Result holds the points returned by a query.
+type Result struct {
+	// Column is "value", or the name of the aggregate.
+	Column string
+
+	// Points are in timestamp order. Aggregated points have the
+	// timestamp of the start of their time range or bucket.
+	Points []catena.Point
+
+	// Resolution is the resolution of raw values read from a
+	// rollup tier, or 0.
+	Resolution int64
+}
+
+// errLimit stops a scan once the limit is reached.
+var errLimit = errors.New("sql: limit reached")
+
+// Query parses, compiles and executes query against db.
+func Query(db *catena.DB, query string) (*Result, error) {
+	s, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := Compile(db, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan.Execute(db)
+}
+
+// Compile plans s for db. Time conditions are resolved against the
+// DB's clock, intersected, and narrowed to the minimum and maximum
+// timestamps of the DB's partitions, so that the time range only
+// covers partitions that may hold points.
+func Compile(db *catena.DB, s *Statement) (*Plan, error) {
+	plan := &Plan{
+		Operation: OperationRange,
+		Source:    s.Source,
+		Metric:    s.Metric,
+		Start:     math.MinInt64,
+		End:       math.MaxInt64,
+		Aggregate: s.Aggregate,
+		Limit:     s.Limit,
+	}
+
+	if s.Aggregate != "" {
+		plan.Operation = OperationAggregate
+	}
+
+	if s.GroupBy > 0 {
+		plan.Operation = OperationDownsample
+
+		plan.Width = int64(s.GroupBy / db.TimestampUnit())
+		if plan.Width <= 0 {
+			return nil, fmt.Errorf("sql: GROUP BY interval %v is shorter than the DB's timestamp unit",
+				s.GroupBy)
+		}
+	}
+
+	for _, c := range s.Conditions {
+		ts := c.Value.resolve(db)
+
+		start, end := int64(math.MinInt64), int64(math.MaxInt64)
+		switch c.Op {
+		case "=":
+			start, end = ts, ts+1
+		case ">":
+			start = ts + 1
+		case ">=":
+			start = ts
+		case "<":
+			end = ts
+		case "<=":
+			end = ts + 1
+		}
+
+		if start > plan.Start {
+			plan.Start = start
+		}
+
+		if end < plan.End {
+			plan.End = end
+		}
+	}
+
+	// Clamp the bounds to the timestamps in the DB, so that an
+	// open-ended condition doesn't span all of int64 and a range
+	// outside of the DB is known to be empty before it is read.
+	// Scans only open the partitions that overlap the bounds.
+	if min := db.MinTimestamp(); min > plan.Start {
+		plan.Start = min
+	}
+
+	if max := db.MaxTimestamp(); max < plan.End-1 {
+		plan.End = max + 1
+	}
+
+	if plan.Start >= plan.End {
+		plan.Empty = true
+	}
+
+	return plan, nil
+}
+
+// Execute runs p against db.
+func (p *Plan) Execute(db *catena.DB) (*Result, error) {
+	result := &Result{
+		Column: "value",
+		Points: []catena.Point{},
+	}
+
+	if p.Aggregate != "" {
+		result.Column = string(p.Aggregate)
+	}
+
+	add := func(point catena.Point) error {
+		result.Points = append(result.Points, point)
+		if p.Limit > 0 && len(result.Points) >= p.Limit {
+			return errLimit
+		}
+
+		return nil
+	}
+
+	var err error
+
+	switch p.Operation {
+	case OperationRange:
+		if !p.Empty {
+			result.Resolution, err = db.Scan(p.Source, p.Metric, p.Start, p.End, add)
+		}
+	case OperationAggregate:
+		value := emptyAggregate(p.Aggregate)
+		if !p.Empty {
+			value, err = db.AggregateRange(p.Source, p.Metric, p.Start, p.End, p.Aggregate)
+		}
+
+		if err == nil {
+			err = add(catena.Point{Timestamp: p.Start, Value: value})
+		}
+	case OperationDownsample:
+		if !p.Empty {
+			err = db.DownsampleRange(p.Source, p.Metric, p.Start, p.End, p.Width, p.Aggregate, add)
+		}
+	default:
+		err = fmt.Errorf("sql: unknown operation %q", p.Operation)
+	}
+
+	if err != nil && err != errLimit {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (p *Plan) String() string {
+	s := fmt.Sprintf("%s source=%q metric=%q start=%d end=%d", p.Operation, p.Source, p.Metric, p.Start, p.End)
+
+	if p.Aggregate != "" {
+		s += " aggregate=" + string(p.Aggregate)
+	}
+
+	if p.Width > 0 {
+		s += fmt.Sprintf(" width=%d", p.Width)
+	}
+
+	if p.Limit > 0 {
+		s += fmt.Sprintf(" limit=%d", p.Limit)
+	}
+
+	if p.Empty {
+		s += " empty"
+	}
+
+	return s
+}
+
+// emptyAggregate returns the result of a over no points.
+func emptyAggregate(a catena.Aggregate) float64 {
+	switch a {
+	case catena.AggregateSum, catena.AggregateCount:
+		return 0
+	}
+
+	return math.NaN()
+}
@@ -0,0 +1,171 @@
+package sql
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+func TestParse(t *testing.T) {
+	valid := map[string]string{
+		"SELECT mean(value) FROM source='r1' AND metric='if_in' WHERE time > now()-1h GROUP BY time(1m)": "SELECT mean(value) FROM source='r1' AND metric='if_in' WHERE time > now()-1h GROUP BY time(1m)",
+		"select * from metric='if_in' where source='it''s' and time <= 100+90s limit 10;":                "SELECT value FROM source='it''s' AND metric='if_in' WHERE time <= 100+90s LIMIT 10",
+		"SELECT MAX(value) FROM source='r1' AND metric='m' AND time >= '2016-01-02T03:04:05Z'":           "SELECT max(value) FROM source='r1' AND metric='m' WHERE time >= '2016-01-02T03:04:05Z'",
+	}
+
+	for query, expected := range valid {
+		s, err := Parse(query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+
+		if s.String() != expected {
+			t.Errorf("%s: expected %s, got %s", query, expected, s)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"SELECT value",
+		"SELECT value FROM source='r1'",
+		"SELECT median(value) FROM source='r1' AND metric='m'",
+		"SELECT value FROM source='r1' AND metric='m' GROUP BY time(1m)",
+		"SELECT mean(value) FROM source='r1' AND metric='m' GROUP BY time(1x)",
+		"SELECT value FROM source='r1' AND source='r2' AND metric='m'",
+		"SELECT value FROM source='r1' AND metric='m' WHERE time > 'yesterday'",
+		"SELECT value FROM source='r1' AND metric='m' WHERE time ! 5",
+		"SELECT value FROM source='r1 AND metric='m'",
+		"SELECT value FROM source='r1' AND metric='m' LIMIT 0",
+		"SELECT value FROM source='r1' AND metric='m' ORDER BY time",
+	}
+
+	for _, query := range invalid {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	os.RemoveAll("/tmp/catena_sql_test")
+
+	db, err := catena.NewDB("/tmp/catena_sql_test", 1000, 0,
+		catena.WithClock(func() time.Time { return time.Unix(7200, 0) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	rows := []catena.Row{}
+	for ts := int64(0); ts < 7200; ts += 10 {
+		rows = append(rows, catena.Row{
+			Source: "r1",
+			Metric: "if_in",
+			Point:  catena.Point{Timestamp: ts, Value: float64(ts)},
+		})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Parse("SELECT mean(value) FROM source='r1' AND metric='if_in' WHERE time > now()-1h GROUP BY time(1m)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := Compile(db, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The end of the range is narrowed to the newest point.
+	expectedPlan := `downsample source="r1" metric="if_in" start=3601 end=7191 aggregate=mean width=60`
+	if plan.String() != expectedPlan {
+		t.Errorf("expected plan %s, got %s", expectedPlan, plan)
+	}
+
+	result, err := plan.Execute(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Column != "mean" || len(result.Points) != 60 ||
+		result.Points[0] != (catena.Point{Timestamp: 3600, Value: 3630}) ||
+		result.Points[59] != (catena.Point{Timestamp: 7140, Value: 7165}) {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	tests := []struct {
+		query  string
+		points []catena.Point
+	}{
+		{
+			query:  "SELECT value FROM source='r1' AND metric='if_in' WHERE time >= 100 AND time < 130",
+			points: []catena.Point{{Timestamp: 100, Value: 100}, {Timestamp: 110, Value: 110}, {Timestamp: 120, Value: 120}},
+		},
+		{
+			query:  "SELECT * FROM source='r1' AND metric='if_in' WHERE time > '1970-01-01T01:00:00Z' LIMIT 2",
+			points: []catena.Point{{Timestamp: 3610, Value: 3610}, {Timestamp: 3620, Value: 3620}},
+		},
+		{
+			query:  "SELECT count(value) FROM source='r1' AND metric='if_in'",
+			points: []catena.Point{{Timestamp: 0, Value: 720}},
+		},
+		{
+			query:  "SELECT sum(value) FROM source='r1' AND metric='if_in' WHERE time = 7190",
+			points: []catena.Point{{Timestamp: 7190, Value: 7190}},
+		},
+		{
+			query:  "SELECT count(value) FROM source='r1' AND metric='if_in' WHERE time > now()",
+			points: []catena.Point{{Timestamp: 7201, Value: 0}},
+		},
+		{
+			query:  "SELECT max(value) FROM source='r1' AND metric='if_in' WHERE time < 120 GROUP BY time(1m)",
+			points: []catena.Point{{Timestamp: 0, Value: 50}, {Timestamp: 60, Value: 110}},
+		},
+		{
+			query:  "SELECT value FROM source='r2' AND metric='if_in'",
+			points: []catena.Point{},
+		},
+	}
+
+	for _, test := range tests {
+		result, err := Query(db, test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+
+		if len(result.Points) != len(test.points) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.points, result.Points)
+			continue
+		}
+
+		for i := range test.points {
+			if result.Points[i] != test.points[i] {
+				t.Errorf("%s: expected %v, got %v", test.query, test.points, result.Points)
+				break
+			}
+		}
+	}
+
+	s, err = Parse("SELECT value FROM source='r1' AND metric='if_in' WHERE time > now()")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err = Compile(db, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !plan.Empty {
+		t.Errorf("expected an empty plan, got %s", plan)
+	}
+}
@@ -0,0 +1,85 @@
+package catena
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/vfs"
+)
+
+// An openCountingPartition counts the iterators opened on a partition.
+type openCountingPartition struct {
+	partition.Partition
+	opened *int
+}
+
+func (p openCountingPartition) NewIterator(source, metric string) (partition.Iterator, error) {
+	*p.opened++
+	return p.Partition.NewIterator(source, metric)
+}
+
+func TestRangePruning(t *testing.T) {
+	db, err := NewDB("/tmp/catena_range_pruning_test", 10, 0, WithFS(vfs.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 50; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := []partition.Partition{}
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+		parts = append(parts, p)
+	}
+
+	opened := map[int64]*int{}
+	for _, p := range parts {
+		counter := new(int)
+		opened[p.MinTimestamp()] = counter
+
+		err = db.partitionList.Swap(p, openCountingPartition{Partition: p, opened: counter})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(opened) != 5 {
+		t.Fatalf("expected 5 partitions, got %d", len(opened))
+	}
+
+	points, _, err := db.Range("a", "b", 18, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Point{}
+	for ts := int64(18); ts < 30; ts++ {
+		expected = append(expected, Point{Timestamp: ts, Value: float64(ts)})
+	}
+
+	if !reflect.DeepEqual(points, expected) {
+		t.Errorf("expected %v, got %v", expected, points)
+	}
+
+	// Only the partitions starting at 10 and 20 overlap [18, 30).
+	for min, count := range opened {
+		if shouldOpen := min == 10 || min == 20; (*count == 1) != shouldOpen || *count > 1 {
+			t.Errorf("partition starting at %d opened %d times", min, *count)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
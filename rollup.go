@@ -0,0 +1,397 @@
+package catena
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/partition/disk"
+)
+
+// Rollup partitions store four series for every raw series,
+// named after the raw metric with one of these suffixes.
+const (
+	rollupSeparator = "#"
+
+	rollupMin   = "min"
+	rollupMax   = "max"
+	rollupSum   = "sum"
+	rollupCount = "count"
+)
+
+// A rollupTier is a set of downsampled partitions at a single
+// resolution. Raw partitions are rolled up into every tier just
+// before they are dropped.
+type rollupTier struct {
+	// resolution is the bucket width in timestamp units.
+	resolution int64
+	retention  time.Duration
+	dir        string
+
+	// partitions is ordered by minimum timestamp. Several rollup
+	// partitions may share buckets when the raw partition size
+	// is not a multiple of the resolution, so buckets are merged
+	// at read time.
+	partitions []*disk.DiskPartition
+	lock       sync.RWMutex
+}
+
+// A rollupBucket summarizes the points of a series within a
+// single bucket of a rollup tier.
+type rollupBucket struct {
+	timestamp int64
+	min       float64
+	max       float64
+	sum       float64
+	count     float64
+}
+
+// WithRollup adds a rollup tier that keeps min, max, sum and count
+// summaries of every series at the given resolution for the given
+// retention period. Raw partitions are rolled up into every tier
+// before they are dropped. Range reads from the finest tier that
+// still covers the requested time range.
+func WithRollup(resolution, retention time.Duration) Option {
+	return func(db *DB) {
+		db.rollupTiers = append(db.rollupTiers, &rollupTier{
+			// Converted to timestamp units by initRollupTiers.
+			resolution: int64(resolution),
+			retention:  retention,
+		})
+	}
+}
+
+// initRollupTiers converts the configured rollup resolutions to
+// timestamp units and orders the tiers from finest to coarsest.
+func (db *DB) initRollupTiers() {
+	for _, tier := range db.rollupTiers {
+		tier.resolution = tier.resolution / int64(db.timestampUnit)
+		if tier.resolution < 1 {
+			tier.resolution = 1
+		}
+
+		tier.dir = filepath.Join(db.baseDir, fmt.Sprintf("rollup_%d", tier.resolution))
+	}
+
+	sort.Sort(rollupTiersByResolution(db.rollupTiers))
+}
+
+type rollupTiersByResolution []*rollupTier
+
+func (t rollupTiersByResolution) Len() int           { return len(t) }
+func (t rollupTiersByResolution) Less(i, j int) bool { return t[i].resolution < t[j].resolution }
+func (t rollupTiersByResolution) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// loadRollupTiers creates the rollup tier directories if needed
+// and opens any existing rollup partitions. A read only DB doesn't
+// create directories.
+func (db *DB) loadRollupTiers() error {
+	for _, tier := range db.rollupTiers {
+		if !db.readOnly {
+			err := db.fs.MkdirAll(tier.dir, 0755)
+			if err != nil {
+				return err
+			}
+		}
+
+		names, err := db.fs.ReadDirNames(tier.dir)
+		if err != nil {
+			if db.readOnly && os.IsNotExist(err) {
+				continue
+			}
+
+			return err
+		}
+
+		ids := []int{}
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".part") {
+				continue
+			}
+
+			id, err := partitionID(name)
+			if err != nil {
+				return err
+			}
+
+			ids = append(ids, int(id))
+		}
+
+		sort.Ints(ids)
+
+		for _, id := range ids {
+			p, err := disk.OpenDiskPartitionFS(db.fs, filepath.Join(tier.dir, fmt.Sprintf("%d.part", id)))
+			if err != nil {
+				return err
+			}
+
+			tier.partitions = append(tier.partitions, p)
+		}
+
+		sort.Sort(diskPartitionsByMinTimestamp(tier.partitions))
+	}
+
+	return nil
+}
+
+// rollup summarizes the points in p into buckets for every
+// rollup tier. p must be held.
+func (db *DB) rollup(p partition.Partition) error {
+	if len(db.rollupTiers) == 0 {
+		return nil
+	}
+
+	id, err := partitionID(p.Filename())
+	if err != nil {
+		return err
+	}
+
+	rowsByTier := make([][]partition.Row, len(db.rollupTiers))
+
+	for _, source := range p.Sources() {
+		for _, metric := range p.Metrics(source) {
+			points, err := partitionPoints(p, source, metric, math.MinInt64, math.MaxInt64)
+			if err != nil {
+				return err
+			}
+
+			for i, tier := range db.rollupTiers {
+				for _, b := range tier.summarize(points) {
+					rowsByTier[i] = append(rowsByTier[i], b.rows(source, metric)...)
+				}
+			}
+		}
+	}
+
+	for i, tier := range db.rollupTiers {
+		if len(rowsByTier[i]) == 0 {
+			continue
+		}
+
+		rollupPart, err := writeDiskPartition(db.fs, filepath.Join(tier.dir, fmt.Sprintf("%d.part", id)),
+			rowsByTier[i])
+		if err != nil {
+			return err
+		}
+
+		tier.add(rollupPart)
+	}
+
+	return nil
+}
+
+// add adds p to the tier, replacing any partition with the same
+// file name.
+func (tier *rollupTier) add(p *disk.DiskPartition) {
+	tier.lock.Lock()
+
+	var replaced *disk.DiskPartition
+	partitions := []*disk.DiskPartition{}
+	for _, existing := range tier.partitions {
+		if existing.Filename() == p.Filename() {
+			replaced = existing
+			continue
+		}
+
+		partitions = append(partitions, existing)
+	}
+
+	partitions = append(partitions, p)
+	sort.Sort(diskPartitionsByMinTimestamp(partitions))
+	tier.partitions = partitions
+
+	tier.lock.Unlock()
+
+	if replaced != nil {
+		// The file has already been replaced on disk,
+		// so only close the old mapping.
+		replaced.ExclusiveHold()
+		replaced.Close()
+		replaced.ExclusiveRelease()
+	}
+}
+
+// dropExpired drops rollup partitions that fall outside of the
+// tier's retention period.
+func (tier *rollupTier) dropExpired(db *DB) {
+	if tier.retention <= 0 {
+		return
+	}
+
+	cutoff := db.clock().Add(-tier.retention).UnixNano() / int64(db.timestampUnit)
+
+	tier.lock.Lock()
+	expired := []*disk.DiskPartition{}
+	partitions := []*disk.DiskPartition{}
+	for _, p := range tier.partitions {
+		if p.MaxTimestamp() < cutoff {
+			expired = append(expired, p)
+			continue
+		}
+
+		partitions = append(partitions, p)
+	}
+	tier.partitions = partitions
+	tier.lock.Unlock()
+
+	for _, p := range expired {
+		p.ExclusiveHold()
+		p.Destroy()
+		p.ExclusiveRelease()
+	}
+}
+
+// oldestTimestamp returns the oldest timestamp covered by the tier.
+// ok is false if the tier is empty.
+func (tier *rollupTier) oldestTimestamp() (oldest int64, ok bool) {
+	tier.lock.RLock()
+	defer tier.lock.RUnlock()
+
+	if len(tier.partitions) == 0 {
+		return 0, false
+	}
+
+	return tier.partitions[0].MinTimestamp(), true
+}
+
+// summarize groups points into the tier's buckets. points must
+// be sorted by timestamp.
+func (tier *rollupTier) summarize(points []partition.Point) []rollupBucket {
+	buckets := []rollupBucket{}
+
+	for _, point := range points {
+		ts := bucketStart(point.Timestamp, tier.resolution)
+
+		if len(buckets) == 0 || buckets[len(buckets)-1].timestamp != ts {
+			buckets = append(buckets, rollupBucket{
+				timestamp: ts,
+				min:       point.Value,
+				max:       point.Value,
+			})
+		}
+
+		b := &buckets[len(buckets)-1]
+		b.min = math.Min(b.min, point.Value)
+		b.max = math.Max(b.max, point.Value)
+		b.sum += point.Value
+		b.count++
+	}
+
+	return buckets
+}
+
+// buckets returns the merged buckets for source and metric with
+// timestamps in [start, end).
+func (tier *rollupTier) buckets(source, metric string, start, end int64) ([]rollupBucket, error) {
+	tier.lock.RLock()
+	partitions := append([]*disk.DiskPartition(nil), tier.partitions...)
+	tier.lock.RUnlock()
+
+	merged := map[int64]*rollupBucket{}
+
+	for _, p := range partitions {
+		p.Hold()
+
+		if p.MaxTimestamp() < start || p.MinTimestamp() >= end ||
+			!p.HasMetric(source, metric+rollupSeparator+rollupCount) {
+			p.Release()
+			continue
+		}
+
+		fields := map[string][]partition.Point{}
+		for _, field := range []string{rollupMin, rollupMax, rollupSum, rollupCount} {
+			points, err := partitionPoints(p, source, metric+rollupSeparator+field, start, end)
+			if err != nil {
+				p.Release()
+				return nil, err
+			}
+
+			fields[field] = points
+		}
+
+		p.Release()
+
+		for i, countPoint := range fields[rollupCount] {
+			b := rollupBucket{
+				timestamp: countPoint.Timestamp,
+				min:       fields[rollupMin][i].Value,
+				max:       fields[rollupMax][i].Value,
+				sum:       fields[rollupSum][i].Value,
+				count:     countPoint.Value,
+			}
+
+			existing, present := merged[b.timestamp]
+			if !present {
+				merged[b.timestamp] = &b
+				continue
+			}
+
+			existing.min = math.Min(existing.min, b.min)
+			existing.max = math.Max(existing.max, b.max)
+			existing.sum += b.sum
+			existing.count += b.count
+		}
+	}
+
+	buckets := make([]rollupBucket, 0, len(merged))
+	for _, b := range merged {
+		buckets = append(buckets, *b)
+	}
+
+	sort.Sort(bucketsByTimestamp(buckets))
+
+	return buckets, nil
+}
+
+// rows returns the rows that store b for the given raw series.
+func (b rollupBucket) rows(source, metric string) []partition.Row {
+	row := func(field string, value float64) partition.Row {
+		return partition.Row{
+			Source: source,
+			Metric: metric + rollupSeparator + field,
+			Point: partition.Point{
+				Timestamp: b.timestamp,
+				Value:     value,
+			},
+		}
+	}
+
+	return []partition.Row{
+		row(rollupMin, b.min),
+		row(rollupMax, b.max),
+		row(rollupSum, b.sum),
+		row(rollupCount, b.count),
+	}
+}
+
+type diskPartitionsByMinTimestamp []*disk.DiskPartition
+
+func (p diskPartitionsByMinTimestamp) Len() int { return len(p) }
+func (p diskPartitionsByMinTimestamp) Less(i, j int) bool {
+	return p[i].MinTimestamp() < p[j].MinTimestamp()
+}
+func (p diskPartitionsByMinTimestamp) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+type bucketsByTimestamp []rollupBucket
+
+func (b bucketsByTimestamp) Len() int           { return len(b) }
+func (b bucketsByTimestamp) Less(i, j int) bool { return b[i].timestamp < b[j].timestamp }
+func (b bucketsByTimestamp) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// rollupMetricName returns the raw metric name for a rollup
+// series name. ok is false if name is not the count series of a
+// rollup, so that every raw metric is only reported once.
+func rollupMetricName(name string) (metric string, ok bool) {
+	suffix := rollupSeparator + rollupCount
+	if !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(name, suffix), true
+}
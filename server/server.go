@@ -0,0 +1,372 @@
+// Package server exposes a catena DB over HTTP with a JSON API.
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/Cistern/catena"
+	"github.com/Cistern/catena/protocol"
+)
+
+// A Handler serves the JSON API for a DB. It handles the
+// following endpoints:
+//
+//	POST /rows        inserts a JSON array of rows
+//	GET  /sources     lists sources, optionally within [start, end)
+//	GET  /metrics     lists the metrics of source
+//	GET  /range       streams the points of source and metric
+//	GET  /aggregate   aggregates the points of source and metric,
+//	                  optionally into buckets of the given interval
+//	GET  /health      reports the DB's health, with status 503
+//	                  if it is unhealthy
+//
+// start and end are timestamps and are optional everywhere.
+// Errors are returned as a JSON object with an "error" field.
+type Handler struct {
+	db  *catena.DB
+	mux *http.ServeMux
+}
+
+// NewHandler returns a Handler that serves db.
+func NewHandler(db *catena.DB) *Handler {
+	h := &Handler{
+		db:  db,
+		mux: http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/rows", h.handleRows)
+	h.mux.HandleFunc("/sources", h.handleSources)
+	h.mux.HandleFunc("/metrics", h.handleMetrics)
+	h.mux.HandleFunc("/range", h.handleRange)
+	h.mux.HandleFunc("/aggregate", h.handleAggregate)
+	h.mux.HandleFunc("/health", h.handleHealth)
+
+	return h
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+
+	// Cutoff is set when rows were rejected for being
+	// older than the retention period.
+	Cutoff *int64 `json:"cutoff,omitempty"`
+}
+
+// handleRows inserts the rows in the request body.
+func (h *Handler) handleRows(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	rows := []catena.Row{}
+	err := json.NewDecoder(r.Body).Decode(&rows)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = h.db.InsertRows(rows)
+	if err != nil {
+		writeInsertError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeInsertError writes the response for an error returned by
+// InsertRows. Rows older than the retention period are the client's
+// fault, and a DB that doesn't accept writes conflicts with the
+// request regardless of its contents.
+func writeInsertError(w http.ResponseWriter, err error) {
+	if retentionErr, ok := err.(*catena.RetentionError); ok {
+		protocol.WriteJSON(w, http.StatusUnprocessableEntity, errorResponse{
+			Error:  retentionErr.Error(),
+			Cutoff: &retentionErr.Cutoff,
+		})
+		return
+	}
+
+	if err == catena.ErrReadOnly {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func (h *Handler) handleSources(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sources := h.db.Sources(start, end)
+	sort.Strings(sources)
+
+	protocol.WriteJSON(w, http.StatusOK, sources)
+}
+
+func (h *Handler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	source, err := requiredParam(r, "source")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	start, end, err := parseTimeRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	metrics := h.db.Metrics(source, start, end)
+	sort.Strings(metrics)
+
+	protocol.WriteJSON(w, http.StatusOK, metrics)
+}
+
+// handleRange streams the points returned by DB.Scan. Once the
+// first point has been written the status can't change anymore,
+// so an error while scanning leaves the response truncated.
+func (h *Handler) handleRange(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	source, metric, start, end, err := parseSeriesRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pw := newPointWriter(w)
+	pw.begin(source, metric)
+
+	resolution, err := h.db.Scan(source, metric, start, end, pw.write)
+	if err != nil {
+		pw.abort()
+		return
+	}
+
+	pw.end(fmt.Sprintf(`,"resolution":%d`, resolution))
+}
+
+// handleAggregate applies the aggregate parameter to a range. With an
+// interval parameter the range is downsampled and the buckets are
+// streamed as points. Otherwise a single value is returned.
+func (h *Handler) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	source, metric, start, end, err := parseSeriesRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	aggregate := catena.Aggregate(r.FormValue("aggregate"))
+	err = aggregate.Valid()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if r.FormValue("interval") == "" {
+		value, err := h.db.AggregateRange(source, metric, start, end, aggregate)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		protocol.WriteJSON(w, http.StatusOK, struct {
+			Source    string           `json:"source"`
+			Metric    string           `json:"metric"`
+			Aggregate catena.Aggregate `json:"aggregate"`
+			Value     json.RawMessage  `json:"value"`
+		}{
+			Source:    source,
+			Metric:    metric,
+			Aggregate: aggregate,
+			Value:     json.RawMessage(formatValue(value)),
+		})
+		return
+	}
+
+	interval, err := strconv.ParseInt(r.FormValue("interval"), 10, 64)
+	if err != nil || interval <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("server: invalid interval %q", r.FormValue("interval")))
+		return
+	}
+
+	pw := newPointWriter(w)
+	pw.begin(source, metric)
+
+	err = h.db.DownsampleRange(source, metric, start, end, interval, aggregate, pw.write)
+	if err != nil {
+		pw.abort()
+		return
+	}
+
+	pw.end(fmt.Sprintf(`,"aggregate":%s,"interval":%d`, quote(string(aggregate)), interval))
+}
+
+// A pointWriter streams a JSON object with a "points" array.
+type pointWriter struct {
+	w       http.ResponseWriter
+	buf     *bufio.Writer
+	written int
+}
+
+func newPointWriter(w http.ResponseWriter) *pointWriter {
+	return &pointWriter{
+		w:   w,
+		buf: bufio.NewWriter(w),
+	}
+}
+
+func (pw *pointWriter) begin(source, metric string) {
+	pw.w.Header().Set("Content-Type", "application/json")
+	pw.w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(pw.buf, `{"source":%s,"metric":%s,"points":[`, quote(source), quote(metric))
+}
+
+func (pw *pointWriter) write(point catena.Point) error {
+	if pw.written > 0 {
+		pw.buf.WriteByte(',')
+	}
+
+	_, err := fmt.Fprintf(pw.buf, `{"timestamp":%d,"value":%s}`,
+		point.Timestamp, formatValue(point.Value))
+	pw.written++
+
+	// Stop scanning if the client has gone away.
+	return err
+}
+
+// end closes the points array, appends the already encoded
+// fields in extra and terminates the object.
+func (pw *pointWriter) end(extra string) {
+	pw.buf.WriteString("]" + extra + "}\n")
+	pw.buf.Flush()
+}
+
+// abort flushes what has been written so far without closing
+// the object, so that clients see a malformed response.
+func (pw *pointWriter) abort() {
+	pw.buf.Flush()
+}
+
+// formatValue encodes v as JSON. NaN and infinite
+// values, which JSON can't represent, are null.
+func formatValue(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "null"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// handleHealth serves the DB's health, so that load balancers
+// and monitoring can check the status code alone.
+func (h *Handler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	health := h.db.Health()
+
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	protocol.WriteJSON(w, status, health)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("server: method %s not allowed", r.Method))
+	return false
+}
+
+func requiredParam(r *http.Request, name string) (string, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return "", fmt.Errorf("server: missing parameter %s", name)
+	}
+
+	return value, nil
+}
+
+// parseTimeRange returns the start and end parameters. They
+// default to the smallest and largest possible timestamps.
+func parseTimeRange(r *http.Request) (start, end int64, err error) {
+	start, end = math.MinInt64, math.MaxInt64
+
+	if s := r.FormValue("start"); s != "" {
+		start, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("server: invalid start %q", s)
+		}
+	}
+
+	if s := r.FormValue("end"); s != "" {
+		end, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("server: invalid end %q", s)
+		}
+	}
+
+	return start, end, nil
+}
+
+func parseSeriesRange(r *http.Request) (source, metric string, start, end int64, err error) {
+	source, err = requiredParam(r, "source")
+	if err != nil {
+		return
+	}
+
+	metric, err = requiredParam(r, "metric")
+	if err != nil {
+		return
+	}
+
+	start, end, err = parseTimeRange(r)
+	return
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	protocol.WriteJSON(w, status, errorResponse{Error: err.Error()})
+}
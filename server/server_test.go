@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cistern/catena"
+)
+
+func TestHandler(t *testing.T) {
+	os.RemoveAll("/tmp/catena_server_test")
+
+	clock := func() time.Time {
+		return time.Unix(1000, 0)
+	}
+
+	db, err := catena.NewDB("/tmp/catena_server_test", 100, 0,
+		catena.WithRetention(500*time.Second), catena.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(NewHandler(db))
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/rows", "application/json", strings.NewReader(`[
+		{"source": "a", "metric": "b", "timestamp": 600, "value": 1},
+		{"source": "a", "metric": "b", "timestamp": 610, "value": 2},
+		{"source": "a", "metric": "b", "timestamp": 650, "value": 3},
+		{"source": "a", "metric": "c", "timestamp": 600, "value": 4},
+		{"source": "d", "metric": "b", "timestamp": 700, "value": 5}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	sources := []string{}
+	getJSON(t, s.URL+"/sources", http.StatusOK, &sources)
+	if strings.Join(sources, ",") != "a,d" {
+		t.Errorf("unexpected sources %v", sources)
+	}
+
+	metrics := []string{}
+	getJSON(t, s.URL+"/metrics?source=a", http.StatusOK, &metrics)
+	if strings.Join(metrics, ",") != "b,c" {
+		t.Errorf("unexpected metrics %v", metrics)
+	}
+
+	series := struct {
+		Points     []catena.Point `json:"points"`
+		Resolution int64          `json:"resolution"`
+	}{}
+	getJSON(t, s.URL+"/range?source=a&metric=b&start=605&end=700", http.StatusOK, &series)
+	if len(series.Points) != 2 || series.Points[0].Timestamp != 610 || series.Points[1].Value != 3 {
+		t.Errorf("unexpected points %v", series.Points)
+	}
+
+	aggregate := struct {
+		Value *float64 `json:"value"`
+	}{}
+	getJSON(t, s.URL+"/aggregate?source=a&metric=b&aggregate=sum", http.StatusOK, &aggregate)
+	if aggregate.Value == nil || *aggregate.Value != 6 {
+		t.Errorf("unexpected sum %v", aggregate.Value)
+	}
+
+	aggregate.Value = nil
+	getJSON(t, s.URL+"/aggregate?source=a&metric=x&aggregate=mean", http.StatusOK, &aggregate)
+	if aggregate.Value != nil {
+		t.Errorf("expected a null mean, got %v", *aggregate.Value)
+	}
+
+	health := catena.Health{}
+	getJSON(t, s.URL+"/health", http.StatusOK, &health)
+	if !health.Healthy || health.BacklogLimit != 10 {
+		t.Errorf("unexpected health %+v", health)
+	}
+
+	series.Points = nil
+	getJSON(t, s.URL+"/aggregate?source=a&metric=b&aggregate=max&interval=20", http.StatusOK, &series)
+	if len(series.Points) != 2 || series.Points[0].Timestamp != 600 || series.Points[0].Value != 2 ||
+		series.Points[1].Timestamp != 640 || series.Points[1].Value != 3 {
+		t.Errorf("unexpected buckets %v", series.Points)
+	}
+
+	getJSON(t, s.URL+"/aggregate?source=a&metric=b&aggregate=median", http.StatusBadRequest, nil)
+	getJSON(t, s.URL+"/range?source=a", http.StatusBadRequest, nil)
+
+	resp, err = http.Post(s.URL+"/rows", "application/json", strings.NewReader(`[
+		{"source": "a", "metric": "b", "timestamp": 700, "value": 1},
+		{"source": "a", "metric": "b", "timestamp": 400, "value": 1}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errResp := errorResponse{}
+	json.NewDecoder(resp.Body).Decode(&errResp)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d", http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+
+	if errResp.Cutoff == nil || *errResp.Cutoff != 500 {
+		t.Errorf("expected cutoff 500, got %v", errResp.Cutoff)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = http.Post(s.URL+"/rows", "application/json", strings.NewReader(`[
+		{"source": "a", "metric": "b", "timestamp": 800, "value": 1}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d", http.StatusConflict, resp.StatusCode)
+	}
+}
+
+func getJSON(t *testing.T, url string, status int, v interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Fatalf("%s: expected status %d, got %d", url, status, resp.StatusCode)
+	}
+
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+	}
+}
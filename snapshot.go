@@ -0,0 +1,255 @@
+package catena
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Cistern/catena/partition/memory"
+	"github.com/Cistern/catena/vfs"
+)
+
+// snapshotManifestFilename is the file within a snapshot
+// that lists the snapshot's files.
+const snapshotManifestFilename = "snapshot.json"
+
+// A snapshotManifest describes a snapshot.
+type snapshotManifest struct {
+	Created       time.Time `json:"created"`
+	PartitionSize int64     `json:"partition_size"`
+	TimestampUnit string    `json:"timestamp_unit"`
+
+	// LastPartitionID is the ID of the newest partition
+	// created when the snapshot was taken.
+	LastPartitionID int64 `json:"last_partition_id"`
+
+	Files []snapshotFile `json:"files"`
+}
+
+// A snapshotFile is a file of a snapshot. Name is relative
+// to the snapshot directory.
+type snapshotFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// A snapshotSource is a file to copy into a snapshot. size is
+// the length of the prefix to copy, or -1 for files that are
+// never modified in place, which are hard linked when possible.
+type snapshotSource struct {
+	filename string
+	size     int64
+}
+
+// Snapshot writes a consistent copy of the DB to destDir, which is
+// created if it does not exist and must be empty otherwise. Inserts
+// continue while the snapshot is taken, but compaction waits for it.
+// Disk partitions are immutable, so they are hard linked rather than
+// copied if destDir is on the same file system. Each WAL is copied up
+// to the end of the last entry written when its partition was visited,
+// so the snapshot holds every row inserted before Snapshot was called
+// and opens with OpenDB like the original DB. A manifest of the
+// snapshot's files is written to "snapshot.json".
+func (db *DB) Snapshot(destDir string) error {
+	err := db.fs.MkdirAll(destDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	names, err := readDirNames(db.fs, destDir)
+	if err != nil {
+		return err
+	}
+
+	if len(names) > 0 {
+		return errors.New("catena: Snapshot called with non-empty directory")
+	}
+
+	// The compactor must not swap or remove files until they
+	// have been copied.
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+
+	sources := []snapshotSource{}
+
+	// Partitions created from here on aren't part of the
+	// snapshot.
+	lastPartitionID := atomic.LoadInt64(&db.lastPartitionID)
+
+	i := db.partitionList.NewIterator()
+	for i.Next() {
+		p, _ := i.Value()
+
+		// Inserts hold the partition, so no entry is
+		// being appended while the WALs are measured.
+		p.ExclusiveHold()
+
+		base := p
+		buffers := []*memory.MemoryPartition{}
+		if lp, ok := p.(*latePartition); ok {
+			base = lp.base
+			buffers = lp.buffers()
+		}
+
+		if memPart, ok := base.(*memory.MemoryPartition); ok {
+			buffers = append([]*memory.MemoryPartition{memPart}, buffers...)
+		} else {
+			sources = append(sources, snapshotSource{base.Filename(), -1})
+		}
+
+		for _, buffer := range buffers {
+			sources = append(sources, snapshotSource{buffer.Filename(), fileSize(db.fs, buffer.Filename())})
+		}
+
+		p.ExclusiveRelease()
+	}
+
+	for _, tier := range db.rollupTiers {
+		tier.lock.RLock()
+		for _, p := range tier.partitions {
+			sources = append(sources, snapshotSource{p.Filename(), -1})
+		}
+		tier.lock.RUnlock()
+	}
+
+	// The continuous queries file is replaced rather
+	// than written to, so it can be linked as well.
+	queriesFilename := filepath.Join(db.baseDir, continuousQueriesFilename)
+	if _, err := db.fs.Stat(queriesFilename); err == nil {
+		sources = append(sources, snapshotSource{queriesFilename, -1})
+	}
+
+	manifest := snapshotManifest{
+		Created:       db.clock().UTC(),
+		PartitionSize: db.partitionSize,
+		TimestampUnit: db.timestampUnit.String(),
+
+		LastPartitionID: lastPartitionID,
+
+		Files: []snapshotFile{},
+	}
+
+	dirs := map[string]bool{destDir: true}
+
+	for _, source := range sources {
+		file, err := db.snapshotFile(destDir, source)
+		if err != nil {
+			return err
+		}
+
+		dirs[filepath.Dir(filepath.Join(destDir, file.Name))] = true
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	sort.Sort(snapshotFilesByName(manifest.Files))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeSyncedFile(db.fs, filepath.Join(destDir, snapshotManifestFilename), data)
+	if err != nil {
+		return err
+	}
+
+	for dir := range dirs {
+		err = db.fs.SyncDir(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotFile links or copies source into destDir, under its path
+// relative to the DB directory.
+func (db *DB) snapshotFile(destDir string, source snapshotSource) (snapshotFile, error) {
+	rel, err := filepath.Rel(db.baseDir, source.filename)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+
+	dest := filepath.Join(destDir, rel)
+
+	err = db.fs.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+
+	size := source.size
+	if size < 0 {
+		size = fileSize(db.fs, source.filename)
+		if vfs.Link(db.fs, source.filename, dest) == nil {
+			return snapshotFile{Name: rel, Size: size}, nil
+		}
+	}
+
+	err = copyFilePrefix(db.fs, source.filename, dest, size)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+
+	return snapshotFile{Name: rel, Size: size}, nil
+}
+
+// copyFilePrefix copies the first size bytes of src to a new
+// file dest of fs and syncs it.
+func copyFilePrefix(fs vfs.FS, src, dest string, size int64) error {
+	in, err := vfs.Open(fs, src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := fs.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(out, in, size)
+	if err == nil {
+		err = out.Sync()
+	}
+
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// writeSyncedFile writes data to a new file
+// of fs at filename and syncs it.
+func writeSyncedFile(fs vfs.FS, filename string, data []byte) error {
+	f, err := fs.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+type snapshotFilesByName []snapshotFile
+
+func (f snapshotFilesByName) Len() int           { return len(f) }
+func (f snapshotFilesByName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+func (f snapshotFilesByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,134 @@
+package catena
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	os.RemoveAll("/tmp/catena_snapshot_test")
+	os.RemoveAll("/tmp/catena_snapshot_test_dest")
+
+	db, err := NewDB("/tmp/catena_snapshot_test", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []Row{}
+	for ts := int64(0); ts < 50; ts++ {
+		rows = append(rows, Row{Source: "a", Metric: "b", Point: Point{Timestamp: ts, Value: float64(ts)}})
+	}
+
+	err = db.InsertRows(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.compact()
+
+	// A late row for a compacted partition.
+	err = db.InsertRows([]Row{{Source: "a", Metric: "b", Point: Point{Timestamp: 5, Value: -5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep inserting while the snapshot is taken.
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ts := int64(40); ; ts++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			err := db.InsertRows([]Row{{Source: "c", Metric: "d", Point: Point{Timestamp: ts}}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	err = db.Snapshot("/tmp/catena_snapshot_test_dest")
+	close(stop)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if db.Snapshot("/tmp/catena_snapshot_test_dest") == nil {
+		t.Error("expected an error for a non-empty directory")
+	}
+
+	original, err := os.Stat("/tmp/catena_snapshot_test/1.part")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	linked, err := os.Stat("/tmp/catena_snapshot_test_dest/1.part")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !os.SameFile(original, linked) {
+		t.Error("expected disk partitions to be hard linked")
+	}
+
+	_, err = os.Stat(filepath.Join("/tmp/catena_snapshot_test_dest", snapshotManifestFilename))
+	if err != nil {
+		t.Error(err)
+	}
+
+	report, err := Check("/tmp/catena_snapshot_test_dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Problems) != 0 {
+		t.Errorf("unexpected problems %v", report.Problems)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := OpenDB("/tmp/catena_snapshot_test_dest", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, _, err := snapshot.Range("a", "b", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 50 || points[5].Value != -5 {
+		t.Errorf("unexpected points %v", points)
+	}
+
+	// Rows inserted during the snapshot are a prefix of those
+	// inserted in total.
+	points, _, err = snapshot.Range("c", "d", 0, 1<<40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, point := range points {
+		if point.Timestamp != int64(40+i) {
+			t.Fatalf("expected timestamp %d, got %d", 40+i, point.Timestamp)
+		}
+	}
+
+	err = snapshot.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrInjected is the error of the operations that a FaultFS fails.
+var ErrInjected = errors.New("vfs: injected fault")
+
+// An Op is a kind of operation that a FaultFS can fail.
+type Op int
+
+const (
+	// OpWrite is File.Write. A failed write writes the first
+	// half of its data, like a write torn by a crash.
+	OpWrite Op = iota
+	// OpSync is File.Sync and FS.SyncDir.
+	OpSync
+	// OpRename is FS.Rename.
+	OpRename
+	// OpRemove is FS.Remove.
+	OpRemove
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpSync:
+		return "sync"
+	case OpRename:
+		return "rename"
+	case OpRemove:
+		return "remove"
+	}
+
+	return "unknown"
+}
+
+// A Fault selects the operations that a FaultFS fails.
+type Fault struct {
+	Op Op
+
+	// Pattern restricts the fault to operations on files whose
+	// base name matches it, as in filepath.Match. For renames,
+	// the old name is matched. An empty pattern matches all files.
+	Pattern string
+
+	// After is the number of selected operations that
+	// succeed before the first one fails.
+	After int
+
+	// Times is the number of operations that fail,
+	// or 0 to fail all later selected operations.
+	Times int
+}
+
+// A FaultFS wraps an FS and fails chosen operations with ErrInjected,
+// so that tests can stop the DB at any point where a crash could
+// leave the files. Counting operations with Count and then failing
+// each of them in turn covers every such point deterministically.
+type FaultFS struct {
+	FS
+
+	lock   sync.Mutex
+	counts map[Op]int
+	faults []*fault
+}
+
+// A fault is a Fault with the number of operations
+// it has selected so far.
+type fault struct {
+	Fault
+	seen int
+}
+
+// NewFaultFS returns a FaultFS that passes operations to fs
+// until faults are injected.
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{
+		FS:     fs,
+		counts: map[Op]int{},
+	}
+}
+
+// Inject adds a fault. Operations fail if any fault selects them.
+func (fs *FaultFS) Inject(f Fault) {
+	fs.lock.Lock()
+	fs.faults = append(fs.faults, &fault{Fault: f})
+	fs.lock.Unlock()
+}
+
+// Clear removes all faults.
+func (fs *FaultFS) Clear() {
+	fs.lock.Lock()
+	fs.faults = nil
+	fs.lock.Unlock()
+}
+
+// Count returns the number of operations of kind op that
+// were attempted, including the ones that failed.
+func (fs *FaultFS) Count(op Op) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return fs.counts[op]
+}
+
+// fail counts an operation of kind op on name and
+// returns whether it should fail.
+func (fs *FaultFS) fail(op Op, name string) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.counts[op]++
+
+	failed := false
+	for _, f := range fs.faults {
+		if f.Op != op {
+			continue
+		}
+
+		if f.Pattern != "" {
+			if matched, _ := filepath.Match(f.Pattern, filepath.Base(name)); !matched {
+				continue
+			}
+		}
+
+		f.seen++
+		if f.seen > f.After && (f.Times == 0 || f.seen <= f.After+f.Times) {
+			failed = true
+		}
+	}
+
+	return failed
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &faultFile{File: f, fs: fs}, nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if fs.fail(OpRemove, name) {
+		return &os.PathError{Op: "remove", Path: name, Err: ErrInjected}
+	}
+
+	return fs.FS.Remove(name)
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if fs.fail(OpRename, oldname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrInjected}
+	}
+
+	return fs.FS.Rename(oldname, newname)
+}
+
+func (fs *FaultFS) Link(oldname, newname string) error {
+	return Link(fs.FS, oldname, newname)
+}
+
+func (fs *FaultFS) SyncDir(dir string) error {
+	if fs.fail(OpSync, dir) {
+		return &os.PathError{Op: "sync", Path: dir, Err: ErrInjected}
+	}
+
+	return fs.FS.SyncDir(dir)
+}
+
+// A faultFile is a File of a FaultFS.
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if f.fs.fail(OpWrite, f.Name()) {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, &os.PathError{Op: "write", Path: f.Name(), Err: ErrInjected}
+	}
+
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if f.fs.fail(OpSync, f.Name()) {
+		return &os.PathError{Op: "sync", Path: f.Name(), Err: ErrInjected}
+	}
+
+	return f.File.Sync()
+}
+
+// Map and Unmap pass through to the wrapped file, so
+// that files of OS are still memory mapped.
+func (f *faultFile) Map() ([]byte, error) {
+	return Map(f.File)
+}
+
+func (f *faultFile) Unmap(data []byte) error {
+	return Unmap(f.File, data)
+}
+
+// FaultFS is an FS
+var _ FS = &FaultFS{}
@@ -0,0 +1,475 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errNotDir = errors.New("not a directory")
+
+// A MemFS is an FS that keeps its files in memory. Every operation
+// is durable as soon as it returns, so Sync and SyncDir do nothing.
+type MemFS struct {
+	lock sync.Mutex
+
+	// files and dirs are keyed by cleaned path.
+	files map[string]*memNode
+	dirs  map[string]time.Time
+}
+
+// A memNode holds the contents of a file. Handles to the same
+// file share the node, even after the file is removed.
+type memNode struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFS returns an empty MemFS with just the
+// root and working directories.
+func NewMemFS() *MemFS {
+	now := time.Now()
+	return &MemFS{
+		files: map[string]*memNode{},
+		dirs: map[string]time.Time{
+			"/": now,
+			".": now,
+		},
+	}
+}
+
+func (fs *MemFS) isDir(name string) bool {
+	_, ok := fs.dirs[name]
+	return ok
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.isDir(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	if !fs.isDir(filepath.Dir(name)) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	node, exists := fs.files[name]
+	if exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	}
+
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	f := &memFile{
+		fs:       fs,
+		name:     name,
+		node:     node,
+		readable: access != os.O_WRONLY,
+		writable: access != os.O_RDONLY,
+		append:   flag&os.O_APPEND != 0,
+	}
+
+	if flag&os.O_TRUNC != 0 && f.writable {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return f, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, exists := fs.files[name]; exists {
+		delete(fs.files, name)
+		return nil
+	}
+
+	if !fs.isDir(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+
+	if len(fs.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+
+	delete(fs.dirs, name)
+	return nil
+}
+
+// Rename renames files. Directories can't be renamed.
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldname = filepath.Clean(oldname)
+	newname = filepath.Clean(newname)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	node, exists := fs.files[oldname]
+	if !exists {
+		err := error(os.ErrNotExist)
+		if fs.isDir(oldname) {
+			err = syscall.EISDIR
+		}
+
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	if fs.isDir(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+	}
+
+	if !fs.isDir(filepath.Dir(newname)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+
+	delete(fs.files, oldname)
+	fs.files[newname] = node
+	return nil
+}
+
+// Link links files. The link shares the contents of oldname.
+func (fs *MemFS) Link(oldname, newname string) error {
+	oldname = filepath.Clean(oldname)
+	newname = filepath.Clean(newname)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	node, exists := fs.files[oldname]
+	if !exists {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+
+	if _, exists := fs.files[newname]; exists || fs.isDir(newname) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+
+	if !fs.isDir(filepath.Dir(newname)) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for dir := path; !fs.isDir(dir); dir = filepath.Dir(dir) {
+		if _, exists := fs.files[dir]; exists {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errNotDir}
+		}
+	}
+
+	now := time.Now()
+	for dir := path; !fs.isDir(dir); dir = filepath.Dir(dir) {
+		fs.dirs[dir] = now
+	}
+
+	return nil
+}
+
+func (fs *MemFS) ReadDirNames(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if !fs.isDir(dir) {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+
+	return fs.children(dir), nil
+}
+
+// children returns the names of the entries of dir.
+// The caller must hold fs.lock.
+func (fs *MemFS) children(dir string) []string {
+	names := []string{}
+	for name := range fs.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+
+	for name := range fs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+
+	return names
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if node, exists := fs.files[name]; exists {
+		return memFileInfo{
+			name:    filepath.Base(name),
+			size:    int64(len(node.data)),
+			modTime: node.modTime,
+		}, nil
+	}
+
+	if modTime, exists := fs.dirs[name]; exists {
+		return memFileInfo{
+			name:    filepath.Base(name),
+			modTime: modTime,
+			dir:     true,
+		}, nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) SyncDir(dir string) error {
+	dir = filepath.Clean(dir)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if !fs.isDir(dir) {
+		return &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+
+	return nil
+}
+
+// A memFile is an open File of a MemFS.
+type memFile struct {
+	fs   *MemFS
+	name string
+	node *memNode
+
+	offset int64
+	closed bool
+
+	readable bool
+	writable bool
+	append   bool
+}
+
+// check returns an error for op if f is closed or doesn't
+// allow op. The caller must hold f.fs.lock.
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+
+	if (write && !f.writable) || (!write && !f.readable) {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	err := f.check("read", false)
+	if err != nil {
+		return 0, err
+	}
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	err := f.check("read", false)
+	if err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	err := f.check("write", true)
+	if err != nil {
+		return 0, err
+	}
+
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	err := f.check("truncate", true)
+	if err != nil {
+		return err
+	}
+
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+
+	f.node.resize(size)
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+
+	return memFileInfo{
+		name:    filepath.Base(f.name),
+		size:    int64(len(f.node.data)),
+		modTime: f.node.modTime,
+	}, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+// resize grows data with zeros or shrinks it to size.
+func (n *memNode) resize(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+
+	data := make([]byte, size, size+size/2)
+	copy(data, n.data)
+	n.data = data
+}
+
+// A memFileInfo describes a file or directory of a MemFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+// MemFS is an FS
+var _ FS = &MemFS{}
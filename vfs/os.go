@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// OS is the file system of the operating system.
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return osFile{f}, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	f.Close()
+	return err
+}
+
+// An osFile is a File of OS.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Map() ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(fi.Size()),
+		// Set read only protection and shared mapping flag.
+		syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func (f osFile) Unmap(data []byte) error {
+	return syscall.Munmap(data)
+}
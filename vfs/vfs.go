@@ -0,0 +1,142 @@
+// Package vfs provides the file systems that a catena DB stores its
+// files in. OS is the file system of the operating system. MemFS keeps
+// files in memory, and FaultFS wraps another FS to fail chosen
+// operations, so that tests can simulate crashes deterministically.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// A File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// An FS is a file system. Names are paths as used by package
+// os, and errors are *os.PathError or *os.LinkError values, so
+// os.IsNotExist and os.IsExist work with them.
+type FS interface {
+	// OpenFile opens a file like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+
+	// Rename replaces newname with oldname.
+	Rename(oldname, newname string) error
+
+	// MkdirAll creates a directory and any missing parents.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// ReadDirNames returns the names of the entries
+	// of a directory, in no particular order.
+	ReadDirNames(dir string) ([]string, error)
+
+	Stat(name string) (os.FileInfo, error)
+
+	// SyncDir makes the creation, removal and renaming
+	// of the entries of a directory durable.
+	SyncDir(dir string) error
+}
+
+// Open opens the file name of fs for reading.
+func Open(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the file name of fs
+// and opens it for reading and writing.
+func Create(fs FS, name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// ReadFile returns the contents of the file name of fs.
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := Open(fs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, int(fi.Size()))
+	_, err = io.ReadFull(f, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// A linker is an FS that can hard link files.
+type linker interface {
+	Link(oldname, newname string) error
+}
+
+var errNoLink = errors.New("hard links not supported")
+
+// Link creates newname as a hard link to oldname if fs supports
+// hard links. OS and MemFS do, and a FaultFS does if the FS it wraps
+// does. Callers can copy the file instead if Link fails.
+func Link(fs FS, oldname, newname string) error {
+	if l, ok := fs.(linker); ok {
+		return l.Link(oldname, newname)
+	}
+
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errNoLink}
+}
+
+// A mapper is a File that can be memory mapped.
+type mapper interface {
+	Map() ([]byte, error)
+	Unmap(data []byte) error
+}
+
+// Map returns the contents of f for reading only. Files of OS are
+// memory mapped. Other files are read into memory, so later writes
+// to them don't show in the returned slice. The contents must be
+// released with Unmap once they are no longer used.
+func Map(f File) ([]byte, error) {
+	if m, ok := f.(mapper); ok {
+		return m.Map()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, int(fi.Size()))
+	_, err = f.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Unmap releases contents of f returned by Map.
+func Unmap(f File, data []byte) error {
+	if m, ok := f.(mapper); ok {
+		return m.Unmap(data)
+	}
+
+	return nil
+}
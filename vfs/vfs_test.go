@@ -0,0 +1,162 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+
+	_, err := Create(fs, "/a/b/c")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a missing directory, got %v", err)
+	}
+
+	err = fs.MkdirAll("/a/b", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/a/b/c", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.OpenFile("/a/b/c", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if !os.IsExist(err) {
+		t.Errorf("expected an existing file, got %v", err)
+	}
+
+	_, err = f.Write([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Truncate(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+	n, err := f.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("expected %q, got %q and %v", "hello", buf[:n], err)
+	}
+
+	f.Close()
+
+	err = fs.Rename("/a/b/c", "/a/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := fs.ReadDirNames("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"b", "d"}) {
+		t.Errorf("unexpected names %v", names)
+	}
+
+	data, err := ReadFile(fs, "/a/d")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected %q, got %q and %v", "hello", data, err)
+	}
+
+	err = Link(fs, "/a/d", "/a/b/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Link(fs, "/a/d", "/a/b/e")
+	if !os.IsExist(err) {
+		t.Errorf("expected an existing file, got %v", err)
+	}
+
+	data, err = ReadFile(fs, "/a/b/e")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("expected %q, got %q and %v", "hello", data, err)
+	}
+
+	err = fs.Remove("/a/b/e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Remove("/a")
+	if err == nil {
+		t.Error("expected an error removing a non-empty directory")
+	}
+
+	err = fs.Remove("/a/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fs.Stat("/a/d")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected a removed file, got %v", err)
+	}
+}
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.Inject(Fault{Op: OpWrite, Pattern: "*.wal", After: 1, Times: 1})
+	fs.Inject(Fault{Op: OpRename, Pattern: "*.tmp"})
+
+	f, err := Create(fs, "1.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []int{4, 2, 4} {
+		n, err := f.Write([]byte("abcd"))
+		if n != expected || (err != nil) != (i == 1) {
+			t.Errorf("write %d: unexpected %d bytes and %v", i, n, err)
+		}
+	}
+
+	f.Close()
+
+	err = fs.Rename("1.wal", "2.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Create(fs, "2.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename("2.tmp", "2.part")
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != ErrInjected {
+		t.Errorf("expected an injected fault, got %v", err)
+	}
+
+	if fs.Count(OpWrite) != 3 || fs.Count(OpRename) != 2 {
+		t.Errorf("unexpected counts %d and %d", fs.Count(OpWrite), fs.Count(OpRename))
+	}
+
+	fs.Clear()
+
+	err = fs.Rename("2.tmp", "2.part")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ReadFile(fs, "2.wal")
+	if err != nil || string(data) != "abcdababcd" {
+		t.Errorf("unexpected contents %q and %v", data, err)
+	}
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"github.com/Cistern/catena/vfs"
+)
+
+// A Factory creates and opens the WALs of a DB. WALs are identified
+// by file names, which a WAL returns from its Filename method, even
+// if the WAL is not stored in a file.
+type Factory interface {
+	// Create returns a new, empty WAL. It fails if there
+	// already is a WAL with the same name.
+	Create(filename string) (WAL, error)
+
+	// Open opens an existing WAL to recover its entries. If
+	// readOnly is set, the WAL must not be modified.
+	Open(filename string, readOnly bool) (WAL, error)
+}
+
+// A Lister is a Factory that can list its WALs. A DB only finds WAL
+// files by listing its directory, so it also recovers the WALs that
+// a Lister lists under the directory when it is opened.
+type Lister interface {
+	Factory
+
+	// Filenames returns the names of the factory's WALs.
+	Filenames() []string
+}
+
+// FileFactory is a Factory of FileWALs. It is the default.
+type FileFactory struct {
+	// FS is the file system of the WALs. If it is
+	// nil, the WALs are files of vfs.OS.
+	FS vfs.FS
+}
+
+func (f FileFactory) fs() vfs.FS {
+	if f.FS == nil {
+		return vfs.OS
+	}
+
+	return f.FS
+}
+
+func (f FileFactory) Create(filename string) (WAL, error) {
+	w, err := NewFileWALFS(f.fs(), filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (f FileFactory) Open(filename string, readOnly bool) (WAL, error) {
+	var w *FileWAL
+	var err error
+
+	if readOnly {
+		w, err = OpenReadOnlyFileWALFS(f.fs(), filename)
+	} else {
+		w, err = OpenFileWALFS(f.fs(), filename)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// FileFactory is a Factory
+var _ Factory = FileFactory{}
@@ -11,6 +11,7 @@ import (
 	"sync"
 
 	"github.com/Cistern/catena/partition"
+	"github.com/Cistern/catena/vfs"
 )
 
 var (
@@ -19,11 +20,13 @@ var (
 
 	errorInvalidWALMagic = errors.New("wal: invalid WAL magic number")
 	errorInvalidWALFile  = errors.New("wal: invalid WAL file")
+	errorReadOnlyWAL     = errors.New("wal: WAL is read only")
 )
 
 // A FileWAL is a write-ahead log represented by a file on disk.
 type FileWAL struct {
-	f    *os.File
+	fs   vfs.FS
+	f    vfs.File
 	lock sync.Mutex
 
 	filename string
@@ -32,18 +35,27 @@ type FileWAL struct {
 	// WAL entry. This way we can truncate the WAL
 	// and keep appending valid data at the end.
 	lastReadOffset int64
+
+	readOnly bool
 }
 
 // NewFileWAL returns a new on-disk write-ahead log
 // with the given file name.
 func NewFileWAL(filename string) (*FileWAL, error) {
+	return NewFileWALFS(vfs.OS, filename)
+}
+
+// NewFileWALFS is like NewFileWAL, but creates
+// the file in fs.
+func NewFileWALFS(fs vfs.FS, filename string) (*FileWAL, error) {
 	// Attempt to open WAL file.
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
+	f, err := fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0666)
 	if err != nil {
 		return nil, err
 	}
 
 	return &FileWAL{
+		fs:       fs,
 		f:        f,
 		filename: filename,
 	}, nil
@@ -51,18 +63,48 @@ func NewFileWAL(filename string) (*FileWAL, error) {
 
 // OpenFileWAL opens a write-ahead long stored at filename.
 func OpenFileWAL(filename string) (*FileWAL, error) {
+	return OpenFileWALFS(vfs.OS, filename)
+}
+
+// OpenFileWALFS is like OpenFileWAL, but opens
+// the file in fs.
+func OpenFileWALFS(fs vfs.FS, filename string) (*FileWAL, error) {
 	// Attempt to open an existing WAL file.
-	f, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	f, err := fs.OpenFile(filename, os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
 
 	return &FileWAL{
+		fs:       fs,
 		f:        f,
 		filename: filename,
 	}, nil
 }
 
+// OpenReadOnlyFileWAL opens a write-ahead log stored at filename
+// for reading only. Append and Truncate return an error, so the
+// file is never modified.
+func OpenReadOnlyFileWAL(filename string) (*FileWAL, error) {
+	return OpenReadOnlyFileWALFS(vfs.OS, filename)
+}
+
+// OpenReadOnlyFileWALFS is like OpenReadOnlyFileWAL,
+// but opens the file in fs.
+func OpenReadOnlyFileWALFS(fs vfs.FS, filename string) (*FileWAL, error) {
+	f, err := vfs.Open(fs, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileWAL{
+		fs:       fs,
+		f:        f,
+		filename: filename,
+		readOnly: true,
+	}, nil
+}
+
 // Append writes the WALentry to the write-ahead log.
 // It returns the number of bytes written and an error.
 func (w *FileWAL) Append(entry WALEntry) (int, error) {
@@ -72,6 +114,10 @@ func (w *FileWAL) Append(entry WALEntry) (int, error) {
 		return 0, errorInvalidWALFile
 	}
 
+	if w.readOnly {
+		return 0, errorReadOnlyWAL
+	}
+
 	// Buffer writes until the end.
 	buf := &bytes.Buffer{}
 
@@ -340,11 +386,25 @@ func (w *FileWAL) ReadEntry() (WALEntry, error) {
 	return entry, err
 }
 
+// ReadOffset returns the offset just past the last entry
+// that ReadEntry decoded, which is where Truncate cuts
+// the file after a read error.
+func (w *FileWAL) ReadOffset() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.lastReadOffset
+}
+
 // Truncate truncates w's backing file to
 // lastReadOffset. Truncation ensures that
 // new entries can be safely read after
 // they are appended.
 func (w *FileWAL) Truncate() error {
+	if w.readOnly {
+		return errorReadOnlyWAL
+	}
+
 	return w.f.Truncate(w.lastReadOffset)
 }
 
@@ -358,8 +418,13 @@ func (w *FileWAL) Close() error {
 // Destroy closes the FileWAL and removes the
 // file on disk.
 func (w *FileWAL) Destroy() error {
+	if w.readOnly {
+		w.Close()
+		return errorReadOnlyWAL
+	}
+
 	w.Close()
-	err := os.Remove(w.filename)
+	err := w.fs.Remove(w.filename)
 	return err
 }
 func (w *FileWAL) Filename() string {
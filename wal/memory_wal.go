@@ -0,0 +1,197 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Cistern/catena/partition"
+)
+
+var errorWALExists = errors.New("wal: WAL already exists")
+
+// A MemoryWAL is a write-ahead log that keeps its entries in memory.
+// Its entries are lost when the process exits, which makes it useful
+// for tests and for benchmarks that leave out the cost of a FileWAL.
+type MemoryWAL struct {
+	lock sync.Mutex
+
+	filename string
+	entries  []WALEntry
+
+	// next is the index of the entry ReadEntry returns next.
+	next int
+
+	readOnly bool
+
+	// factory created the WAL, if it was created by a factory.
+	factory *MemoryFactory
+}
+
+// NewMemoryWAL returns a new, empty MemoryWAL with the given name.
+func NewMemoryWAL(filename string) *MemoryWAL {
+	return &MemoryWAL{
+		filename: filename,
+	}
+}
+
+// Append adds entry to the log. It returns the size the
+// entry's rows would have uncompressed in a FileWAL.
+func (w *MemoryWAL) Append(entry WALEntry) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.readOnly {
+		return 0, errorReadOnlyWAL
+	}
+
+	// The caller may reuse the rows.
+	rows := make([]partition.Row, len(entry.Rows))
+	copy(rows, entry.Rows)
+
+	w.entries = append(w.entries, WALEntry{
+		Operation: entry.Operation,
+		Rows:      rows,
+	})
+
+	size := 13
+	for _, row := range rows {
+		size += 2 + len(row.Source) + len(row.Metric) + 16
+	}
+
+	return size, nil
+}
+
+// ReadEntry returns the next entry, or io.EOF
+// after the last one.
+func (w *MemoryWAL) ReadEntry() (WALEntry, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.next >= len(w.entries) {
+		return WALEntry{}, io.EOF
+	}
+
+	entry := w.entries[w.next]
+	w.next++
+
+	return entry, nil
+}
+
+// Truncate drops the entries that haven't been read.
+func (w *MemoryWAL) Truncate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.readOnly {
+		return errorReadOnlyWAL
+	}
+
+	w.entries = w.entries[:w.next]
+	return nil
+}
+
+// Close does nothing. The entries are kept so that
+// the WAL can be opened again by its factory.
+func (w *MemoryWAL) Close() error {
+	return nil
+}
+
+// Destroy drops the entries and removes the
+// WAL from its factory.
+func (w *MemoryWAL) Destroy() error {
+	w.lock.Lock()
+	readOnly := w.readOnly
+	w.entries = nil
+	w.next = 0
+	w.lock.Unlock()
+
+	if readOnly {
+		return errorReadOnlyWAL
+	}
+
+	if w.factory != nil {
+		w.factory.remove(w)
+	}
+
+	return nil
+}
+
+func (w *MemoryWAL) Filename() string {
+	return w.filename
+}
+
+// A MemoryFactory is a Lister of MemoryWALs. It keeps the WALs it
+// creates until they are destroyed, so that a DB that is opened
+// again with the same factory recovers them.
+type MemoryFactory struct {
+	lock sync.Mutex
+	wals map[string]*MemoryWAL
+}
+
+// NewMemoryFactory returns a MemoryFactory without any WALs.
+func NewMemoryFactory() *MemoryFactory {
+	return &MemoryFactory{
+		wals: map[string]*MemoryWAL{},
+	}
+}
+
+func (f *MemoryFactory) Create(filename string) (WAL, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, exists := f.wals[filename]; exists {
+		return nil, errorWALExists
+	}
+
+	w := NewMemoryWAL(filename)
+	w.factory = f
+	f.wals[filename] = w
+
+	return w, nil
+}
+
+// Open returns the WAL created with filename, positioned
+// at its first entry.
+func (f *MemoryFactory) Open(filename string, readOnly bool) (WAL, error) {
+	f.lock.Lock()
+	w, exists := f.wals[filename]
+	f.lock.Unlock()
+
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+
+	w.lock.Lock()
+	w.next = 0
+	w.readOnly = readOnly
+	w.lock.Unlock()
+
+	return w, nil
+}
+
+// Filenames returns the names of the factory's WALs.
+func (f *MemoryFactory) Filenames() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	filenames := []string{}
+	for filename := range f.wals {
+		filenames = append(filenames, filename)
+	}
+
+	return filenames
+}
+
+func (f *MemoryFactory) remove(w *MemoryWAL) {
+	f.lock.Lock()
+	if f.wals[w.filename] == w {
+		delete(f.wals, w.filename)
+	}
+	f.lock.Unlock()
+}
+
+// MemoryWAL is a WAL and MemoryFactory is a Lister
+var _ WAL = &MemoryWAL{}
+var _ Lister = &MemoryFactory{}